@@ -17,8 +17,15 @@ limitations under the License.
 package v1beta1
 
 import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -28,6 +35,10 @@ import (
 type CcRuntimeName string
 
 // CcRuntimeSpec defines the desired state of CcRuntime
+// +kubebuilder:validation:XValidation:rule="has(self.profile) || has(self.runtimeName)",message="spec.runtimeName: required without a profile"
+// +kubebuilder:validation:XValidation:rule="has(self.profile) || (has(self.config) && has(self.config.installType))",message="spec.config.installType: required without a profile"
+// +kubebuilder:validation:XValidation:rule="has(self.profile) || (has(self.config) && has(self.config.payloadImage))",message="spec.config.payloadImage: required without a profile"
+// +kubebuilder:validation:XValidation:rule="!has(self.config) || !has(self.config.runtimeClasses) || !self.config.runtimeClasses.exists(c, has(c.tee)) || (has(self.config.teeDiscovery) && self.config.teeDiscovery.enabled)",message="spec.config.runtimeClasses: tee needs teeDiscovery.enabled"
 type CcRuntimeSpec struct {
 	// CcNodeSelector is used to select the worker nodes to deploy the runtime
 	// if not specified, all worker nodes are selected
@@ -37,14 +48,152 @@ type CcRuntimeSpec struct {
 
 	CcTolerations []corev1.Toleration `json:"ccTolerations,omitempty"`
 
-	RuntimeName CcRuntimeName `json:"runtimeName"`
+	// This specifies the runtime to install. It defaults to the runtime of the profile
+	// +optional
+	RuntimeName CcRuntimeName `json:"runtimeName,omitempty"`
 
+	// This specifies the built-in install profile the configuration is based on. The
+	// fields set in config override the ones of the profile, and the merged configuration
+	// is reported in status.effectiveConfig
+	// +optional
+	Profile CcRuntimeProfileName `json:"profile,omitempty"`
+
+	// +optional
 	Config CcInstallConfig `json:"config"`
+
+	// This specifies how the guests of the runtime classes reach the Key Broker Service
+	// +optional
+	Attestation *AttestationConfig `json:"attestation,omitempty"`
+
+	// This specifies the peer pods configuration. When set, the operator creates the
+	// PeerPodConfig running the cloud-api-adaptor and the kata-remote runtime class
+	// +optional
+	PeerPods *PeerPodsConfig `json:"peerPods,omitempty"`
+}
+
+// PeerPodsConfig is the configuration of the peer pods, run as virtual machines of a
+// cloud provider by the cloud-api-adaptor
+type PeerPodsConfig struct {
+	// This specifies the cloud provider the peer pods virtual machines are created on
+	// +kubebuilder:validation:Enum=aws;azure;ibmcloud;ibmcloud-powervs;libvirt;vsphere
+	CloudProvider string `json:"cloudProvider"`
+
+	// This specifies the ConfigMap, in the peer pods namespace, holding the settings of the
+	// cloud provider passed to the cloud-api-adaptor as environment variables
+	ConfigMapRef corev1.LocalObjectReference `json:"configMapRef"`
+
+	// This specifies the Secret, in the peer pods namespace, holding the credentials of the
+	// cloud provider
+	SecretRef corev1.LocalObjectReference `json:"secretRef"`
+
+	// This specifies the maximum number of peer pods per node. Default is 10
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	Limit *int32 `json:"limit,omitempty"`
+
+	// This specifies the instance type of the peer pods virtual machines
+	// +optional
+	InstanceType string `json:"instanceType,omitempty"`
+
+	// This specifies the overhead of the pods of the kata-remote runtime class. Default is
+	// 250m of CPU, 120Mi of memory and one kata.peerpods.io/vm, which the limit applies to
+	// +optional
+	Overhead corev1.ResourceList `json:"overhead,omitempty"`
+}
+
+// AttestationConfig is the attestation and Key Broker Service configuration
+// rendered into the default initdata of the runtime classes
+type AttestationConfig struct {
+	// This specifies the URL of the Key Broker Service, e.g. https://kbs.example.com:8080
+	// +kubebuilder:validation:Pattern=`^https?://`
+	KbsURL string `json:"kbsURL"`
+
+	// This specifies the key of a Secret of the operator namespace holding the PEM encoded
+	// CA certificate of the Key Broker Service
+	// +optional
+	KbsCACertSecretRef *corev1.SecretKeySelector `json:"kbsCACertSecretRef,omitempty"`
+
+	// This specifies the default initdata of some of the runtime classes, instead of the one
+	// generated from kbsURL and kbsCACertSecretRef
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	RuntimeClasses []AttestationRuntimeClassConfig `json:"runtimeClasses,omitempty"`
+}
+
+// AttestationRuntimeClassConfig is the default initdata of a runtime class
+type AttestationRuntimeClassConfig struct {
+	// Name of the runtime class, one of spec.config.runtimeClasses
+	Name string `json:"name"`
+
+	// This specifies the initdata TOML document, holding the aa.toml and cdh.toml
+	// configuration of the guest components
+	// +kubebuilder:validation:MinLength=1
+	InitData string `json:"initData"`
+}
+
+// Validate checks the attestation configuration against the runtime classes
+// it applies to
+func (c *AttestationConfig) Validate(runtimeClasses []RuntimeClass) error {
+	kbsURL, err := url.Parse(c.KbsURL)
+	if err != nil {
+		return fmt.Errorf("invalid kbsURL: %w", err)
+	}
+	if (kbsURL.Scheme != "http" && kbsURL.Scheme != "https") || kbsURL.Host == "" {
+		return fmt.Errorf("invalid kbsURL %q, expected http(s)://host[:port]", c.KbsURL)
+	}
+	if c.KbsCACertSecretRef != nil && kbsURL.Scheme != "https" {
+		return fmt.Errorf("kbsCACertSecretRef is set but kbsURL %q doesn't use https", c.KbsURL)
+	}
+
+	for _, rc := range c.RuntimeClasses {
+		found := false
+		for _, runtimeClass := range runtimeClasses {
+			if runtimeClass.Name == rc.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("attestation runtime class %q is not one of spec.config.runtimeClasses", rc.Name)
+		}
+	}
+	return nil
 }
 
 // +kubebuilder:validation:Enum=bundle;osnative
 type CcInstallType string
 
+// HookStage is the point of the runtime lifecycle a hook runs at
+// +kubebuilder:validation:Enum=preInstall;postInstall;preUninstall;postUninstall;preUpgrade
+type HookStage string
+
+const (
+	// PreInstallHookStage hooks run before the runtime is installed
+	PreInstallHookStage HookStage = "preInstall"
+
+	// PostInstallHookStage hooks run once the runtime is installed on all nodes, e.g. smoke tests
+	PostInstallHookStage HookStage = "postInstall"
+
+	// PreUninstallHookStage hooks run before the runtime is uninstalled
+	PreUninstallHookStage HookStage = "preUninstall"
+
+	// PostUninstallHookStage hooks run once the runtime is uninstalled from all nodes
+	PostUninstallHookStage HookStage = "postUninstall"
+
+	// PreUpgradeHookStage hooks run before a changed payload configuration is rolled out
+	PreUpgradeHookStage HookStage = "preUpgrade"
+)
+
+// HookPhase is the phase of a hook
+type HookPhase string
+
+const (
+	HookRunning   HookPhase = "Running"
+	HookCompleted HookPhase = "Completed"
+	HookFailed    HookPhase = "Failed"
+)
+
 const (
 	// Use container image with all installation artifacts
 	BundleInstallType CcInstallType = "bundle"
@@ -75,6 +224,72 @@ type CcRuntimeStatus struct {
 	// Upgradestatus reflects the status of the ongoing runtime upgrade
 	// +optional
 	Upgradestatus CcUpgradeStatus `json:"upgradeStatus,omitempty"`
+
+	// CurrentRevision is the revision of the payload configuration that is currently rolled out.
+	// It is 0 until a payload configuration has been installed successfully on all nodes
+	// +optional
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+
+	// Revisions identifies the payload configurations that were installed successfully on all
+	// nodes, oldest first
+	// +optional
+	Revisions []CcRuntimeRevision `json:"revisions,omitempty"`
+
+	// Hooks reflects the progress of the hooks
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+
+	// Images reflects the images used by the DaemonSets
+	// +optional
+	Images []CcImageStatus `json:"images,omitempty"`
+
+	// ImagesGeneration is the spec generation the images were resolved for
+	// +optional
+	ImagesGeneration int64 `json:"imagesGeneration,omitempty"`
+
+	// AgentPolicies reflects the agent policies installed on all the nodes
+	// +optional
+	AgentPolicies []AgentPolicyStatus `json:"agentPolicies,omitempty"`
+
+	// Architectures reflects the installation progress on the nodes of each architecture
+	// +optional
+	Architectures []ArchitectureStatus `json:"architectures,omitempty"`
+
+	// RuntimeClasses reflects the number of nodes each runtime class can run on
+	// +optional
+	RuntimeClasses []RuntimeClassNodesStatus `json:"runtimeClasses,omitempty"`
+
+	// Preflight reflects the results of the preflight checks on each selected node
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Preflight []PreflightNodeStatus `json:"preflight,omitempty"`
+
+	// NodeRuntimes reflects the container runtime detected on each selected node
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	NodeRuntimes []NodeRuntimeStatus `json:"nodeRuntimes,omitempty"`
+
+	// DepartedNodes are the nodes that left the ccNodeSelector, which the runtime is being
+	// uninstalled from
+	// +optional
+	DepartedNodes []string `json:"departedNodes,omitempty"`
+
+	// EffectiveConfig is the configuration of the profile merged with spec.config, as
+	// installed by the operator. It is only set when the CcRuntime references a profile.
+	// It isn't validated again, its schema is the one of spec.config
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	EffectiveConfig *CcInstallConfig `json:"effectiveConfig,omitempty"`
+
+	// Conditions reflects the latest available observations of the CcRuntime state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -104,11 +319,21 @@ type CcInstallConfig struct {
 
 	// This indicates whether to use native OS packaging (rpm/deb) or Container image
 	// Default is bundle (container image)
-	InstallType CcInstallType `json:"installType"`
+	// +optional
+	InstallType CcInstallType `json:"installType,omitempty"`
 
 	// This specifies the location of the container image with all artifacts (Cc runtime binaries, initrd, kernel, config etc)
 	// when using "bundle" installType
-	PayloadImage string `json:"payloadImage"`
+	// +optional
+	PayloadImage string `json:"payloadImage,omitempty"`
+
+	// This specifies the images used on the nodes of an architecture instead of payloadImage
+	// and the images of the hooks, keyed on the kubernetes.io/arch label of the nodes. The
+	// nodes of the other architectures use the default images
+	// +optional
+	// +listType=map
+	// +listMapKey=arch
+	Architectures []ArchitectureConfig `json:"architectures,omitempty"`
 
 	// This specifies the registry secret to pull of the container images
 	// +optional
@@ -117,6 +342,16 @@ type CcInstallConfig struct {
 	// +optional
 	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
 
+	// This specifies whether the payload and hook images are resolved to their digests once
+	// per spec generation, and the DaemonSets use the digests instead of the (mutable) tags
+	// +optional
+	PinImageDigests bool `json:"pinImageDigests,omitempty"`
+
+	// This specifies the policy used to verify the signatures of the payload and hook images
+	// before any DaemonSet is created. Setting it implies pinImageDigests
+	// +optional
+	ImageVerification *ImageVerificationPolicy `json:"imageVerification,omitempty"`
+
 	// This specifies the repo location to be used when using rpm/deb packages
 	// Some examples
 	//   add-apt-repository 'deb [arch=amd64] https://repo.confidential-containers.org/apt/ubuntu’
@@ -177,6 +412,15 @@ type CcInstallConfig struct {
 	// This specifies the environment variables required by the daemon set
 	// +optional
 	EnvironmentVariables []corev1.EnvVar `json:"environmentVariables,omitempty"`
+
+	// This specifies environment variables of the installer pods whose values are read from
+	// Secrets or ConfigMaps of the operator namespace, for sensitive configuration such as
+	// DECRYPT_CONFIG. The keys are also mounted as files in /etc/cc-operator/config
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	ConfigFrom []PayloadConfigSource `json:"configFrom,omitempty"`
+
 	// This specifies the label that the install daemonset adds to nodes
 	// when the installation is done
 	InstallDoneLabel map[string]string `json:"installDoneLabel,omitempty"`
@@ -192,6 +436,303 @@ type CcInstallConfig struct {
 	// This specifies the configuration for the post-uninstall daemonset
 	// +optional
 	PostUninstall PostUninstallConfig `json:"postUninstall,omitempty"`
+
+	// This specifies whether the nodes are labelled with their TEEs, as needed by the
+	// runtime classes declaring a tee
+	// +optional
+	TeeDiscovery TeeDiscoveryConfig `json:"teeDiscovery,omitempty"`
+
+	// This specifies the checks run on each selected node before anything is installed
+	// +optional
+	Preflight PreflightConfig `json:"preflight,omitempty"`
+
+	// This specifies the volumes and environment variables the pods need on the nodes
+	// running each container runtime, as detected from the container runtime version of
+	// the nodes. When set, each runtime is installed by its own DaemonSet, and nodes
+	// running a runtime without configuration aren't installed
+	// +optional
+	ContainerRuntimes *ContainerRuntimesConfig `json:"containerRuntimes,omitempty"`
+
+	// This specifies the hooks run on the nodes at the lifecycle points of the runtime.
+	// The hooks of a stage run one after the other, in the order they are listed, after
+	// the ones from preInstall and postUninstall
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Hooks []HookConfig `json:"hooks,omitempty"`
+
+	// This specifies how the operator rolls back to the last known-good payload
+	// +optional
+	Rollback RollbackConfig `json:"rollback,omitempty"`
+
+	// This specifies the per-node Jobs running the one-shot operations: the hooks,
+	// including preInstall and postUninstall, and the uninstallation
+	// +optional
+	NodeJobs NodeJobsConfig `json:"nodeJobs,omitempty"`
+
+	// This specifies strategic merge patches applied to the pod templates of the install,
+	// uninstall and hook pods, to set resources, a priority class, labels, annotations,
+	// affinity, tolerations or the DNS policy
+	// +optional
+	PodTemplateOverrides PodTemplateOverrides `json:"podTemplateOverrides,omitempty"`
+
+	// This specifies the security settings of the install, uninstall and hook pods. By
+	// default they run privileged, as root and in the host PID namespace
+	// +optional
+	SecurityContext *InstallerSecurityContext `json:"securityContext,omitempty"`
+
+	// This specifies the ServiceAccount the install, uninstall and hook pods run with. By
+	// default the operator creates a dedicated one, only allowed to label nodes and to
+	// manage RuntimeClasses
+	// +optional
+	ServiceAccount PayloadServiceAccountConfig `json:"serviceAccount,omitempty"`
+}
+
+// ArchitectureConfig holds the images used on the nodes of an architecture
+type ArchitectureConfig struct {
+	// This specifies the architecture, as in the kubernetes.io/arch label of the nodes, e.g. s390x
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]+$`
+	// +kubebuilder:validation:MaxLength=20
+	Arch string `json:"arch"`
+
+	// This specifies the payload image of the nodes of the architecture. When not set, the
+	// nodes use payloadImage
+	// +optional
+	PayloadImage string `json:"payloadImage,omitempty"`
+
+	// This specifies the images of the hooks on the nodes of the architecture, keyed on the
+	// name of the hook: pre-install and post-uninstall for the preInstall and postUninstall
+	// configurations, tee-probe for the TEE discovery probe
+	// +optional
+	HookImages map[string]string `json:"hookImages,omitempty"`
+}
+
+// ValidateArchitectures checks that the architectures only override the images
+// of the hooks that are configured
+func (c *CcInstallConfig) ValidateArchitectures() error {
+	hooks := map[string]bool{
+		"pre-install":    c.PreInstall.Image != "",
+		"post-uninstall": c.PostUninstall.Image != "",
+		"tee-probe":      c.TeeDiscovery.Enabled && c.TeeDiscovery.ProbeImage != "",
+	}
+	for _, hook := range c.Hooks {
+		hooks[hook.Name] = true
+	}
+
+	for _, arch := range c.Architectures {
+		for name, image := range arch.HookImages {
+			if !hooks[name] {
+				return fmt.Errorf("architectures %s: hookImages references the unknown hook %s", arch.Arch, name)
+			}
+			if image == "" {
+				return fmt.Errorf("architectures %s: hookImages has an empty image for hook %s", arch.Arch, name)
+			}
+		}
+	}
+	return nil
+}
+
+// PayloadServiceAccountConfig holds the settings of the ServiceAccount of the payload pods
+type PayloadServiceAccountConfig struct {
+	// Name of an existing ServiceAccount, in the operator namespace, to use instead of the
+	// dedicated one
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// AutomountToken mounts the ServiceAccount token in the pods, default true. Payloads
+	// labelling their node or creating RuntimeClasses need it
+	// +optional
+	AutomountToken *bool `json:"automountToken,omitempty"`
+}
+
+// SecurityProfile is a built-in set of security settings for the installer pods
+// +kubebuilder:validation:Enum=privileged;runtime-installer
+type SecurityProfile string
+
+const (
+	// PrivilegedSecurityProfile runs the containers privileged, as root and in the host
+	// PID namespace. It's what the payloads are tested with
+	PrivilegedSecurityProfile SecurityProfile = "privileged"
+
+	// RuntimeInstallerSecurityProfile is the minimum the kata-deploy, enclave-cc and
+	// pre-install payloads need to install the runtime files on the host and restart
+	// the container runtime with nsenter: root, the host PID namespace, the capabilities
+	// of RuntimeInstallerCapabilities and unconfined seccomp and AppArmor profiles
+	RuntimeInstallerSecurityProfile SecurityProfile = "runtime-installer"
+)
+
+// RuntimeInstallerCapabilities are the capabilities of the runtime-installer profile
+var RuntimeInstallerCapabilities = []corev1.Capability{
+	"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "MKNOD", "SETGID", "SETUID",
+	"SYS_ADMIN", "SYS_CHROOT", "SYS_PTRACE",
+}
+
+// InstallerSecurityContext holds the security settings of the installer pods. The
+// settings apply on top of the profile
+type InstallerSecurityContext struct {
+	// Profile is the built-in set of security settings to start from, default privileged
+	// +optional
+	Profile SecurityProfile `json:"profile,omitempty"`
+
+	// Privileged runs the containers privileged
+	// +optional
+	Privileged *bool `json:"privileged,omitempty"`
+
+	// Capabilities is the allow-list of capabilities, all the others are dropped
+	// +optional
+	Capabilities []corev1.Capability `json:"capabilities,omitempty"`
+
+	// SeccompProfile is the seccomp profile of the containers
+	// +optional
+	SeccompProfile *corev1.SeccompProfile `json:"seccompProfile,omitempty"`
+
+	// AppArmorProfile is the AppArmor profile of the containers
+	// +optional
+	AppArmorProfile *corev1.AppArmorProfile `json:"appArmorProfile,omitempty"`
+
+	// SELinuxOptions are the SELinux options of the containers
+	// +optional
+	SELinuxOptions *corev1.SELinuxOptions `json:"seLinuxOptions,omitempty"`
+
+	// HostPID runs the pods in the host PID namespace, which the payloads use to restart
+	// the container runtime
+	// +optional
+	HostPID *bool `json:"hostPID,omitempty"`
+}
+
+// FullyPrivileged returns whether the installer pods run privileged with these settings
+func (c *InstallerSecurityContext) FullyPrivileged() bool {
+	if c == nil {
+		return true
+	}
+	if c.Privileged != nil {
+		return *c.Privileged
+	}
+	return c.Profile == "" || c.Profile == PrivilegedSecurityProfile
+}
+
+// PodTemplateOverrides holds strategic merge patches of pod templates, per pod type. The
+// containers are matched by name: cc-runtime-install-pod for the install and uninstall
+// pods, cc-runtime-hook-pod for the hook pods. The patches may only set the labels and
+// annotations of the pods, their priorityClassName, affinity, tolerations and dnsPolicy,
+// and the resources of the containers
+type PodTemplateOverrides struct {
+	// Install is applied to the pods of the install DaemonSet
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	Install *runtime.RawExtension `json:"install,omitempty"`
+
+	// Uninstall is applied to the pods of the uninstall Jobs
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	Uninstall *runtime.RawExtension `json:"uninstall,omitempty"`
+
+	// Hooks is applied to the pods of the hook Jobs, including preInstall and postUninstall
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	Hooks *runtime.RawExtension `json:"hooks,omitempty"`
+}
+
+// NodeJobsConfig holds the settings of the per-node Jobs
+type NodeJobsConfig struct {
+	// This specifies the number of retries before a Job is reported as failed on a node, default 3
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// This specifies how long finished Jobs are kept before being deleted, default 3600
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// HookConfig holds the configuration of a hook run on all the nodes
+type HookConfig struct {
+	// This specifies the name of the hook. The names pre-install and post-uninstall are
+	// reserved for the preInstall and postUninstall configurations, and tee-probe for
+	// the TEE discovery
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=40
+	// +kubebuilder:validation:XValidation:rule="self != 'pre-install' && self != 'post-uninstall' && self != 'tee-probe'",message="name is reserved"
+	Name string `json:"name"`
+
+	// This specifies the lifecycle point the hook runs at
+	Stage HookStage `json:"stage"`
+
+	// This specifies the image of the hook
+	Image string `json:"image"`
+
+	// This specifies the command of the hook. The hook is done on a node once the command
+	// exits successfully
+	// +optional
+	Cmd []string `json:"cmd,omitempty"`
+
+	// This specifies the env variables for the hook
+	// +optional
+	EnvironmentVariables []corev1.EnvVar `json:"environmentVariables,omitempty"`
+
+	// This specifies the volumes for the hook
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// This specifies the volumeMounts for the hook
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// This specifies how long the hook may run on a node before it's reported as failed.
+	// The following hooks don't run until it completes
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// ImageVerificationPolicy holds the settings used to verify cosign signatures of the images
+type ImageVerificationPolicy struct {
+	// SecretRef is the Secret, in the operator namespace, holding the verification material:
+	// the PEM encoded public keys under "cosign.pub", or, for keyless verification, the PEM
+	// encoded Fulcio root certificates under "fulcio-roots.pem" and the PEM encoded public
+	// keys of the Rekor transparency logs under "rekor.pub"
+	SecretRef corev1.LocalObjectReference `json:"secretRef"`
+
+	// Keyless is the identity the signing certificate must carry. When set, the signatures are
+	// verified against a Fulcio issued certificate instead of the public keys, and must have
+	// been recorded in a trusted Rekor transparency log while the certificate was valid
+	// +optional
+	Keyless *KeylessIdentity `json:"keyless,omitempty"`
+}
+
+// KeylessIdentity is the identity of a keyless signature
+type KeylessIdentity struct {
+	// Issuer is the OIDC issuer that authenticated the signer
+	Issuer string `json:"issuer"`
+
+	// Subject is the email address or URI of the signer
+	Subject string `json:"subject"`
+}
+
+// RollbackConfig holds the settings used to roll back to the last known-good payload configuration
+type RollbackConfig struct {
+	// This specifies whether the operator rolls back automatically to the last known-good
+	// revision when a new payload configuration fails on FailureThreshold nodes
+	// +optional
+	Auto bool `json:"auto,omitempty"`
+
+	// This specifies the number of nodes that have to fail the installation before an
+	// automatic rollback is triggered. Default is 1
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+
+	// This specifies the number of revisions kept in the status. Default is 10
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit int `json:"revisionHistoryLimit,omitempty"`
 }
 
 type PostUninstallConfig struct {
@@ -235,6 +776,122 @@ type PreInstallConfig struct {
 	// This specifies the volumeMounts for the pre-install daemon set
 	// +optional
 	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// This specifies the containerd the pre-install payload installs on the nodes, "none"
+	// relying on the containerd of the nodes. It replaces the INSTALL_*_CONTAINERD
+	// environment variables
+	// +optional
+	Containerd ContainerdFlavour `json:"containerd,omitempty"`
+
+	// This specifies whether the pre-install payload installs nydus-snapshotter and
+	// nydus-image on the nodes. It replaces the INSTALL_NYDUS_SNAPSHOTTER environment variable
+	// +optional
+	InstallNydusSnapshotter *bool `json:"installNydusSnapshotter,omitempty"`
+}
+
+// ContainerdFlavour is the containerd installed by the pre-install payload
+// +kubebuilder:validation:Enum=none;coco;official;vfio-gpu
+type ContainerdFlavour string
+
+const (
+	// NoContainerd relies on the containerd of the nodes
+	NoContainerd ContainerdFlavour = "none"
+
+	// CocoContainerd is the CoCo fork of containerd
+	CocoContainerd ContainerdFlavour = "coco"
+
+	// OfficialContainerd is the upstream release of containerd
+	OfficialContainerd ContainerdFlavour = "official"
+
+	// VfioGpuContainerd is the CoCo fork of containerd with the GPU / VFIO patches
+	VfioGpuContainerd ContainerdFlavour = "vfio-gpu"
+)
+
+// containerdFlavourEnv are the environment variables of the pre-install payload
+// selecting each containerd flavour
+var containerdFlavourEnv = []struct {
+	flavour ContainerdFlavour
+	name    string
+}{
+	{CocoContainerd, "INSTALL_COCO_CONTAINERD"},
+	{OfficialContainerd, "INSTALL_OFFICIAL_CONTAINERD"},
+	{VfioGpuContainerd, "INSTALL_VFIO_GPU_CONTAINERD"},
+}
+
+const (
+	installNydusSnapshotterEnv = "INSTALL_NYDUS_SNAPSHOTTER"
+
+	// nydusSnapshotter is the snapshotter of the runtime classes relying on nydus
+	nydusSnapshotter = "nydus"
+)
+
+// PreInstallEnv returns the environment variables of the pre-install and
+// post-uninstall payloads rendered from the containerd and
+// installNydusSnapshotter switches, and checks them for conflicts with the
+// environment variables and the runtime classes
+func (c *CcInstallConfig) PreInstallEnv() ([]corev1.EnvVar, error) {
+	preInstall := &c.PreInstall
+	if preInstall.Image == "" {
+		if preInstall.Containerd != "" || preInstall.InstallNydusSnapshotter != nil {
+			return nil, fmt.Errorf("preInstall.containerd and preInstall.installNydusSnapshotter require preInstall.image")
+		}
+		return nil, nil
+	}
+
+	// The variables set later win, like for the containers
+	values := map[string]string{}
+	for _, envs := range [][]corev1.EnvVar{c.EnvironmentVariables, preInstall.EnvironmentVariables} {
+		for _, env := range envs {
+			if env.ValueFrom == nil {
+				values[env.Name] = env.Value
+			}
+		}
+	}
+	switchEnv := func(name string, enabled bool) (corev1.EnvVar, error) {
+		if value, ok := values[name]; ok && (value == "true") != enabled {
+			return corev1.EnvVar{}, fmt.Errorf("%s is set to %q in the environment variables, conflicting with preInstall", name, value)
+		}
+		values[name] = strconv.FormatBool(enabled)
+		return corev1.EnvVar{Name: name, Value: values[name]}, nil
+	}
+
+	var envs []corev1.EnvVar
+	if preInstall.Containerd != "" {
+		for _, flavour := range containerdFlavourEnv {
+			env, err := switchEnv(flavour.name, flavour.flavour == preInstall.Containerd)
+			if err != nil {
+				return nil, err
+			}
+			envs = append(envs, env)
+		}
+	}
+	var enabled []string
+	for _, flavour := range containerdFlavourEnv {
+		if values[flavour.name] == "true" {
+			enabled = append(enabled, flavour.name)
+		}
+	}
+	if len(enabled) > 1 {
+		return nil, fmt.Errorf("only one containerd can be installed, but %s are true", strings.Join(enabled, ", "))
+	}
+
+	if preInstall.InstallNydusSnapshotter != nil {
+		env, err := switchEnv(installNydusSnapshotterEnv, *preInstall.InstallNydusSnapshotter)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	// The pre-install payload installs nydus-snapshotter unless told otherwise
+	if value, ok := values[installNydusSnapshotterEnv]; ok && value != "true" {
+		for _, runtimeClass := range c.RuntimeClasses {
+			if runtimeClass.Snapshotter == nydusSnapshotter {
+				return nil, fmt.Errorf("runtime class %s uses the nydus snapshotter, which isn't installed", runtimeClass.Name)
+			}
+		}
+	}
+
+	return envs, nil
 }
 
 // CcInstallationStatus reflects the status of the ongoing confidential containers runtime installation
@@ -307,6 +964,114 @@ type CcUnInstallationInProgressStatus struct {
 type CcUpgradeStatus struct {
 }
 
+// PayloadConfigSource is an environment variable of the installer pods read from
+// a key of a Secret or of a ConfigMap
+// +kubebuilder:validation:XValidation:rule="has(self.secretKeyRef) != has(self.configMapKeyRef)",message="exactly one of secretKeyRef and configMapKeyRef must be set"
+type PayloadConfigSource struct {
+	// This specifies the name of the environment variable, which is also the name of the
+	// file the key is mounted as
+	// +kubebuilder:validation:Pattern=`^[A-Za-z_][A-Za-z0-9_]*$`
+	Name string `json:"name"`
+
+	// This specifies the key of a Secret of the operator namespace holding the value
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+
+	// This specifies the key of a ConfigMap of the operator namespace holding the value
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+}
+
+// CcRuntimeRevision identifies a payload configuration that was installed successfully on all
+// nodes. The configuration itself is kept in a ControllerRevision of the operator namespace
+type CcRuntimeRevision struct {
+	// Revision is the sequence number of this revision
+	Revision int64 `json:"revision"`
+
+	// Hash identifies the payload configuration of this revision, and names its ControllerRevision
+	Hash string `json:"hash"`
+
+	// PayloadImage is the payload image of this revision
+	PayloadImage string `json:"payloadImage"`
+
+	// HookImages are the images of the preInstall, postUninstall and hooks of this revision
+	// +optional
+	HookImages []RevisionImage `json:"hookImages,omitempty"`
+
+	// InstalledTime is the time at which this revision completed the installation on all nodes
+	// +optional
+	InstalledTime metav1.Time `json:"installedTime,omitempty"`
+}
+
+// RevisionImage is an image of a revision
+type RevisionImage struct {
+	// Name of the component using the image, e.g. preInstall or the name of a hook
+	Name string `json:"name"`
+
+	// Image is the image reference
+	Image string `json:"image"`
+}
+
+// HookStatus reflects the progress of a hook
+type HookStatus struct {
+	// Name of the hook
+	Name string `json:"name"`
+
+	// Stage the hook runs at
+	Stage HookStage `json:"stage"`
+
+	// Phase of the hook
+	Phase HookPhase `json:"phase"`
+
+	// CompletedNodesList reflects the list of nodes the hook completed on
+	// +optional
+	CompletedNodesList []string `json:"completedNodesList,omitempty"`
+
+	// FailedNodesList reflects the list of nodes the Job of the hook failed on
+	// +optional
+	FailedNodesList []FailedNodeStatus `json:"failedNodesList,omitempty"`
+
+	// Message explains a failure of the hook
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// CcImageStatus holds the image reference from the spec and the one used by the DaemonSets
+type CcImageStatus struct {
+	// Name of the component using the image, e.g. payload or preInstall
+	Name string `json:"name"`
+
+	// Image is the image reference as specified in the spec
+	Image string `json:"image"`
+
+	// Digest is the manifest digest the image resolved to
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// ResolvedImage is the image reference used by the DaemonSets, after applying the
+	// registry mirrors of the operator and pinning the digest
+	ResolvedImage string `json:"resolvedImage"`
+
+	// Verified reflects whether the signature of the image was verified
+	// +optional
+	Verified bool `json:"verified,omitempty"`
+}
+
+// AgentPolicyStatus holds the digest of the agent policy of a runtime class
+type AgentPolicyStatus struct {
+	// RuntimeClass is the name of the runtime class
+	RuntimeClass string `json:"runtimeClass"`
+
+	// ConfigMap is the name of the ConfigMap holding the policy
+	ConfigMap string `json:"configMap"`
+
+	// Key is the key of the ConfigMap holding the policy
+	Key string `json:"key"`
+
+	// Digest is the sha256 digest of the policy distributed to the nodes
+	Digest string `json:"digest"`
+}
+
 // FailedNodeStatus holds the name and the error message of the failed node
 type FailedNodeStatus struct {
 	// Name of the failed node
@@ -323,6 +1088,340 @@ type RuntimeClass struct {
 	Snapshotter string `json:"snapshotter"`
 	// The pulling image method to be used by the runtime class
 	PullType string `json:"pulltype"`
+	// This specifies the key of a ConfigMap of the operator namespace holding the Rego
+	// agent policy used by default for the pods of the runtime class
+	// +optional
+	AgentPolicy *corev1.ConfigMapKeySelector `json:"agentPolicy,omitempty"`
+	// This specifies the TEE the nodes need to run the pods of the runtime class. Only
+	// the nodes labelled with it are counted for the runtime class, and the pods are
+	// scheduled on them
+	// +optional
+	Tee TeeType `json:"tee,omitempty"`
+}
+
+// TeeType is a Trusted Execution Environment technology
+// +kubebuilder:validation:Enum=tdx;sev-snp;se;sgx
+type TeeType string
+
+const (
+	// TdxTee is Intel TDX
+	TdxTee TeeType = "tdx"
+
+	// SevSnpTee is AMD SEV-SNP
+	SevSnpTee TeeType = "sev-snp"
+
+	// SeTee is IBM Secure Execution
+	SeTee TeeType = "se"
+
+	// SgxTee is Intel SGX
+	SgxTee TeeType = "sgx"
+)
+
+// TeeTypes are all the known TEE technologies
+var TeeTypes = []TeeType{TdxTee, SevSnpTee, SeTee, SgxTee}
+
+// ValidateTees checks that the nodes are labelled with their TEEs when a
+// runtime class needs one, as it would be scheduled on no node otherwise
+func (c *CcInstallConfig) ValidateTees() error {
+	if c.TeeDiscovery.Enabled {
+		return nil
+	}
+	for _, runtimeClass := range c.RuntimeClasses {
+		if runtimeClass.Tee != "" {
+			return fmt.Errorf("runtimeClasses %s: tee needs teeDiscovery.enabled", runtimeClass.Name)
+		}
+	}
+	return nil
+}
+
+// TeeDiscoveryConfig configures the discovery of the TEEs of the nodes
+type TeeDiscoveryConfig struct {
+	// This specifies whether the nodes are labelled with their TEEs, from the Node
+	// Feature Discovery labels and the probe
+	Enabled bool `json:"enabled"`
+
+	// This specifies the image the TEEs are probed on the nodes with, before the
+	// preInstall hooks. It needs a shell and kubectl, e.g. the reqs-payload image.
+	// When not set only the Node Feature Discovery labels are used
+	// +optional
+	ProbeImage string `json:"probeImage,omitempty"`
+}
+
+// ContainerRuntime is a container runtime of the nodes, as named in their
+// container runtime version
+type ContainerRuntime string
+
+const (
+	// ContainerdRuntime is containerd
+	ContainerdRuntime ContainerRuntime = "containerd"
+
+	// CriORuntime is CRI-O
+	CriORuntime ContainerRuntime = "cri-o"
+)
+
+// ContainerRuntimes are the container runtimes the payloads support
+var ContainerRuntimes = []ContainerRuntime{ContainerdRuntime, CriORuntime}
+
+// ContainerRuntimesConfig holds the configuration specific to each container runtime
+type ContainerRuntimesConfig struct {
+	// This specifies the configuration of the nodes running containerd
+	// +optional
+	Containerd *ContainerRuntimeConfig `json:"containerd,omitempty"`
+
+	// This specifies the configuration of the nodes running CRI-O
+	// +optional
+	CriO *ContainerRuntimeConfig `json:"crio,omitempty"`
+}
+
+// Get returns the configuration of the container runtime, nil when it has none
+func (c *ContainerRuntimesConfig) Get(runtime ContainerRuntime) *ContainerRuntimeConfig {
+	switch runtime {
+	case ContainerdRuntime:
+		return c.Containerd
+	case CriORuntime:
+		return c.CriO
+	}
+	return nil
+}
+
+// ValidateContainerRuntimes checks that the volumes of the container runtimes
+// don't clash with the ones they're added to
+func (c *CcInstallConfig) ValidateContainerRuntimes() error {
+	if c.ContainerRuntimes == nil {
+		return nil
+	}
+	hookVolumes := [][]corev1.Volume{c.PreInstall.Volumes, c.PostUninstall.Volumes}
+	for _, hook := range c.Hooks {
+		hookVolumes = append(hookVolumes, hook.Volumes)
+	}
+	for _, runtime := range ContainerRuntimes {
+		config := c.ContainerRuntimes.Get(runtime)
+		if config == nil {
+			continue
+		}
+		if name := clashingVolume(config.InstallerVolumes, c.InstallerVolumes); name != "" {
+			return fmt.Errorf("containerRuntimes %s: the installer volume %s is already in installerVolumes", runtime, name)
+		}
+		for _, volumes := range hookVolumes {
+			if name := clashingVolume(config.HookVolumes, volumes); name != "" {
+				return fmt.Errorf("containerRuntimes %s: the hook volume %s is already a volume of a hook", runtime, name)
+			}
+		}
+	}
+	return nil
+}
+
+func clashingVolume(volumes []corev1.Volume, others []corev1.Volume) string {
+	for _, volume := range volumes {
+		for _, other := range others {
+			if volume.Name == other.Name {
+				return volume.Name
+			}
+		}
+	}
+	return ""
+}
+
+// ContainerRuntimeConfig holds what the pods need on the nodes running a container runtime,
+// on top of the rest of the configuration
+type ContainerRuntimeConfig struct {
+	// This specifies the volumes added to the install and uninstall pods, e.g. the
+	// configuration directory of the runtime
+	// +optional
+	InstallerVolumes []corev1.Volume `json:"installerVolumes,omitempty"`
+
+	// This specifies the volume mounts added to the install and uninstall pods
+	// +optional
+	InstallerVolumeMounts []corev1.VolumeMount `json:"installerVolumeMounts,omitempty"`
+
+	// This specifies the volumes added to the hook pods
+	// +optional
+	HookVolumes []corev1.Volume `json:"hookVolumes,omitempty"`
+
+	// This specifies the volume mounts added to the hook pods
+	// +optional
+	HookVolumeMounts []corev1.VolumeMount `json:"hookVolumeMounts,omitempty"`
+
+	// This specifies the env variables added to the install, uninstall and hook pods
+	// +optional
+	EnvironmentVariables []corev1.EnvVar `json:"environmentVariables,omitempty"`
+}
+
+// NodeRuntimeStatus holds the container runtime detected on a node
+type NodeRuntimeStatus struct {
+	// Name of the node
+	Name string `json:"name"`
+
+	// ContainerRuntime is the container runtime of the node
+	ContainerRuntime ContainerRuntime `json:"containerRuntime"`
+
+	// Version is the version of the container runtime
+	// +optional
+	Version string `json:"version,omitempty"`
+}
+
+// PreflightPolicy is what happens to the nodes failing the preflight checks
+// +kubebuilder:validation:Enum=Block;Exclude
+type PreflightPolicy string
+
+const (
+	// BlockPreflightPolicy holds the installation until all the nodes pass the checks
+	BlockPreflightPolicy PreflightPolicy = "Block"
+
+	// ExcludePreflightPolicy installs on the nodes passing the checks only
+	ExcludePreflightPolicy PreflightPolicy = "Exclude"
+)
+
+// PreflightConfig configures the checks run on the selected nodes before the installation
+type PreflightConfig struct {
+	// This specifies whether the checks run, before the preInstall hooks
+	Enabled bool `json:"enabled"`
+
+	// This specifies what happens to the nodes failing the checks: Block, the default,
+	// holds the installation until they pass, Exclude installs on the other nodes only
+	// +optional
+	Policy PreflightPolicy `json:"policy,omitempty"`
+
+	// This specifies the image gathering the facts checked on the nodes. It needs a POSIX
+	// shell and df. The payload image of the node is used by default
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// This specifies the minimum kernel version of the nodes, e.g. 5.15
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+){0,2}$`
+	MinKernelVersion string `json:"minKernelVersion,omitempty"`
+
+	// This specifies the kernel modules the nodes must have loaded, or built in. By
+	// default kvm and vhost_vsock, unless the runtime is enclave-cc
+	// +optional
+	KernelModules []string `json:"kernelModules,omitempty"`
+
+	// This specifies the supported container runtimes, as named in the container runtime
+	// version of the nodes, with their minimum version, e.g. containerd: "1.7". An empty
+	// version accepts any version. Any runtime is accepted by default
+	// +optional
+	ContainerRuntimes map[string]string `json:"containerRuntimes,omitempty"`
+
+	// This specifies the cgroup version the nodes must run. Any by default
+	// +optional
+	// +kubebuilder:validation:Enum=1;2
+	CgroupVersion int32 `json:"cgroupVersion,omitempty"`
+
+	// This specifies the free disk space required under each of the installPaths
+	// +optional
+	MinFreeDisk *resource.Quantity `json:"minFreeDisk,omitempty"`
+
+	// This specifies the host paths the payload installs under, /opt by default
+	// +optional
+	InstallPaths []string `json:"installPaths,omitempty"`
+
+	// This specifies the host paths whose presence reveals a runtime conflicting with the
+	// payload, e.g. /usr/bin/containerd-shim-kata-v2 for kata installed from the
+	// distribution packages
+	// +optional
+	ConflictingPaths []string `json:"conflictingPaths,omitempty"`
+
+	// This specifies how long the facts can take to be gathered on a node
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// Validate checks that the paths and kernel modules can be passed to the
+// script gathering the facts, which splits them on whitespaces
+func (c *PreflightConfig) Validate() error {
+	for _, module := range c.KernelModules {
+		if module == "" || strings.ContainsAny(module, " \t\n/") {
+			return fmt.Errorf("kernelModules: invalid kernel module name %q", module)
+		}
+	}
+	for field, paths := range map[string][]string{"installPaths": c.InstallPaths, "conflictingPaths": c.ConflictingPaths} {
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t\n") {
+				return fmt.Errorf("%s: %q must be an absolute path without whitespaces", field, path)
+			}
+		}
+	}
+	if c.MinFreeDisk != nil && c.MinFreeDisk.Sign() < 0 {
+		return fmt.Errorf("minFreeDisk must not be negative")
+	}
+	return nil
+}
+
+// PreflightNodeStatus holds the results of the preflight checks on a node
+type PreflightNodeStatus struct {
+	// Name of the node
+	Name string `json:"name"`
+
+	// Passed reflects whether the node passed all the checks
+	Passed bool `json:"passed"`
+
+	// Failures lists the checks the node failed
+	// +optional
+	Failures []string `json:"failures,omitempty"`
+
+	// KernelVersion is the kernel version of the node
+	// +optional
+	KernelVersion string `json:"kernelVersion,omitempty"`
+
+	// ContainerRuntimeVersion is the container runtime of the node, with its version
+	// +optional
+	ContainerRuntimeVersion string `json:"containerRuntimeVersion,omitempty"`
+
+	// CgroupVersion is the cgroup version the node runs
+	// +optional
+	CgroupVersion int32 `json:"cgroupVersion,omitempty"`
+
+	// MissingKernelModules lists the kernel modules the node lacks
+	// +optional
+	MissingKernelModules []string `json:"missingKernelModules,omitempty"`
+
+	// FreeDisk is the free disk space under each of the install paths
+	// +optional
+	FreeDisk map[string]resource.Quantity `json:"freeDisk,omitempty"`
+
+	// ConflictingPaths lists the paths of conflicting runtimes found on the node
+	// +optional
+	ConflictingPaths []string `json:"conflictingPaths,omitempty"`
+
+	// FactsHash is the hash of the pod template the facts were gathered with. They are
+	// gathered again when it changes
+	// +optional
+	FactsHash string `json:"factsHash,omitempty"`
+
+	// LastGatheredTime is when the facts were gathered. They are gathered again
+	// periodically while the node fails the checks
+	// +optional
+	LastGatheredTime metav1.Time `json:"lastGatheredTime,omitempty"`
+}
+
+// ArchitectureStatus reflects the installation progress on the nodes of an architecture
+type ArchitectureStatus struct {
+	// Arch is the kubernetes.io/arch label of the nodes
+	Arch string `json:"arch"`
+
+	// PayloadImage is the payload image installed on the nodes
+	PayloadImage string `json:"payloadImage"`
+
+	// NodesCount is the number of selected nodes of the architecture
+	NodesCount int `json:"nodesCount"`
+
+	// CompletedNodesCount is the number of nodes of the architecture that completed the installation
+	CompletedNodesCount int `json:"completedNodesCount"`
+}
+
+// RuntimeClassNodesStatus holds the nodes a runtime class can run on
+type RuntimeClassNodesStatus struct {
+	// Name of the runtime class
+	Name string `json:"name"`
+
+	// Tee is the TEE the runtime class needs, if any
+	// +optional
+	Tee TeeType `json:"tee,omitempty"`
+
+	// NodesCount is the number of selected nodes the runtime class can run on
+	NodesCount int `json:"nodesCount"`
 }
 
 func init() {
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("preInstall switches", func() {
+	enabled, disabled := true, false
+
+	newConfig := func(preInstall PreInstallConfig, env ...corev1.EnvVar) *CcInstallConfig {
+		if preInstall.Image == "" {
+			preInstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+		}
+		preInstall.EnvironmentVariables = env
+		return &CcInstallConfig{
+			PreInstall:     preInstall,
+			RuntimeClasses: []RuntimeClass{{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull"}},
+		}
+	}
+
+	DescribeTable("rendering the environment variables",
+		func(config *CcInstallConfig, want []corev1.EnvVar) {
+			envs, err := config.PreInstallEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(envs).To(Equal(want))
+		},
+		Entry("no switch", newConfig(PreInstallConfig{}), nil),
+		Entry("coco containerd and nydus-snapshotter",
+			newConfig(PreInstallConfig{Containerd: CocoContainerd, InstallNydusSnapshotter: &enabled}),
+			[]corev1.EnvVar{
+				{Name: "INSTALL_COCO_CONTAINERD", Value: "true"},
+				{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_VFIO_GPU_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_NYDUS_SNAPSHOTTER", Value: "true"},
+			}),
+		Entry("containerd of the nodes",
+			newConfig(PreInstallConfig{Containerd: NoContainerd}),
+			[]corev1.EnvVar{
+				{Name: "INSTALL_COCO_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_VFIO_GPU_CONTAINERD", Value: "false"},
+			}),
+		Entry("matching environment variable",
+			newConfig(PreInstallConfig{Containerd: VfioGpuContainerd},
+				corev1.EnvVar{Name: "INSTALL_VFIO_GPU_CONTAINERD", Value: "true"}),
+			[]corev1.EnvVar{
+				{Name: "INSTALL_COCO_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "false"},
+				{Name: "INSTALL_VFIO_GPU_CONTAINERD", Value: "true"},
+			}),
+		Entry("switches without the pre-install payload", &CcInstallConfig{}, nil),
+	)
+
+	DescribeTable("rejecting conflicting settings",
+		func(config *CcInstallConfig, want string) {
+			_, err := config.PreInstallEnv()
+			Expect(err).To(MatchError(want))
+		},
+		Entry("switches without the pre-install payload",
+			&CcInstallConfig{PreInstall: PreInstallConfig{Containerd: CocoContainerd}},
+			"preInstall.containerd and preInstall.installNydusSnapshotter require preInstall.image"),
+		Entry("containerd conflicting with an environment variable",
+			newConfig(PreInstallConfig{Containerd: CocoContainerd},
+				corev1.EnvVar{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "true"}),
+			`INSTALL_OFFICIAL_CONTAINERD is set to "true" in the environment variables, conflicting with preInstall`),
+		Entry("two containerd flavours in the environment variables",
+			newConfig(PreInstallConfig{},
+				corev1.EnvVar{Name: "INSTALL_COCO_CONTAINERD", Value: "true"},
+				corev1.EnvVar{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "true"}),
+			"only one containerd can be installed, but INSTALL_COCO_CONTAINERD, INSTALL_OFFICIAL_CONTAINERD are true"),
+		Entry("nydus snapshotter not installed",
+			newConfig(PreInstallConfig{InstallNydusSnapshotter: &disabled}),
+			"runtime class kata-qemu-tdx uses the nydus snapshotter, which isn't installed"),
+		Entry("nydus snapshotter disabled by an environment variable",
+			newConfig(PreInstallConfig{}, corev1.EnvVar{Name: "INSTALL_NYDUS_SNAPSHOTTER", Value: "false"}),
+			"runtime class kata-qemu-tdx uses the nydus snapshotter, which isn't installed"),
+	)
+
+	It("takes the preInstall environment variables over the common ones", func() {
+		config := newConfig(PreInstallConfig{Containerd: OfficialContainerd},
+			corev1.EnvVar{Name: "INSTALL_COCO_CONTAINERD", Value: "false"})
+		config.EnvironmentVariables = []corev1.EnvVar{{Name: "INSTALL_COCO_CONTAINERD", Value: "true"}}
+
+		envs, err := config.PreInstallEnv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(envs).To(ContainElement(corev1.EnvVar{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "true"}))
+	})
+})
+
+var _ = Describe("Preflight configuration", func() {
+	negative := resource.MustParse("-1Gi")
+
+	DescribeTable("validating the settings passed to the script",
+		func(config PreflightConfig, want string) {
+			err := config.Validate()
+			if want == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(want))
+		},
+		Entry("valid", PreflightConfig{
+			KernelModules: []string{"kvm_intel", "vhost_vsock"}, InstallPaths: []string{"/opt", "/usr/local"},
+			ConflictingPaths: []string{"/opt/confidential-containers"},
+		}, ""),
+		Entry("empty kernel module", PreflightConfig{KernelModules: []string{""}},
+			`kernelModules: invalid kernel module name ""`),
+		Entry("several kernel modules in one", PreflightConfig{KernelModules: []string{"kvm vhost_vsock"}},
+			`kernelModules: invalid kernel module name "kvm vhost_vsock"`),
+		Entry("kernel module path", PreflightConfig{KernelModules: []string{"../kvm"}},
+			`kernelModules: invalid kernel module name "../kvm"`),
+		Entry("relative install path", PreflightConfig{InstallPaths: []string{"opt"}},
+			`installPaths: "opt" must be an absolute path without whitespaces`),
+		Entry("conflicting path with whitespaces", PreflightConfig{ConflictingPaths: []string{"/opt/kata /usr"}},
+			`conflictingPaths: "/opt/kata /usr" must be an absolute path without whitespaces`),
+		Entry("negative free disk space", PreflightConfig{MinFreeDisk: &negative},
+			"minFreeDisk must not be negative"),
+	)
+})
+
+var _ = Describe("Container runtimes configuration", func() {
+	volume := func(name string) corev1.Volume {
+		return corev1.Volume{Name: name, VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: "/etc/" + name}}}
+	}
+
+	DescribeTable("validating the volumes of the container runtimes",
+		func(config CcInstallConfig, want string) {
+			err := config.ValidateContainerRuntimes()
+			if want == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(want))
+		},
+		Entry("no configuration", CcInstallConfig{InstallerVolumes: []corev1.Volume{volume("containerd-conf")}}, ""),
+		Entry("volumes of their own", CcInstallConfig{
+			InstallerVolumes: []corev1.Volume{volume("containerd-conf")},
+			ContainerRuntimes: &ContainerRuntimesConfig{CriO: &ContainerRuntimeConfig{
+				InstallerVolumes: []corev1.Volume{volume("crio-conf")},
+				HookVolumes:      []corev1.Volume{volume("crio-hooks")},
+			}},
+		}, ""),
+		Entry("installer volume clash", CcInstallConfig{
+			InstallerVolumes: []corev1.Volume{volume("containerd-conf")},
+			ContainerRuntimes: &ContainerRuntimesConfig{Containerd: &ContainerRuntimeConfig{
+				InstallerVolumes: []corev1.Volume{volume("containerd-conf")},
+			}},
+		}, "containerRuntimes containerd: the installer volume containerd-conf is already in installerVolumes"),
+		Entry("hook volume clash", CcInstallConfig{
+			Hooks: []HookConfig{{Name: "smoke-test", Volumes: []corev1.Volume{volume("crio-hooks")}}},
+			ContainerRuntimes: &ContainerRuntimesConfig{CriO: &ContainerRuntimeConfig{
+				HookVolumes: []corev1.Volume{volume("crio-hooks")},
+			}},
+		}, "containerRuntimes cri-o: the hook volume crio-hooks is already a volume of a hook"),
+		Entry("preInstall volume clash", CcInstallConfig{
+			PreInstall: PreInstallConfig{Volumes: []corev1.Volume{volume("crio-hooks")}},
+			ContainerRuntimes: &ContainerRuntimesConfig{CriO: &ContainerRuntimeConfig{
+				HookVolumes: []corev1.Volume{volume("crio-hooks")},
+			}},
+		}, "containerRuntimes cri-o: the hook volume crio-hooks is already a volume of a hook"),
+	)
+})
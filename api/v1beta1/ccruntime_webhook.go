@@ -0,0 +1,129 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var ccruntimelog = logf.Log.WithName("ccruntime-resource")
+
+// SetupWebhookWithManager will setup the manager to manage the webhooks
+func (r *CcRuntime) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&CcRuntimeCustomValidator{}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-confidentialcontainers-org-v1beta1-ccruntime,mutating=false,failurePolicy=fail,sideEffects=None,groups=confidentialcontainers.org,resources=ccruntimes,verbs=create;update,versions=v1beta1,name=vccruntime.kb.io,admissionReviewVersions=v1
+
+// CcRuntimeCustomValidator validates the CcRuntime resources
+type CcRuntimeCustomValidator struct{}
+
+var _ webhook.CustomValidator = &CcRuntimeCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *CcRuntimeCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	ccRuntime, ok := obj.(*CcRuntime)
+	if !ok {
+		return nil, fmt.Errorf("expected a CcRuntime object but got %T", obj)
+	}
+	ccruntimelog.Info("validate create", "name", ccRuntime.Name)
+
+	return ccRuntime.validate()
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *CcRuntimeCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	ccRuntime, ok := newObj.(*CcRuntime)
+	if !ok {
+		return nil, fmt.Errorf("expected a CcRuntime object but got %T", newObj)
+	}
+	ccruntimelog.Info("validate update", "name", ccRuntime.Name)
+
+	return ccRuntime.validate()
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *CcRuntimeCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (r *CcRuntime) validate() (admission.Warnings, error) {
+	var warnings admission.Warnings
+
+	if r.Spec.Profile != "" {
+		effective := r.DeepCopy()
+		if err := effective.ApplyProfile(); err != nil {
+			return warnings, fmt.Errorf("spec.profile: %w", err)
+		}
+		r = effective
+	}
+
+	// The profile provides them otherwise
+	if r.Spec.RuntimeName == "" {
+		return warnings, fmt.Errorf("spec.runtimeName: required without a profile")
+	}
+	if r.Spec.Config.InstallType == "" {
+		return warnings, fmt.Errorf("spec.config.installType: required without a profile")
+	}
+	if r.Spec.Config.PayloadImage == "" {
+		return warnings, fmt.Errorf("spec.config.payloadImage: required without a profile")
+	}
+
+	if r.Spec.Config.SecurityContext.FullyPrivileged() {
+		warnings = append(warnings, fmt.Sprintf("CcRuntime %s runs the install, uninstall and hook pods fully "+
+			"privileged, set spec.config.securityContext to reduce their privileges", r.Name))
+	}
+
+	if _, err := r.Spec.Config.PreInstallEnv(); err != nil {
+		return warnings, fmt.Errorf("spec.config: %w", err)
+	}
+
+	if err := r.Spec.Config.ValidateArchitectures(); err != nil {
+		return warnings, fmt.Errorf("spec.config: %w", err)
+	}
+
+	if err := r.Spec.Config.ValidateContainerRuntimes(); err != nil {
+		return warnings, fmt.Errorf("spec.config: %w", err)
+	}
+
+	if err := r.Spec.Config.ValidateTees(); err != nil {
+		return warnings, fmt.Errorf("spec.config: %w", err)
+	}
+
+	if err := r.Spec.Config.Preflight.Validate(); err != nil {
+		return warnings, fmt.Errorf("spec.config.preflight: %w", err)
+	}
+
+	if r.Spec.Attestation != nil {
+		if err := r.Spec.Attestation.Validate(r.Spec.Config.RuntimeClasses); err != nil {
+			return warnings, fmt.Errorf("spec.attestation: %w", err)
+		}
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("CcRuntime validating webhook", func() {
+	validator := &CcRuntimeCustomValidator{}
+	privileged := true
+
+	newCcRuntime := func(change func(*CcRuntime)) *CcRuntime {
+		ccRuntime := &CcRuntime{
+			ObjectMeta: metav1.ObjectMeta{Name: "ccruntime-sample"},
+			Spec: CcRuntimeSpec{
+				RuntimeName: "kata",
+				Config: CcInstallConfig{
+					InstallType:  BundleInstallType,
+					PayloadImage: "quay.io/kata-containers/kata-deploy:3.23.0",
+					SecurityContext: &InstallerSecurityContext{
+						Profile: RuntimeInstallerSecurityProfile,
+					},
+				},
+			},
+		}
+		if change != nil {
+			change(ccRuntime)
+		}
+		return ccRuntime
+	}
+
+	DescribeTable("warning about fully privileged installer pods",
+		func(securityContext *InstallerSecurityContext, wantWarning bool) {
+			ccRuntime := newCcRuntime(func(c *CcRuntime) { c.Spec.Config.SecurityContext = securityContext })
+
+			for _, validate := range []func() ([]string, error){
+				func() ([]string, error) { return validator.ValidateCreate(context.TODO(), ccRuntime) },
+				func() ([]string, error) {
+					return validator.ValidateUpdate(context.TODO(), newCcRuntime(nil), ccRuntime)
+				},
+			} {
+				warnings, err := validate()
+				Expect(err).NotTo(HaveOccurred())
+				if wantWarning {
+					Expect(warnings).To(ConsistOf(ContainSubstring("runs the install, uninstall and hook pods fully privileged")))
+				} else {
+					Expect(warnings).To(BeEmpty())
+				}
+			}
+		},
+		Entry("no security context", nil, true),
+		Entry("privileged profile", &InstallerSecurityContext{Profile: PrivilegedSecurityProfile}, true),
+		Entry("privileged on top of a profile",
+			&InstallerSecurityContext{Profile: RuntimeInstallerSecurityProfile, Privileged: &privileged}, true),
+		Entry("runtime-installer profile", &InstallerSecurityContext{Profile: RuntimeInstallerSecurityProfile}, false),
+		Entry("capabilities allow-list",
+			&InstallerSecurityContext{Privileged: new(bool), Capabilities: []corev1.Capability{"SYS_ADMIN"}}, false),
+	)
+
+	DescribeTable("rejecting invalid CcRuntimes",
+		func(change func(*CcRuntime), want string) {
+			_, err := validator.ValidateCreate(context.TODO(), newCcRuntime(change))
+			Expect(err).To(MatchError(ContainSubstring(want)))
+		},
+		Entry("unknown profile", func(c *CcRuntime) { c.Spec.Profile = "unknown" }, "spec.profile"),
+		Entry("no runtimeName", func(c *CcRuntime) { c.Spec.RuntimeName = "" },
+			"spec.runtimeName: required without a profile"),
+		Entry("no installType", func(c *CcRuntime) { c.Spec.Config.InstallType = "" },
+			"spec.config.installType: required without a profile"),
+		Entry("no payloadImage", func(c *CcRuntime) { c.Spec.Config.PayloadImage = "" },
+			"spec.config.payloadImage: required without a profile"),
+		Entry("preInstall switches without its image",
+			func(c *CcRuntime) { c.Spec.Config.PreInstall.Containerd = CocoContainerd },
+			"spec.config: preInstall.containerd and preInstall.installNydusSnapshotter require preInstall.image"),
+	)
+
+	It("takes the required fields from the profile", func() {
+		ccRuntime := newCcRuntime(func(c *CcRuntime) {
+			c.Spec = CcRuntimeSpec{
+				Profile: "kata",
+				Config: CcInstallConfig{
+					SecurityContext: &InstallerSecurityContext{Profile: RuntimeInstallerSecurityProfile},
+				},
+			}
+		})
+		warnings, err := validator.ValidateCreate(context.TODO(), ccRuntime)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("rejects other objects", func() {
+		_, err := validator.ValidateCreate(context.TODO(), &CcRuntimeList{})
+		Expect(err).To(MatchError(ContainSubstring("expected a CcRuntime object")))
+	})
+})
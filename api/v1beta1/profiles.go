@@ -0,0 +1,148 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"embed"
+	"fmt"
+	"reflect"
+
+	"sigs.k8s.io/yaml"
+)
+
+// +kubebuilder:validation:Enum=kata;enclave-cc;s390x
+type CcRuntimeProfileName string
+
+const (
+	// Kata Containers installed by kata-deploy, with the runtime classes of x86_64
+	KataProfile CcRuntimeProfileName = "kata"
+
+	// enclave-cc on SGX hardware, with the CoCo fork of containerd
+	EnclaveCcProfile CcRuntimeProfileName = "enclave-cc"
+
+	// Kata Containers installed by kata-deploy, with the runtime classes of IBM Secure Execution
+	S390xProfile CcRuntimeProfileName = "s390x"
+)
+
+// CcRuntimeProfiles are the built-in profiles
+var CcRuntimeProfiles = []CcRuntimeProfileName{KataProfile, EnclaveCcProfile, S390xProfile}
+
+//go:embed profiles/*.yaml
+var profileFiles embed.FS
+
+// ccRuntimeProfile is the content of a profile file
+type ccRuntimeProfile struct {
+	RuntimeName CcRuntimeName   `json:"runtimeName"`
+	Config      CcInstallConfig `json:"config"`
+}
+
+// apiPkgPath is the package of the structs merged field by field
+var apiPkgPath = reflect.TypeOf(CcInstallConfig{}).PkgPath()
+
+// replacedMaps are the maps of CcInstallConfig replacing the ones of the
+// profile instead of being merged key by key. The nodes must carry all the
+// labels of a done label, a merged one would wait for the label of the profile
+// the payload of the user doesn't set.
+var replacedMaps = map[string]bool{"InstallDoneLabel": true, "UninstallDoneLabel": true}
+
+func loadProfile(name CcRuntimeProfileName) (*ccRuntimeProfile, error) {
+	data, err := profileFiles.ReadFile("profiles/" + string(name) + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	profile := &ccRuntimeProfile{}
+	if err := yaml.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	return profile, nil
+}
+
+// mergeConfig merges the fields set by the user over the ones of the profile,
+// in place. The structs of the API are merged field by field and the maps key
+// by key, but for the done labels, while lists and values replace the ones of
+// the profile once set. A pointer is set even when it points to false or an
+// empty value, which is why the switches of the profiles are pointers.
+func mergeConfig(profile, overrides reflect.Value) {
+	switch overrides.Kind() {
+	case reflect.Struct:
+		if overrides.Type().PkgPath() != apiPkgPath {
+			if !overrides.IsZero() {
+				profile.Set(overrides)
+			}
+			return
+		}
+		for i := 0; i < overrides.NumField(); i++ {
+			if overrides.Type() == reflect.TypeOf(CcInstallConfig{}) && replacedMaps[overrides.Type().Field(i).Name] {
+				if overrides.Field(i).Len() > 0 {
+					profile.Field(i).Set(overrides.Field(i))
+				}
+				continue
+			}
+			mergeConfig(profile.Field(i), overrides.Field(i))
+		}
+	case reflect.Pointer:
+		if overrides.IsNil() {
+			return
+		}
+		elem := overrides.Type().Elem()
+		if profile.IsNil() || elem.Kind() != reflect.Struct || elem.PkgPath() != apiPkgPath {
+			profile.Set(overrides)
+			return
+		}
+		merged := reflect.New(elem)
+		merged.Elem().Set(profile.Elem())
+		mergeConfig(merged.Elem(), overrides.Elem())
+		profile.Set(merged)
+	case reflect.Map:
+		if overrides.Len() == 0 {
+			return
+		}
+		merged := reflect.MakeMapWithSize(overrides.Type(), profile.Len()+overrides.Len())
+		for _, maps := range []reflect.Value{profile, overrides} {
+			iter := maps.MapRange()
+			for iter.Next() {
+				merged.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+		profile.Set(merged)
+	case reflect.Slice:
+		if overrides.Len() > 0 {
+			profile.Set(overrides)
+		}
+	default:
+		if !overrides.IsZero() {
+			profile.Set(overrides)
+		}
+	}
+}
+
+// ApplyProfile merges the spec.config of the CcRuntime over its profile. The
+// fields left empty in spec.config are the ones of the profile, and the runtime
+// name defaults to the one of the profile
+func (r *CcRuntime) ApplyProfile() error {
+	profile, err := loadProfile(r.Spec.Profile)
+	if err != nil {
+		return err
+	}
+	config := profile.Config
+	mergeConfig(reflect.ValueOf(&config).Elem(), reflect.ValueOf(r.Spec.Config.DeepCopy()).Elem())
+	r.Spec.Config = config
+	if r.Spec.RuntimeName == "" {
+		r.Spec.RuntimeName = profile.RuntimeName
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"reflect"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("Profiles", func() {
+	yes, no := true, false
+
+	// merge merges overrides over the kata profile, as ApplyProfile does
+	merge := func(overrides CcInstallConfig) CcInstallConfig {
+		profile, err := loadProfile(KataProfile)
+		Expect(err).NotTo(HaveOccurred())
+		config := profile.Config
+		mergeConfig(reflect.ValueOf(&config).Elem(), reflect.ValueOf(overrides.DeepCopy()).Elem())
+		return config
+	}
+
+	Describe("mergeConfig", func() {
+		It("keeps the profile when nothing is set", func() {
+			profile, err := loadProfile(KataProfile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(merge(CcInstallConfig{})).To(Equal(profile.Config))
+		})
+
+		It("replaces the values that are set", func() {
+			config := merge(CcInstallConfig{PayloadImage: "quay.io/kata-containers/kata-deploy:3.24.0"})
+			Expect(config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.24.0"))
+			Expect(config.InstallType).To(Equal(BundleInstallType))
+		})
+
+		It("merges the structs field by field", func() {
+			config := merge(CcInstallConfig{PreInstall: PreInstallConfig{Image: "quay.io/example/reqs-payload:test"}})
+			Expect(config.PreInstall.Image).To(Equal("quay.io/example/reqs-payload:test"))
+			Expect(config.PreInstall.Containerd).To(Equal(NoContainerd))
+			Expect(config.PreInstall.InstallNydusSnapshotter).To(Equal(&yes))
+			Expect(config.PreInstall.VolumeMounts).To(HaveLen(5))
+		})
+
+		It("overrides a switch with false", func() {
+			config := merge(CcInstallConfig{PreInstall: PreInstallConfig{InstallNydusSnapshotter: &no}})
+			Expect(config.PreInstall.InstallNydusSnapshotter).To(Equal(&no))
+			Expect(config.PreInstall.Image).NotTo(BeEmpty())
+		})
+
+		It("replaces the lists", func() {
+			config := merge(CcInstallConfig{
+				RuntimeClasses:       []RuntimeClass{{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull"}},
+				EnvironmentVariables: []corev1.EnvVar{{Name: "DEBUG", Value: "true"}},
+			})
+			Expect(config.RuntimeClasses).To(Equal([]RuntimeClass{{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull"}}))
+			Expect(config.EnvironmentVariables).To(Equal([]corev1.EnvVar{{Name: "DEBUG", Value: "true"}}))
+		})
+
+		It("replaces the done labels", func() {
+			config := merge(CcInstallConfig{
+				InstallDoneLabel:   map[string]string{"example.com/runtime": "installed"},
+				UninstallDoneLabel: map[string]string{"example.com/runtime": "removed"},
+			})
+			Expect(config.InstallDoneLabel).To(Equal(map[string]string{"example.com/runtime": "installed"}))
+			Expect(config.UninstallDoneLabel).To(Equal(map[string]string{"example.com/runtime": "removed"}))
+		})
+
+		It("merges the other maps key by key", func() {
+			profile := map[string]string{"pre-install": "quay.io/example/pre-install:1", "tee-probe": "quay.io/example/probe:1"}
+			mergeConfig(reflect.ValueOf(&profile).Elem(),
+				reflect.ValueOf(map[string]string{"tee-probe": "quay.io/example/probe:2"}))
+			Expect(profile).To(Equal(map[string]string{
+				"pre-install": "quay.io/example/pre-install:1",
+				"tee-probe":   "quay.io/example/probe:2",
+			}))
+		})
+
+		It("doesn't modify the profile it merges over", func() {
+			first := merge(CcInstallConfig{PreInstall: PreInstallConfig{InstallNydusSnapshotter: &no}})
+			Expect(first.PreInstall.InstallNydusSnapshotter).To(Equal(&no))
+			Expect(merge(CcInstallConfig{}).PreInstall.InstallNydusSnapshotter).To(Equal(&yes))
+		})
+	})
+
+	Describe("ApplyProfile", func() {
+		It("defaults the runtime name to the one of the profile", func() {
+			ccRuntime := &CcRuntime{Spec: CcRuntimeSpec{Profile: S390xProfile}}
+			Expect(ccRuntime.ApplyProfile()).To(Succeed())
+			Expect(ccRuntime.Spec.RuntimeName).To(Equal(CcRuntimeName("kata")))
+		})
+
+		It("keeps the runtime name that is set", func() {
+			ccRuntime := &CcRuntime{Spec: CcRuntimeSpec{Profile: EnclaveCcProfile, RuntimeName: "kata"}}
+			Expect(ccRuntime.ApplyProfile()).To(Succeed())
+			Expect(ccRuntime.Spec.RuntimeName).To(Equal(CcRuntimeName("kata")))
+			Expect(ccRuntime.Spec.Config.PayloadImage).To(ContainSubstring("enclave-cc"))
+		})
+
+		It("fails on an unknown profile", func() {
+			ccRuntime := &CcRuntime{Spec: CcRuntimeSpec{Profile: "unknown"}}
+			Expect(ccRuntime.ApplyProfile()).To(MatchError(`unknown profile "unknown"`))
+		})
+	})
+
+	Describe("embedded profiles", func() {
+		validator := &CcRuntimeCustomValidator{}
+
+		DescribeTable("are complete and valid",
+			func(name CcRuntimeProfileName, runtimeName CcRuntimeName, runtimeClasses []string) {
+				data, err := profileFiles.ReadFile("profiles/" + string(name) + ".yaml")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(yaml.UnmarshalStrict(data, &ccRuntimeProfile{})).To(Succeed())
+
+				profile, err := loadProfile(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(profile.RuntimeName).To(Equal(runtimeName))
+				Expect(profile.Config.InstallType).To(Equal(BundleInstallType))
+				Expect(profile.Config.PayloadImage).NotTo(BeEmpty())
+				Expect(profile.Config.InstallDoneLabel).NotTo(BeEmpty())
+				Expect(profile.Config.UninstallDoneLabel).To(HaveLen(len(profile.Config.InstallDoneLabel)))
+				Expect(profile.Config.InstallCmd).NotTo(BeEmpty())
+				Expect(profile.Config.UninstallCmd).NotTo(BeEmpty())
+				Expect(profile.Config.CleanupCmd).NotTo(BeEmpty())
+				names := []string{}
+				for _, runtimeClass := range profile.Config.RuntimeClasses {
+					names = append(names, runtimeClass.Name)
+				}
+				Expect(names).To(Equal(runtimeClasses))
+
+				ccRuntime := &CcRuntime{
+					ObjectMeta: metav1.ObjectMeta{Name: "ccruntime-" + string(name)},
+					Spec: CcRuntimeSpec{
+						Profile: name,
+						Config: CcInstallConfig{
+							SecurityContext: &InstallerSecurityContext{Profile: RuntimeInstallerSecurityProfile},
+						},
+					},
+				}
+				warnings, err := validator.ValidateCreate(context.TODO(), ccRuntime)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(warnings).To(BeEmpty())
+			},
+			Entry("kata", KataProfile, CcRuntimeName("kata"),
+				[]string{"kata-clh", "kata-qemu", "kata-qemu-coco-dev", "kata-qemu-tdx", "kata-qemu-snp"}),
+			Entry("enclave-cc", EnclaveCcProfile, CcRuntimeName("enclave-cc"), []string{"enclave-cc"}),
+			Entry("s390x", S390xProfile, CcRuntimeName("kata"), []string{"kata-qemu", "kata-qemu-se"}),
+		)
+
+		It("cover the profiles of the API", func() {
+			entries, err := profileFiles.ReadDir("profiles")
+			Expect(err).NotTo(HaveOccurred())
+			files := []string{}
+			for _, entry := range entries {
+				files = append(files, entry.Name())
+			}
+			expected := []string{}
+			for _, name := range CcRuntimeProfiles {
+				expected = append(expected, string(name)+".yaml")
+			}
+			Expect(files).To(ConsistOf(expected))
+		})
+	})
+})
@@ -22,10 +22,103 @@ package v1beta1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AgentPolicyStatus) DeepCopyInto(out *AgentPolicyStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AgentPolicyStatus.
+func (in *AgentPolicyStatus) DeepCopy() *AgentPolicyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AgentPolicyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ArchitectureConfig) DeepCopyInto(out *ArchitectureConfig) {
+	*out = *in
+	if in.HookImages != nil {
+		in, out := &in.HookImages, &out.HookImages
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ArchitectureConfig.
+func (in *ArchitectureConfig) DeepCopy() *ArchitectureConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ArchitectureConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ArchitectureStatus) DeepCopyInto(out *ArchitectureStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ArchitectureStatus.
+func (in *ArchitectureStatus) DeepCopy() *ArchitectureStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ArchitectureStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AttestationConfig) DeepCopyInto(out *AttestationConfig) {
+	*out = *in
+	if in.KbsCACertSecretRef != nil {
+		in, out := &in.KbsCACertSecretRef, &out.KbsCACertSecretRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RuntimeClasses != nil {
+		in, out := &in.RuntimeClasses, &out.RuntimeClasses
+		*out = make([]AttestationRuntimeClassConfig, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttestationConfig.
+func (in *AttestationConfig) DeepCopy() *AttestationConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AttestationConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AttestationRuntimeClassConfig) DeepCopyInto(out *AttestationRuntimeClassConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttestationRuntimeClassConfig.
+func (in *AttestationRuntimeClassConfig) DeepCopy() *AttestationRuntimeClassConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AttestationRuntimeClassConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CcCompletedStatus) DeepCopyInto(out *CcCompletedStatus) {
 	*out = *in
@@ -66,14 +159,41 @@ func (in *CcFailedNodeStatus) DeepCopy() *CcFailedNodeStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CcImageStatus) DeepCopyInto(out *CcImageStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcImageStatus.
+func (in *CcImageStatus) DeepCopy() *CcImageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CcImageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CcInstallConfig) DeepCopyInto(out *CcInstallConfig) {
 	*out = *in
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]ArchitectureConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ImagePullSecret != nil {
 		in, out := &in.ImagePullSecret, &out.ImagePullSecret
 		*out = new(corev1.LocalObjectReference)
 		**out = **in
 	}
+	if in.ImageVerification != nil {
+		in, out := &in.ImageVerification, &out.ImageVerification
+		*out = new(ImageVerificationPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.InstallerVolumeMounts != nil {
 		in, out := &in.InstallerVolumeMounts, &out.InstallerVolumeMounts
 		*out = make([]corev1.VolumeMount, len(*in))
@@ -106,7 +226,9 @@ func (in *CcInstallConfig) DeepCopyInto(out *CcInstallConfig) {
 	if in.RuntimeClasses != nil {
 		in, out := &in.RuntimeClasses, &out.RuntimeClasses
 		*out = make([]RuntimeClass, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.EnvironmentVariables != nil {
 		in, out := &in.EnvironmentVariables, &out.EnvironmentVariables
@@ -115,6 +237,13 @@ func (in *CcInstallConfig) DeepCopyInto(out *CcInstallConfig) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.ConfigFrom != nil {
+		in, out := &in.ConfigFrom, &out.ConfigFrom
+		*out = make([]PayloadConfigSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.InstallDoneLabel != nil {
 		in, out := &in.InstallDoneLabel, &out.InstallDoneLabel
 		*out = make(map[string]string, len(*in))
@@ -131,6 +260,29 @@ func (in *CcInstallConfig) DeepCopyInto(out *CcInstallConfig) {
 	}
 	in.PreInstall.DeepCopyInto(&out.PreInstall)
 	in.PostUninstall.DeepCopyInto(&out.PostUninstall)
+	out.TeeDiscovery = in.TeeDiscovery
+	in.Preflight.DeepCopyInto(&out.Preflight)
+	if in.ContainerRuntimes != nil {
+		in, out := &in.ContainerRuntimes, &out.ContainerRuntimes
+		*out = new(ContainerRuntimesConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = make([]HookConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.Rollback = in.Rollback
+	in.NodeJobs.DeepCopyInto(&out.NodeJobs)
+	in.PodTemplateOverrides.DeepCopyInto(&out.PodTemplateOverrides)
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(InstallerSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcInstallConfig.
@@ -208,6 +360,21 @@ func (in *CcRuntime) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CcRuntimeCustomValidator) DeepCopyInto(out *CcRuntimeCustomValidator) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcRuntimeCustomValidator.
+func (in *CcRuntimeCustomValidator) DeepCopy() *CcRuntimeCustomValidator {
+	if in == nil {
+		return nil
+	}
+	out := new(CcRuntimeCustomValidator)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CcRuntimeList) DeepCopyInto(out *CcRuntimeList) {
 	*out = *in
@@ -240,6 +407,27 @@ func (in *CcRuntimeList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CcRuntimeRevision) DeepCopyInto(out *CcRuntimeRevision) {
+	*out = *in
+	if in.HookImages != nil {
+		in, out := &in.HookImages, &out.HookImages
+		*out = make([]RevisionImage, len(*in))
+		copy(*out, *in)
+	}
+	in.InstalledTime.DeepCopyInto(&out.InstalledTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcRuntimeRevision.
+func (in *CcRuntimeRevision) DeepCopy() *CcRuntimeRevision {
+	if in == nil {
+		return nil
+	}
+	out := new(CcRuntimeRevision)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CcRuntimeSpec) DeepCopyInto(out *CcRuntimeSpec) {
 	*out = *in
@@ -256,6 +444,16 @@ func (in *CcRuntimeSpec) DeepCopyInto(out *CcRuntimeSpec) {
 		}
 	}
 	in.Config.DeepCopyInto(&out.Config)
+	if in.Attestation != nil {
+		in, out := &in.Attestation, &out.Attestation
+		*out = new(AttestationConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PeerPods != nil {
+		in, out := &in.PeerPods, &out.PeerPods
+		*out = new(PeerPodsConfig)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcRuntimeSpec.
@@ -274,6 +472,69 @@ func (in *CcRuntimeStatus) DeepCopyInto(out *CcRuntimeStatus) {
 	in.InstallationStatus.DeepCopyInto(&out.InstallationStatus)
 	in.UnInstallationStatus.DeepCopyInto(&out.UnInstallationStatus)
 	out.Upgradestatus = in.Upgradestatus
+	if in.Revisions != nil {
+		in, out := &in.Revisions, &out.Revisions
+		*out = make([]CcRuntimeRevision, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = make([]HookStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]CcImageStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.AgentPolicies != nil {
+		in, out := &in.AgentPolicies, &out.AgentPolicies
+		*out = make([]AgentPolicyStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]ArchitectureStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClasses != nil {
+		in, out := &in.RuntimeClasses, &out.RuntimeClasses
+		*out = make([]RuntimeClassNodesStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Preflight != nil {
+		in, out := &in.Preflight, &out.Preflight
+		*out = make([]PreflightNodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NodeRuntimes != nil {
+		in, out := &in.NodeRuntimes, &out.NodeRuntimes
+		*out = make([]NodeRuntimeStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.DepartedNodes != nil {
+		in, out := &in.DepartedNodes, &out.DepartedNodes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.EffectiveConfig != nil {
+		in, out := &in.EffectiveConfig, &out.EffectiveConfig
+		*out = new(CcInstallConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CcRuntimeStatus.
@@ -339,6 +600,81 @@ func (in *CcUpgradeStatus) DeepCopy() *CcUpgradeStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContainerRuntimeConfig) DeepCopyInto(out *ContainerRuntimeConfig) {
+	*out = *in
+	if in.InstallerVolumes != nil {
+		in, out := &in.InstallerVolumes, &out.InstallerVolumes
+		*out = make([]corev1.Volume, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.InstallerVolumeMounts != nil {
+		in, out := &in.InstallerVolumeMounts, &out.InstallerVolumeMounts
+		*out = make([]corev1.VolumeMount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.HookVolumes != nil {
+		in, out := &in.HookVolumes, &out.HookVolumes
+		*out = make([]corev1.Volume, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.HookVolumeMounts != nil {
+		in, out := &in.HookVolumeMounts, &out.HookVolumeMounts
+		*out = make([]corev1.VolumeMount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.EnvironmentVariables != nil {
+		in, out := &in.EnvironmentVariables, &out.EnvironmentVariables
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContainerRuntimeConfig.
+func (in *ContainerRuntimeConfig) DeepCopy() *ContainerRuntimeConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ContainerRuntimeConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContainerRuntimesConfig) DeepCopyInto(out *ContainerRuntimesConfig) {
+	*out = *in
+	if in.Containerd != nil {
+		in, out := &in.Containerd, &out.Containerd
+		*out = new(ContainerRuntimeConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CriO != nil {
+		in, out := &in.CriO, &out.CriO
+		*out = new(ContainerRuntimeConfig)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContainerRuntimesConfig.
+func (in *ContainerRuntimesConfig) DeepCopy() *ContainerRuntimesConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ContainerRuntimesConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FailedNodeStatus) DeepCopyInto(out *FailedNodeStatus) {
 	*out = *in
@@ -354,6 +690,302 @@ func (in *FailedNodeStatus) DeepCopy() *FailedNodeStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookConfig) DeepCopyInto(out *HookConfig) {
+	*out = *in
+	if in.Cmd != nil {
+		in, out := &in.Cmd, &out.Cmd
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.EnvironmentVariables != nil {
+		in, out := &in.EnvironmentVariables, &out.EnvironmentVariables
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]corev1.Volume, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VolumeMounts != nil {
+		in, out := &in.VolumeMounts, &out.VolumeMounts
+		*out = make([]corev1.VolumeMount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookConfig.
+func (in *HookConfig) DeepCopy() *HookConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(HookConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookStatus) DeepCopyInto(out *HookStatus) {
+	*out = *in
+	if in.CompletedNodesList != nil {
+		in, out := &in.CompletedNodesList, &out.CompletedNodesList
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FailedNodesList != nil {
+		in, out := &in.FailedNodesList, &out.FailedNodesList
+		*out = make([]FailedNodeStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookStatus.
+func (in *HookStatus) DeepCopy() *HookStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HookStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageVerificationPolicy) DeepCopyInto(out *ImageVerificationPolicy) {
+	*out = *in
+	out.SecretRef = in.SecretRef
+	if in.Keyless != nil {
+		in, out := &in.Keyless, &out.Keyless
+		*out = new(KeylessIdentity)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageVerificationPolicy.
+func (in *ImageVerificationPolicy) DeepCopy() *ImageVerificationPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageVerificationPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstallerSecurityContext) DeepCopyInto(out *InstallerSecurityContext) {
+	*out = *in
+	if in.Privileged != nil {
+		in, out := &in.Privileged, &out.Privileged
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Capabilities != nil {
+		in, out := &in.Capabilities, &out.Capabilities
+		*out = make([]corev1.Capability, len(*in))
+		copy(*out, *in)
+	}
+	if in.SeccompProfile != nil {
+		in, out := &in.SeccompProfile, &out.SeccompProfile
+		*out = new(corev1.SeccompProfile)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AppArmorProfile != nil {
+		in, out := &in.AppArmorProfile, &out.AppArmorProfile
+		*out = new(corev1.AppArmorProfile)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SELinuxOptions != nil {
+		in, out := &in.SELinuxOptions, &out.SELinuxOptions
+		*out = new(corev1.SELinuxOptions)
+		**out = **in
+	}
+	if in.HostPID != nil {
+		in, out := &in.HostPID, &out.HostPID
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstallerSecurityContext.
+func (in *InstallerSecurityContext) DeepCopy() *InstallerSecurityContext {
+	if in == nil {
+		return nil
+	}
+	out := new(InstallerSecurityContext)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeylessIdentity) DeepCopyInto(out *KeylessIdentity) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeylessIdentity.
+func (in *KeylessIdentity) DeepCopy() *KeylessIdentity {
+	if in == nil {
+		return nil
+	}
+	out := new(KeylessIdentity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeJobsConfig) DeepCopyInto(out *NodeJobsConfig) {
+	*out = *in
+	if in.BackoffLimit != nil {
+		in, out := &in.BackoffLimit, &out.BackoffLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeJobsConfig.
+func (in *NodeJobsConfig) DeepCopy() *NodeJobsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeJobsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeRuntimeStatus) DeepCopyInto(out *NodeRuntimeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeRuntimeStatus.
+func (in *NodeRuntimeStatus) DeepCopy() *NodeRuntimeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeRuntimeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PayloadConfigSource) DeepCopyInto(out *PayloadConfigSource) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(corev1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PayloadConfigSource.
+func (in *PayloadConfigSource) DeepCopy() *PayloadConfigSource {
+	if in == nil {
+		return nil
+	}
+	out := new(PayloadConfigSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PayloadServiceAccountConfig) DeepCopyInto(out *PayloadServiceAccountConfig) {
+	*out = *in
+	if in.AutomountToken != nil {
+		in, out := &in.AutomountToken, &out.AutomountToken
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PayloadServiceAccountConfig.
+func (in *PayloadServiceAccountConfig) DeepCopy() *PayloadServiceAccountConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PayloadServiceAccountConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PeerPodsConfig) DeepCopyInto(out *PeerPodsConfig) {
+	*out = *in
+	out.ConfigMapRef = in.ConfigMapRef
+	out.SecretRef = in.SecretRef
+	if in.Limit != nil {
+		in, out := &in.Limit, &out.Limit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Overhead != nil {
+		in, out := &in.Overhead, &out.Overhead
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PeerPodsConfig.
+func (in *PeerPodsConfig) DeepCopy() *PeerPodsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PeerPodsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateOverrides) DeepCopyInto(out *PodTemplateOverrides) {
+	*out = *in
+	if in.Install != nil {
+		in, out := &in.Install, &out.Install
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Uninstall != nil {
+		in, out := &in.Uninstall, &out.Uninstall
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateOverrides.
+func (in *PodTemplateOverrides) DeepCopy() *PodTemplateOverrides {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateOverrides)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostUninstallConfig) DeepCopyInto(out *PostUninstallConfig) {
 	*out = *in
@@ -424,6 +1056,11 @@ func (in *PreInstallConfig) DeepCopyInto(out *PreInstallConfig) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.InstallNydusSnapshotter != nil {
+		in, out := &in.InstallNydusSnapshotter, &out.InstallNydusSnapshotter
+		*out = new(bool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreInstallConfig.
@@ -436,9 +1073,129 @@ func (in *PreInstallConfig) DeepCopy() *PreInstallConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreflightConfig) DeepCopyInto(out *PreflightConfig) {
+	*out = *in
+	if in.KernelModules != nil {
+		in, out := &in.KernelModules, &out.KernelModules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ContainerRuntimes != nil {
+		in, out := &in.ContainerRuntimes, &out.ContainerRuntimes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MinFreeDisk != nil {
+		in, out := &in.MinFreeDisk, &out.MinFreeDisk
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.InstallPaths != nil {
+		in, out := &in.InstallPaths, &out.InstallPaths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ConflictingPaths != nil {
+		in, out := &in.ConflictingPaths, &out.ConflictingPaths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreflightConfig.
+func (in *PreflightConfig) DeepCopy() *PreflightConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PreflightConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreflightNodeStatus) DeepCopyInto(out *PreflightNodeStatus) {
+	*out = *in
+	if in.Failures != nil {
+		in, out := &in.Failures, &out.Failures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MissingKernelModules != nil {
+		in, out := &in.MissingKernelModules, &out.MissingKernelModules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FreeDisk != nil {
+		in, out := &in.FreeDisk, &out.FreeDisk
+		*out = make(map[string]resource.Quantity, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.ConflictingPaths != nil {
+		in, out := &in.ConflictingPaths, &out.ConflictingPaths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.LastGatheredTime.DeepCopyInto(&out.LastGatheredTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreflightNodeStatus.
+func (in *PreflightNodeStatus) DeepCopy() *PreflightNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PreflightNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RevisionImage) DeepCopyInto(out *RevisionImage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RevisionImage.
+func (in *RevisionImage) DeepCopy() *RevisionImage {
+	if in == nil {
+		return nil
+	}
+	out := new(RevisionImage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RollbackConfig) DeepCopyInto(out *RollbackConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RollbackConfig.
+func (in *RollbackConfig) DeepCopy() *RollbackConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RollbackConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RuntimeClass) DeepCopyInto(out *RuntimeClass) {
 	*out = *in
+	if in.AgentPolicy != nil {
+		in, out := &in.AgentPolicy, &out.AgentPolicy
+		*out = new(corev1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RuntimeClass.
@@ -450,3 +1207,33 @@ func (in *RuntimeClass) DeepCopy() *RuntimeClass {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RuntimeClassNodesStatus) DeepCopyInto(out *RuntimeClassNodesStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RuntimeClassNodesStatus.
+func (in *RuntimeClassNodesStatus) DeepCopy() *RuntimeClassNodesStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RuntimeClassNodesStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TeeDiscoveryConfig) DeepCopyInto(out *TeeDiscoveryConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TeeDiscoveryConfig.
+func (in *TeeDiscoveryConfig) DeepCopy() *TeeDiscoveryConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TeeDiscoveryConfig)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,488 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	nodeapi "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// redacted replaces the values of the secret environment variables
+	redacted = "REDACTED"
+
+	// diagnosticsScript prints the containerd and kata configuration of the
+	// node, redacted by redactConfig
+	diagnosticsScript = `for f in /host/etc/containerd/config.toml /host/etc/containerd/config.d/*.toml \
+    /host/var/lib/rancher/k3s/agent/etc/containerd/config.toml \
+    /host/opt/kata/share/defaults/kata-containers/*.toml \
+    /host/etc/kata-containers/*.toml; do
+  [ -f "$f" ] || continue
+  echo "==> ${f#/host} <=="
+  cat "$f"
+done`
+)
+
+// secretEnvName matches the names of the environment variables redacted
+// whatever their origin
+var secretEnvName = regexp.MustCompile(`(?i)(secret|token|passw|credential|key)`)
+
+// secretConfigKey matches the TOML settings holding credentials, such as the
+// auth, password and identitytoken of the containerd registry configs
+var secretConfigKey = regexp.MustCompile(`(?im)^(\s*"?[\w.-]*(auth|passw|token|secret|credential)[\w.-]*"?\s*=\s*).*$`)
+
+// lastAppliedAnnotation holds the object as last applied by kubectl, secret
+// environment variables included
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// bundleWriter adds the files of the support bundle to a gzipped tarball
+type bundleWriter struct {
+	tw  *tar.Writer
+	dir string
+}
+
+func (b *bundleWriter) add(name string, data []byte) error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    b.dir + "/" + name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// addYAML adds the object, its secret environment variables redacted and
+// without the managed fields and last applied configuration of its metadata
+func (b *bundleWriter) addYAML(name string, obj interface{}, secretEnv map[string]bool) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	redactEnv(tree, secretEnv)
+	stripMetadata(tree)
+	out, err := yaml.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return b.add(name, out)
+}
+
+// redactEnv replaces the values of the secret environment variables in the
+// env and environmentVariables lists of the JSON tree
+func redactEnv(tree interface{}, secretEnv map[string]bool) {
+	switch node := tree.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if list, ok := value.([]interface{}); ok && (key == "env" || key == "environmentVariables") {
+				for _, item := range list {
+					env, ok := item.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					name, _ := env["name"].(string)
+					if _, hasValue := env["value"]; hasValue && (secretEnv[name] || secretEnvName.MatchString(name)) {
+						env["value"] = redacted
+					}
+				}
+			}
+			redactEnv(value, secretEnv)
+		}
+	case []interface{}:
+		for _, item := range node {
+			redactEnv(item, secretEnv)
+		}
+	}
+}
+
+// stripMetadata removes the managed fields and the last applied configuration
+// from the metadata of the objects of the JSON tree, which repeat their
+// content unredacted
+func stripMetadata(tree interface{}) {
+	switch node := tree.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if metadata, ok := value.(map[string]interface{}); ok && key == "metadata" {
+				delete(metadata, "managedFields")
+				if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+					delete(annotations, lastAppliedAnnotation)
+				}
+			}
+			stripMetadata(value)
+		}
+	case []interface{}:
+		for _, item := range node {
+			stripMetadata(item)
+		}
+	}
+}
+
+// redactConfig replaces the values of the credentials in the output of the
+// diagnostics pods
+func redactConfig(data []byte) []byte {
+	return secretConfigKey.ReplaceAll(data, []byte(`${1}"`+redacted+`"`))
+}
+
+// secretEnvNames returns the environment variables the operator renders from
+// the Secrets of configFrom. The pod templates reference the Secrets with
+// valueFrom, so this only redacts the values set inline under the same names,
+// e.g. in environmentVariables
+func secretEnvNames(ccRuntime *ccv1beta1.CcRuntime) map[string]bool {
+	names := map[string]bool{}
+	for _, source := range ccRuntime.Spec.Config.ConfigFrom {
+		if source.SecretKeyRef != nil {
+			names[source.Name] = true
+		}
+	}
+	return names
+}
+
+// bundle gathers what's needed to investigate the installation of a
+// CcRuntime into a tarball
+func (p *plugin) bundle(args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	output := fs.String("o", "", "The tarball to write, coco-bundle-<ccruntime>-<time>.tar.gz by default.")
+	managerNamespace := fs.String("manager-namespace", "", "The namespace of the operator, the namespace of the workloads by default.")
+	diagnostics := fs.Bool("diagnostics", false, "Run a pod on each node to capture its containerd and kata configuration.")
+	diagnosticsImage := fs.String("diagnostics-image", "busybox", "The image of the diagnostics pods.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl coco bundle [-o FILE] [--diagnostics] CCRUNTIME")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the name of a CcRuntime")
+	}
+	ccRuntimes, err := p.ccRuntimes(fs.Args())
+	if err != nil {
+		return err
+	}
+	ccRuntime := &ccRuntimes[0]
+	if *managerNamespace == "" {
+		*managerNamespace = p.namespace
+	}
+
+	dir := fmt.Sprintf("coco-bundle-%s-%s", ccRuntime.Name, time.Now().UTC().Format("20060102T150405Z"))
+	if *output == "" {
+		*output = dir + ".tar.gz"
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	b := &bundleWriter{tw: tar.NewWriter(gz), dir: dir}
+
+	// Failing to gather a part is reported in the bundle, the rest is still
+	// useful
+	var errs []string
+	collect := func(what string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", what, err))
+		}
+	}
+	secretEnv := secretEnvNames(ccRuntime)
+	// The CcRuntime is gathered as stored, rather than with its configuration
+	// merged with the profile
+	stored := &ccv1beta1.CcRuntime{}
+	if err := p.client.Get(context.TODO(), client.ObjectKeyFromObject(ccRuntime), stored); err != nil {
+		collect("ccruntime", err)
+	} else {
+		collect("ccruntime", b.addYAML("ccruntime.yaml", stored, secretEnv))
+	}
+	collect("workloads", p.bundleWorkloads(b, secretEnv))
+	collect("events", p.bundleEvents(b, ccRuntime))
+	collect("nodes", p.bundleNodes(b, ccRuntime))
+	collect("runtime classes", p.bundleRuntimeClasses(b))
+	collect("manager", p.bundleManager(b, *managerNamespace))
+	if *diagnostics {
+		collect("diagnostics", p.bundleDiagnostics(b, ccRuntime, *diagnosticsImage))
+	}
+	if len(errs) > 0 {
+		collect("errors", b.add("errors.txt", []byte(strings.Join(errs, "\n")+"\n")))
+	}
+
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "Wrote %s\n", *output)
+	for _, e := range errs {
+		fmt.Fprintln(os.Stderr, "failed to gather "+e)
+	}
+	return nil
+}
+
+// podLogs returns the logs of the containers of the pod, the previous
+// instance's too when the container restarted
+func (p *plugin) podLogs(pod *corev1.Pod) map[string][]byte {
+	logs := map[string][]byte{}
+	restarts := map[string]int32{}
+	for _, status := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		restarts[status.Name] = status.RestartCount
+	}
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, previous := range []bool{false, true} {
+			if previous && restarts[container.Name] == 0 {
+				continue
+			}
+			name := container.Name
+			if previous {
+				name += ".previous"
+			}
+			data, err := p.clientset.CoreV1().Pods(pod.Namespace).
+				GetLogs(pod.Name, &corev1.PodLogOptions{Container: container.Name, Previous: previous}).
+				DoRaw(context.TODO())
+			if err != nil {
+				data = []byte(fmt.Sprintf("failed to get the logs: %v\n", err))
+			}
+			logs[name] = data
+		}
+	}
+	return logs
+}
+
+func (p *plugin) addPod(b *bundleWriter, dir string, pod *corev1.Pod, secretEnv map[string]bool) error {
+	if err := b.addYAML(dir+"/"+pod.Name+".yaml", pod, secretEnv); err != nil {
+		return err
+	}
+	for container, data := range p.podLogs(pod) {
+		if err := b.add(dir+"/"+pod.Name+"/"+container+".log", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleWorkloads adds the DaemonSets, Jobs and pods the operator runs
+func (p *plugin) bundleWorkloads(b *bundleWriter, secretEnv map[string]bool) error {
+	dss := &appsv1.DaemonSetList{}
+	if err := p.client.List(context.TODO(), dss, client.InNamespace(p.namespace)); err != nil {
+		return err
+	}
+	for i := range dss.Items {
+		if strings.HasPrefix(dss.Items[i].Name, operatorPodPrefix) {
+			if err := b.addYAML("daemonsets/"+dss.Items[i].Name+".yaml", &dss.Items[i], secretEnv); err != nil {
+				return err
+			}
+		}
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := p.client.List(context.TODO(), jobs, client.InNamespace(p.namespace)); err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		if strings.HasPrefix(jobs.Items[i].Name, operatorPodPrefix) {
+			if err := b.addYAML("jobs/"+jobs.Items[i].Name+".yaml", &jobs.Items[i], secretEnv); err != nil {
+				return err
+			}
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := p.client.List(context.TODO(), pods, client.InNamespace(p.namespace), client.HasLabels{"name"}); err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		if podKind(&pods.Items[i]) == "" {
+			continue
+		}
+		if err := p.addPod(b, "pods", &pods.Items[i], secretEnv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleEvents adds the events of the workloads namespace, and those of the
+// CcRuntime, recorded in the default namespace as it's cluster-scoped
+func (p *plugin) bundleEvents(b *bundleWriter, ccRuntime *ccv1beta1.CcRuntime) error {
+	events := &corev1.EventList{}
+	if err := p.client.List(context.TODO(), events, client.InNamespace(p.namespace)); err != nil {
+		return err
+	}
+	if err := b.addYAML("events/"+p.namespace+".yaml", events, nil); err != nil {
+		return err
+	}
+
+	ccRuntimeEvents, err := p.clientset.CoreV1().Events(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "CcRuntime",
+			"involvedObject.name": ccRuntime.Name,
+		}.String(),
+	})
+	if err != nil {
+		return err
+	}
+	return b.addYAML("events/ccruntime.yaml", ccRuntimeEvents, nil)
+}
+
+// bundleNodes adds the labels, NodeInfo and conditions of the selected nodes
+func (p *plugin) bundleNodes(b *bundleWriter, ccRuntime *ccv1beta1.CcRuntime) error {
+	nodes, err := p.selectedNodes(ccRuntime)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		summary := map[string]interface{}{
+			"name":        node.Name,
+			"labels":      node.Labels,
+			"taints":      node.Spec.Taints,
+			"nodeInfo":    node.Status.NodeInfo,
+			"conditions":  node.Status.Conditions,
+			"allocatable": node.Status.Allocatable,
+			"phase":       nodeStatus(ccRuntime, &node).phase,
+		}
+		if err := b.addYAML("nodes/"+node.Name+".yaml", summary, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plugin) bundleRuntimeClasses(b *bundleWriter) error {
+	runtimeClasses := &nodeapi.RuntimeClassList{}
+	if err := p.client.List(context.TODO(), runtimeClasses); err != nil {
+		return err
+	}
+	return b.addYAML("runtimeclasses.yaml", runtimeClasses, nil)
+}
+
+// bundleManager adds the pods and logs of the operator
+func (p *plugin) bundleManager(b *bundleWriter, namespace string) error {
+	pods := &corev1.PodList{}
+	if err := p.client.List(context.TODO(), pods, client.InNamespace(namespace),
+		client.MatchingLabels{"control-plane": "controller-manager"}); err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no operator pod in namespace %s", namespace)
+	}
+	for i := range pods.Items {
+		if err := p.addPod(b, "manager", &pods.Items[i], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleDiagnostics runs a pod on each selected node printing the containerd
+// and kata configuration from the host filesystem, mounted read-only
+func (p *plugin) bundleDiagnostics(b *bundleWriter, ccRuntime *ccv1beta1.CcRuntime, image string) error {
+	nodes, err := p.selectedNodes(ccRuntime)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "cc-operator-diagnostics-",
+				Namespace:    p.namespace,
+			},
+			Spec: corev1.PodSpec{
+				NodeName:      node.Name,
+				RestartPolicy: corev1.RestartPolicyNever,
+				Tolerations:   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+				Containers: []corev1.Container{{
+					Name:         "diagnostics",
+					Image:        image,
+					Command:      []string{"sh", "-c", diagnosticsScript},
+					VolumeMounts: []corev1.VolumeMount{{Name: "host", MountPath: "/host", ReadOnly: true}},
+				}},
+				Volumes: []corev1.Volume{{
+					Name:         "host",
+					VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}},
+				}},
+			},
+		}
+		if err := p.client.Create(context.TODO(), pod); err != nil {
+			return err
+		}
+		data, err := p.diagnosticsOutput(pod)
+		if deleteErr := p.client.Delete(context.TODO(), pod); deleteErr != nil && err == nil {
+			err = deleteErr
+		}
+		if err != nil {
+			data = []byte(fmt.Sprintf("failed to run the diagnostics pod: %v\n", err))
+		} else {
+			data = redactConfig(data)
+		}
+		if err := b.add("diagnostics/"+node.Name+".txt", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diagnosticsOutput waits for the diagnostics pod to finish and returns its
+// output
+func (p *plugin) diagnosticsOutput(pod *corev1.Pod) ([]byte, error) {
+	err := wait.PollUntilContextTimeout(context.TODO(), 2*time.Second, 2*time.Minute, true,
+		func(ctx context.Context) (bool, error) {
+			if err := p.client.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+				return false, err
+			}
+			return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("pod %s didn't finish: %w", pod.Name, err)
+	}
+	stream, err := p.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).Stream(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	var out bytes.Buffer
+	_, err = io.Copy(&out, stream)
+	return out.Bytes(), err
+}
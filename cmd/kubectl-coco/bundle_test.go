@@ -0,0 +1,284 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// containerdConfig is the configuration of a containerd 1.7 node with the kata
+// runtime installed and registry credentials
+const containerdConfig = `version = 2
+root = "/var/lib/containerd"
+state = "/run/containerd"
+
+[grpc]
+  address = "/run/containerd/containerd.sock"
+
+[plugins]
+  [plugins."io.containerd.grpc.v1.cri"]
+    sandbox_image = "registry.k8s.io/pause:3.9"
+    [plugins."io.containerd.grpc.v1.cri".containerd]
+      snapshotter = "overlayfs"
+      default_runtime_name = "runc"
+      [plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu-tdx]
+        runtime_type = "io.containerd.kata-qemu-tdx.v2"
+        runtime_path = "/opt/kata/bin/containerd-shim-kata-v2"
+        snapshotter = "nydus"
+        pod_annotations = ["io.katacontainers.*"]
+        [plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu-tdx.options]
+          ConfigPath = "/opt/kata/share/defaults/kata-containers/configuration-qemu-tdx.toml"
+    [plugins."io.containerd.grpc.v1.cri".registry]
+      config_path = ""
+      [plugins."io.containerd.grpc.v1.cri".registry.configs."registry.example.com".auth]
+        username = "robot"
+        password = "hunter2"
+        auth = "cm9ib3Q6aHVudGVyMg=="
+        identitytoken = "eyJhbGciOiJSUzI1NiJ9"
+      [plugins."io.containerd.grpc.v1.cri".registry.configs."registry.example.com".tls]
+        ca_file = "/etc/containerd/certs.d/registry.example.com/ca.crt"
+        key_file = "/etc/containerd/certs.d/registry.example.com/client.key"
+    [plugins."io.containerd.grpc.v1.cri".image_decryption]
+      key_model = "node"
+`
+
+// readBundle returns the files of a tarball, gzipped or not, by name
+func readBundle(r io.Reader) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(tr)
+		Expect(err).NotTo(HaveOccurred())
+		files[header.Name] = string(data)
+	}
+}
+
+// loadSample returns the CcRuntime of a sample of the repository
+func loadSample(path string) *ccv1beta1.CcRuntime {
+	data, err := os.ReadFile(filepath.Join("..", "..", "config", "samples", path))
+	Expect(err).NotTo(HaveOccurred())
+	ccRuntime := &ccv1beta1.CcRuntime{}
+	Expect(yaml.UnmarshalStrict(data, ccRuntime)).To(Succeed())
+	return ccRuntime
+}
+
+// withSecrets sets the secrets the bundle mustn't leak on the CcRuntime: inline
+// values of secret variables, and the last applied configuration repeating
+// them
+func withSecrets(ccRuntime *ccv1beta1.CcRuntime) *ccv1beta1.CcRuntime {
+	ccRuntime.Spec.Config.EnvironmentVariables = append(ccRuntime.Spec.Config.EnvironmentVariables,
+		corev1.EnvVar{Name: "REGISTRY_AUTH_TOKEN", Value: "ghp_s3cr3t"},
+		corev1.EnvVar{Name: "HTTPS_PROXY", Value: "http://proxy.example.com:3128"})
+	lastApplied, err := json.Marshal(ccRuntime)
+	Expect(err).NotTo(HaveOccurred())
+	ccRuntime.Annotations = map[string]string{
+		lastAppliedAnnotation: string(lastApplied),
+		"example.com/owner":   "platform",
+	}
+	ccRuntime.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: "kubectl-client-side-apply", Operation: metav1.ManagedFieldsOperationUpdate},
+	}
+	return ccRuntime
+}
+
+var _ = Describe("kubectl coco bundle", func() {
+	DescribeTable("telling the secret environment variables by their name",
+		func(name string, secret bool) {
+			Expect(secretEnvName.MatchString(name)).To(Equal(secret))
+		},
+		Entry("token", "REGISTRY_AUTH_TOKEN", true),
+		Entry("password", "HTTPS_PROXY_PASSWORD", true),
+		Entry("secret", "AWS_SECRET_ACCESS_KEY", true),
+		Entry("key", "SIGNING_KEY", true),
+		Entry("credentials", "GOOGLE_APPLICATION_CREDENTIALS", true),
+		Entry("lower case", "kbs_api_key", true),
+		Entry("node name", "NODE_NAME", false),
+		Entry("proxy", "HTTPS_PROXY", false),
+		Entry("debug", "DEBUG", false),
+	)
+
+	DescribeTable("listing the variables the configFrom Secrets set",
+		func(sample string, want []string) {
+			names := secretEnvNames(loadSample(sample))
+			Expect(names).To(HaveLen(len(want)))
+			for _, name := range want {
+				Expect(names).To(HaveKeyWithValue(name, true))
+			}
+		},
+		Entry("enclave-cc", "enclave-cc/base/ccruntime-enclave-cc.yaml", []string{"DECRYPT_CONFIG", "OCICRYPT_CONFIG"}),
+		Entry("kata", "ccruntime/base/ccruntime.yaml", []string{}),
+	)
+
+	It("leaves the variables of the configFrom ConfigMaps out", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		ccRuntime.Spec.Config.ConfigFrom = []ccv1beta1.PayloadConfigSource{
+			{Name: "HTTPS_PROXY", ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "proxy"}, Key: "HTTPS_PROXY"}},
+			{Name: "DECRYPT_CONFIG", SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "decrypt"}, Key: "DECRYPT_CONFIG"}},
+		}
+		Expect(secretEnvNames(ccRuntime)).To(Equal(map[string]bool{"DECRYPT_CONFIG": true}))
+	})
+
+	It("redacts the credentials of the containerd configuration", func() {
+		redactedConfig := string(redactConfig([]byte(containerdConfig)))
+		for _, secret := range []string{"hunter2", "cm9ib3Q6aHVudGVyMg==", "eyJhbGciOiJSUzI1NiJ9"} {
+			Expect(redactedConfig).NotTo(ContainSubstring(secret))
+		}
+		Expect(redactedConfig).To(ContainSubstring(`        password = "REDACTED"` + "\n"))
+		Expect(redactedConfig).To(ContainSubstring(`        auth = "REDACTED"` + "\n"))
+		Expect(redactedConfig).To(ContainSubstring(`        identitytoken = "REDACTED"` + "\n"))
+
+		// The rest of the configuration is left as is
+		Expect(strings.Count(redactedConfig, "\n")).To(Equal(strings.Count(containerdConfig, "\n")))
+		for _, line := range []string{
+			`        username = "robot"`,
+			`[plugins."io.containerd.grpc.v1.cri".registry.configs."registry.example.com".auth]`,
+			`        runtime_type = "io.containerd.kata-qemu-tdx.v2"`,
+			`        key_file = "/etc/containerd/certs.d/registry.example.com/client.key"`,
+			`      key_model = "node"`,
+		} {
+			Expect(redactedConfig).To(ContainSubstring(line))
+		}
+	})
+
+	DescribeTable("redacting the configuration",
+		func(config, want string) {
+			Expect(string(redactConfig([]byte(config)))).To(Equal(want))
+		},
+		Entry("quoted key", `"password" = "hunter2"`, `"password" = "REDACTED"`),
+		Entry("inline table", `  auth = { username = "robot" }`, `  auth = "REDACTED"`),
+		Entry("kata setting", `guest_hook_path = "/usr/share/oci/hooks"`, `guest_hook_path = "/usr/share/oci/hooks"`),
+		Entry("comment", `# password = "example"`, `# password = "example"`),
+		Entry("section", `[plugins."io.containerd.grpc.v1.cri".registry.configs."r".auth]`,
+			`[plugins."io.containerd.grpc.v1.cri".registry.configs."r".auth]`),
+	)
+
+	DescribeTable("redacting the CcRuntime samples",
+		func(sample string, secrets []string, kept []string) {
+			ccRuntime := withSecrets(loadSample(sample))
+			var buf bytes.Buffer
+			b := &bundleWriter{tw: tar.NewWriter(&buf), dir: "coco-bundle"}
+			Expect(b.addYAML("ccruntime.yaml", ccRuntime, secretEnvNames(ccRuntime))).To(Succeed())
+			Expect(b.tw.Close()).To(Succeed())
+
+			data := readBundle(&buf)["coco-bundle/ccruntime.yaml"]
+			for _, secret := range secrets {
+				Expect(data).NotTo(ContainSubstring(secret))
+			}
+			for _, value := range kept {
+				Expect(data).To(ContainSubstring(value))
+			}
+			Expect(data).NotTo(ContainSubstring(lastAppliedAnnotation))
+			Expect(data).NotTo(ContainSubstring("managedFields"))
+			Expect(data).To(ContainSubstring("example.com/owner: platform"))
+
+			redactedRuntime := &ccv1beta1.CcRuntime{}
+			Expect(yaml.Unmarshal([]byte(data), redactedRuntime)).To(Succeed())
+			Expect(redactedRuntime.Spec.Config.EnvironmentVariables).To(ContainElements(
+				corev1.EnvVar{Name: "REGISTRY_AUTH_TOKEN", Value: redacted},
+				corev1.EnvVar{Name: "HTTPS_PROXY", Value: "http://proxy.example.com:3128"},
+				HaveField("ValueFrom.FieldRef.FieldPath", "spec.nodeName")))
+		},
+		Entry("kata", "ccruntime/base/ccruntime.yaml",
+			[]string{"ghp_s3cr3t"}, []string{"CONFIGURE_CC"}),
+		Entry("enclave-cc", "enclave-cc/base/ccruntime-enclave-cc.yaml",
+			[]string{"ghp_s3cr3t"}, []string{"enclave-cc-payload-config", "DECRYPT_CONFIG"}),
+	)
+
+	It("redacts the values set inline under the names of the configFrom Secrets", func() {
+		ccRuntime := loadSample("enclave-cc/base/ccruntime-enclave-cc.yaml")
+		ccRuntime.Spec.Config.EnvironmentVariables = append(ccRuntime.Spec.Config.EnvironmentVariables,
+			corev1.EnvVar{Name: "DECRYPT_CONFIG", Value: "provider:attestation-agent:cc_kbc::http://kbs:8080"})
+		var buf bytes.Buffer
+		b := &bundleWriter{tw: tar.NewWriter(&buf), dir: "coco-bundle"}
+		Expect(b.addYAML("ccruntime.yaml", ccRuntime, secretEnvNames(ccRuntime))).To(Succeed())
+		Expect(b.tw.Close()).To(Succeed())
+
+		data := readBundle(&buf)["coco-bundle/ccruntime.yaml"]
+		Expect(data).NotTo(ContainSubstring("cc_kbc"))
+		Expect(data).To(ContainSubstring("value: " + redacted))
+	})
+
+	It("gathers the CcRuntime, its workloads and nodes into a tarball", func() {
+		ccRuntime := withSecrets(newTestCcRuntime("ccruntime-sample"))
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "cc-operator-daemon-install", Namespace: testNamespace},
+			Spec: appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "cc-runtime-install-pod", Env: []corev1.EnvVar{
+					{Name: "REGISTRY_AUTH_TOKEN", Value: "ghp_s3cr3t"},
+				}}},
+			}}},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "cc-operator-daemon-install-abcde", Namespace: testNamespace,
+				Labels: map[string]string{"name": "cc-operator-daemon-install"}},
+			Spec: corev1.PodSpec{NodeName: "worker-0", Containers: []corev1.Container{{Name: "cc-runtime-install-pod"}}},
+		}
+		p, out := newTestPlugin(ccRuntime, ds, pod, newTestNode("worker-0", nil))
+		output := filepath.Join(GinkgoT().TempDir(), "bundle.tar.gz")
+
+		Expect(p.bundle([]string{"-o", output, "ccruntime-sample"})).To(Succeed())
+		Expect(out.String()).To(Equal("Wrote " + output + "\n"))
+
+		file, err := os.Open(output)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		Expect(err).NotTo(HaveOccurred())
+		files := readBundle(gz)
+		var names []string
+		for name, data := range files {
+			names = append(names, strings.SplitN(name, "/", 2)[1])
+			Expect(data).NotTo(ContainSubstring("ghp_s3cr3t"), name)
+		}
+		Expect(names).To(ContainElements(
+			"ccruntime.yaml",
+			"daemonsets/cc-operator-daemon-install.yaml",
+			"pods/cc-operator-daemon-install-abcde.yaml",
+			"pods/cc-operator-daemon-install-abcde/cc-runtime-install-pod.log",
+			"events/"+testNamespace+".yaml",
+			"events/ccruntime.yaml",
+			"nodes/worker-0.yaml",
+			"runtimeclasses.yaml",
+			"errors.txt"))
+		Expect(files).To(HaveKeyWithValue(ContainSubstring("errors.txt"),
+			"manager: no operator pod in namespace "+testNamespace+"\n"))
+		Expect(files).To(HaveKeyWithValue(ContainSubstring("nodes/worker-0.yaml"), ContainSubstring("phase: Installing")))
+	})
+})
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	installPodPrefix   = "cc-operator-daemon-install"
+	uninstallPodPrefix = "cc-operator-daemon-uninstall"
+	operatorPodPrefix  = "cc-operator-"
+)
+
+// podKind tells the installer, uninstall and hook pods apart from the name
+// label of their template
+func podKind(pod *corev1.Pod) string {
+	name := pod.Labels["name"]
+	switch {
+	case strings.HasPrefix(name, installPodPrefix):
+		return "install"
+	case strings.HasPrefix(name, uninstallPodPrefix):
+		return "uninstall"
+	case strings.HasPrefix(name, operatorPodPrefix):
+		return "hook"
+	}
+	return ""
+}
+
+// logs prints the logs of the operator pods that ran on a node
+func (p *plugin) logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	kind := fs.String("kind", "", "Only the pods of the kind: install, uninstall or hook.")
+	tail := fs.Int64("tail", -1, "The number of lines to print from the end of the logs, all of them by default.")
+	previous := fs.Bool("previous", false, "Print the logs of the previous instance of the containers.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl coco logs [--kind KIND] [--tail N] [--previous] NODE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the name of a node")
+	}
+	nodeName := fs.Arg(0)
+	if *kind != "" && *kind != "install" && *kind != "uninstall" && *kind != "hook" {
+		return fmt.Errorf("unknown kind %q, expected install, uninstall or hook", *kind)
+	}
+
+	pods := &corev1.PodList{}
+	if err := p.client.List(context.TODO(), pods, client.InNamespace(p.namespace), client.HasLabels{"name"}); err != nil {
+		return err
+	}
+	var selected []corev1.Pod
+	for _, pod := range pods.Items {
+		podKind := podKind(&pod)
+		if pod.Spec.NodeName != nodeName || podKind == "" || (*kind != "" && podKind != *kind) {
+			continue
+		}
+		selected = append(selected, pod)
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no operator pod on node %s in namespace %s", nodeName, p.namespace)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].CreationTimestamp.Before(&selected[j].CreationTimestamp)
+	})
+
+	for _, pod := range selected {
+		containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			fmt.Fprintf(p.out, "==> %s pod %s, container %s (%s) <==\n", podKind(&pod), pod.Name, container.Name, pod.Status.Phase)
+			options := &corev1.PodLogOptions{Container: container.Name, Previous: *previous}
+			if *tail >= 0 {
+				options.TailLines = tail
+			}
+			stream, err := p.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, options).Stream(context.TODO())
+			if err != nil {
+				fmt.Fprintf(p.out, "failed to get the logs: %v\n\n", err)
+				continue
+			}
+			_, err = io.Copy(p.out, stream)
+			stream.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(p.out)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("kubectl coco logs", func() {
+	pod := func(name, template, nodeName string, created int) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         testNamespace,
+				Labels:            map[string]string{"name": template},
+				CreationTimestamp: metav1.Unix(int64(created), 0),
+			},
+			Spec: corev1.PodSpec{
+				NodeName:   nodeName,
+				Containers: []corev1.Container{{Name: "installer", Image: "quay.io/kata-containers/kata-deploy:3.23.0"}},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+
+	DescribeTable("telling the pods apart",
+		func(template, want string) {
+			Expect(podKind(pod("pod", template, "worker-0", 0))).To(Equal(want))
+		},
+		Entry("install", "cc-operator-daemon-install", "install"),
+		Entry("install of an architecture", "cc-operator-daemon-install-s390x", "install"),
+		Entry("uninstall", "cc-operator-daemon-uninstall", "uninstall"),
+		Entry("hook", "cc-operator-pre-install-worker-0", "hook"),
+		Entry("other pod", "coredns", ""),
+	)
+
+	It("prints the logs of the operator pods of the node, oldest first", func() {
+		hook := pod("pre-install", "cc-operator-pre-install-worker-0", "worker-0", 1)
+		hook.Spec.InitContainers = []corev1.Container{{Name: "wait", Image: "busybox"}}
+		p, out := newTestPlugin(
+			pod("install", "cc-operator-daemon-install", "worker-0", 2),
+			hook,
+			pod("install-other", "cc-operator-daemon-install", "worker-1", 1),
+			pod("coredns", "coredns", "worker-0", 1))
+
+		Expect(p.logs([]string{"worker-0"})).To(Succeed())
+		Expect(out.String()).To(Equal(`==> hook pod pre-install, container wait (Running) <==
+fake logs
+==> hook pod pre-install, container installer (Running) <==
+fake logs
+==> install pod install, container installer (Running) <==
+fake logs
+`))
+	})
+
+	It("only prints the pods of the kind", func() {
+		p, out := newTestPlugin(
+			pod("install", "cc-operator-daemon-install", "worker-0", 2),
+			pod("uninstall", "cc-operator-daemon-uninstall", "worker-0", 1))
+
+		Expect(p.logs([]string{"--kind", "uninstall", "worker-0"})).To(Succeed())
+		Expect(out.String()).To(HavePrefix("==> uninstall pod uninstall"))
+		Expect(out.String()).NotTo(ContainSubstring("install pod install"))
+	})
+
+	It("rejects unknown kinds and nodes without operator pods", func() {
+		p, _ := newTestPlugin(pod("install", "cc-operator-daemon-install", "worker-0", 1))
+		Expect(p.logs([]string{"--kind", "payload", "worker-0"})).To(
+			MatchError(`unknown kind "payload", expected install, uninstall or hook`))
+		Expect(p.logs([]string{"worker-1"})).To(
+			MatchError("no operator pod on node worker-1 in namespace " + testNamespace))
+	})
+})
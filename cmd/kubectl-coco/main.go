@@ -0,0 +1,178 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-coco is a kubectl plugin reporting the state of the CcRuntimes,
+// node by node, from their status, the node labels and the operator pods.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const usage = `kubectl coco reports the state of the CcRuntimes node by node.
+
+Usage:
+  kubectl coco [--kubeconfig FILE] [--namespace NAMESPACE] COMMAND [ARGS]
+
+Commands:
+  status [CCRUNTIME]   Summarize the CcRuntimes, with the phase of each node
+  nodes [CCRUNTIME]    Show the operator labels each node carries
+  logs NODE            Print the logs of the installer, uninstall and hook pods of the node
+  why [CCRUNTIME]      Explain what the installation, or the finalizer, waits for
+  bundle CCRUNTIME     Gather what's needed to investigate the installation into a tarball
+
+The namespace is the one the operator runs the CcRuntime workloads in.
+`
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(ccv1beta1.AddToScheme(scheme))
+}
+
+// plugin holds the clients of the commands
+type plugin struct {
+	client    client.Client
+	clientset kubernetes.Interface
+	namespace string
+
+	// out is where the commands print their report
+	out io.Writer
+}
+
+func main() {
+	var namespace string
+	flag.StringVar(&namespace, "namespace", "confidential-containers-system",
+		"The namespace of the CcRuntime workloads.")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage+"\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func(*plugin, []string) error{
+		"status": (*plugin).status,
+		"nodes":  (*plugin).nodes,
+		"logs":   (*plugin).logs,
+		"why":    (*plugin).why,
+		"bundle": (*plugin).bundle,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.GetConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	p, err := newPlugin(cfg, namespace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := command(p, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func newPlugin(cfg *rest.Config, namespace string) (*plugin, error) {
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &plugin{client: c, clientset: clientset, namespace: namespace, out: os.Stdout}, nil
+}
+
+// withEffectiveConfig replaces the configuration of a CcRuntime referencing a
+// profile with the merged one the operator reports in the status
+func withEffectiveConfig(ccRuntime *ccv1beta1.CcRuntime) {
+	if ccRuntime.Status.EffectiveConfig != nil {
+		ccRuntime.Spec.Config = *ccRuntime.Status.EffectiveConfig
+	}
+	if ccRuntime.Spec.RuntimeName == "" {
+		ccRuntime.Spec.RuntimeName = ccRuntime.Status.RuntimeName
+	}
+}
+
+// ccRuntimes returns the CcRuntime of the name, or all of them
+func (p *plugin) ccRuntimes(args []string) ([]ccv1beta1.CcRuntime, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("expected at most one CcRuntime, got %d arguments", len(args))
+	}
+	if len(args) == 1 {
+		ccRuntime := ccv1beta1.CcRuntime{}
+		if err := p.client.Get(context.TODO(), client.ObjectKey{Name: args[0]}, &ccRuntime); err != nil {
+			return nil, err
+		}
+		withEffectiveConfig(&ccRuntime)
+		return []ccv1beta1.CcRuntime{ccRuntime}, nil
+	}
+
+	ccRuntimeList := &ccv1beta1.CcRuntimeList{}
+	if err := p.client.List(context.TODO(), ccRuntimeList); err != nil {
+		return nil, err
+	}
+	if len(ccRuntimeList.Items) == 0 {
+		return nil, fmt.Errorf("no CcRuntime found")
+	}
+	for i := range ccRuntimeList.Items {
+		withEffectiveConfig(&ccRuntimeList.Items[i])
+	}
+	return ccRuntimeList.Items, nil
+}
+
+// selectedNodes returns the nodes selected by the ccNodeSelector of the
+// CcRuntime, the worker nodes by default
+func (p *plugin) selectedNodes(ccRuntime *ccv1beta1.CcRuntime) ([]corev1.Node, error) {
+	matchLabels := map[string]string{"node.kubernetes.io/worker": ""}
+	if ccRuntime.Spec.CcNodeSelector != nil {
+		matchLabels = ccRuntime.Spec.CcNodeSelector.MatchLabels
+	}
+	nodes := &corev1.NodeList{}
+	if err := p.client.List(context.TODO(), nodes, client.MatchingLabels(matchLabels)); err != nil {
+		return nil, err
+	}
+	return nodes.Items, nil
+}
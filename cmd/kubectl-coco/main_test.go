@@ -0,0 +1,76 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Reading the CcRuntimes", func() {
+	It("reads the CcRuntime of the name with the configuration of its profile", func() {
+		ccRuntime := newTestCcRuntime("kata")
+		ccRuntime.Spec = ccv1beta1.CcRuntimeSpec{Profile: "kata"}
+		effective := newTestCcRuntime("kata").Spec.Config
+		ccRuntime.Status.EffectiveConfig = &effective
+		ccRuntime.Status.RuntimeName = "kata"
+		p, _ := newTestPlugin(ccRuntime, newTestCcRuntime("enclave-cc"))
+
+		ccRuntimes, err := p.ccRuntimes([]string{"kata"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ccRuntimes).To(HaveLen(1))
+		Expect(ccRuntimes[0].Spec.RuntimeName).To(Equal(ccv1beta1.CcRuntimeName("kata")))
+		Expect(ccRuntimes[0].Spec.Config).To(Equal(effective))
+	})
+
+	It("reads all the CcRuntimes", func() {
+		p, _ := newTestPlugin(newTestCcRuntime("kata"), newTestCcRuntime("enclave-cc"))
+		ccRuntimes, err := p.ccRuntimes(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ccRuntimes).To(ConsistOf(HaveField("Name", "kata"), HaveField("Name", "enclave-cc")))
+	})
+
+	It("reports the missing CcRuntimes", func() {
+		p, _ := newTestPlugin()
+		_, err := p.ccRuntimes(nil)
+		Expect(err).To(MatchError("no CcRuntime found"))
+		_, err = p.ccRuntimes([]string{"kata"})
+		Expect(err).To(MatchError(ContainSubstring("not found")))
+		_, err = p.ccRuntimes([]string{"kata", "enclave-cc"})
+		Expect(err).To(MatchError("expected at most one CcRuntime, got 2 arguments"))
+	})
+
+	It("selects the nodes of the ccNodeSelector, the worker nodes by default", func() {
+		ccRuntime := newTestCcRuntime("kata")
+		tee := newTestNode("worker-1", map[string]string{"node-role.kubernetes.io/tee": ""})
+		p, _ := newTestPlugin(newTestNode("worker-0", nil), tee)
+
+		nodes, err := p.selectedNodes(ccRuntime)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(HaveLen(2))
+
+		ccRuntime.Spec.CcNodeSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{"node-role.kubernetes.io/tee": ""},
+		}
+		nodes, err = p.selectedNodes(ccRuntime)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(ConsistOf(HaveField("Name", "worker-1")))
+	})
+})
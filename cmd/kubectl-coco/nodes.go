@@ -0,0 +1,96 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/confidential-containers/operator/controllers"
+)
+
+// labelColumn reports whether a node carries a label
+func labelColumn(node *corev1.Node, labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	if hasLabels(node, labels) {
+		return "yes"
+	}
+	return "no"
+}
+
+// hookDoneColumn reports whether a node carries the done label of a hook of
+// the CcRuntime
+func hookDoneColumn(node *corev1.Node, ccRuntimeName, hookName string) string {
+	return labelColumn(node, map[string]string{controllers.HookDoneLabel(ccRuntimeName, hookName): "done"})
+}
+
+// hookLabels lists the hooks of the CcRuntime whose done labels the node
+// carries
+func hookLabels(node *corev1.Node, ccRuntimeName string) string {
+	var hooks []string
+	for k := range node.Labels {
+		if !strings.HasPrefix(k, controllers.HookDoneLabelPrefix) {
+			continue
+		}
+		hookName, _, _ := strings.Cut(strings.TrimPrefix(k, controllers.HookDoneLabelPrefix), ".")
+		if k == controllers.HookDoneLabel(ccRuntimeName, hookName) {
+			hooks = append(hooks, hookName)
+		}
+	}
+	if len(hooks) == 0 {
+		return "-"
+	}
+	sort.Strings(hooks)
+	return strings.Join(hooks, ",")
+}
+
+// nodes prints which of the labels driving the installation each node of the
+// CcRuntimes carries
+func (p *plugin) nodes(args []string) error {
+	ccRuntimes, err := p.ccRuntimes(args)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CCRUNTIME\tNODE\tRUNTIME\tINSTALL-DONE\tUNINSTALL-DONE\tSTARTUNINSTALL\tPREINSTALL\tPOSTUNINSTALL\tHOOKS")
+	for i := range ccRuntimes {
+		ccRuntime := &ccRuntimes[i]
+		nodes, err := p.selectedNodes(ccRuntime)
+		if err != nil {
+			return err
+		}
+		for j := range nodes {
+			node := &nodes[j]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ccRuntime.Name, node.Name,
+				node.Status.NodeInfo.ContainerRuntimeVersion,
+				labelColumn(node, ccRuntime.Spec.Config.InstallDoneLabel),
+				labelColumn(node, ccRuntime.Spec.Config.UninstallDoneLabel),
+				labelColumn(node, map[string]string{controllers.StartUninstallLabel[0]: controllers.StartUninstallLabel[1]}),
+				hookDoneColumn(node, ccRuntime.Name, string(controllers.PreInstallOperation)),
+				hookDoneColumn(node, ccRuntime.Name, string(controllers.PostUninstallOperation)),
+				hookLabels(node, ccRuntime.Name))
+		}
+	}
+	return w.Flush()
+}
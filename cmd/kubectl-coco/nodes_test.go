@@ -0,0 +1,63 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/confidential-containers/operator/controllers"
+)
+
+var _ = Describe("kubectl coco nodes", func() {
+	It("lists the hooks of the CcRuntime the node completed", func() {
+		node := newTestNode("worker-0", map[string]string{
+			controllers.HookDoneLabel("ccruntime-sample", "smoke-test"):  "done",
+			controllers.HookDoneLabel("ccruntime-sample", "pre-install"): "done",
+			controllers.HookDoneLabel("other", "smoke-test"):             "done",
+		})
+		Expect(hookLabels(node, "ccruntime-sample")).To(Equal("pre-install,smoke-test"))
+		Expect(hookLabels(node, "third")).To(Equal("-"))
+	})
+
+	It("shows the operator labels of each node", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		installed := newTestNode("worker-0", map[string]string{
+			"katacontainers.io/kata-runtime": "true",
+			controllers.HookDoneLabel("ccruntime-sample", string(controllers.PreInstallOperation)): "done",
+		})
+		installed.Status.NodeInfo.ContainerRuntimeVersion = "containerd://1.7.27"
+		uninstalling := newTestNode("worker-1", map[string]string{
+			controllers.StartUninstallLabel[0]: controllers.StartUninstallLabel[1],
+		})
+		uninstalling.Status.NodeInfo = corev1.NodeSystemInfo{ContainerRuntimeVersion: "cri-o://1.31.0"}
+		p, out := newTestPlugin(ccRuntime, installed, uninstalling)
+
+		Expect(p.nodes(nil)).To(Succeed())
+		Expect(out.String()).To(Equal(`CCRUNTIME         NODE      RUNTIME              INSTALL-DONE  UNINSTALL-DONE  STARTUNINSTALL  PREINSTALL  POSTUNINSTALL  HOOKS
+ccruntime-sample  worker-0  containerd://1.7.27  yes           no              no              yes         no             pre-install
+ccruntime-sample  worker-1  cri-o://1.31.0       no            no              yes             no          no             -
+`))
+	})
+
+	It("leaves the labels the CcRuntime doesn't set out", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		ccRuntime.Spec.Config.UninstallDoneLabel = nil
+		Expect(labelColumn(newTestNode("worker-0", nil), ccRuntime.Spec.Config.UninstallDoneLabel)).To(Equal("-"))
+	})
+})
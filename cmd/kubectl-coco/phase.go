@@ -0,0 +1,164 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+// NodePhase is the phase of a node in the installation, or uninstallation,
+// of a CcRuntime
+type NodePhase string
+
+const (
+	NodePreflight       NodePhase = "Preflight"
+	NodePreflightFailed NodePhase = "PreflightFailed"
+	NodeExcluded        NodePhase = "Excluded"
+	NodePreInstalling   NodePhase = "PreInstalling"
+	NodeHookFailed      NodePhase = "HookFailed"
+	NodeInstalling      NodePhase = "Installing"
+	NodeInstalled       NodePhase = "Installed"
+	NodeInstallFailed   NodePhase = "InstallFailed"
+	NodePreUninstall    NodePhase = "PreUninstalling"
+	NodeUninstalling    NodePhase = "Uninstalling"
+	NodeUninstalled     NodePhase = "Uninstalled"
+	NodeUninstallFailed NodePhase = "UninstallFailed"
+)
+
+// nodeState is the phase of a node, with what it waits for or why it failed
+type nodeState struct {
+	phase  NodePhase
+	detail string
+}
+
+func hasLabels(node *corev1.Node, labels map[string]string) bool {
+	if len(labels) == 0 {
+		return false
+	}
+	for k, v := range labels {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func failedNode(list []ccv1beta1.FailedNodeStatus, name string) *ccv1beta1.FailedNodeStatus {
+	for i := range list {
+		if list[i].Name == name {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingHook returns the first hook of the stage the node didn't complete
+func pendingHook(ccRuntime *ccv1beta1.CcRuntime, stage ccv1beta1.HookStage, nodeName string) *ccv1beta1.HookStatus {
+	for i := range ccRuntime.Status.Hooks {
+		hook := &ccRuntime.Status.Hooks[i]
+		if hook.Stage == stage && hook.Phase != ccv1beta1.HookCompleted && !contains(hook.CompletedNodesList, nodeName) {
+			return hook
+		}
+	}
+	return nil
+}
+
+// hookState is the state of a node waiting for a hook
+func hookState(hook *ccv1beta1.HookStatus, nodeName string, phase NodePhase) nodeState {
+	if failed := failedNode(hook.FailedNodesList, nodeName); failed != nil {
+		return nodeState{phase: NodeHookFailed, detail: "hook " + hook.Name + ": " + failed.Error}
+	}
+	return nodeState{phase: phase, detail: "waiting for the " + string(hook.Stage) + " hook " + hook.Name}
+}
+
+// preflightState is the state of a node that didn't pass the preflight checks,
+// if any
+func preflightState(ccRuntime *ccv1beta1.CcRuntime, nodeName string) *nodeState {
+	preflight := &ccRuntime.Spec.Config.Preflight
+	if !preflight.Enabled {
+		return nil
+	}
+	for _, status := range ccRuntime.Status.Preflight {
+		if status.Name != nodeName {
+			continue
+		}
+		if status.Passed {
+			return nil
+		}
+		state := nodeState{phase: NodePreflightFailed, detail: strings.Join(status.Failures, "; ")}
+		if preflight.Policy == ccv1beta1.ExcludePreflightPolicy {
+			state.phase = NodeExcluded
+		}
+		return &state
+	}
+	return &nodeState{phase: NodePreflight, detail: "waiting for the preflight checks"}
+}
+
+// nodeStatus derives the phase of the node from the status of the CcRuntime
+// and the labels the operator and the payload set on the node
+func nodeStatus(ccRuntime *ccv1beta1.CcRuntime, node *corev1.Node) nodeState {
+	status := &ccRuntime.Status
+	if ccRuntime.DeletionTimestamp != nil {
+		if failed := failedNode(status.UnInstallationStatus.Failed.FailedNodesList, node.Name); failed != nil {
+			return nodeState{phase: NodeUninstallFailed, detail: failed.Error}
+		}
+		if hasLabels(node, ccRuntime.Spec.Config.UninstallDoneLabel) {
+			if hook := pendingHook(ccRuntime, ccv1beta1.PostUninstallHookStage, node.Name); hook != nil {
+				return hookState(hook, node.Name, NodeUninstalled)
+			}
+			return nodeState{phase: NodeUninstalled}
+		}
+		if node.Labels[controllers.StartUninstallLabel[0]] == controllers.StartUninstallLabel[1] {
+			return nodeState{phase: NodeUninstalling, detail: "waiting for the uninstall Job"}
+		}
+		if hook := pendingHook(ccRuntime, ccv1beta1.PreUninstallHookStage, node.Name); hook != nil {
+			return hookState(hook, node.Name, NodePreUninstall)
+		}
+		return nodeState{phase: NodePreUninstall, detail: "waiting for the node to be labelled for uninstallation"}
+	}
+
+	if state := preflightState(ccRuntime, node.Name); state != nil {
+		return *state
+	}
+	if failed := failedNode(status.InstallationStatus.Failed.FailedNodesList, node.Name); failed != nil {
+		return nodeState{phase: NodeInstallFailed, detail: failed.Error}
+	}
+	if hook := pendingHook(ccRuntime, ccv1beta1.PreInstallHookStage, node.Name); hook != nil {
+		return hookState(hook, node.Name, NodePreInstalling)
+	}
+	if hasLabels(node, ccRuntime.Spec.Config.InstallDoneLabel) || contains(status.InstallationStatus.Completed.CompletedNodesList, node.Name) {
+		if hook := pendingHook(ccRuntime, ccv1beta1.PostInstallHookStage, node.Name); hook != nil {
+			return hookState(hook, node.Name, NodeInstalled)
+		}
+		return nodeState{phase: NodeInstalled}
+	}
+	return nodeState{phase: NodeInstalling, detail: "waiting for the install DaemonSet pod"}
+}
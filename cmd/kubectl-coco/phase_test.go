@@ -0,0 +1,135 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+var _ = Describe("Node phases", func() {
+	installed := map[string]string{"katacontainers.io/kata-runtime": "true"}
+	uninstalled := map[string]string{"katacontainers.io/kata-runtime": "cleanup"}
+	startUninstall := map[string]string{controllers.StartUninstallLabel[0]: controllers.StartUninstallLabel[1]}
+
+	hook := func(name string, stage ccv1beta1.HookStage, completed ...string) ccv1beta1.HookStatus {
+		return ccv1beta1.HookStatus{Name: name, Stage: stage, Phase: ccv1beta1.HookRunning, CompletedNodesList: completed}
+	}
+	failedHook := func(name string, stage ccv1beta1.HookStage, error string) ccv1beta1.HookStatus {
+		status := hook(name, stage)
+		status.Phase = ccv1beta1.HookFailed
+		status.FailedNodesList = []ccv1beta1.FailedNodeStatus{{Name: "worker-0", Error: error}}
+		return status
+	}
+	preflight := func(policy ccv1beta1.PreflightPolicy, nodes ...ccv1beta1.PreflightNodeStatus) func(*ccv1beta1.CcRuntime) {
+		return func(ccRuntime *ccv1beta1.CcRuntime) {
+			ccRuntime.Spec.Config.Preflight.Enabled = true
+			ccRuntime.Spec.Config.Preflight.Policy = policy
+			ccRuntime.Status.Preflight = nodes
+		}
+	}
+	hooks := func(statuses ...ccv1beta1.HookStatus) func(*ccv1beta1.CcRuntime) {
+		return func(ccRuntime *ccv1beta1.CcRuntime) {
+			ccRuntime.Status.Hooks = statuses
+		}
+	}
+	installFailed := func(ccRuntime *ccv1beta1.CcRuntime) {
+		ccRuntime.Status.InstallationStatus.Failed.FailedNodesList = []ccv1beta1.FailedNodeStatus{
+			{Name: "worker-0", Error: "CrashLoopBackOff"},
+		}
+	}
+	installCompleted := func(ccRuntime *ccv1beta1.CcRuntime) {
+		ccRuntime.Status.InstallationStatus.Completed.CompletedNodesList = []string{"worker-0"}
+	}
+
+	DescribeTable("deriving the phase of a node being installed",
+		func(change func(*ccv1beta1.CcRuntime), labels map[string]string, want nodeState) {
+			ccRuntime := newTestCcRuntime("ccruntime-sample")
+			if change != nil {
+				change(ccRuntime)
+			}
+			Expect(nodeStatus(ccRuntime, newTestNode("worker-0", labels))).To(Equal(want))
+		},
+		Entry("waiting for the installer", nil, nil,
+			nodeState{phase: NodeInstalling, detail: "waiting for the install DaemonSet pod"}),
+		Entry("labelled by the installer", nil, installed,
+			nodeState{phase: NodeInstalled}),
+		Entry("counted as installed by the operator", installCompleted, nil,
+			nodeState{phase: NodeInstalled}),
+		Entry("failed installation", installFailed, nil,
+			nodeState{phase: NodeInstallFailed, detail: "CrashLoopBackOff"}),
+		Entry("waiting for the preflight checks", preflight(ccv1beta1.BlockPreflightPolicy), nil,
+			nodeState{phase: NodePreflight, detail: "waiting for the preflight checks"}),
+		Entry("failed preflight checks",
+			preflight(ccv1beta1.BlockPreflightPolicy, ccv1beta1.PreflightNodeStatus{
+				Name: "worker-0", Failures: []string{"kvm: /dev/kvm is missing", "kernel: 4.18 is too old"},
+			}), nil,
+			nodeState{phase: NodePreflightFailed, detail: "kvm: /dev/kvm is missing; kernel: 4.18 is too old"}),
+		Entry("excluded by the preflight checks",
+			preflight(ccv1beta1.ExcludePreflightPolicy, ccv1beta1.PreflightNodeStatus{
+				Name: "worker-0", Failures: []string{"kvm: /dev/kvm is missing"},
+			}), nil,
+			nodeState{phase: NodeExcluded, detail: "kvm: /dev/kvm is missing"}),
+		Entry("passed preflight checks",
+			preflight(ccv1beta1.BlockPreflightPolicy, ccv1beta1.PreflightNodeStatus{Name: "worker-0", Passed: true}),
+			installed, nodeState{phase: NodeInstalled}),
+		Entry("waiting for a preInstall hook",
+			hooks(hook("pre-install", ccv1beta1.PreInstallHookStage)), nil,
+			nodeState{phase: NodePreInstalling, detail: "waiting for the preInstall hook pre-install"}),
+		Entry("preInstall hook completed on the node",
+			hooks(hook("pre-install", ccv1beta1.PreInstallHookStage, "worker-0")), nil,
+			nodeState{phase: NodeInstalling, detail: "waiting for the install DaemonSet pod"}),
+		Entry("failed preInstall hook",
+			hooks(failedHook("pre-install", ccv1beta1.PreInstallHookStage, "BackoffLimitExceeded")), nil,
+			nodeState{phase: NodeHookFailed, detail: "hook pre-install: BackoffLimitExceeded"}),
+		Entry("waiting for a postInstall hook",
+			hooks(hook("smoke-test", ccv1beta1.PostInstallHookStage)), installed,
+			nodeState{phase: NodeInstalled, detail: "waiting for the postInstall hook smoke-test"}),
+	)
+
+	DescribeTable("deriving the phase of a node being uninstalled",
+		func(change func(*ccv1beta1.CcRuntime), labels map[string]string, want nodeState) {
+			ccRuntime := deleting(newTestCcRuntime("ccruntime-sample"))
+			if change != nil {
+				change(ccRuntime)
+			}
+			Expect(nodeStatus(ccRuntime, newTestNode("worker-0", labels))).To(Equal(want))
+		},
+		Entry("waiting for the uninstall label", nil, installed,
+			nodeState{phase: NodePreUninstall, detail: "waiting for the node to be labelled for uninstallation"}),
+		Entry("waiting for a preUninstall hook",
+			hooks(hook("drain", ccv1beta1.PreUninstallHookStage)), installed,
+			nodeState{phase: NodePreUninstall, detail: "waiting for the preUninstall hook drain"}),
+		Entry("waiting for the uninstall Job", nil, startUninstall,
+			nodeState{phase: NodeUninstalling, detail: "waiting for the uninstall Job"}),
+		Entry("labelled by the uninstaller", nil, uninstalled,
+			nodeState{phase: NodeUninstalled}),
+		Entry("waiting for a postUninstall hook",
+			hooks(hook("post-uninstall", ccv1beta1.PostUninstallHookStage)), uninstalled,
+			nodeState{phase: NodeUninstalled, detail: "waiting for the postUninstall hook post-uninstall"}),
+		Entry("failed uninstallation",
+			func(ccRuntime *ccv1beta1.CcRuntime) {
+				ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesList = []ccv1beta1.FailedNodeStatus{
+					{Name: "worker-0", Error: "DeadlineExceeded: Job was active longer than specified deadline"},
+				}
+			}, startUninstall,
+			nodeState{phase: NodeUninstallFailed, detail: "DeadlineExceeded: Job was active longer than specified deadline"}),
+	)
+})
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/confidential-containers/operator/controllers"
+)
+
+// status prints a summary of each CcRuntime, with the phase of its nodes
+func (p *plugin) status(args []string) error {
+	ccRuntimes, err := p.ccRuntimes(args)
+	if err != nil {
+		return err
+	}
+
+	for i := range ccRuntimes {
+		ccRuntime := &ccRuntimes[i]
+		nodes, err := p.selectedNodes(ccRuntime)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(p.out)
+		}
+
+		status := &ccRuntime.Status
+		state := "Installing"
+		if ccRuntime.DeletionTimestamp != nil {
+			state = "Uninstalling"
+		}
+		fmt.Fprintf(p.out, "CcRuntime:      %s (%s)\n", ccRuntime.Name, ccRuntime.Spec.RuntimeName)
+		fmt.Fprintf(p.out, "State:          %s\n", state)
+		fmt.Fprintf(p.out, "Runtime class:  %s\n", status.RuntimeClass)
+		fmt.Fprintf(p.out, "Revision:       %d\n", status.CurrentRevision)
+		fmt.Fprintf(p.out, "Nodes:          %d selected, %d installed, %d failed\n", status.TotalNodesCount,
+			status.InstallationStatus.Completed.CompletedNodesCount, status.InstallationStatus.Failed.FailedNodesCount)
+		if len(status.DepartedNodes) > 0 {
+			fmt.Fprintf(p.out, "Departed:       %s, being uninstalled\n", strings.Join(status.DepartedNodes, ", "))
+		}
+		if ccRuntime.DeletionTimestamp != nil {
+			fmt.Fprintf(p.out, "Uninstalled:    %d of %d, %d failed\n", status.UnInstallationStatus.Completed.CompletedNodesCount,
+				status.TotalNodesCount, status.UnInstallationStatus.Failed.FailedNodesCount)
+		}
+		for _, condition := range status.Conditions {
+			if condition.Status != metav1.ConditionTrue {
+				fmt.Fprintf(p.out, "Condition:      %s=%s (%s) %s\n", condition.Type, condition.Status, condition.Reason, condition.Message)
+			}
+		}
+		fmt.Fprintln(p.out)
+
+		w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tARCH\tPHASE\tDETAIL")
+		for j := range nodes {
+			state := nodeStatus(ccRuntime, &nodes[j])
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", nodes[j].Name, nodes[j].Labels[controllers.ArchLabel], state.phase, state.detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
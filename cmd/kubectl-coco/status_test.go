@@ -0,0 +1,74 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+var _ = Describe("kubectl coco status", func() {
+	It("summarizes the CcRuntime with the phase of each node", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		ccRuntime.Status = ccv1beta1.CcRuntimeStatus{
+			RuntimeClass:    "kata-qemu,kata-qemu-tdx",
+			CurrentRevision: 3,
+			TotalNodesCount: 2,
+			DepartedNodes:   []string{"worker-9"},
+			Conditions: []metav1.Condition{
+				{Type: controllers.InstallerPrivilegesReducedCondition, Status: metav1.ConditionFalse,
+					Reason: "FullyPrivileged", Message: "The installer pods run privileged"},
+				{Type: "Ready", Status: metav1.ConditionTrue, Reason: "Ready"},
+			},
+		}
+		ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount = 1
+		p, out := newTestPlugin(ccRuntime,
+			newTestNode("worker-0", map[string]string{"katacontainers.io/kata-runtime": "true"}),
+			newTestNode("worker-1", nil))
+
+		Expect(p.status(nil)).To(Succeed())
+		Expect(out.String()).To(Equal(`CcRuntime:      ccruntime-sample (kata)
+State:          Installing
+Runtime class:  kata-qemu,kata-qemu-tdx
+Revision:       3
+Nodes:          2 selected, 1 installed, 0 failed
+Departed:       worker-9, being uninstalled
+Condition:      InstallerPrivilegesReduced=False (FullyPrivileged) The installer pods run privileged
+
+` +
+			"NODE      ARCH   PHASE       DETAIL\n" +
+			"worker-0  amd64  Installed   \n" +
+			"worker-1  amd64  Installing  waiting for the install DaemonSet pod\n"))
+	})
+
+	It("reports the uninstallation", func() {
+		ccRuntime := deleting(newTestCcRuntime("ccruntime-sample"))
+		ccRuntime.Status.TotalNodesCount = 1
+		ccRuntime.Status.UnInstallationStatus.Completed.CompletedNodesCount = 1
+		p, out := newTestPlugin(ccRuntime,
+			newTestNode("worker-0", map[string]string{"katacontainers.io/kata-runtime": "cleanup"}))
+
+		Expect(p.status([]string{"ccruntime-sample"})).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("State:          Uninstalling\n"))
+		Expect(out.String()).To(ContainSubstring("Uninstalled:    1 of 1, 0 failed\n"))
+		Expect(out.String()).To(ContainSubstring("worker-0  amd64  Uninstalled"))
+	})
+})
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+// testNamespace is the namespace of the CcRuntime workloads of the specs
+const testNamespace = "confidential-containers-system"
+
+func TestPlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "kubectl-coco Suite")
+}
+
+// newTestPlugin returns a plugin reading the objects, and the buffer it
+// prints to. The clientset serves the pods, for their logs.
+func newTestPlugin(objects ...client.Object) (*plugin, *bytes.Buffer) {
+	var pods []runtime.Object
+	for _, object := range objects {
+		if pod, ok := object.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	out := &bytes.Buffer{}
+	return &plugin{
+		client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		clientset: k8sfake.NewClientset(pods...),
+		namespace: testNamespace,
+		out:       out,
+	}, out
+}
+
+// newTestCcRuntime returns a CcRuntime installing kata-deploy on the worker
+// nodes, as the base sample does
+func newTestCcRuntime(name string) *ccv1beta1.CcRuntime {
+	return &ccv1beta1.CcRuntime{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: ccv1beta1.CcRuntimeSpec{
+			RuntimeName: "kata",
+			Config: ccv1beta1.CcInstallConfig{
+				InstallType:        ccv1beta1.BundleInstallType,
+				PayloadImage:       "quay.io/kata-containers/kata-deploy:3.23.0",
+				InstallDoneLabel:   map[string]string{"katacontainers.io/kata-runtime": "true"},
+				UninstallDoneLabel: map[string]string{"katacontainers.io/kata-runtime": "cleanup"},
+			},
+		},
+	}
+}
+
+// deleting marks the CcRuntime as being deleted, its finalizer holding it
+func deleting(ccRuntime *ccv1beta1.CcRuntime) *ccv1beta1.CcRuntime {
+	now := metav1.Now()
+	ccRuntime.DeletionTimestamp = &now
+	ccRuntime.Finalizers = []string{controllers.RuntimeConfigFinalizer}
+	return ccRuntime
+}
+
+// newTestNode returns a worker node with the labels
+func newTestNode(name string, labels map[string]string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{"node.kubernetes.io/worker": "", controllers.ArchLabel: "amd64"},
+	}}
+	for k, v := range labels {
+		node.Labels[k] = v
+	}
+	return node
+}
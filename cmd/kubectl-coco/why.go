@@ -0,0 +1,207 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// explainHooks explains what the unfinished hooks of the stage wait for
+func explainHooks(ccRuntime *ccv1beta1.CcRuntime, stage ccv1beta1.HookStage) []string {
+	var reasons []string
+	for _, hook := range ccRuntime.Status.Hooks {
+		if hook.Stage != stage || hook.Phase == ccv1beta1.HookCompleted {
+			continue
+		}
+		reason := fmt.Sprintf("the %s hook %s is %s, completed on %d of %d nodes", stage, hook.Name, hook.Phase,
+			len(hook.CompletedNodesList), ccRuntime.Status.TotalNodesCount)
+		if hook.Message != "" {
+			reason += ": " + hook.Message
+		}
+		reasons = append(reasons, reason)
+		for _, failed := range hook.FailedNodesList {
+			reasons = append(reasons, fmt.Sprintf("  node %s: %s", failed.Name, failed.Error))
+		}
+	}
+	return reasons
+}
+
+// explainNodes lists the nodes that aren't in one of the phases
+func explainNodes(ccRuntime *ccv1beta1.CcRuntime, nodes []corev1.Node, done ...NodePhase) []string {
+	var reasons []string
+	for i := range nodes {
+		state := nodeStatus(ccRuntime, &nodes[i])
+		finished := false
+		for _, phase := range done {
+			finished = finished || state.phase == phase
+		}
+		if finished {
+			continue
+		}
+		reason := fmt.Sprintf("  node %s is %s", nodes[i].Name, state.phase)
+		if state.detail != "" {
+			reason += ": " + state.detail
+		}
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+// explainInstallDaemonsets explains which install DaemonSets aren't rolled out
+func (p *plugin) explainInstallDaemonsets() ([]string, error) {
+	dss := &appsv1.DaemonSetList{}
+	if err := p.client.List(context.TODO(), dss, client.InNamespace(p.namespace)); err != nil {
+		return nil, err
+	}
+	var reasons []string
+	for _, ds := range dss.Items {
+		if !strings.HasPrefix(ds.Name, installPodPrefix) {
+			continue
+		}
+		status := ds.Status
+		if status.DesiredNumberScheduled == status.NumberReady && status.UpdatedNumberScheduled == status.DesiredNumberScheduled {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("the DaemonSet %s has %d of %d pods ready, %d updated",
+			ds.Name, status.NumberReady, status.DesiredNumberScheduled, status.UpdatedNumberScheduled))
+	}
+	return reasons, nil
+}
+
+// why explains what the installation, or the finalizer, of each CcRuntime
+// waits for
+func (p *plugin) why(args []string) error {
+	ccRuntimes, err := p.ccRuntimes(args)
+	if err != nil {
+		return err
+	}
+
+	for i := range ccRuntimes {
+		ccRuntime := &ccRuntimes[i]
+		nodes, err := p.selectedNodes(ccRuntime)
+		if err != nil {
+			return err
+		}
+		var reasons []string
+		if ccRuntime.DeletionTimestamp != nil {
+			reasons, err = p.explainUninstallation(ccRuntime, nodes)
+		} else {
+			reasons, err = p.explainInstallation(ccRuntime, nodes)
+		}
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			fmt.Fprintln(p.out)
+		}
+		if len(reasons) == 0 {
+			fmt.Fprintf(p.out, "CcRuntime %s waits for nothing, it's installed on its %d nodes\n", ccRuntime.Name, ccRuntime.Status.TotalNodesCount)
+			continue
+		}
+		fmt.Fprintf(p.out, "CcRuntime %s waits for:\n", ccRuntime.Name)
+		for _, reason := range reasons {
+			// The details of a reason are indented under it
+			if strings.HasPrefix(reason, "  ") {
+				fmt.Fprintln(p.out, "    - "+strings.TrimSpace(reason))
+			} else {
+				fmt.Fprintln(p.out, "- "+reason)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *plugin) explainInstallation(ccRuntime *ccv1beta1.CcRuntime, nodes []corev1.Node) ([]string, error) {
+	var reasons []string
+	for _, condition := range ccRuntime.Status.Conditions {
+		if condition.Status != metav1.ConditionTrue && condition.Type != controllers.RolledBackCondition {
+			reasons = append(reasons, fmt.Sprintf("the %s condition is %s (%s): %s",
+				condition.Type, condition.Status, condition.Reason, condition.Message))
+		}
+	}
+	reasons = append(reasons, explainHooks(ccRuntime, ccv1beta1.PreInstallHookStage)...)
+
+	dsReasons, err := p.explainInstallDaemonsets()
+	if err != nil {
+		return nil, err
+	}
+	reasons = append(reasons, dsReasons...)
+
+	if nodeReasons := explainNodes(ccRuntime, nodes, NodeInstalled, NodeExcluded); len(nodeReasons) > 0 {
+		reasons = append(reasons, fmt.Sprintf("the nodes to be labelled %s by the installer",
+			formatLabels(ccRuntime.Spec.Config.InstallDoneLabel)))
+		reasons = append(reasons, nodeReasons...)
+	}
+	reasons = append(reasons, explainHooks(ccRuntime, ccv1beta1.PostInstallHookStage)...)
+	if len(ccRuntime.Status.DepartedNodes) > 0 {
+		reasons = append(reasons, fmt.Sprintf("the uninstallation of the nodes that left the node selector: %s",
+			strings.Join(ccRuntime.Status.DepartedNodes, ", ")))
+		for _, failed := range ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesList {
+			reasons = append(reasons, fmt.Sprintf("  node %s: %s", failed.Name, failed.Error))
+		}
+	}
+	return reasons, nil
+}
+
+func (p *plugin) explainUninstallation(ccRuntime *ccv1beta1.CcRuntime, nodes []corev1.Node) ([]string, error) {
+	if !contains(ccRuntime.Finalizers, controllers.RuntimeConfigFinalizer) {
+		return []string{fmt.Sprintf("the finalizers %s of other controllers", strings.Join(ccRuntime.Finalizers, ", "))}, nil
+	}
+
+	reasons := explainHooks(ccRuntime, ccv1beta1.PreUninstallHookStage)
+
+	// The finalizer waits for the selected nodes the runtime was installed on,
+	// which the CcRuntime counts, to have the uninstall done label
+	doneNodes := 0
+	for i := range nodes {
+		if hasLabels(&nodes[i], ccRuntime.Spec.Config.UninstallDoneLabel) {
+			doneNodes++
+		}
+	}
+	if doneNodes != ccRuntime.Status.TotalNodesCount {
+		reasons = append(reasons, fmt.Sprintf("the finalizer %s, %d of %d nodes are labelled %s",
+			controllers.RuntimeConfigFinalizer, doneNodes, ccRuntime.Status.TotalNodesCount,
+			formatLabels(ccRuntime.Spec.Config.UninstallDoneLabel)))
+		reasons = append(reasons, explainNodes(ccRuntime, nodes, NodeUninstalled)...)
+	}
+	reasons = append(reasons, explainHooks(ccRuntime, ccv1beta1.PostUninstallHookStage)...)
+	if len(reasons) == 0 {
+		reasons = append(reasons, fmt.Sprintf("the operator to remove the finalizer %s", controllers.RuntimeConfigFinalizer))
+	}
+	return reasons, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+	"github.com/confidential-containers/operator/controllers"
+)
+
+var _ = Describe("kubectl coco why", func() {
+	installed := map[string]string{"katacontainers.io/kata-runtime": "true"}
+	uninstalled := map[string]string{"katacontainers.io/kata-runtime": "cleanup"}
+
+	It("waits for nothing once the nodes are installed", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		ccRuntime.Status.TotalNodesCount = 1
+		ccRuntime.Status.Conditions = []metav1.Condition{
+			{Type: controllers.RolledBackCondition, Status: metav1.ConditionFalse, Reason: "RolledBack"},
+		}
+		p, out := newTestPlugin(ccRuntime, newTestNode("worker-0", installed))
+
+		Expect(p.why(nil)).To(Succeed())
+		Expect(out.String()).To(Equal("CcRuntime ccruntime-sample waits for nothing, it's installed on its 1 nodes\n"))
+	})
+
+	It("explains what the installation waits for", func() {
+		ccRuntime := newTestCcRuntime("ccruntime-sample")
+		ccRuntime.Status.TotalNodesCount = 2
+		ccRuntime.Status.Conditions = []metav1.Condition{
+			{Type: controllers.InstallerPrivilegesReducedCondition, Status: metav1.ConditionFalse,
+				Reason: "FullyPrivileged", Message: "The installer pods run privileged"},
+		}
+		ccRuntime.Status.Hooks = []ccv1beta1.HookStatus{
+			{Name: "pre-install", Stage: ccv1beta1.PreInstallHookStage, Phase: ccv1beta1.HookFailed,
+				CompletedNodesList: []string{"worker-0"},
+				FailedNodesList:    []ccv1beta1.FailedNodeStatus{{Name: "worker-1", Error: "BackoffLimitExceeded"}}},
+			{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Phase: ccv1beta1.HookRunning},
+		}
+		ccRuntime.Status.DepartedNodes = []string{"worker-9"}
+		ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesList = []ccv1beta1.FailedNodeStatus{
+			{Name: "worker-9", Error: "DeadlineExceeded"},
+		}
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "cc-operator-daemon-install", Namespace: testNamespace},
+			Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 2, NumberReady: 1, UpdatedNumberScheduled: 2},
+		}
+		p, out := newTestPlugin(ccRuntime, ds,
+			newTestNode("worker-0", installed), newTestNode("worker-1", nil))
+
+		Expect(p.why([]string{"ccruntime-sample"})).To(Succeed())
+		Expect(out.String()).To(Equal(`CcRuntime ccruntime-sample waits for:
+- the InstallerPrivilegesReduced condition is False (FullyPrivileged): The installer pods run privileged
+- the preInstall hook pre-install is Failed, completed on 1 of 2 nodes
+    - node worker-1: BackoffLimitExceeded
+- the DaemonSet cc-operator-daemon-install has 1 of 2 pods ready, 2 updated
+- the nodes to be labelled katacontainers.io/kata-runtime=true by the installer
+    - node worker-1 is HookFailed: hook pre-install: BackoffLimitExceeded
+- the postInstall hook smoke-test is Running, completed on 0 of 2 nodes
+- the uninstallation of the nodes that left the node selector: worker-9
+    - node worker-9: DeadlineExceeded
+`))
+	})
+
+	It("explains what the finalizer waits for", func() {
+		ccRuntime := deleting(newTestCcRuntime("ccruntime-sample"))
+		ccRuntime.Status.TotalNodesCount = 2
+		p, out := newTestPlugin(ccRuntime, newTestNode("worker-0", uninstalled), newTestNode("worker-1", map[string]string{
+			controllers.StartUninstallLabel[0]: controllers.StartUninstallLabel[1],
+		}))
+
+		Expect(p.why(nil)).To(Succeed())
+		Expect(out.String()).To(Equal(`CcRuntime ccruntime-sample waits for:
+- the finalizer ` + controllers.RuntimeConfigFinalizer + `, 1 of 2 nodes are labelled katacontainers.io/kata-runtime=cleanup
+    - node worker-1 is Uninstalling: waiting for the uninstall Job
+`))
+	})
+
+	It("waits for the operator once the nodes are uninstalled", func() {
+		ccRuntime := deleting(newTestCcRuntime("ccruntime-sample"))
+		ccRuntime.Status.TotalNodesCount = 1
+		p, out := newTestPlugin(ccRuntime, newTestNode("worker-0", uninstalled))
+
+		Expect(p.why(nil)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("- the operator to remove the finalizer " + controllers.RuntimeConfigFinalizer))
+	})
+
+	It("points at the finalizers of other controllers", func() {
+		ccRuntime := deleting(newTestCcRuntime("ccruntime-sample"))
+		ccRuntime.Finalizers = []string{"example.com/backup"}
+		p, out := newTestPlugin(ccRuntime)
+
+		Expect(p.why(nil)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("- the finalizers example.com/backup of other controllers"))
+	})
+})
@@ -0,0 +1,235 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// ArchLabel is the label of the nodes the architectures are keyed on
+const ArchLabel = corev1.LabelArchStable
+
+// archNodes are the nodes running the workloads of an architecture, arch
+// being empty for the nodes using the default images. runtime is their
+// container runtime, when the pods are rendered for each runtime
+type archNodes struct {
+	arch    string
+	runtime string
+	nodes   []corev1.Node
+}
+
+func (r *CcRuntimeReconciler) architecture(arch string) *ccv1beta1.ArchitectureConfig {
+	for i := range r.ccRuntime.Spec.Config.Architectures {
+		if r.ccRuntime.Spec.Config.Architectures[i].Arch == arch {
+			return &r.ccRuntime.Spec.Config.Architectures[i]
+		}
+	}
+	return nil
+}
+
+// archPayloadImage returns the payload image of the architecture, if it has
+// its own
+func (r *CcRuntimeReconciler) archPayloadImage(arch string) string {
+	if config := r.architecture(arch); config != nil {
+		return config.PayloadImage
+	}
+	return ""
+}
+
+// payloadImage returns the payload image installed on the nodes of the
+// architecture
+func (r *CcRuntimeReconciler) payloadImage(arch string) string {
+	if image := r.archPayloadImage(arch); image != "" {
+		return image
+	}
+	return r.ccRuntime.Spec.Config.PayloadImage
+}
+
+// archHookImage returns the image of the hook on the nodes of the
+// architecture, if it has its own
+func (r *CcRuntimeReconciler) archHookImage(arch string, hookName string) string {
+	if config := r.architecture(arch); config != nil {
+		return config.HookImages[hookName]
+	}
+	return ""
+}
+
+// payloadArchs returns the architectures with their own payload image, each
+// installed by its own DaemonSet
+func (r *CcRuntimeReconciler) payloadArchs() []string {
+	var archs []string
+	for _, config := range r.ccRuntime.Spec.Config.Architectures {
+		if config.PayloadImage != "" {
+			archs = append(archs, config.Arch)
+		}
+	}
+	return archs
+}
+
+// daemonsetName returns the name of the DaemonSet of the operation for the
+// nodes of the architecture and the container runtime
+func daemonsetName(operation DaemonOperation, arch string, runtime string) string {
+	name := "cc-operator-daemon-" + string(operation)
+	if arch != "" {
+		name += "-" + arch
+	}
+	if runtime != "" {
+		name += "-" + runtime
+	}
+	return name
+}
+
+// installDaemonsetName returns the name of the DaemonSet installing the
+// payload of the architecture on the nodes running the container runtime
+func installDaemonsetName(arch string, runtime string) string {
+	return daemonsetName(InstallOperation, arch, runtime)
+}
+
+// groupNodesByArch splits the nodes between the architectures that have their
+// own image, and the default group, first, for the other nodes
+func groupNodesByArch(nodes []corev1.Node, ownImage func(arch string) bool) []archNodes {
+	groups := []archNodes{{}}
+	index := map[string]int{}
+	for _, node := range nodes {
+		arch := node.Labels[ArchLabel]
+		if arch == "" || !ownImage(arch) {
+			groups[0].nodes = append(groups[0].nodes, node)
+			continue
+		}
+		i, ok := index[arch]
+		if !ok {
+			i = len(groups)
+			index[arch] = i
+			groups = append(groups, archNodes{arch: arch})
+		}
+		groups[i].nodes = append(groups[i].nodes, node)
+	}
+	return groups
+}
+
+// excludeArchs keeps the pods of the default install DaemonSet off the nodes
+// of the architectures installed by their own DaemonSet
+func excludeArchs(spec *corev1.PodSpec, archs []string) {
+	requireNode(spec, corev1.NodeSelectorRequirement{
+		Key:      ArchLabel,
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   archs,
+	})
+}
+
+// requireNode adds the requirement to the required node affinity of the pod
+// spec, on top of the affinity the pod template overrides may have set
+func requireNode(spec *corev1.PodSpec, requirement corev1.NodeSelectorRequirement) {
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	// The terms are ORed, the requirement has to be part of each of them
+	for i := range selector.NodeSelectorTerms {
+		if !containsRequirement(selector.NodeSelectorTerms[i].MatchExpressions, requirement) {
+			selector.NodeSelectorTerms[i].MatchExpressions = append(selector.NodeSelectorTerms[i].MatchExpressions, requirement)
+		}
+	}
+}
+
+func containsRequirement(requirements []corev1.NodeSelectorRequirement, requirement corev1.NodeSelectorRequirement) bool {
+	for _, r := range requirements {
+		if equality.Semantic.DeepEqual(r, requirement) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteStaleArchDaemonsets deletes the install DaemonSets of the
+// architectures that no longer have their own payload image, and of the
+// container runtimes that no longer have their own configuration
+func (r *CcRuntimeReconciler) deleteStaleArchDaemonsets() error {
+	dss := &appsv1.DaemonSetList{}
+	if err := r.List(context.TODO(), dss, client.InNamespace(r.Namespace)); err != nil {
+		return err
+	}
+
+	desired := map[string]bool{}
+	for _, arch := range append([]string{""}, r.payloadArchs()...) {
+		for _, runtime := range r.installRuntimes() {
+			desired[installDaemonsetName(arch, runtime)] = true
+		}
+	}
+	base := installDaemonsetName("", "")
+	for i := range dss.Items {
+		ds := &dss.Items[i]
+		if (ds.Name != base && !strings.HasPrefix(ds.Name, base+"-")) || desired[ds.Name] || !metav1.IsControlledBy(ds, r.ccRuntime) {
+			continue
+		}
+		r.Log.Info("Deleting the installation Daemonset of a removed architecture", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
+		if _, err := r.deleteDaemonset(ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateArchitecturesStatus reports the installation progress on the nodes of
+// each architecture
+func (r *CcRuntimeReconciler) updateArchitecturesStatus(nodes *corev1.NodeList) error {
+	byArch := map[string]*ccv1beta1.ArchitectureStatus{}
+	for _, node := range nodes.Items {
+		arch := node.Labels[ArchLabel]
+		status, ok := byArch[arch]
+		if !ok {
+			status = &ccv1beta1.ArchitectureStatus{Arch: arch, PayloadImage: r.payloadImage(arch)}
+			byArch[arch] = status
+		}
+		status.NodesCount++
+		if contains(r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesList, node.Name) {
+			status.CompletedNodesCount++
+		}
+	}
+
+	statuses := make([]ccv1beta1.ArchitectureStatus, 0, len(byArch))
+	for _, status := range byArch {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Arch < statuses[j].Arch })
+
+	if equality.Semantic.DeepEqual(statuses, r.ccRuntime.Status.Architectures) {
+		return nil
+	}
+	r.ccRuntime.Status.Architectures = statuses
+	return r.updateCcRuntimeStatus()
+}
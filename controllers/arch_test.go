@@ -0,0 +1,214 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Architectures", func() {
+	const (
+		s390xPayloadImage = "quay.io/kata-containers/kata-deploy:3.23.0-s390x"
+		s390xHookImage    = "quay.io/coco/smoke-test:latest-s390x"
+	)
+
+	It("groups the nodes of the architectures with their own image", func() {
+		nodes := []corev1.Node{
+			testNode("amd64", map[string]string{ArchLabel: "amd64"}),
+			testNode("s390x-1", map[string]string{ArchLabel: "s390x"}),
+			testNode("unlabelled", nil),
+			testNode("s390x-2", map[string]string{ArchLabel: "s390x"}),
+			testNode("arm64", map[string]string{ArchLabel: "arm64"}),
+		}
+		groups := groupNodesByArch(nodes, func(arch string) bool { return arch == "s390x" })
+
+		names := func(nodes []corev1.Node) []string {
+			var names []string
+			for _, node := range nodes {
+				names = append(names, node.Name)
+			}
+			return names
+		}
+		Expect(groups).To(HaveLen(2))
+		Expect(groups[0].arch).To(BeEmpty())
+		Expect(names(groups[0].nodes)).To(Equal([]string{"amd64", "unlabelled", "arm64"}))
+		Expect(groups[1].arch).To(Equal("s390x"))
+		Expect(names(groups[1].nodes)).To(Equal([]string{"s390x-1", "s390x-2"}))
+	})
+
+	DescribeTable("naming the DaemonSets",
+		func(arch, runtime, want string) {
+			Expect(daemonsetName(InstallOperation, arch, runtime)).To(Equal(want))
+		},
+		Entry("default", "", "", "cc-operator-daemon-install"),
+		Entry("architecture", "s390x", "", "cc-operator-daemon-install-s390x"),
+		Entry("architecture and container runtime", "s390x", "crio", "cc-operator-daemon-install-s390x-crio"),
+	)
+
+	DescribeTable("validating the hook images",
+		func(hookImages map[string]string, want string) {
+			config := &ccv1beta1.CcInstallConfig{
+				PreInstall:    ccv1beta1.PreInstallConfig{Image: "quay.io/confidential-containers/reqs-payload:latest"},
+				Hooks:         []ccv1beta1.HookConfig{{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage}},
+				Architectures: []ccv1beta1.ArchitectureConfig{{Arch: "s390x", HookImages: hookImages}},
+			}
+			err := config.ValidateArchitectures()
+			if want == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(want))
+		},
+		Entry("configured hooks", map[string]string{"pre-install": "reqs-payload:s390x", "smoke-test": "smoke:s390x"}, ""),
+		Entry("unknown hook", map[string]string{"post-uninstall": "reqs-payload:s390x"},
+			"architectures s390x: hookImages references the unknown hook post-uninstall"),
+		Entry("empty image", map[string]string{"smoke-test": ""},
+			"architectures s390x: hookImages has an empty image for hook smoke-test"),
+	)
+
+	Context("on the nodes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			labels    map[string]string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("arch"))
+			ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+				{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+			}
+			ccRuntime.Spec.Config.Architectures = []ccv1beta1.ArchitectureConfig{{
+				Arch:         "s390x",
+				PayloadImage: s390xPayloadImage,
+				HookImages:   map[string]string{"smoke-test": s390xHookImage},
+			}}
+			labels = selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+			r, _ = newTestReconciler(ccRuntime)
+		})
+
+		createNode := func(arch string, extra map[string]string) string {
+			name := uniqueName("arch-" + arch)
+			nodeLabels := map[string]string{ArchLabel: arch}
+			for _, set := range []map[string]string{labels, extra} {
+				for k, v := range set {
+					nodeLabels[k] = v
+				}
+			}
+			createTestNode(name, nodeLabels)
+			return name
+		}
+
+		It("installs the architecture with its own DaemonSet", func() {
+			ds, err := r.processDaemonset(InstallOperation, "s390x", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Name).To(Equal("cc-operator-daemon-install-s390x"))
+			Expect(ds.Spec.Template.Spec.Containers[0].Image).To(Equal(s390xPayloadImage))
+			Expect(ds.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue(ArchLabel, "s390x"))
+			Expect(ds.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue(testNodeLabel, ccRuntime.Name))
+
+			ds, err = r.processDaemonset(InstallOperation, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Spec.Template.Spec.Containers[0].Image).To(Equal(ccRuntime.Spec.Config.PayloadImage))
+			terms := ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			Expect(terms).To(ConsistOf(HaveField("MatchExpressions", ConsistOf(corev1.NodeSelectorRequirement{
+				Key: ArchLabel, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"s390x"},
+			}))))
+		})
+
+		It("runs the hooks with the image of the node architecture", func() {
+			ccRuntime.Status.TotalNodesCount = 2
+			amd64 := createNode("amd64", nil)
+			s390x := createNode("s390x", nil)
+
+			hook := &r.hooks(ccv1beta1.PostInstallHookStage)[0]
+			done, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+
+			job, err := getNodeJob(hook.operation, amd64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("quay.io/coco/smoke-test:latest"))
+			job, err = getNodeJob(hook.operation, s390x)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal(s390xHookImage))
+		})
+
+		It("uninstalls each node with the payload image of its architecture", func() {
+			uninstalling := map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]}
+			amd64 := createNode("amd64", uninstalling)
+			s390x := createNode("s390x", uninstalling)
+
+			nodes, err := r.getNodesWithLabels(labels)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = r.runUninstallNodeJobs(nodes.Items)
+			Expect(err).NotTo(HaveOccurred())
+
+			job, err := getNodeJob(string(UninstallOperation), amd64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal(ccRuntime.Spec.Config.PayloadImage))
+			job, err = getNodeJob(string(UninstallOperation), s390x)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal(s390xPayloadImage))
+		})
+
+		It("reports the progress per architecture", func() {
+			amd64 := createNode("amd64", nil)
+			createNode("s390x", nil)
+			createNode("s390x", nil)
+			ccRuntime.Status.InstallationStatus.Completed.CompletedNodesList = []string{amd64}
+
+			nodes, err := r.getNodesWithLabels(labels)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.updateArchitecturesStatus(nodes)).To(Succeed())
+			Expect(getCcRuntime(ccRuntime.Name).Status.Architectures).To(Equal([]ccv1beta1.ArchitectureStatus{
+				{Arch: "amd64", PayloadImage: ccRuntime.Spec.Config.PayloadImage, NodesCount: 1, CompletedNodesCount: 1},
+				{Arch: "s390x", PayloadImage: s390xPayloadImage, NodesCount: 2},
+			}))
+		})
+
+		It("deletes the DaemonSet of an architecture without its own image", func() {
+			ds, err := r.processDaemonset(InstallOperation, "s390x", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(controllerutil.SetControllerReference(ccRuntime, ds, r.Scheme)).To(Succeed())
+			ds.Namespace = testNamespace
+			Expect(k8sClient.Create(context.TODO(), ds)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(context.TODO(), ds)
+			})
+
+			Expect(r.deleteStaleArchDaemonsets()).To(Succeed())
+			Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(ds), &appsv1.DaemonSet{})).To(Succeed())
+
+			ccRuntime.Spec.Config.Architectures[0].PayloadImage = ""
+			Expect(r.deleteStaleArchDaemonsets()).To(Succeed())
+			err = k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(ds), &appsv1.DaemonSet{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+})
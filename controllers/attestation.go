@@ -0,0 +1,220 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// AttestationMountPath is where the rendered attestation configuration is mounted in the installer pods
+	AttestationMountPath = "/etc/cc-operator/attestation"
+
+	// attestationCACertKey is the key of the rendered ConfigMap holding the KBS CA certificate
+	attestationCACertKey = "kbs-ca.crt"
+
+	attestationVolumeName = "cc-operator-attestation"
+)
+
+// defaultInitData renders the initdata pointing the attestation agent and the
+// confidential data hub of the guest at the KBS
+func defaultInitData(kbsURL, caCert string) string {
+	certLine := ""
+	kbsCertLine := ""
+	if caCert = strings.TrimSpace(caCert); caCert != "" {
+		certLine = fmt.Sprintf("cert = \"\"\"\n%s\n\"\"\"\n", caCert)
+		kbsCertLine = fmt.Sprintf("kbs_cert = \"\"\"\n%s\n\"\"\"\n", caCert)
+	}
+
+	return fmt.Sprintf(`algorithm = "sha384"
+version = "0.1.0"
+
+[data]
+"aa.toml" = '''
+[token_configs]
+[token_configs.kbs]
+url = "%[1]s"
+%[2]s'''
+
+"cdh.toml" = '''
+socket = 'unix:///run/confidential-containers/cdh.sock'
+credentials = []
+
+[kbc]
+name = "cc_kbc"
+url = "%[1]s"
+%[3]s'''
+`, kbsURL, certLine, kbsCertLine)
+}
+
+func (r *CcRuntimeReconciler) attestationConfigMapName() string {
+	return "cc-operator-attestation-" + r.ccRuntime.Name
+}
+
+// readKbsCACert reads and checks the PEM encoded CA certificate of the KBS
+func (r *CcRuntimeReconciler) readKbsCACert(ref *corev1.SecretKeySelector) (string, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: r.Namespace}, secret); err != nil {
+		return "", fmt.Errorf("failed to get the KBS CA certificate Secret %s: %w", ref.Name, err)
+	}
+	data, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no key %s", ref.Name, ref.Key)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("key %s of Secret %s is not a PEM encoded certificate", ref.Key, ref.Name)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return "", fmt.Errorf("key %s of Secret %s: %w", ref.Key, ref.Name, err)
+	}
+	return string(data), nil
+}
+
+// renderAttestationConfig returns the initdata of each runtime class, keyed by
+// shim, and the KBS CA certificate
+func (r *CcRuntimeReconciler) renderAttestationConfig() (map[string]string, error) {
+	attestation := r.ccRuntime.Spec.Attestation
+	if err := attestation.Validate(r.ccRuntime.Spec.Config.RuntimeClasses); err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{}
+	caCert := ""
+	if attestation.KbsCACertSecretRef != nil {
+		var err error
+		caCert, err = r.readKbsCACert(attestation.KbsCACertSecretRef)
+		if err != nil {
+			return nil, err
+		}
+		data[attestationCACertKey] = caCert
+	}
+
+	overrides := map[string]string{}
+	for _, rc := range attestation.RuntimeClasses {
+		overrides[rc.Name] = rc.InitData
+	}
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		initData, ok := overrides[runtimeClass.Name]
+		if !ok {
+			initData = defaultInitData(attestation.KbsURL, caCert)
+		}
+		data[strings.TrimPrefix(runtimeClass.Name, "kata-")+".toml"] = initData
+	}
+	return data, nil
+}
+
+// reconcileAttestation validates spec.attestation and renders it into a
+// ConfigMap mounted by the installer pods. The hash of the rendered
+// configuration is set on the pod templates, so a change rolls out.
+func (r *CcRuntimeReconciler) reconcileAttestation() error {
+	r.attestationHash = ""
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: r.attestationConfigMapName(), Namespace: r.Namespace},
+	}
+
+	if r.ccRuntime.Spec.Attestation == nil {
+		if err := r.Delete(context.TODO(), configMap); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, AttestationConfigValidCondition) {
+			return r.updateCcRuntimeStatus()
+		}
+		return nil
+	}
+
+	data, err := r.renderAttestationConfig()
+	if err == nil {
+		_, err = controllerutil.CreateOrUpdate(context.TODO(), r.Client, configMap, func() error {
+			configMap.Data = data
+			return controllerutil.SetControllerReference(r.ccRuntime, configMap, r.Scheme)
+		})
+	}
+	if err == nil {
+		r.attestationHash, err = hashObject(data)
+	}
+	return r.setConditionFromError(metav1.Condition{
+		Type:    AttestationConfigValidCondition,
+		Reason:  "Valid",
+		Message: "The attestation configuration is rendered in ConfigMap " + configMap.Name,
+	}, "InvalidAttestationConfig", err)
+}
+
+// addAttestationConfig passes the rendered attestation configuration to the
+// first container of the pod template:
+//   - KBS_URL is the URL of the KBS
+//   - KBS_CA_CERT_FILE is the path of the KBS CA certificate, if any
+//   - INITDATA_MAPPING maps each shim to the path of its default initdata, as
+//     shim:path pairs separated by commas
+func (r *CcRuntimeReconciler) addAttestationConfig(template *corev1.PodTemplateSpec) {
+	attestation := r.ccRuntime.Spec.Attestation
+	if attestation == nil {
+		return
+	}
+
+	var initDataMapping []string
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		shim := strings.TrimPrefix(runtimeClass.Name, "kata-")
+		initDataMapping = append(initDataMapping, shim+":"+path.Join(AttestationMountPath, shim+".toml"))
+	}
+	sort.Strings(initDataMapping)
+
+	container := &template.Spec.Containers[0]
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "KBS_URL", Value: attestation.KbsURL},
+		corev1.EnvVar{Name: "INITDATA_MAPPING", Value: strings.Join(initDataMapping, ",")},
+	)
+	if attestation.KbsCACertSecretRef != nil {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "KBS_CA_CERT_FILE",
+			Value: path.Join(AttestationMountPath, attestationCACertKey),
+		})
+	}
+
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: attestationVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.attestationConfigMapName()},
+			},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      attestationVolumeName,
+		MountPath: AttestationMountPath,
+		ReadOnly:  true,
+	})
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[AttestationHashAnnotation] = r.attestationHash
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// kbsCACertPEM returns a self signed CA certificate
+func kbsCACertPEM() string {
+	key := newTestKey()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kbs-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return certificatePEM(cert)
+}
+
+var _ = Describe("Attestation configuration", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+		secret    *corev1.Secret
+		caCert    string
+	)
+
+	BeforeEach(func() {
+		caCert = kbsCACertPEM()
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: uniqueName("kbs-ca"), Namespace: testNamespace},
+			Data:       map[string][]byte{"ca.crt": []byte(caCert), "invalid": []byte("not a certificate")},
+		}
+		Expect(k8sClient.Create(context.TODO(), secret)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, context.TODO(), secret)
+
+		ccRuntime = newTestCcRuntime(uniqueName("attestation"))
+		ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{
+			{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull"},
+			{Name: "kata-qemu-snp", Snapshotter: "nydus", PullType: "guest-pull"},
+		}
+		ccRuntime.Spec.Attestation = &ccv1beta1.AttestationConfig{
+			KbsURL: "https://kbs.example.com:8080",
+			KbsCACertSecretRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name}, Key: "ca.crt",
+			},
+			RuntimeClasses: []ccv1beta1.AttestationRuntimeClassConfig{
+				{Name: "kata-qemu-snp", InitData: "version = \"0.1.0\"\n"},
+			},
+		}
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+	})
+
+	getConfigMap := func() (*corev1.ConfigMap, error) {
+		configMap := &corev1.ConfigMap{}
+		err := k8sClient.Get(context.TODO(),
+			client.ObjectKey{Name: r.attestationConfigMapName(), Namespace: testNamespace}, configMap)
+		return configMap, err
+	}
+
+	validCondition := func() *metav1.Condition {
+		return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, AttestationConfigValidCondition)
+	}
+
+	It("renders the initdata of each runtime class into a ConfigMap owned by the CcRuntime", func() {
+		Expect(r.reconcileAttestation()).To(Succeed())
+		Expect(validCondition()).To(HaveField("Status", metav1.ConditionTrue))
+
+		configMap, err := getConfigMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMap.OwnerReferences).To(ConsistOf(And(
+			HaveField("Name", ccRuntime.Name), HaveField("Controller", HaveValue(BeTrue())))))
+		Expect(configMap.Data).To(Equal(map[string]string{
+			attestationCACertKey: caCert,
+			"qemu-tdx.toml":      defaultInitData("https://kbs.example.com:8080", caCert),
+			"qemu-snp.toml":      "version = \"0.1.0\"\n",
+		}))
+		Expect(configMap.Data["qemu-tdx.toml"]).To(And(
+			ContainSubstring(`url = "https://kbs.example.com:8080"`),
+			ContainSubstring("kbs_cert = \"\"\"\n-----BEGIN CERTIFICATE-----")))
+	})
+
+	It("passes the configuration to the install pods", func() {
+		Expect(r.reconcileAttestation()).To(Succeed())
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		container := ds.Spec.Template.Spec.Containers[0]
+		Expect(container.Env).To(ContainElements(
+			corev1.EnvVar{Name: "KBS_URL", Value: "https://kbs.example.com:8080"},
+			corev1.EnvVar{Name: "INITDATA_MAPPING",
+				Value: "qemu-snp:" + AttestationMountPath + "/qemu-snp.toml," +
+					"qemu-tdx:" + AttestationMountPath + "/qemu-tdx.toml"},
+			corev1.EnvVar{Name: "KBS_CA_CERT_FILE", Value: AttestationMountPath + "/" + attestationCACertKey},
+		))
+		Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name: attestationVolumeName, MountPath: AttestationMountPath, ReadOnly: true,
+		}))
+		Expect(ds.Spec.Template.Spec.Volumes).To(ContainElement(
+			HaveField("VolumeSource.ConfigMap.Name", r.attestationConfigMapName())))
+		Expect(ds.Spec.Template.Annotations).To(HaveKeyWithValue(AttestationHashAnnotation, r.attestationHash))
+	})
+
+	It("rolls the change of the KBS out", func() {
+		Expect(r.reconcileAttestation()).To(Succeed())
+		hash := r.attestationHash
+		Expect(hash).NotTo(BeEmpty())
+
+		ccRuntime.Spec.Attestation.KbsURL = "https://kbs.example.org"
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+		Expect(r.reconcileAttestation()).To(Succeed())
+		Expect(r.attestationHash).NotTo(Equal(hash))
+		configMap, err := getConfigMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMap.Data["qemu-tdx.toml"]).To(ContainSubstring(`url = "https://kbs.example.org"`))
+	})
+
+	DescribeTable("rejecting invalid configurations",
+		func(change func(*ccv1beta1.AttestationConfig), want string) {
+			change(ccRuntime.Spec.Attestation)
+			r, recorder := newTestReconciler(ccRuntime)
+
+			Expect(r.reconcileAttestation()).To(MatchError(ContainSubstring(want)))
+			Expect(r.attestationHash).To(BeEmpty())
+			condition := validCondition()
+			Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("InvalidAttestationConfig"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("InvalidAttestationConfig")))
+			_, err := getConfigMap()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		},
+		Entry("certificate over http", func(a *ccv1beta1.AttestationConfig) {
+			a.KbsURL = "http://kbs.example.com"
+		}, "doesn't use https"),
+		Entry("no host", func(a *ccv1beta1.AttestationConfig) {
+			a.KbsURL = "https://"
+		}, "expected http(s)://host[:port]"),
+		Entry("unknown runtime class", func(a *ccv1beta1.AttestationConfig) {
+			a.RuntimeClasses[0].Name = "kata-clh"
+		}, `attestation runtime class "kata-clh" is not one of spec.config.runtimeClasses`),
+		Entry("missing Secret", func(a *ccv1beta1.AttestationConfig) {
+			a.KbsCACertSecretRef.Name = "missing"
+		}, "failed to get the KBS CA certificate Secret missing"),
+		Entry("missing key", func(a *ccv1beta1.AttestationConfig) {
+			a.KbsCACertSecretRef.Key = "tls.crt"
+		}, "has no key tls.crt"),
+		Entry("not a certificate", func(a *ccv1beta1.AttestationConfig) {
+			a.KbsCACertSecretRef.Key = "invalid"
+		}, "is not a PEM encoded certificate"),
+	)
+
+	It("deletes the ConfigMap and the condition without spec.attestation", func() {
+		Expect(r.reconcileAttestation()).To(Succeed())
+		ccRuntime.Spec.Attestation = nil
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+		Expect(r.reconcileAttestation()).To(Succeed())
+		_, err := getConfigMap()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(validCondition()).To(BeNil())
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.Containers[0].Env).NotTo(ContainElement(HaveField("Name", "KBS_URL")))
+	})
+
+	It("renders the initdata without a CA certificate", func() {
+		initData := defaultInitData("http://kbs.example.com", "")
+		Expect(initData).To(ContainSubstring(`url = "http://kbs.example.com"`))
+		Expect(initData).NotTo(ContainSubstring("cert ="))
+	})
+})
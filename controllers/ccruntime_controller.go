@@ -23,14 +23,13 @@ import (
 	"strings"
 	"time"
 
-	"k8s.io/client-go/kubernetes"
-	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	nodeapi "k8s.io/api/node/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -53,17 +52,59 @@ type CcRuntimeReconciler struct {
 	client.Client
 	Scheme    *runtime.Scheme
 	Log       logr.Logger
+	Recorder  record.EventRecorder
 	ccRuntime *ccv1beta1.CcRuntime
 	Namespace string
+
+	// ImageResolver resolves the image tags to digests when PinImageDigests is set
+	ImageResolver ImageResolver
+
+	// ImageVerifier verifies the image signatures when ImageVerification is set
+	ImageVerifier ImageVerifier
+
+	// ImageRewriteRules map source registries to mirrors for all the rendered images
+	ImageRewriteRules []ImageRewriteRule
+
+	// LabelNamespace allows privileged pods in Namespace while CcRuntimes exist
+	LabelNamespace bool
+
+	// PeerPodsNamespace holds the PeerPodConfigs, and the ConfigMaps and Secrets of spec.peerPods
+	PeerPodsNamespace string
+
+	// PeerPodsControllers runs the peer pods controllers while CcRuntimes configure peer pods
+	PeerPodsControllers *PeerPodsControllers
+
+	// writtenSpec is the spec written by the user when the one of ccRuntime is merged with a profile, see resolveProfile
+	writtenSpec *ccv1beta1.CcRuntimeSpec
+
+	// payloadConfigHash is the hash of the configFrom values, see resolvePayloadConfig
+	payloadConfigHash string
+
+	// attestationHash is the hash of the rendered attestation configuration, see reconcileAttestation
+	attestationHash string
+
+	// agentPolicies are the digests of the agent policies distributed to the
+	// install pods, and agentPoliciesHash their hash, see reconcileAgentPolicies
+	agentPolicies     []ccv1beta1.AgentPolicyStatus
+	agentPoliciesHash string
 }
 
 //+kubebuilder:rbac:groups=confidentialcontainers.org,resources=ccruntimes,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=confidentialcontainers.org,resources=ccruntimes/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=confidentialcontainers.org,resources=ccruntimes/finalizers,verbs=update
+//+kubebuilder:rbac:groups=confidentialcontainers.org,resources=peerpodconfigs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;patch;update
 //+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;create;delete;update;patch
+//+kubebuilder:rbac:groups=apps,namespace=system,resources=controllerrevisions,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete;deletecollection
 //+kubebuilder:rbac:groups=node.k8s.io,resources=runtimeclasses,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",namespace=system,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -87,23 +128,49 @@ func (r *CcRuntimeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
-			return ctrl.Result{}, nil
+			return ctrl.Result{}, r.restoreNamespaceLabels()
 		}
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
 	}
-	// Create the uninstall DaemonSet
-	ds := r.processDaemonset(UninstallOperation)
-	if err := controllerutil.SetControllerReference(r.ccRuntime, ds, r.Scheme); err != nil {
-		r.Log.Error(err, "Failed setting ControllerReference for uninstall DS")
+
+	// The whole reconciliation, including the uninstallation, works on the
+	// configuration merged with the profile
+	if err := r.resolveProfile(); err != nil {
 		return ctrl.Result{}, err
 	}
-	foundDs := &appsv1.DaemonSet{}
-	err = r.Get(context.TODO(), types.NamespacedName{Name: ds.Name, Namespace: ds.Namespace}, foundDs)
-	if err != nil && errors.IsNotFound(err) {
-		r.Log.Info("Creating cleanup Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
-		err = r.Create(context.TODO(), ds)
-		if err != nil {
+
+	// Resolve the images before rendering any DaemonSet. On deletion the images
+	// resolved for the installation are used.
+	if r.ccRuntime.GetDeletionTimestamp() == nil {
+		if err := r.resolveImages(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.validatePodTemplateOverrides(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reportInstallerPrivileges(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.validatePreInstallConfig(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.resolvePayloadConfig(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileAttestation(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileAgentPolicies(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcilePeerPods(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcilePayloadServiceAccount(); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.labelNamespace(); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
@@ -121,40 +188,24 @@ func (r *CcRuntimeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 	}
 
-	return r.processCcRuntimeInstallRequest()
-}
-
-func (r *CcRuntimeReconciler) getNodeClient() (v1.NodeInterface, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
+	if revision, ok := r.ccRuntime.Annotations[RollbackToRevisionAnnotation]; ok {
+		return r.processRollbackRequest(revision)
 	}
 
-	nodeClient := clientset.CoreV1().Nodes()
-	return nodeClient, err
+	return r.processCcRuntimeInstallRequest()
 }
 
 // This function sets the StartUninstallLabel on all nodes that completed
 // the ccruntime install (have InstallDoneLabel set), which is used by
-// the uninstall DS
+// the uninstall Jobs
 func (r *CcRuntimeReconciler) setCleanupNodeLabels() (ctrl.Result, error) {
 	var nodesList = &corev1.NodeList{}
-	nodesClient, err := r.getNodeClient()
-	if err != nil {
-		r.Log.Info("Couldn't get nodes client")
-		return ctrl.Result{}, err
-	}
 
 	listOpts := []client.ListOption{
 		client.MatchingLabels(r.ccRuntime.Spec.Config.InstallDoneLabel),
 	}
 
-	err = r.List(context.TODO(), nodesList, listOpts...)
+	err := r.List(context.TODO(), nodesList, listOpts...)
 	if err != nil {
 		r.Log.Info("failed to list nodes during uninstallation status update")
 		return ctrl.Result{}, err
@@ -172,12 +223,7 @@ func (r *CcRuntimeReconciler) setCleanupNodeLabels() (ctrl.Result, error) {
 		labels := node.GetLabels()
 		if val, exists := labels[installDoneLabel[0]]; exists && val == "true" {
 			labels[StartUninstallLabel[0]] = StartUninstallLabel[1]
-			_, err := nodesClient.Update(context.TODO(), &node, metav1.UpdateOptions{
-				TypeMeta:     metav1.TypeMeta{},
-				DryRun:       nil,
-				FieldManager: "",
-			})
-			if err != nil {
+			if err := r.Update(context.TODO(), &node); err != nil {
 				r.Log.Info("failed to update node labels")
 				return ctrl.Result{}, err
 			}
@@ -187,25 +233,8 @@ func (r *CcRuntimeReconciler) setCleanupNodeLabels() (ctrl.Result, error) {
 }
 
 func (r *CcRuntimeReconciler) processCcRuntimeDeleteRequest() (ctrl.Result, error) {
-	// Create the uninstall DaemonSet
-	ds := r.processDaemonset(UninstallOperation)
-	if err := controllerutil.SetControllerReference(r.ccRuntime, ds, r.Scheme); err != nil {
-		r.Log.Error(err, "Failed setting ControllerReference for uninstall DS")
-		return ctrl.Result{}, err
-	}
-	foundDs := &appsv1.DaemonSet{}
-	err := r.Get(context.TODO(), types.NamespacedName{Name: ds.Name, Namespace: ds.Namespace}, foundDs)
-	if err != nil && errors.IsNotFound(err) {
-		r.Log.Info("Creating cleanup Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
-		err = r.Create(context.TODO(), ds)
-	}
-
-	if err != nil {
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
-	}
-
 	if !contains(r.ccRuntime.GetFinalizers(), RuntimeConfigFinalizer) {
-		return ctrl.Result{}, err
+		return ctrl.Result{}, nil
 	}
 
 	return handleFinalizers(r)
@@ -215,66 +244,56 @@ func handleFinalizers(r *CcRuntimeReconciler) (ctrl.Result, error) {
 	var result = ctrl.Result{}
 
 	// Check for nodes with label set by install DS prestop hook.
-	// If no nodes exist then remove finalizer and reconcile
-	nodes, err := r.getNodesWithLabels(r.ccRuntime.Spec.Config.UninstallDoneLabel)
+	// If no nodes exist then remove finalizer and reconcile. The hooks wait
+	// for the nodes counted here too
+	finishedNodes, err := r.countUninstalledNodes()
 	if err != nil {
-		r.Log.Error(err, "Error in getting list of nodes with uninstallDoneLabel")
+		r.Log.Error(err, "Error in counting the nodes with uninstallDoneLabel")
 		return ctrl.Result{}, err
 	}
 
-	finishedNodes := len(nodes.Items)
+	done, result, err := r.runHooks(ccv1beta1.PreUninstallHookStage)
+	if !done || err != nil {
+		return result, err
+	}
 
 	if allNodesDone(finishedNodes, r) {
-		if r.ccRuntime.Spec.Config.PostUninstall.Image == "" {
-			controllerutil.RemoveFinalizer(r.ccRuntime, RuntimeConfigFinalizer)
-
-			if err != nil {
-				return result, err
-			}
-
-			return r.updateCcRuntime()
+		done, result, err := r.runHooks(ccv1beta1.PostUninstallHookStage)
+		if !done || err != nil {
+			return result, err
 		}
 
-		result, err = handlePostUninstall(r)
-		if !result.Requeue {
-			controllerutil.RemoveFinalizer(r.ccRuntime, RuntimeConfigFinalizer)
-			result, err = r.updateCcRuntime()
-			if err != nil {
-				return result, err
-			}
-			result, err = r.deleteUninstallDaemonsets()
-			prepostLabels := map[string]string{}
-			if r.ccRuntime.Spec.Config.PreInstall.Image != "" {
-				prepostLabels[PreInstallDoneLabel[0]] = PreInstallDoneLabel[1]
-			}
-			if r.ccRuntime.Spec.Config.PostUninstall.Image != "" {
-				prepostLabels[PostUninstallDoneLabel[0]] = PostUninstallDoneLabel[1]
-
-			}
-			nodes, err := r.getNodesWithLabels(prepostLabels)
-			if err != nil {
-				r.Log.Error(err, "an error occured when getting the list of nodes from which we want to"+
-					"remove preinstall/postuninstall labels")
-				return ctrl.Result{}, err
-			}
-
-			postuninstalledNodes := len(nodes.Items)
-			if !allNodesDone(postuninstalledNodes, r) {
-				return ctrl.Result{Requeue: true}, nil
-			}
+		if err := r.restoreNamespaceLabels(); err != nil {
+			r.Log.Info("failed to restore the namespace labels")
+			return ctrl.Result{}, err
+		}
 
-			if postuninstalledNodes > 0 {
-				result, err = r.removeNodeLabels(nodes)
-				if err != nil {
-					r.Log.Error(err, "removing the labels from nodes failed")
-					return ctrl.Result{}, err
-				}
-			}
+		controllerutil.RemoveFinalizer(r.ccRuntime, RuntimeConfigFinalizer)
+		result, err = r.updateCcRuntime()
+		if err != nil {
+			return result, err
 		}
+		result, err = r.deleteNodeWorkloads()
 		if err != nil {
 			return result, err
 		}
-		return r.updateCcRuntime()
+
+		nodes, _, err := r.getAllNodes()
+		if err != nil {
+			r.Log.Error(err, "an error occured when getting the list of nodes from which we want to"+
+				"remove the hook labels")
+			return ctrl.Result{}, err
+		}
+		// The nodes that left the selection before they were uninstalled too
+		for _, name := range r.ccRuntime.Status.DepartedNodes {
+			node := corev1.Node{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Name: name}, &node); err == nil {
+				nodes.Items = append(nodes.Items, node)
+			} else if !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+		}
+		return r.removeNodeLabels(nodes)
 	}
 
 	result, err = r.setCleanupNodeLabels()
@@ -283,6 +302,12 @@ func handleFinalizers(r *CcRuntimeReconciler) (ctrl.Result, error) {
 		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 5}, err
 	}
 
+	err = r.runUninstallJobs()
+	if err != nil {
+		r.Log.Error(err, "running the uninstall Jobs failed")
+		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 5}, err
+	}
+
 	result, err = r.updateUninstallationStatus(finishedNodes)
 	if err != nil {
 		r.Log.Info("Error from updateUninstallationStatus")
@@ -293,13 +318,28 @@ func handleFinalizers(r *CcRuntimeReconciler) (ctrl.Result, error) {
 	return result, err
 }
 
-func (r *CcRuntimeReconciler) updateCcRuntime() (ctrl.Result, error) {
-	err := r.Update(context.TODO(), r.ccRuntime)
+// countUninstalledNodes counts the selected nodes the runtime is uninstalled
+// from, the ones it was installed on, as TotalNodesCount, and returns how many
+// of them report the uninstallation is done
+func (r *CcRuntimeReconciler) countUninstalledNodes() (int, error) {
+	nodes, _, err := r.getInstalledNodes()
 	if err != nil {
-		r.Log.Error(err, "failed to update ccRuntime")
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
+		return 0, err
+	}
+	total, finished := 0, 0
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !r.uninstallPending(node) {
+			finished++
+		} else if !hasNodeLabels(node, r.ccRuntime.Spec.Config.InstallDoneLabel) &&
+			node.Labels[StartUninstallLabel[0]] != StartUninstallLabel[1] {
+			// Nothing was installed on the node
+			continue
+		}
+		total++
 	}
-	return ctrl.Result{}, nil
+	r.ccRuntime.Status.TotalNodesCount = total
+	return finished, nil
 }
 
 func allNodesDone(finishedNodes int, r *CcRuntimeReconciler) bool {
@@ -322,7 +362,7 @@ func (r *CcRuntimeReconciler) updateUninstallationStatus(finishedNodes int) (ctr
 		doneNodes = append(doneNodes, cleanupNodes.Items[i].Name)
 	}
 	r.ccRuntime.Status.UnInstallationStatus.InProgress.BinariesUnInstalledNodesList = doneNodes
-	err = r.Update(context.TODO(), r.ccRuntime)
+	_, err = r.updateCcRuntime()
 	if err != nil {
 		r.Log.Error(err, "failed to update ccRuntime with finalizer")
 		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 5}, err
@@ -330,32 +370,6 @@ func (r *CcRuntimeReconciler) updateUninstallationStatus(finishedNodes int) (ctr
 	return ctrl.Result{}, nil
 }
 
-func handlePostUninstall(r *CcRuntimeReconciler) (ctrl.Result, error) {
-	postUninstallDoneLabel := map[string]string{PostUninstallDoneLabel[0]: PostUninstallDoneLabel[1]}
-	nodes, err := r.getNodesWithLabels(postUninstallDoneLabel)
-	if err != nil {
-		r.Log.Info("couldn't get nodes labeled with postuninstall done label")
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
-	}
-
-	if r.ccRuntime.Spec.Config.PostUninstall.Image != "" &&
-		len(nodes.Items) < r.ccRuntime.Status.TotalNodesCount &&
-		r.ccRuntime.Status.TotalNodesCount > 0 {
-		postUninstallDs := r.makeHookDaemonset(PostUninstallOperation)
-		// get daemonset
-		res, err := r.handlePrePostDs(postUninstallDs, postUninstallDoneLabel)
-		if res.Requeue {
-			if err != nil {
-				r.Log.Info("error from handlePrePostDs")
-			}
-		}
-		return res, err
-	} else if len(nodes.Items) == r.ccRuntime.Status.TotalNodesCount {
-		return ctrl.Result{}, nil
-	}
-	return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
-}
-
 func (r *CcRuntimeReconciler) processCcRuntimeInstallRequest() (ctrl.Result, error) {
 	nodesList := &corev1.NodeList{}
 	r.Log.Info("processCcRuntimeInstallRequest")
@@ -374,6 +388,9 @@ func (r *CcRuntimeReconciler) processCcRuntimeInstallRequest() (ctrl.Result, err
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	if err := r.reconcileNodeMembership(nodesList.Items); err != nil {
+		return ctrl.Result{}, err
+	}
 	r.ccRuntime.Status.TotalNodesCount = len(nodesList.Items)
 
 	if r.ccRuntime.Status.TotalNodesCount == 0 {
@@ -386,98 +403,154 @@ func (r *CcRuntimeReconciler) processCcRuntimeInstallRequest() (ctrl.Result, err
 			fmt.Errorf("PayloadImage must be specified to download the runtime binaries")
 	}
 
+	done, res, err := r.runPreflight(nodesList.Items)
+	if !done || err != nil {
+		return res, err
+	}
+	r.ccRuntime.Status.TotalNodesCount = len(r.withoutExcludedNodes(nodesList.Items))
+	if r.ccRuntime.Status.TotalNodesCount == 0 {
+		return ctrl.Result{Requeue: true, RequeueAfter: 15 * time.Second},
+			fmt.Errorf("all the selected nodes failed the preflight checks")
+	}
+
+	if err := r.validateContainerRuntimes(r.withoutExcludedNodes(nodesList.Items)); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	r.ccRuntime.Status.RuntimeName = r.ccRuntime.Spec.RuntimeName
 
-	err = r.Client.Status().Update(context.TODO(), r.ccRuntime)
+	err = r.updateCcRuntimeStatus()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	err = r.deleteLegacyDaemonsets()
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	preInstallDoneLabel := map[string]string{PreInstallDoneLabel[0]: PreInstallDoneLabel[1]}
+	done, res, err = r.runHooks(ccv1beta1.PreInstallHookStage)
+	if !done || err != nil {
+		r.Log.Info("waiting for the preInstall hooks")
+		return res, err
+	}
 
-	// if ds exists, get all labels
-	nodes, err := r.getNodesWithLabels(preInstallDoneLabel)
+	// The probe, if any, ran as the first preInstall hook
+	nodesList, res, err = r.getInstalledNodes()
 	if err != nil {
-		r.Log.Info("couldn't GET labelled nodes")
+		return res, err
+	}
+	if err := r.labelNodeTees(nodesList); err != nil {
 		return ctrl.Result{}, err
 	}
-	if r.ccRuntime.Spec.Config.PreInstall.Image != "" &&
-		len(nodes.Items) < r.ccRuntime.Status.TotalNodesCount {
-		preInstallDs := r.makeHookDaemonset(PreInstallOperation)
-		r.Log.Info("ds = ", "daemonset", preInstallDs)
-		res, err := r.handlePrePostDs(preInstallDs, preInstallDoneLabel)
-		if res.Requeue {
-			r.Log.Info("requeue request from handlePrePostDs")
-			return res, err
-		}
+	if err := r.labelNodeRuntimes(nodesList); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.updateRuntimeClassNodes(nodesList); err != nil {
+		return ctrl.Result{}, err
 	}
 
-	// Don't create the daemonset if the runtime is already installed on the cluster nodes
-	if r.ccRuntime.Status.TotalNodesCount > 0 &&
-		r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount != r.ccRuntime.Status.TotalNodesCount {
-		ds := r.processDaemonset(InstallOperation)
+	// The nodes of the architectures with their own payload image, and of the
+	// container runtimes with their own configuration, are installed by their
+	// own DaemonSet
+	var dss, installDss, foundDss, changedDss []*appsv1.DaemonSet
+	for _, arch := range append([]string{""}, r.payloadArchs()...) {
+		for _, runtime := range r.installRuntimes() {
+			ds, err := r.processDaemonset(InstallOperation, arch, runtime)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			dss = append(dss, ds)
+		}
+	}
+	for _, ds := range dss {
 		// Set CcRuntime instance as the owner and controller
 		if err := controllerutil.SetControllerReference(r.ccRuntime, ds, r.Scheme); err != nil {
 			r.Log.Error(err, "Failed setting ControllerReference")
 			return ctrl.Result{}, err
 		}
+		installDss = append(installDss, ds)
+
 		foundDs := &appsv1.DaemonSet{}
-		err := r.Get(context.TODO(), types.NamespacedName{Name: ds.Name, Namespace: ds.Namespace}, foundDs)
+		err = r.Get(context.TODO(), types.NamespacedName{Name: ds.Name, Namespace: ds.Namespace}, foundDs)
 		if err != nil && errors.IsNotFound(err) {
-			r.Log.Info("Creating a new installation Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
-			err = r.Create(context.TODO(), ds)
-			if err != nil {
-				return ctrl.Result{}, err
+			// Don't create the daemonset if the runtime is already installed on the cluster nodes
+			if r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount != r.ccRuntime.Status.TotalNodesCount {
+				r.Log.Info("Creating a new installation Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
+				err = r.Create(context.TODO(), ds)
+				if err != nil {
+					return ctrl.Result{}, err
+				}
 			}
 		} else if err != nil {
 			return ctrl.Result{}, err
+		} else if templateHashChanged(foundDs, ds) {
+			foundDss = append(foundDss, foundDs)
+			changedDss = append(changedDss, ds)
+		}
+	}
+
+	if len(changedDss) > 0 {
+		done, res, err := r.runHooks(ccv1beta1.PreUpgradeHookStage)
+		if !done || err != nil {
+			r.Log.Info("waiting for the preUpgrade hooks")
+			return res, err
 		}
+		return r.upgradeInstallDaemonsets(foundDss, changedDss)
+	}
 
+	if err := r.deleteStaleArchDaemonsets(); err != nil {
+		return ctrl.Result{}, err
 	}
-	return r.monitorCcRuntimeInstallation()
+
+	return r.monitorCcRuntimeInstallation(installDss)
 
 }
 
-/*
-This creates DaemonSets for pre-install/post-uninstall unless it already exists.
-We leave the DaemonSets running until the ccRuntime finalizer is called.
-This way the running DaemonSet automatically applies changes when a new
-node is added.
-*/
-func (r *CcRuntimeReconciler) handlePrePostDs(preInstallDs *appsv1.DaemonSet, doneLabel map[string]string) (
-	ctrl.Result, error,
-) {
-	foundPreinstallDs := &appsv1.DaemonSet{}
-	err := r.Get(context.TODO(), types.NamespacedName{Name: preInstallDs.Name, Namespace: preInstallDs.Namespace}, foundPreinstallDs)
-	r.Log.Info("create preinstall/postuninstall DS", "DS", preInstallDs)
-	if err != nil && errors.IsNotFound(err) {
-		err = r.Create(context.TODO(), preInstallDs)
+// upgradeInstallDaemonsets rolls out a changed payload configuration by
+// updating the pod templates of the existing installation DaemonSets
+func (r *CcRuntimeReconciler) upgradeInstallDaemonsets(foundDss, dss []*appsv1.DaemonSet) (ctrl.Result, error) {
+	for i, ds := range dss {
+		r.Log.Info("Updating the installation Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
+		foundDss[i].Spec.Template = ds.Spec.Template
+		err := r.Update(context.TODO(), foundDss[i])
 		if err != nil {
-			r.Log.Info("failed to create preinstall/postuninstall DS", "DS", preInstallDs)
-			return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
+			return ctrl.Result{}, err
 		}
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, nil
-	} else if err != nil {
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
 	}
-	// if ds exists, get all labels
-	nodes, err := r.getNodesWithLabels(doneLabel)
+
+	// The nodes have to report the installation of the new payload again, and
+	// the hooks run again for the next upgrade and against the new payload
+	err := r.resetHooks(ccv1beta1.PreUpgradeHookStage, ccv1beta1.PostInstallHookStage)
 	if err != nil {
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
+		r.Log.Info("failed to reset the preUpgrade and postInstall hooks")
+		return ctrl.Result{}, err
 	}
-	if len(nodes.Items) < r.ccRuntime.Status.TotalNodesCount {
-		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
+	r.ccRuntime.Status.InstallationStatus = ccv1beta1.CcInstallationStatus{}
+	err = r.updateCcRuntimeStatus()
+	if err != nil {
+		r.Log.Info("failed to reset the installation status")
+		return ctrl.Result{}, err
 	}
-
-	return ctrl.Result{}, nil
+	r.recordEvent(corev1.EventTypeNormal, "Upgrading", "Rolling out payload image %s", r.ccRuntime.Spec.Config.PayloadImage)
+	return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, nil
 }
 
-func (r *CcRuntimeReconciler) monitorCcRuntimeInstallation() (ctrl.Result, error) {
+func (r *CcRuntimeReconciler) monitorCcRuntimeInstallation(installDss []*appsv1.DaemonSet) (ctrl.Result, error) {
 	var (
 		err    error
 		result ctrl.Result
 	)
 
+	pods, err := r.currentInstallPods(installDss)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	r.updateFailedNodes(pods)
+	if rolledBack, res, err := r.checkAutomaticRollback(); rolledBack || err != nil {
+		return res, err
+	}
+
 	// If the installation of the binaries is successful on all nodes, proceed with creating the runtime classes
 	if r.allNodesInstalled() {
 		// Update runtimeClass field
@@ -493,6 +566,9 @@ func (r *CcRuntimeReconciler) monitorCcRuntimeInstallation() (ctrl.Result, error
 			runtimeClassNames = append(runtimeClassNames, runtimeClass.Name)
 		}
 		r.ccRuntime.Status.RuntimeClass = strings.Join(runtimeClassNames, ",")
+		if err := r.scheduleRuntimeClassesOnTees(); err != nil {
+			return ctrl.Result{}, err
+		}
 
 		// Add finalizer for this CR
 		if !contains(r.ccRuntime.GetFinalizers(), RuntimeConfigFinalizer) {
@@ -503,23 +579,36 @@ func (r *CcRuntimeReconciler) monitorCcRuntimeInstallation() (ctrl.Result, error
 		r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount = len(r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesList)
 		r.ccRuntime.Status.InstallationStatus.InProgress.BinariesInstalledNodesList = []string{}
 		r.ccRuntime.Status.InstallationStatus.InProgress.InProgressNodesCount = 0
+
+		// The payload is only known-good once the postInstall hooks passed
+		done, res, err := r.runHooks(ccv1beta1.PostInstallHookStage)
+		if !done || err != nil {
+			return res, err
+		}
+		if err := r.recordRevision(); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.confirmAgentPolicies()
 	}
 
-	err = r.Client.Status().Update(context.TODO(), r.ccRuntime)
+	err = r.updateCcRuntimeStatus()
 	if err != nil {
 		r.Log.Info("failed to update status while monitoring installation")
 		return ctrl.Result{}, err
 	}
 
-	nodesList, result, err := r.getAllNodes()
+	nodesList, result, err := r.getInstalledNodes()
 	if err != nil {
 		return result, err
 	}
 
-	result, err = r.updateInstallationStatus(nodesList)
+	result, err = r.updateInstallationStatus(nodesList, pods)
 	if err != nil {
 		return result, err
 	}
+	if err := r.updateArchitecturesStatus(nodesList); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	if r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount != r.ccRuntime.Status.TotalNodesCount {
 		return ctrl.Result{Requeue: true}, nil
@@ -527,10 +616,17 @@ func (r *CcRuntimeReconciler) monitorCcRuntimeInstallation() (ctrl.Result, error
 	return ctrl.Result{}, nil
 }
 
-func (r *CcRuntimeReconciler) updateInstallationStatus(nodesList *corev1.NodeList) (ctrl.Result, error) {
+// updateInstallationStatus adds the nodes the current payload configuration is
+// installed on to the completed list. The install done label outlives the
+// payload that set it, so a node only counts once the pod of the current pod
+// template is ready on it as well
+func (r *CcRuntimeReconciler) updateInstallationStatus(nodesList *corev1.NodeList, pods map[string]*corev1.Pod) (ctrl.Result, error) {
 	r.ccRuntime.Status.InstallationStatus.InProgress.BinariesInstalledNodesList = []string{}
 	for _, node := range nodesList.Items {
 		r.ccRuntime.Status.InstallationStatus.InProgress.InProgressNodesCount = len(r.ccRuntime.Status.InstallationStatus.InProgress.BinariesInstalledNodesList)
+		if pod := pods[node.Name]; pod == nil || !podReady(pod) {
+			continue
+		}
 		for k, v := range node.GetLabels() {
 			doneLabel, exists := r.ccRuntime.Spec.Config.InstallDoneLabel[k]
 			if exists && v == doneLabel {
@@ -547,7 +643,7 @@ func (r *CcRuntimeReconciler) updateInstallationStatus(nodesList *corev1.NodeLis
 				}
 			}
 		}
-		err := r.Client.Status().Update(context.TODO(), r.ccRuntime)
+		err := r.updateCcRuntimeStatus()
 		if err != nil {
 			r.Log.Info("Updating status of completed nodes etc failed")
 			return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 5}, err
@@ -578,22 +674,39 @@ func (r *CcRuntimeReconciler) getAllNodes() (*corev1.NodeList, ctrl.Result, erro
 	return nodesList, ctrl.Result{}, nil
 }
 
+// getInstalledNodes returns the selected nodes, without the ones excluded for
+// failing the preflight checks
+func (r *CcRuntimeReconciler) getInstalledNodes() (*corev1.NodeList, ctrl.Result, error) {
+	nodesList, result, err := r.getAllNodes()
+	if err != nil {
+		return nil, result, err
+	}
+	nodesList.Items = r.withoutExcludedNodes(nodesList.Items)
+	return nodesList, result, nil
+}
+
 func (r *CcRuntimeReconciler) allNodesInstalled() bool {
 	return r.ccRuntime.Status.TotalNodesCount > 0 &&
 		r.ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount == r.ccRuntime.Status.TotalNodesCount
 }
 
-func (r *CcRuntimeReconciler) processDaemonset(operation DaemonOperation) *appsv1.DaemonSet {
-	runPrivileged := true
-	var runAsUser int64 = 0
+// processDaemonset renders the DaemonSet of the operation for the nodes of the
+// architecture, arch being empty for the nodes using the default payload image
+func (r *CcRuntimeReconciler) processDaemonset(operation DaemonOperation, arch string, runtime string) (*appsv1.DaemonSet, error) {
+	securityContext, hostPID := r.installerSecurityContext()
 
-	dsName := "cc-operator-daemon-" + string(operation)
+	dsName := daemonsetName(operation, arch, runtime)
 	dsLabelSelectors := map[string]string{
 		"name": dsName,
 	}
 
 	var nodeSelector map[string]string
-	if r.ccRuntime.Spec.CcNodeSelector != nil && operation == InstallOperation {
+	if r.ccRuntime.Spec.CcNodeSelector != nil && operation == InstallOperation && arch != "" {
+		nodeSelector = map[string]string{ArchLabel: arch}
+		for k, v := range r.ccRuntime.Spec.CcNodeSelector.MatchLabels {
+			nodeSelector[k] = v
+		}
+	} else if r.ccRuntime.Spec.CcNodeSelector != nil && operation == InstallOperation {
 		nodeSelector = r.ccRuntime.Spec.CcNodeSelector.MatchLabels
 	} else if operation == UninstallOperation {
 		nodeSelector = map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]}
@@ -689,9 +802,18 @@ func (r *CcRuntimeReconciler) processDaemonset(operation DaemonOperation) *appsv
 			Value: strings.Join(pull_type_mapping, ","),
 		},
 	}
+	if operation == UninstallOperation {
+		// The uninstallation runs in Jobs: the payload exits once done instead
+		// of keeping its container running, as kata-deploy does in the post
+		// delete hook of its Helm chart
+		envVars = append(envVars,
+			corev1.EnvVar{Name: "RUN_TO_COMPLETION", Value: "true"},
+			corev1.EnvVar{Name: "HELM_POST_DELETE_HOOK", Value: "true"},
+		)
+	}
 	envVars = append(envVars, r.ccRuntime.Spec.Config.EnvironmentVariables...)
 
-	return &appsv1.DaemonSet{
+	ds := &appsv1.DaemonSet{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "apps/v1",
 			Kind:       "DaemonSet",
@@ -718,24 +840,21 @@ func (r *CcRuntimeReconciler) processDaemonset(operation DaemonOperation) *appsv
 					Labels: dsLabelSelectors,
 				},
 				Spec: corev1.PodSpec{
-					ServiceAccountName: "cc-operator-controller-manager",
-					NodeSelector:       nodeSelector,
-					Tolerations:        r.ccRuntime.Spec.CcTolerations,
-					HostPID:            true,
+					ServiceAccountName:           r.payloadServiceAccountName(),
+					AutomountServiceAccountToken: r.payloadAutomountToken(),
+					NodeSelector:                 nodeSelector,
+					Tolerations:                  r.ccRuntime.Spec.CcTolerations,
+					HostPID:                      hostPID,
 					Containers: []corev1.Container{
 						{
 							Name:            "cc-runtime-install-pod",
-							Image:           r.ccRuntime.Spec.Config.PayloadImage,
+							Image:           r.effectiveImage(r.payloadImage(arch)),
 							ImagePullPolicy: imagePullPolicyOrDefault(r.ccRuntime.Spec.Config.ImagePullPolicy),
 							Lifecycle:       preStopHook,
-							SecurityContext: &corev1.SecurityContext{
-								// TODO - do we really need to run as root?
-								Privileged: &runPrivileged,
-								RunAsUser:  &runAsUser,
-							},
-							Command:      containerCommand,
-							Env:          envVars,
-							VolumeMounts: r.ccRuntime.Spec.Config.InstallerVolumeMounts,
+							SecurityContext: securityContext,
+							Command:         containerCommand,
+							Env:             envVars,
+							VolumeMounts:    r.ccRuntime.Spec.Config.InstallerVolumeMounts,
 						},
 					},
 					Volumes: r.ccRuntime.Spec.Config.InstallerVolumes,
@@ -743,6 +862,33 @@ func (r *CcRuntimeReconciler) processDaemonset(operation DaemonOperation) *appsv
 			},
 		},
 	}
+	if archs := r.payloadArchs(); arch == "" && len(archs) > 0 {
+		excludeArchs(&ds.Spec.Template.Spec, archs)
+	}
+	if config := r.containerRuntimeConfig(runtime); config != nil {
+		addContainerRuntimeConfig(&ds.Spec.Template.Spec, config.InstallerVolumes, config.InstallerVolumeMounts,
+			config.EnvironmentVariables)
+		if operation == InstallOperation {
+			requireNode(&ds.Spec.Template.Spec, corev1.NodeSelectorRequirement{
+				Key:      ContainerRuntimeLabel,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{runtime},
+			})
+		}
+	}
+	r.addPayloadConfig(&ds.Spec.Template)
+	r.addAttestationConfig(&ds.Spec.Template)
+	r.addAgentPolicies(&ds.Spec.Template)
+	if operation == InstallOperation {
+		r.applyPodTemplateOverride(&ds.Spec.Template, r.ccRuntime.Spec.Config.PodTemplateOverrides.Install)
+		r.excludePreflightFailures(&ds.Spec.Template.Spec)
+	} else if operation == UninstallOperation {
+		r.applyPodTemplateOverride(&ds.Spec.Template, r.ccRuntime.Spec.Config.PodTemplateOverrides.Uninstall)
+	}
+	if err := r.setPayloadHash(&ds.Spec.Template); err != nil {
+		return nil, err
+	}
+	return ds, nil
 }
 
 func (r *CcRuntimeReconciler) addFinalizer() error {
@@ -750,7 +896,7 @@ func (r *CcRuntimeReconciler) addFinalizer() error {
 	controllerutil.AddFinalizer(r.ccRuntime, RuntimeConfigFinalizer)
 
 	// Update CR
-	err := r.Update(context.TODO(), r.ccRuntime)
+	_, err := r.updateCcRuntime()
 	if err != nil {
 		r.Log.Error(err, "Failed to update ccRuntime with finalizer")
 		return err
@@ -796,28 +942,31 @@ func (r *CcRuntimeReconciler) mapCcRuntimeToRequests(ctx context.Context, ccRunt
 func (r *CcRuntimeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&ccv1beta1.CcRuntime{}).
+		Owns(&batchv1.Job{}).
 		Watches(
 			&corev1.Node{},
 			handler.EnqueueRequestsFromMapFunc(r.mapCcRuntimeToRequests)).
+		Watches(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.mapPayloadConfigToRequests)).
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.mapPayloadConfigToRequests)).
+		Watches(
+			&appsv1.DaemonSet{},
+			handler.EnqueueRequestsFromMapFunc(r.mapPeerPodsToRequests)).
 		Complete(r)
 }
-func (r *CcRuntimeReconciler) deleteUninstallDaemonsets() (ctrl.Result, error) {
-	ds := r.processDaemonset(UninstallOperation)
-	result, err := r.deleteDaemonset(ds)
-	if err != nil {
-		return result, err
-	}
-	ds = r.makeHookDaemonset(PostUninstallOperation)
-	result, err = r.deleteDaemonset(ds)
-	if err != nil {
-		return result, err
+
+// deleteNodeWorkloads deletes the Jobs of the one-shot operations, as well as
+// the DaemonSets previous versions of the operator ran them with
+func (r *CcRuntimeReconciler) deleteNodeWorkloads() (ctrl.Result, error) {
+	if err := r.deleteNodeJobs(""); err != nil {
+		return ctrl.Result{}, err
 	}
-	ds = r.makeHookDaemonset(PreInstallOperation)
-	result, err = r.deleteDaemonset(ds)
-	if err != nil {
-		return result, err
+	if err := r.deleteLegacyDaemonsets(); err != nil {
+		return ctrl.Result{}, err
 	}
-
 	return ctrl.Result{}, nil
 }
 
@@ -831,15 +980,11 @@ func (r *CcRuntimeReconciler) deleteDaemonset(ds *appsv1.DaemonSet) (ctrl.Result
 	return ctrl.Result{}, nil
 }
 
-func (r *CcRuntimeReconciler) makeHookDaemonset(operation DaemonOperation) *appsv1.DaemonSet {
+// makeHookPodTemplate renders the pod template the Jobs of the hook run
+func (r *CcRuntimeReconciler) makeHookPodTemplate(hook *nodeHook) (corev1.PodTemplateSpec, error) {
 	var (
-		runPrivileged       = true
-		runAsUser     int64 = 0
-		image               = "" //nolint: ineffassign
-		dsName        string
-		volumes       []corev1.Volume
-		volumeMounts  []corev1.VolumeMount
-		envVars       = []corev1.EnvVar{
+		securityContext, hostPID = r.installerSecurityContext()
+		envVars                  = []corev1.EnvVar{
 			{
 				Name: "NODE_NAME",
 				ValueFrom: &corev1.EnvVarSource{
@@ -848,105 +993,58 @@ func (r *CcRuntimeReconciler) makeHookDaemonset(operation DaemonOperation) *apps
 					},
 				},
 			},
+			{
+				Name:  "HOOK_DONE_LABEL",
+				Value: hook.doneLabel[0] + "=" + hook.doneLabel[1],
+			},
+			{
+				Name:  "RUN_TO_COMPLETION",
+				Value: "true",
+			},
 		}
 	)
 
 	envVars = append(envVars, r.ccRuntime.Spec.Config.EnvironmentVariables...)
+	envVars = append(envVars, hook.EnvironmentVariables...)
 
-	switch operation {
-	case PreInstallOperation:
-		dsName = "cc-operator-pre-install-daemon"
-		image = r.ccRuntime.Spec.Config.PreInstall.Image
-		volumeMounts = r.ccRuntime.Spec.Config.PreInstall.VolumeMounts
-		volumes = r.ccRuntime.Spec.Config.PreInstall.Volumes
-		envVars = append(envVars, r.ccRuntime.Spec.Config.PreInstall.EnvironmentVariables...)
-	case PostUninstallOperation:
-		dsName = "cc-operator-post-uninstall-daemon"
-		image = r.ccRuntime.Spec.Config.PostUninstall.Image
-		volumeMounts = r.ccRuntime.Spec.Config.PostUninstall.VolumeMounts
-		volumes = r.ccRuntime.Spec.Config.PostUninstall.Volumes
-		envVars = append(envVars, r.ccRuntime.Spec.Config.PostUninstall.EnvironmentVariables...)
-	default:
-		dsName = "invalid operation"
-		image = "invalid image"
-		volumeMounts = []corev1.VolumeMount{}
-		volumes = []corev1.Volume{}
-		envVars = []corev1.EnvVar{}
-	}
-
-	dsLabelSelectors := map[string]string{
-		"name": dsName,
-	}
-
-	var nodeSelector map[string]string
-	if r.ccRuntime.Spec.CcNodeSelector != nil {
-		nodeSelector = r.ccRuntime.Spec.CcNodeSelector.MatchLabels
-	} else {
-		nodeSelector = map[string]string{
-			"node.kubernetes.io/worker": "",
-		}
-	}
-
-	return &appsv1.DaemonSet{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "apps/v1",
-			Kind:       "DaemonSet",
-		},
+	template := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      dsName,
-			Namespace: r.Namespace,
-		},
-		Spec: appsv1.DaemonSetSpec{
-			Selector: &metav1.LabelSelector{
-				MatchLabels: dsLabelSelectors,
-			},
-			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
-				Type: "RollingUpdate",
-				RollingUpdate: &appsv1.RollingUpdateDaemonSet{
-					MaxUnavailable: &intstr.IntOrString{
-						Type:   intstr.Int,
-						IntVal: 1,
-					},
-				},
+			Labels: map[string]string{
+				"name": "cc-operator-" + hook.operation,
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: dsLabelSelectors,
-				},
-				Spec: corev1.PodSpec{
-					ServiceAccountName: "cc-operator-controller-manager",
-					NodeSelector:       nodeSelector,
-					Tolerations:        r.ccRuntime.Spec.CcTolerations,
-					HostPID:            true,
-					Containers: []corev1.Container{
-						{
-							Name:            "cc-runtime-" + string(operation) + "-pod",
-							Image:           image,
-							ImagePullPolicy: imagePullPolicyOrDefault(r.ccRuntime.Spec.Config.ImagePullPolicy),
-							SecurityContext: &corev1.SecurityContext{
-								Privileged: &runPrivileged,
-								RunAsUser:  &runAsUser,
-							},
-							Command: []string{"/bin/sh", "-c", "/opt/confidential-containers-pre-install-artifacts/scripts/" + string(operation) + ".sh"},
-							Env:     envVars,
-
-							VolumeMounts: volumeMounts,
-						},
-					},
-					Volumes: volumes,
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName:           r.payloadServiceAccountName(),
+			AutomountServiceAccountToken: r.payloadAutomountToken(),
+			Tolerations:                  r.ccRuntime.Spec.CcTolerations,
+			HostPID:                      hostPID,
+			Containers: []corev1.Container{
+				{
+					Name:            hookContainerName,
+					Image:           r.effectiveImage(hook.Image),
+					ImagePullPolicy: imagePullPolicyOrDefault(r.ccRuntime.Spec.Config.ImagePullPolicy),
+					SecurityContext: securityContext,
+					Command:         hook.Cmd,
+					Env:             envVars,
+
+					VolumeMounts: hook.VolumeMounts,
 				},
 			},
+			Volumes: hook.Volumes,
 		},
 	}
+	if config := r.containerRuntimeConfig(hook.containerRuntime); config != nil {
+		addContainerRuntimeConfig(&template.Spec, config.HookVolumes, config.HookVolumeMounts, config.EnvironmentVariables)
+	}
+	r.addPayloadConfig(&template)
+	r.applyPodTemplateOverride(&template, r.ccRuntime.Spec.Config.PodTemplateOverrides.Hooks)
+	if err := setTemplateHash(&template); err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+	return template, nil
 }
 
 func (r *CcRuntimeReconciler) removeNodeLabels(nodesList *corev1.NodeList) (ctrl.Result, error) {
-	nodesClient, err := r.getNodeClient()
-	if err != nil {
-		r.Log.Info("Couldn't get nodes client")
-		return ctrl.Result{}, err
-	}
-
 	kataCleanupDoneLabel := make([]string, 0, len(r.ccRuntime.Spec.Config.UninstallDoneLabel))
 	for key := range r.ccRuntime.Spec.Config.UninstallDoneLabel {
 		kataCleanupDoneLabel = append(kataCleanupDoneLabel, key)
@@ -965,19 +1063,20 @@ func (r *CcRuntimeReconciler) removeNodeLabels(nodesList *corev1.NodeList) (ctrl
 			delete(nodeLabels, PostUninstallDoneLabel[0])
 		}
 
+		for _, hook := range r.allHooks() {
+			delete(nodeLabels, hook.doneLabel[0])
+		}
+
 		if val, ok := nodeLabels[kataCleanupDoneLabel[0]]; ok && val == "cleanup" {
 			delete(nodeLabels, kataCleanupDoneLabel[0])
 		}
 		if val, ok := nodeLabels[StartUninstallLabel[0]]; ok && val == StartUninstallLabel[1] {
 			delete(nodeLabels, StartUninstallLabel[0])
 		}
+		delete(nodeLabels, PreflightLabel)
+		delete(nodeLabels, ContainerRuntimeLabel)
 		node.SetLabels(nodeLabels)
-		_, err := nodesClient.Update(context.TODO(), &node, metav1.UpdateOptions{
-			TypeMeta:     metav1.TypeMeta{},
-			DryRun:       nil,
-			FieldManager: "",
-		})
-		if err != nil {
+		if err := r.Update(context.TODO(), &node); err != nil {
 			r.Log.Info("failed to update node labels")
 			return ctrl.Result{}, err
 		}
@@ -8,6 +8,9 @@ import (
 type DaemonOperation string
 
 var (
+	// PreInstallDoneLabel and PostUninstallDoneLabel are the labels the
+	// preInstall and postUninstall images predating the per CcRuntime hook
+	// done labels add once done, which still completes their Jobs
 	PreInstallDoneLabel    = []string{"confidentialcontainers.org/preinstall", "done"}
 	PostUninstallDoneLabel = []string{"confidentialcontainers.org/postuninstall", "done"}
 	StartUninstallLabel    = []string{"confidentialcontainers.org/startuninstall", "true"}
@@ -32,6 +35,87 @@ const (
 	RuntimeConfigFinalizer = "runtimeconfig.confidentialcontainers.org/finalizer"
 
 	DefaultImagePullPolicy = corev1.PullAlways
+
+	// RollbackToRevisionAnnotation is set by the user on a CcRuntime to roll back
+	// to one of the revisions recorded in its status
+	RollbackToRevisionAnnotation = "confidentialcontainers.org/rollback-to-revision"
+
+	// TemplateHashAnnotation holds the hash of the payload configuration a DaemonSet or uninstall Job
+	// was rendered with, or of the pod template of a hook Job
+	TemplateHashAnnotation = "confidentialcontainers.org/template-hash"
+
+	// RolledBackCondition is set when the payload configuration was rolled back to a previous revision
+	RolledBackCondition = "RolledBack"
+
+	// ImagesResolvedCondition reflects whether the images could be resolved to their digests
+	ImagesResolvedCondition = "ImagesResolved"
+
+	// ImagesVerifiedCondition reflects whether the signatures of the images could be verified
+	ImagesVerifiedCondition = "ImagesVerified"
+
+	// VerificationPublicKeysKey is the key of the verification Secret holding the public keys
+	VerificationPublicKeysKey = "cosign.pub"
+
+	// VerificationRootsKey is the key of the verification Secret holding the Fulcio roots
+	VerificationRootsKey = "fulcio-roots.pem"
+
+	// VerificationRekorKeysKey is the key of the verification Secret holding the public keys
+	// of the Rekor transparency logs
+	VerificationRekorKeysKey = "rekor.pub"
+
+	// PodTemplateOverridesValidCondition reflects whether the pod template overrides apply
+	PodTemplateOverridesValidCondition = "PodTemplateOverridesValid"
+
+	// PayloadConfigResolvedCondition reflects whether the Secrets and ConfigMaps of configFrom could be read
+	PayloadConfigResolvedCondition = "PayloadConfigResolved"
+
+	// PayloadConfigHashAnnotation holds the hash of the configFrom values a pod template was rendered with
+	PayloadConfigHashAnnotation = "confidentialcontainers.org/payload-config-hash"
+
+	// AttestationConfigValidCondition reflects whether spec.attestation is valid and rendered
+	AttestationConfigValidCondition = "AttestationConfigValid"
+
+	// AttestationHashAnnotation holds the hash of the attestation configuration a pod template was rendered with
+	AttestationHashAnnotation = "confidentialcontainers.org/attestation-hash"
+
+	// AgentPoliciesHashAnnotation holds the hash of the agent policies a pod template was rendered with
+	AgentPoliciesHashAnnotation = "confidentialcontainers.org/agent-policies-hash"
+
+	// AgentPoliciesResolvedCondition reflects whether the agent policies of the runtime classes could be read
+	AgentPoliciesResolvedCondition = "AgentPoliciesResolved"
+
+	// InstallerPrivilegesReducedCondition reflects whether the installer pods run with less than full privileges
+	InstallerPrivilegesReducedCondition = "InstallerPrivilegesReduced"
+
+	// PreInstallConfigValidCondition reflects whether the preInstall switches are consistent
+	PreInstallConfigValidCondition = "PreInstallConfigValid"
+
+	// PeerPodsReadyCondition reflects whether the cloud-api-adaptor runs the peer pods of spec.peerPods
+	PeerPodsReadyCondition = "PeerPodsReady"
+
+	// PreflightPassedCondition reflects whether the selected nodes passed the preflight checks
+	PreflightPassedCondition = "PreflightPassed"
+
+	// ContainerRuntimesSupportedCondition reflects whether the container runtimes of the nodes support the configuration
+	ContainerRuntimesSupportedCondition = "ContainerRuntimesSupported"
+
+	// PodSecurityLabelsAnnotation holds the Pod Security labels the namespace had
+	// before the operator labelled it
+	PodSecurityLabelsAnnotation = "confidentialcontainers.org/original-pod-security-labels"
+
+	// NodeJobOperationLabel holds the operation a per-node Job runs
+	NodeJobOperationLabel = "confidentialcontainers.org/operation"
+
+	// NodeJobNodeAnnotation holds the name of the node a per-node Job runs on
+	NodeJobNodeAnnotation = "confidentialcontainers.org/node"
+
+	DefaultRollbackFailureThreshold = 1
+	DefaultRevisionHistoryLimit     = 10
+
+	DefaultPeerPodsLimit int32 = 10
+
+	DefaultNodeJobBackoffLimit            int32 = 3
+	DefaultNodeJobTTLSecondsAfterFinished int32 = 3600
 )
 
 func contains(list []string, s string) bool {
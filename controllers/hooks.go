@@ -0,0 +1,399 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// legacyHookScriptsDir holds the scripts run by the preInstall and postUninstall
+	// hooks when no command is given
+	legacyHookScriptsDir = "/opt/confidential-containers-pre-install-artifacts/scripts/"
+
+	// HookDoneLabelPrefix prefixes the labels the hooks add to nodes once done
+	HookDoneLabelPrefix = "hooks.confidentialcontainers.org/"
+
+	// hookDoneLabelMaxName is the maximum length of the name of a label key
+	hookDoneLabelMaxName = 63
+
+	// hookContainerName is the name of the container running the hooks
+	hookContainerName = "cc-runtime-hook-pod"
+)
+
+// nodeHook is a hook of the pipeline, either from the hooks list or from the
+// preInstall and postUninstall configurations
+type nodeHook struct {
+	ccv1beta1.HookConfig
+
+	// operation identifies the Jobs running the hook
+	operation string
+
+	// doneLabel is the label the hook adds to nodes once done
+	doneLabel []string
+
+	// legacyDoneLabel is the label the preInstall and postUninstall images
+	// predating the per CcRuntime done labels add once done, before they keep
+	// their container running
+	legacyDoneLabel []string
+
+	// containerRuntime is the container runtime of the nodes the hook runs on,
+	// when the pods are rendered for each runtime
+	containerRuntime string
+}
+
+// HookDoneLabel returns the key of the label the hook of the CcRuntime adds to
+// nodes once done, <hook>.<ccRuntime> under HookDoneLabelPrefix. The CcRuntime
+// name is replaced by its hash when the key would get too long.
+func HookDoneLabel(ccRuntimeName, hookName string) string {
+	scope := ccRuntimeName
+	if len(hookName)+1+len(scope) > hookDoneLabelMaxName {
+		scope = shortHash([]byte(ccRuntimeName))
+	}
+	return HookDoneLabelPrefix + hookName + "." + scope
+}
+
+func (h *nodeHook) doneLabelSelector() map[string]string {
+	return map[string]string{h.doneLabel[0]: h.doneLabel[1]}
+}
+
+// hooks returns the hooks of the stage, in the order they run
+func (r *CcRuntimeReconciler) hooks(stage ccv1beta1.HookStage) []nodeHook {
+	config := &r.ccRuntime.Spec.Config
+	var hooks []nodeHook
+
+	// Checked by validatePreInstallConfig before anything is rendered
+	switchEnv, _ := config.PreInstallEnv()
+
+	if probe := r.teeProbeHook(); probe != nil && stage == ccv1beta1.PreInstallHookStage {
+		hooks = append(hooks, *probe)
+	}
+
+	if stage == ccv1beta1.PreInstallHookStage && config.PreInstall.Image != "" {
+		hooks = append(hooks, nodeHook{
+			HookConfig: ccv1beta1.HookConfig{
+				Name:                 string(PreInstallOperation),
+				Stage:                stage,
+				Image:                config.PreInstall.Image,
+				Cmd:                  legacyHookCmd(config.PreInstall.Cmd, PreInstallOperation),
+				EnvironmentVariables: append(append([]corev1.EnvVar{}, config.PreInstall.EnvironmentVariables...), switchEnv...),
+				Volumes:              config.PreInstall.Volumes,
+				VolumeMounts:         config.PreInstall.VolumeMounts,
+			},
+			operation:       string(PreInstallOperation),
+			doneLabel:       []string{HookDoneLabel(r.ccRuntime.Name, string(PreInstallOperation)), "done"},
+			legacyDoneLabel: PreInstallDoneLabel,
+		})
+	}
+	if stage == ccv1beta1.PostUninstallHookStage && config.PostUninstall.Image != "" {
+		hooks = append(hooks, nodeHook{
+			HookConfig: ccv1beta1.HookConfig{
+				Name:                 string(PostUninstallOperation),
+				Stage:                stage,
+				Image:                config.PostUninstall.Image,
+				Cmd:                  legacyHookCmd(config.PostUninstall.Cmd, PostUninstallOperation),
+				EnvironmentVariables: append(append([]corev1.EnvVar{}, config.PostUninstall.EnvironmentVariables...), switchEnv...),
+				Volumes:              config.PostUninstall.Volumes,
+				VolumeMounts:         config.PostUninstall.VolumeMounts,
+			},
+			operation:       string(PostUninstallOperation),
+			doneLabel:       []string{HookDoneLabel(r.ccRuntime.Name, string(PostUninstallOperation)), "done"},
+			legacyDoneLabel: PostUninstallDoneLabel,
+		})
+	}
+
+	for _, hook := range config.Hooks {
+		if hook.Stage != stage {
+			continue
+		}
+		hooks = append(hooks, nodeHook{
+			HookConfig: hook,
+			operation:  "hook-" + hook.Name,
+			doneLabel:  []string{HookDoneLabel(r.ccRuntime.Name, hook.Name), "done"},
+		})
+	}
+	return hooks
+}
+
+// validatePreInstallConfig checks the preInstall switches for conflicts and
+// reports the outcome in a condition
+func (r *CcRuntimeReconciler) validatePreInstallConfig() error {
+	config := &r.ccRuntime.Spec.Config
+	if config.PreInstall.Image == "" && config.PreInstall.Containerd == "" && config.PreInstall.InstallNydusSnapshotter == nil {
+		if meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, PreInstallConfigValidCondition) {
+			return r.updateCcRuntimeStatus()
+		}
+		return nil
+	}
+
+	_, err := config.PreInstallEnv()
+	return r.setConditionFromError(metav1.Condition{
+		Type:    PreInstallConfigValidCondition,
+		Reason:  "Valid",
+		Message: "The preInstall configuration is consistent",
+	}, "InvalidPreInstallConfig", err)
+}
+
+// allHooks returns the hooks of all the stages
+func (r *CcRuntimeReconciler) allHooks() []nodeHook {
+	var hooks []nodeHook
+	for _, stage := range []ccv1beta1.HookStage{
+		ccv1beta1.PreInstallHookStage,
+		ccv1beta1.PostInstallHookStage,
+		ccv1beta1.PreUpgradeHookStage,
+		ccv1beta1.PreUninstallHookStage,
+		ccv1beta1.PostUninstallHookStage,
+	} {
+		hooks = append(hooks, r.hooks(stage)...)
+	}
+	return hooks
+}
+
+func legacyHookCmd(cmd []string, operation DaemonOperation) []string {
+	if len(cmd) > 0 {
+		return cmd
+	}
+	return []string{"/bin/sh", "-c", legacyHookScriptsDir + string(operation) + ".sh"}
+}
+
+// runHooks runs the hooks of the stage one after the other. It returns true
+// once all of them completed on all the nodes.
+func (r *CcRuntimeReconciler) runHooks(stage ccv1beta1.HookStage) (bool, ctrl.Result, error) {
+	for _, hook := range r.hooks(stage) {
+		done, res, err := r.runHook(&hook)
+		if !done || err != nil {
+			return false, res, err
+		}
+	}
+	return true, ctrl.Result{}, nil
+}
+
+func (r *CcRuntimeReconciler) runHook(hook *nodeHook) (bool, ctrl.Result, error) {
+	requeue := ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}
+
+	nodes, _, err := r.getInstalledNodes()
+	if err != nil {
+		return false, requeue, err
+	}
+	pending := func(node *corev1.Node) bool {
+		return node.Labels[hook.doneLabel[0]] != hook.doneLabel[1]
+	}
+	var completedNodes []string
+	for i := range nodes.Items {
+		if !pending(&nodes.Items[i]) {
+			completedNodes = append(completedNodes, nodes.Items[i].Name)
+		}
+	}
+
+	if r.ccRuntime.Status.TotalNodesCount > 0 && len(completedNodes) >= r.ccRuntime.Status.TotalNodesCount {
+		return true, ctrl.Result{}, r.updateHookStatus(hook, ccv1beta1.HookCompleted, completedNodes, nil, "")
+	}
+
+	result, err := r.runHookJobs(hook, nodes.Items, pending)
+	if err != nil {
+		return false, requeue, err
+	}
+
+	// Report the completion with the done label, so it outlives the Jobs
+	if err := r.labelNodes(result.completed, hook.doneLabelSelector()); err != nil {
+		return false, requeue, err
+	}
+	completedNodes = append(completedNodes, result.completed...)
+
+	if r.ccRuntime.Status.TotalNodesCount > 0 && len(completedNodes) >= r.ccRuntime.Status.TotalNodesCount {
+		return true, ctrl.Result{}, r.updateHookStatus(hook, ccv1beta1.HookCompleted, completedNodes, nil, "")
+	}
+
+	phase, message := ccv1beta1.HookRunning, ""
+	if len(result.failed) > 0 {
+		phase = ccv1beta1.HookFailed
+		message = fmt.Sprintf("failed on %d of %d nodes", len(result.failed), r.ccRuntime.Status.TotalNodesCount)
+	}
+
+	if phase == ccv1beta1.HookFailed && r.hookPhase(hook) != ccv1beta1.HookFailed {
+		r.Log.Info("hook failed", "hook", hook.Name, "stage", hook.Stage, "message", message)
+		r.recordEvent(corev1.EventTypeWarning, "HookFailed", "Hook %s (%s) %s", hook.Name, hook.Stage, message)
+	}
+	err = r.updateHookStatus(hook, phase, completedNodes, result.failed, message)
+	if err != nil {
+		return false, requeue, err
+	}
+
+	// A failed postInstall hook is a failed smoke test of the payload
+	if phase == ccv1beta1.HookFailed && hook.Stage == ccv1beta1.PostInstallHookStage {
+		if rolledBack, res, err := r.rollbackToLastKnownGood("SmokeTestFailed",
+			fmt.Sprintf("postInstall hook %s %s", hook.Name, message)); rolledBack || err != nil {
+			return false, res, err
+		}
+	}
+	return false, requeue, nil
+}
+
+// runHookJobs runs the Jobs of the hook, with the image of their architecture
+func (r *CcRuntimeReconciler) runHookJobs(hook *nodeHook, nodes []corev1.Node,
+	pending func(*corev1.Node) bool) (*nodeJobsResult, error) {
+	result := &nodeJobsResult{}
+	groups := r.groupNodesByRuntime(groupNodesByArch(nodes, func(arch string) bool { return r.archHookImage(arch, hook.Name) != "" }))
+	for _, group := range groups {
+		archHook := *hook
+		if group.arch != "" {
+			archHook.Image = r.archHookImage(group.arch, hook.Name)
+		}
+		archHook.containerRuntime = group.runtime
+		template, err := r.makeHookPodTemplate(&archHook)
+		if err != nil {
+			return nil, err
+		}
+		groupResult, err := r.runNodeJobs(hook.operation, &template, group.nodes, pending, hook.legacyDoneLabel,
+			hook.TimeoutSeconds)
+		if err != nil {
+			return nil, err
+		}
+		result.completed = append(result.completed, groupResult.completed...)
+		result.failed = append(result.failed, groupResult.failed...)
+	}
+	return result, nil
+}
+
+func (r *CcRuntimeReconciler) hookPhase(hook *nodeHook) ccv1beta1.HookPhase {
+	for _, status := range r.ccRuntime.Status.Hooks {
+		if status.Name == hook.Name {
+			return status.Phase
+		}
+	}
+	return ""
+}
+
+// updateHookStatus records the progress of the hook in the status, if it changed
+func (r *CcRuntimeReconciler) updateHookStatus(hook *nodeHook, phase ccv1beta1.HookPhase, completedNodes []string,
+	failedNodes []ccv1beta1.FailedNodeStatus, message string) error {
+	status := ccv1beta1.HookStatus{
+		Name:               hook.Name,
+		Stage:              hook.Stage,
+		Phase:              phase,
+		CompletedNodesList: completedNodes,
+		FailedNodesList:    failedNodes,
+		Message:            message,
+	}
+
+	for i := range r.ccRuntime.Status.Hooks {
+		if r.ccRuntime.Status.Hooks[i].Name != hook.Name {
+			continue
+		}
+		if equalHookStatus(&r.ccRuntime.Status.Hooks[i], &status) {
+			return nil
+		}
+		r.ccRuntime.Status.Hooks[i] = status
+		return r.updateCcRuntimeStatus()
+	}
+	r.ccRuntime.Status.Hooks = append(r.ccRuntime.Status.Hooks, status)
+	return r.updateCcRuntimeStatus()
+}
+
+func equalHookStatus(a, b *ccv1beta1.HookStatus) bool {
+	if a.Stage != b.Stage || a.Phase != b.Phase || a.Message != b.Message ||
+		len(a.CompletedNodesList) != len(b.CompletedNodesList) ||
+		len(a.FailedNodesList) != len(b.FailedNodesList) {
+		return false
+	}
+	for _, node := range b.CompletedNodesList {
+		if !contains(a.CompletedNodesList, node) {
+			return false
+		}
+	}
+	for i := range b.FailedNodesList {
+		if a.FailedNodesList[i] != b.FailedNodesList[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resetHooks makes the hooks of the stages run again: their Jobs, done labels
+// and status are removed
+func (r *CcRuntimeReconciler) resetHooks(stages ...ccv1beta1.HookStage) error {
+	for _, stage := range stages {
+		for _, hook := range r.hooks(stage) {
+			if err := r.deleteNodeJobs(hook.operation); err != nil {
+				return err
+			}
+
+			nodes, err := r.getNodesWithLabels(hook.doneLabelSelector())
+			if err != nil {
+				return err
+			}
+			if err := r.removeNodeLabel(nodes, hook.doneLabel[0]); err != nil {
+				return err
+			}
+
+			for i := range r.ccRuntime.Status.Hooks {
+				if r.ccRuntime.Status.Hooks[i].Name == hook.Name {
+					r.ccRuntime.Status.Hooks = append(r.ccRuntime.Status.Hooks[:i], r.ccRuntime.Status.Hooks[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *CcRuntimeReconciler) removeNodeLabel(nodesList *corev1.NodeList, label string) error {
+	for i := range nodesList.Items {
+		node := &nodesList.Items[i]
+		if _, ok := node.Labels[label]; !ok {
+			continue
+		}
+		delete(node.Labels, label)
+		if err := r.Update(context.TODO(), node); err != nil {
+			r.Log.Info("failed to update node labels", "nodeName", node.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// labelNodes sets the labels on the named nodes
+func (r *CcRuntimeReconciler) labelNodes(nodeNames []string, nodeLabels map[string]string) error {
+	for _, name := range nodeNames {
+		node := &corev1.Node{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: name}, node); err != nil {
+			r.Log.Info("failed to get node", "nodeName", name)
+			return err
+		}
+		if node.Labels == nil {
+			node.Labels = map[string]string{}
+		}
+		for k, v := range nodeLabels {
+			node.Labels[k] = v
+		}
+		if err := r.Update(context.TODO(), node); err != nil {
+			r.Log.Info("failed to update node labels", "nodeName", name)
+			return err
+		}
+	}
+	return nil
+}
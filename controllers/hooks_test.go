@@ -0,0 +1,225 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Node hooks", func() {
+	It("labels the nodes per CcRuntime", func() {
+		Expect(HookDoneLabel("ccruntime-sample", "pre-install")).To(
+			Equal("hooks.confidentialcontainers.org/pre-install.ccruntime-sample"))
+
+		long := HookDoneLabel(strings.Repeat("c", 60), "pre-install")
+		Expect(long).To(Equal("hooks.confidentialcontainers.org/pre-install." + shortHash([]byte(strings.Repeat("c", 60)))))
+		Expect(len(strings.TrimPrefix(long, HookDoneLabelPrefix))).To(BeNumerically("<=", hookDoneLabelMaxName))
+	})
+
+	It("completes the preInstall and postUninstall hooks with the labels of previous releases", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("hooks"))
+		ccRuntime.Spec.Config.PreInstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+		ccRuntime.Spec.Config.PostUninstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+		ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+			{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+		}
+		r, _ := newTestReconciler(ccRuntime)
+
+		preInstall := r.hooks(ccv1beta1.PreInstallHookStage)
+		Expect(preInstall).To(HaveLen(1))
+		Expect(preInstall[0].doneLabel).To(Equal([]string{HookDoneLabel(ccRuntime.Name, "pre-install"), "done"}))
+		Expect(preInstall[0].legacyDoneLabel).To(Equal(PreInstallDoneLabel))
+
+		postUninstall := r.hooks(ccv1beta1.PostUninstallHookStage)
+		Expect(postUninstall).To(HaveLen(1))
+		Expect(postUninstall[0].legacyDoneLabel).To(Equal(PostUninstallDoneLabel))
+
+		postInstall := r.hooks(ccv1beta1.PostInstallHookStage)
+		Expect(postInstall).To(HaveLen(1))
+		Expect(postInstall[0].doneLabel).To(Equal([]string{HookDoneLabel(ccRuntime.Name, "smoke-test"), "done"}))
+		Expect(postInstall[0].legacyDoneLabel).To(BeNil())
+	})
+
+	Context("validating the preInstall switches", func() {
+		var ccRuntime *ccv1beta1.CcRuntime
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("hooks"))
+			ccRuntime.Spec.Config.PreInstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+			ccRuntime.Spec.Config.PostUninstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+			ccRuntime.Spec.Config.PreInstall.Containerd = ccv1beta1.CocoContainerd
+			ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{
+				{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull"},
+			}
+			createTestCcRuntime(ccRuntime)
+		})
+
+		validCondition := func() *metav1.Condition {
+			return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions,
+				PreInstallConfigValidCondition)
+		}
+
+		It("passes the switches to the preInstall and postUninstall hooks", func() {
+			r, _ := newTestReconciler(ccRuntime)
+			Expect(r.validatePreInstallConfig()).To(Succeed())
+			Expect(validCondition()).To(HaveField("Status", metav1.ConditionTrue))
+
+			for _, stage := range []ccv1beta1.HookStage{ccv1beta1.PreInstallHookStage, ccv1beta1.PostUninstallHookStage} {
+				hooks := r.hooks(stage)
+				Expect(hooks).To(HaveLen(1))
+				Expect(hooks[0].EnvironmentVariables).To(ContainElements(
+					corev1.EnvVar{Name: "INSTALL_COCO_CONTAINERD", Value: "true"},
+					corev1.EnvVar{Name: "INSTALL_OFFICIAL_CONTAINERD", Value: "false"}))
+			}
+		})
+
+		It("reports the conflicting switches", func() {
+			disabled := false
+			ccRuntime.Spec.Config.PreInstall.InstallNydusSnapshotter = &disabled
+			r, recorder := newTestReconciler(ccRuntime)
+
+			Expect(r.validatePreInstallConfig()).To(MatchError(ContainSubstring("uses the nydus snapshotter")))
+			condition := validCondition()
+			Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("InvalidPreInstallConfig"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("InvalidPreInstallConfig")))
+		})
+
+		It("removes the condition without preInstall switches", func() {
+			r, _ := newTestReconciler(ccRuntime)
+			Expect(r.validatePreInstallConfig()).To(Succeed())
+			ccRuntime.Spec.Config.PreInstall = ccv1beta1.PreInstallConfig{}
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+			Expect(r.validatePreInstallConfig()).To(Succeed())
+			Expect(validCondition()).To(BeNil())
+		})
+	})
+
+	Context("running on the nodes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			nodeName  string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("hooks"))
+			ccRuntime.Spec.Config.PreInstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+			ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+				{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+			}
+			labels := selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+			ccRuntime.Status.TotalNodesCount = 1
+			r, _ = newTestReconciler(ccRuntime)
+
+			nodeName = uniqueName("hooks-node")
+			createTestNode(nodeName, labels)
+		})
+
+		It("takes the label of a previous release as completion once its Job runs", func() {
+			hook := &r.hooks(ccv1beta1.PreInstallHookStage)[0]
+
+			// A label left over by a previous run doesn't complete the hook
+			setNodeLabels(nodeName, map[string]string{PreInstallDoneLabel[0]: PreInstallDoneLabel[1]})
+			done, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+			Expect(getNode(nodeName).Labels).NotTo(HaveKey(PreInstallDoneLabel[0]))
+			job, err := getNodeJob(hook.operation, nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Containers[0].Env).To(ContainElements(
+				HaveField("Name", "HOOK_DONE_LABEL"), HaveField("Name", "RUN_TO_COMPLETION")))
+
+			// The image reports it's done and keeps running
+			setNodeLabels(nodeName, map[string]string{PreInstallDoneLabel[0]: PreInstallDoneLabel[1]})
+			done, _, err = r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeTrue())
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue(hook.doneLabel[0], "done"))
+			_, err = getNodeJob(hook.operation, nodeName)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			Expect(getCcRuntime(ccRuntime.Name).Status.Hooks).To(ContainElement(And(
+				HaveField("Name", "pre-install"),
+				HaveField("Phase", ccv1beta1.HookCompleted),
+				HaveField("CompletedNodesList", []string{nodeName}))))
+		})
+
+		It("doesn't take the label of a previous release for the other hooks", func() {
+			hook := &r.hooks(ccv1beta1.PostInstallHookStage)[0]
+
+			done, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+			setNodeLabels(nodeName, map[string]string{PreInstallDoneLabel[0]: PreInstallDoneLabel[1]})
+
+			done, _, err = r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+			Expect(getNode(nodeName).Labels).To(HaveKey(PreInstallDoneLabel[0]))
+
+			job, err := getNodeJob(hook.operation, nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			completeJob(job)
+			done, _, err = r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeTrue())
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue(hook.doneLabel[0], "done"))
+		})
+
+		It("reports the nodes the hook failed on", func() {
+			hook := &r.hooks(ccv1beta1.PreInstallHookStage)[0]
+			r, recorder := newTestReconciler(ccRuntime)
+
+			_, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			job, err := getNodeJob(hook.operation, nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			failJob(job, "BackoffLimitExceeded", "Job has reached the specified backoff limit")
+
+			done, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+			Expect(getCcRuntime(ccRuntime.Name).Status.Hooks).To(ContainElement(And(
+				HaveField("Phase", ccv1beta1.HookFailed),
+				HaveField("FailedNodesList", ConsistOf(HaveField("Name", nodeName))))))
+			Expect(events(recorder)).To(ContainElement(ContainSubstring("HookFailed")))
+		})
+
+		It("doesn't share the completion with the hooks of other CcRuntimes", func() {
+			hook := &r.hooks(ccv1beta1.PreInstallHookStage)[0]
+			setNodeLabels(nodeName, map[string]string{HookDoneLabel("other-ccruntime", "pre-install"): "done"})
+
+			done, _, err := r.runHook(hook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeFalse())
+			_, err = getNodeJob(hook.operation, nodeName)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,379 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// ccRuntimeImages lists the images rendered into the DaemonSets, by component
+func (r *CcRuntimeReconciler) ccRuntimeImages() []ccv1beta1.CcImageStatus {
+	config := &r.ccRuntime.Spec.Config
+	images := []ccv1beta1.CcImageStatus{
+		{Name: "payload", Image: config.PayloadImage},
+	}
+	if config.PreInstall.Image != "" {
+		images = append(images, ccv1beta1.CcImageStatus{Name: "preInstall", Image: config.PreInstall.Image})
+	}
+	if config.PostUninstall.Image != "" {
+		images = append(images, ccv1beta1.CcImageStatus{Name: "postUninstall", Image: config.PostUninstall.Image})
+	}
+	for _, hook := range config.Hooks {
+		images = append(images, ccv1beta1.CcImageStatus{Name: "hook-" + hook.Name, Image: hook.Image})
+	}
+	if probe := r.teeProbeHook(); probe != nil {
+		images = append(images, ccv1beta1.CcImageStatus{Name: teeProbeHookName, Image: probe.Image})
+	}
+
+	// The images of the architectures are named after the component, e.g. payload/s390x
+	for _, arch := range config.Architectures {
+		if arch.PayloadImage != "" {
+			images = append(images, ccv1beta1.CcImageStatus{Name: "payload/" + arch.Arch, Image: arch.PayloadImage})
+		}
+		for _, hook := range r.allHooks() {
+			if image := arch.HookImages[hook.Name]; image != "" {
+				images = append(images, ccv1beta1.CcImageStatus{Name: hookImageName(&hook) + "/" + arch.Arch, Image: image})
+			}
+		}
+	}
+	return images
+}
+
+// hookImageName returns the name of the image of the hook in the status
+func hookImageName(hook *nodeHook) string {
+	switch hook.operation {
+	case string(PreInstallOperation):
+		return "preInstall"
+	case string(PostUninstallOperation):
+		return "postUninstall"
+	}
+	return hook.operation
+}
+
+// resolveImages fills the images of the status. When PinImageDigests or
+// ImageVerification is set the images are resolved to their digests, and their
+// signatures verified, once per spec generation.
+func (r *CcRuntimeReconciler) resolveImages() error {
+	images := r.ccRuntimeImages()
+	verify := r.ccRuntime.Spec.Config.ImageVerification != nil
+
+	if !r.ccRuntime.Spec.Config.PinImageDigests && !verify {
+		for i := range images {
+			images[i].ResolvedImage = r.rewriteImage(images[i].Image)
+		}
+		if equality.Semantic.DeepEqual(images, r.ccRuntime.Status.Images) {
+			return nil
+		}
+		r.ccRuntime.Status.Images = images
+		r.ccRuntime.Status.ImagesGeneration = r.ccRuntime.Generation
+		meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, ImagesResolvedCondition)
+		meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, ImagesVerifiedCondition)
+		return r.updateCcRuntimeStatus()
+	}
+
+	if r.ccRuntime.Status.ImagesGeneration == r.ccRuntime.Generation && r.imagesResolved(images, verify) {
+		return nil
+	}
+
+	err := r.resolveImageDigests(images)
+	if err != nil {
+		r.Log.Error(err, "failed to resolve the image digests")
+		meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+			Type:               ImagesResolvedCondition,
+			Status:             metav1.ConditionFalse,
+			Reason:             "ResolutionFailed",
+			Message:            err.Error(),
+			ObservedGeneration: r.ccRuntime.Generation,
+		})
+		r.recordEvent(corev1.EventTypeWarning, "ImageResolutionFailed", "%s", err.Error())
+		if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+			r.Log.Info("failed to update status after image resolution failure")
+		}
+		return err
+	}
+	meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+		Type:               ImagesResolvedCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Resolved",
+		Message:            "All images are pinned to their digests",
+		ObservedGeneration: r.ccRuntime.Generation,
+	})
+
+	if verify {
+		err = r.verifyImages(images)
+		if err != nil {
+			// Refuse to proceed, no DaemonSet is created with unverified images
+			r.Log.Error(err, "failed to verify the image signatures")
+			meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+				Type:               ImagesVerifiedCondition,
+				Status:             metav1.ConditionFalse,
+				Reason:             "VerificationFailed",
+				Message:            err.Error(),
+				ObservedGeneration: r.ccRuntime.Generation,
+			})
+			r.recordEvent(corev1.EventTypeWarning, "ImageVerificationFailed", "%s", err.Error())
+			if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+				r.Log.Info("failed to update status after image verification failure")
+			}
+			return err
+		}
+		meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+			Type:               ImagesVerifiedCondition,
+			Status:             metav1.ConditionTrue,
+			Reason:             "Verified",
+			Message:            "The signatures of all images were verified",
+			ObservedGeneration: r.ccRuntime.Generation,
+		})
+	} else {
+		meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, ImagesVerifiedCondition)
+	}
+
+	r.ccRuntime.Status.Images = images
+	r.ccRuntime.Status.ImagesGeneration = r.ccRuntime.Generation
+	return r.updateCcRuntimeStatus()
+}
+
+// imagesResolved checks that the status holds a digest, and a verified
+// signature if required, for each of the images
+func (r *CcRuntimeReconciler) imagesResolved(images []ccv1beta1.CcImageStatus, verify bool) bool {
+	if len(images) != len(r.ccRuntime.Status.Images) {
+		return false
+	}
+	for i := range images {
+		status := r.ccRuntime.Status.Images[i]
+		if status.Name != images[i].Name || status.Image != images[i].Image || status.Digest == "" {
+			return false
+		}
+		// The mirrors may have changed since the images were resolved
+		ref, err := parseImageReference(r.rewriteImage(images[i].Image))
+		if err != nil || status.ResolvedImage != ref.pinned(status.Digest) {
+			return false
+		}
+		if verify && !status.Verified {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CcRuntimeReconciler) verifyImages(images []ccv1beta1.CcImageStatus) error {
+	if r.ImageVerifier == nil {
+		return fmt.Errorf("imageVerification is set but no image verifier is configured")
+	}
+
+	policy, err := r.verificationPolicy()
+	if err != nil {
+		return err
+	}
+	credentials, err := r.registryCredentials()
+	if err != nil {
+		return err
+	}
+
+	for i := range images {
+		err := r.ImageVerifier.Verify(context.TODO(), images[i].ResolvedImage, images[i].Digest, policy, credentials)
+		if err != nil {
+			return fmt.Errorf("failed to verify the %s image %s: %w", images[i].Name, images[i].Image, err)
+		}
+		r.Log.Info("verified image signature", "image", images[i].ResolvedImage)
+		images[i].Verified = true
+	}
+	return nil
+}
+
+// verificationPolicy reads the verification material from the Secret of the ImageVerification policy
+func (r *CcRuntimeReconciler) verificationPolicy() (*VerificationPolicy, error) {
+	verification := r.ccRuntime.Spec.Config.ImageVerification
+
+	secret := &corev1.Secret{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: verification.SecretRef.Name, Namespace: r.Namespace}, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the verification secret %s: %w", verification.SecretRef.Name, err)
+	}
+
+	policy := &VerificationPolicy{}
+	if verification.Keyless != nil {
+		roots, err := parseCertificates(secret.Data[VerificationRootsKey])
+		if err != nil || len(roots) == 0 {
+			return nil, fmt.Errorf("secret %s has no valid %s", secret.Name, VerificationRootsKey)
+		}
+		policy.Roots = x509.NewCertPool()
+		for _, root := range roots {
+			policy.Roots.AddCert(root)
+		}
+		policy.Issuer = verification.Keyless.Issuer
+		policy.Subject = verification.Keyless.Subject
+
+		rekorKeys, err := parsePublicKeys(secret.Data[VerificationRekorKeysKey])
+		if err != nil || len(rekorKeys) == 0 {
+			return nil, fmt.Errorf("secret %s has no valid %s", secret.Name, VerificationRekorKeysKey)
+		}
+		policy.RekorKeys = map[string]crypto.PublicKey{}
+		for _, key := range rekorKeys {
+			logID, err := rekorLogID(key)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s has no valid %s: %w", secret.Name, VerificationRekorKeysKey, err)
+			}
+			policy.RekorKeys[logID] = key
+		}
+		return policy, nil
+	}
+
+	policy.PublicKeys, err = parsePublicKeys(secret.Data[VerificationPublicKeysKey])
+	if err != nil || len(policy.PublicKeys) == 0 {
+		return nil, fmt.Errorf("secret %s has no valid %s", secret.Name, VerificationPublicKeysKey)
+	}
+	return policy, nil
+}
+
+func (r *CcRuntimeReconciler) resolveImageDigests(images []ccv1beta1.CcImageStatus) error {
+	if r.ImageResolver == nil {
+		return fmt.Errorf("pinImageDigests is set but no image resolver is configured")
+	}
+
+	credentials, err := r.registryCredentials()
+	if err != nil {
+		return err
+	}
+
+	for i := range images {
+		image := r.rewriteImage(images[i].Image)
+		ref, err := parseImageReference(image)
+		if err != nil {
+			return fmt.Errorf("%s image: %w", images[i].Name, err)
+		}
+		digest, err := r.ImageResolver.Resolve(context.TODO(), image, credentials)
+		if err != nil {
+			return fmt.Errorf("failed to resolve the %s image %s: %w", images[i].Name, image, err)
+		}
+		r.Log.Info("resolved image", "image", image, "digest", digest)
+		images[i].Digest = digest
+		images[i].ResolvedImage = ref.pinned(digest)
+	}
+	return nil
+}
+
+// registryCredentials reads the credentials of the ImagePullSecret, if any
+func (r *CcRuntimeReconciler) registryCredentials() (RegistryCredentials, error) {
+	pullSecret := r.ccRuntime.Spec.Config.ImagePullSecret
+	if pullSecret == nil || pullSecret.Name == "" {
+		return RegistryCredentials{}, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: pullSecret.Name, Namespace: r.Namespace}, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the image pull secret %s: %w", pullSecret.Name, err)
+	}
+	return credentialsFromSecret(secret)
+}
+
+// effectiveImage returns the image reference to render for an image of the spec
+func (r *CcRuntimeReconciler) effectiveImage(image string) string {
+	for _, status := range r.ccRuntime.Status.Images {
+		if status.Image == image && status.ResolvedImage != "" {
+			return status.ResolvedImage
+		}
+	}
+	return r.rewriteImage(image)
+}
+
+// ImageRewriteRule maps a source registry, or repository prefix, to a mirror
+type ImageRewriteRule struct {
+	// Source is a registry host or repository prefix, e.g. quay.io or quay.io/kata-containers
+	Source string `json:"source"`
+
+	// Mirror replaces Source in the image references, e.g. registry.example.com:5000/quay.io
+	Mirror string `json:"mirror"`
+}
+
+// ImageRewriteConfig is the format of the file passed to --image-rewrite-config
+type ImageRewriteConfig struct {
+	Rules []ImageRewriteRule `json:"rules"`
+}
+
+// ParseImageRewriteRule parses a rule written as source=mirror
+func ParseImageRewriteRule(value string) (ImageRewriteRule, error) {
+	source, mirror, found := strings.Cut(value, "=")
+	rule := ImageRewriteRule{Source: strings.TrimSpace(source), Mirror: strings.TrimSpace(mirror)}
+	if !found || rule.Source == "" || rule.Mirror == "" {
+		return rule, fmt.Errorf("invalid image rewrite rule %q, expected source=mirror", value)
+	}
+	return rule, nil
+}
+
+// LoadImageRewriteRules reads the rules from an ImageRewriteConfig file
+func LoadImageRewriteRules(path string) ([]ImageRewriteRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := ImageRewriteConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, rule := range config.Rules {
+		if rule.Source == "" || rule.Mirror == "" {
+			return nil, fmt.Errorf("invalid image rewrite rule in %s: source and mirror are required", path)
+		}
+	}
+	return config.Rules, nil
+}
+
+// rewriteImage applies the most specific rewrite rule matching the image
+func rewriteImage(rules []ImageRewriteRule, image string) string {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return image
+	}
+	// Match against the normalised name, so docker.io rules apply to e.g. busybox
+	name := ref.Registry + "/" + ref.Repository
+	suffix := strings.TrimPrefix(image, ref.Name)
+
+	var match *ImageRewriteRule
+	for i := range rules {
+		source := strings.TrimSuffix(rules[i].Source, "/")
+		if name != source && !strings.HasPrefix(name, source+"/") {
+			continue
+		}
+		if match == nil || len(source) > len(strings.TrimSuffix(match.Source, "/")) {
+			match = &rules[i]
+		}
+	}
+	if match == nil {
+		return image
+	}
+	return strings.TrimSuffix(match.Mirror, "/") + strings.TrimPrefix(name, strings.TrimSuffix(match.Source, "/")) + suffix
+}
+
+func (r *CcRuntimeReconciler) rewriteImage(image string) string {
+	return rewriteImage(r.ImageRewriteRules, image)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry mirrors", func() {
+	rules := []ImageRewriteRule{
+		{Source: "quay.io", Mirror: "registry.example.com:5000/quay.io"},
+		{Source: "quay.io/kata-containers/", Mirror: "registry.example.com:5000/kata/"},
+		{Source: "docker.io", Mirror: "registry.example.com:5000/docker.io"},
+	}
+
+	DescribeTable("rewriting the image references",
+		func(image, want string) {
+			Expect(rewriteImage(rules, image)).To(Equal(want))
+		},
+		Entry("registry",
+			"quay.io/confidential-containers/reqs-payload:v1",
+			"registry.example.com:5000/quay.io/confidential-containers/reqs-payload:v1"),
+		Entry("most specific repository prefix",
+			"quay.io/kata-containers/kata-deploy:3.23.0",
+			"registry.example.com:5000/kata/kata-deploy:3.23.0"),
+		Entry("digest",
+			"quay.io/kata-containers/kata-deploy@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"registry.example.com:5000/kata/kata-deploy@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+		Entry("prefix of a path element",
+			"quay.io/kata-containers-ci/kata-deploy:latest",
+			"registry.example.com:5000/quay.io/kata-containers-ci/kata-deploy:latest"),
+		Entry("normalised Docker Hub name",
+			"busybox:1.36",
+			"registry.example.com:5000/docker.io/library/busybox:1.36"),
+		Entry("no matching rule",
+			"ghcr.io/confidential-containers/payload:v1",
+			"ghcr.io/confidential-containers/payload:v1"),
+	)
+
+	DescribeTable("parsing the --image-rewrite rules",
+		func(value string, want ImageRewriteRule, wantErr bool) {
+			rule, err := ParseImageRewriteRule(value)
+			if wantErr {
+				Expect(err).To(MatchError(ContainSubstring("expected source=mirror")))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule).To(Equal(want))
+		},
+		Entry("source and mirror", " quay.io = mirror.example.com/quay.io ",
+			ImageRewriteRule{Source: "quay.io", Mirror: "mirror.example.com/quay.io"}, false),
+		Entry("no separator", "quay.io", ImageRewriteRule{}, true),
+		Entry("no mirror", "quay.io=", ImageRewriteRule{}, true),
+		Entry("no source", "=mirror.example.com", ImageRewriteRule{}, true),
+	)
+
+	Context("loading the --image-rewrite-config file", func() {
+		load := func(content string) ([]ImageRewriteRule, error) {
+			path := filepath.Join(GinkgoT().TempDir(), "rules.yaml")
+			Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+			return LoadImageRewriteRules(path)
+		}
+
+		It("reads the rules", func() {
+			loaded, err := load("rules:\n- source: quay.io\n  mirror: mirror.example.com/quay.io\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(Equal([]ImageRewriteRule{{Source: "quay.io", Mirror: "mirror.example.com/quay.io"}}))
+		})
+
+		It("rejects incomplete rules", func() {
+			_, err := load("rules:\n- source: quay.io\n")
+			Expect(err).To(MatchError(ContainSubstring("source and mirror are required")))
+		})
+
+		It("rejects unknown fields", func() {
+			_, err := load("rules:\n- source: quay.io\n  target: mirror.example.com\n")
+			Expect(err).To(MatchError(ContainSubstring("failed to parse")))
+		})
+	})
+
+	It("renders the mirrored images without passing the rules to the payload", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("mirror"))
+		createTestCcRuntime(ccRuntime)
+		r, _ := newTestReconciler(ccRuntime)
+		r.ImageRewriteRules = rules
+
+		Expect(r.resolveImages()).To(Succeed())
+		Expect(ccRuntime.Status.Images[0].ResolvedImage).To(Equal("registry.example.com:5000/kata/kata-deploy:3.23.0"))
+
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		container := ds.Spec.Template.Spec.Containers[0]
+		Expect(container.Image).To(Equal("registry.example.com:5000/kata/kata-deploy:3.23.0"))
+		for _, env := range container.Env {
+			Expect(env.Name).NotTo(Equal("IMAGE_REWRITE_RULES"))
+		}
+	})
+})
@@ -0,0 +1,388 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// legacyDaemonsets are the DaemonSets previous versions of the operator ran
+// the one-shot operations with
+var legacyDaemonsets = []string{
+	"cc-operator-daemon-" + string(UninstallOperation),
+	"cc-operator-pre-install-daemon",
+	"cc-operator-post-uninstall-daemon",
+}
+
+// nodeJobsResult reflects the outcome of the per-node Jobs of an operation
+type nodeJobsResult struct {
+	// completed are the nodes the Job completed on
+	completed []string
+
+	// failed are the nodes the Job failed on
+	failed []ccv1beta1.FailedNodeStatus
+}
+
+// nodeJobName returns the name of the Job of the operation on the node. The
+// name is also used as a label value by the Job controller, so it's kept
+// within 63 characters.
+func nodeJobName(operation string, nodeName string) string {
+	name := "cc-operator-" + operation + "-" + nodeName
+	if len(name) <= 63 {
+		return name
+	}
+	hash := shortHash([]byte(nodeName))
+	return strings.TrimRight(name[:63-len(hash)-1], "-.") + "-" + hash
+}
+
+func nodeJobBackoffLimit(config *ccv1beta1.NodeJobsConfig) int32 {
+	if config.BackoffLimit == nil {
+		return DefaultNodeJobBackoffLimit
+	}
+	return *config.BackoffLimit
+}
+
+func nodeJobTTLSecondsAfterFinished(config *ccv1beta1.NodeJobsConfig) int32 {
+	if config.TTLSecondsAfterFinished == nil {
+		return DefaultNodeJobTTLSecondsAfterFinished
+	}
+	return *config.TTLSecondsAfterFinished
+}
+
+// makeNodeJob renders the Job running the pod template once on the node
+func (r *CcRuntimeReconciler) makeNodeJob(operation string, nodeName string, template *corev1.PodTemplateSpec,
+	activeDeadlineSeconds *int64) *batchv1.Job {
+	backoffLimit := nodeJobBackoffLimit(&r.ccRuntime.Spec.Config.NodeJobs)
+	ttlSecondsAfterFinished := nodeJobTTLSecondsAfterFinished(&r.ccRuntime.Spec.Config.NodeJobs)
+
+	podTemplate := template.DeepCopy()
+	podTemplate.Spec.RestartPolicy = corev1.RestartPolicyNever
+	// The Job is pinned to the node, whatever its labels are by now
+	podTemplate.Spec.NodeSelector = nil
+	pinToNode(&podTemplate.Spec, nodeName)
+	// Like the DaemonSet pods, run on cordoned nodes too
+	podTemplate.Spec.Tolerations = append(podTemplate.Spec.Tolerations, corev1.Toleration{
+		Key:      corev1.TaintNodeUnschedulable,
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectNoSchedule,
+	})
+
+	return &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nodeJobName(operation, nodeName),
+			Namespace: r.Namespace,
+			Labels: map[string]string{
+				NodeJobOperationLabel: operation,
+			},
+			Annotations: map[string]string{
+				NodeJobNodeAnnotation: nodeName,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttlSecondsAfterFinished,
+			ActiveDeadlineSeconds:   activeDeadlineSeconds,
+			Template:                *podTemplate,
+		},
+	}
+}
+
+// pinToNode requires the pod to run on the node, on top of the affinity the
+// pod template overrides may have set
+func pinToNode(spec *corev1.PodSpec, nodeName string) {
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      "metadata.name",
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{nodeName},
+	}
+
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchFields: []corev1.NodeSelectorRequirement{requirement}},
+			},
+		}
+		return
+	}
+	// The terms are ORed, the requirement has to be part of each of them
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchFields = append(required.NodeSelectorTerms[i].MatchFields, requirement)
+	}
+}
+
+func jobCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		if job.Status.Conditions[i].Type == conditionType && job.Status.Conditions[i].Status == corev1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func jobFinished(job *batchv1.Job) bool {
+	return jobCondition(job, batchv1.JobComplete) != nil || jobCondition(job, batchv1.JobFailed) != nil
+}
+
+/*
+runNodeJobs makes sure the pod template runs once on each of the pending nodes,
+as a Job pinned to the node. A Job is started over when the pod template
+changes before it completed. The Jobs of the nodes that aren't pending anymore
+are deleted, which stops payloads reporting their completion with a node label
+and then keeping their container running.
+
+Such payloads may also report it with a doneLabel other than the one pending
+checks, shared by all the CcRuntimes. It counts as the Job completing once the
+Job exists, and the Job is then deleted. The label is removed from the node
+before the Job is created.
+*/
+func (r *CcRuntimeReconciler) runNodeJobs(operation string, template *corev1.PodTemplateSpec, nodes []corev1.Node,
+	pending func(*corev1.Node) bool, doneLabel []string, activeDeadlineSeconds *int64) (*nodeJobsResult, error) {
+	jobs := &batchv1.JobList{}
+	listOpts := []client.ListOption{
+		client.InNamespace(r.Namespace),
+		client.MatchingLabels{NodeJobOperationLabel: operation},
+	}
+	if err := r.List(context.TODO(), jobs, listOpts...); err != nil {
+		r.Log.Info("failed to list the node Jobs", "operation", operation)
+		return nil, err
+	}
+	foundJobs := map[string]*batchv1.Job{}
+	for i := range jobs.Items {
+		foundJobs[jobs.Items[i].Annotations[NodeJobNodeAnnotation]] = &jobs.Items[i]
+	}
+
+	result := &nodeJobsResult{}
+	for i := range nodes {
+		node := &nodes[i]
+		job := foundJobs[node.Name]
+
+		if !pending(node) {
+			if job != nil && !jobFinished(job) {
+				if err := r.deleteJob(job); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		reported := doneLabel != nil && node.Labels[doneLabel[0]] == doneLabel[1]
+
+		if job == nil {
+			if reported {
+				// Left over by a previous run, the label would complete the new Job at once
+				if err := r.removeNodeLabel(&corev1.NodeList{Items: []corev1.Node{*node}}, doneLabel[0]); err != nil {
+					return nil, err
+				}
+			}
+			job = r.makeNodeJob(operation, node.Name, template, activeDeadlineSeconds)
+			if err := controllerutil.SetControllerReference(r.ccRuntime, job, r.Scheme); err != nil {
+				r.Log.Error(err, "Failed setting ControllerReference for node Job")
+				return nil, err
+			}
+			r.Log.Info("Creating node Job", "job.Namespace", job.Namespace, "job.Name", job.Name)
+			if err := r.Create(context.TODO(), job); err != nil && !errors.IsAlreadyExists(err) {
+				return nil, err
+			}
+			continue
+		}
+
+		if complete := jobCondition(job, batchv1.JobComplete); complete != nil {
+			result.completed = append(result.completed, node.Name)
+			continue
+		}
+
+		if job.Spec.Template.Annotations[TemplateHashAnnotation] != template.Annotations[TemplateHashAnnotation] {
+			// The operation changed before it completed, start over
+			r.Log.Info("Restarting node Job", "job.Name", job.Name)
+			if err := r.deleteJob(job); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if reported {
+			// The payload keeps running once done
+			if err := r.deleteJob(job); err != nil {
+				return nil, err
+			}
+			result.completed = append(result.completed, node.Name)
+			continue
+		}
+
+		if failed := jobCondition(job, batchv1.JobFailed); failed != nil {
+			result.failed = append(result.failed, ccv1beta1.FailedNodeStatus{
+				Name:  node.Name,
+				Error: fmt.Sprintf("%s: %s", failed.Reason, failed.Message),
+			})
+		}
+	}
+	return result, nil
+}
+
+func (r *CcRuntimeReconciler) deleteJob(job *batchv1.Job) error {
+	err := r.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		r.Log.Error(err, "Couldn't delete Job", "Name:", job.Name)
+		return err
+	}
+	return nil
+}
+
+// deleteNodeJob deletes the Job of the operation on the node, if any
+func (r *CcRuntimeReconciler) deleteNodeJob(operation string, nodeName string) error {
+	return r.deleteJob(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nodeJobName(operation, nodeName),
+			Namespace: r.Namespace,
+		},
+	})
+}
+
+// deleteNodeJobs deletes the Jobs of the operation, or of all the operations
+// when none is given
+func (r *CcRuntimeReconciler) deleteNodeJobs(operation string) error {
+	opts := []client.DeleteAllOfOption{
+		client.InNamespace(r.Namespace),
+		client.PropagationPolicy(metav1.DeletePropagationBackground),
+	}
+	if operation != "" {
+		opts = append(opts, client.MatchingLabels{NodeJobOperationLabel: operation})
+	} else {
+		opts = append(opts, client.HasLabels{NodeJobOperationLabel})
+	}
+	err := r.DeleteAllOf(context.TODO(), &batchv1.Job{}, opts...)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Log.Error(err, "Couldn't delete the node Jobs", "operation", operation)
+		return err
+	}
+	return nil
+}
+
+// deleteLegacyDaemonsets deletes the DaemonSets previous versions of the
+// operator left running on all nodes after the one-shot operations completed
+func (r *CcRuntimeReconciler) deleteLegacyDaemonsets() error {
+	for _, name := range legacyDaemonsets {
+		ds := &appsv1.DaemonSet{}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: r.Namespace}, ds)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		r.Log.Info("Deleting legacy Daemonset", "ds.Namespace", ds.Namespace, "ds.Name", ds.Name)
+		if _, err := r.deleteDaemonset(ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uninstallPending returns whether the node didn't report the uninstallation
+// is done with the UninstallDoneLabel
+func (r *CcRuntimeReconciler) uninstallPending(node *corev1.Node) bool {
+	for k, v := range r.ccRuntime.Spec.Config.UninstallDoneLabel {
+		if node.Labels[k] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// runUninstallNodeJobs runs the uninstallation on the nodes, which must carry
+// the StartUninstallLabel, and labels the nodes it completed on with the
+// UninstallDoneLabel
+func (r *CcRuntimeReconciler) runUninstallNodeJobs(nodes []corev1.Node) (*nodeJobsResult, error) {
+	// Each node is uninstalled with the payload image it was installed with
+	result := &nodeJobsResult{}
+	groups := r.groupNodesByRuntime(groupNodesByArch(nodes, func(arch string) bool { return r.archPayloadImage(arch) != "" }))
+	for _, group := range groups {
+		ds, err := r.processDaemonset(UninstallOperation, group.arch, group.runtime)
+		if err != nil {
+			return nil, err
+		}
+		groupResult, err := r.runNodeJobs(string(UninstallOperation), &ds.Spec.Template, group.nodes, r.uninstallPending,
+			nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.completed = append(result.completed, groupResult.completed...)
+		result.failed = append(result.failed, groupResult.failed...)
+	}
+
+	// Report the completion with the label the payload would have set, so
+	// it outlives the Job
+	if err := r.labelNodes(result.completed, r.ccRuntime.Spec.Config.UninstallDoneLabel); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// runUninstallJobs runs the uninstallation on the nodes setCleanupNodeLabels
+// labelled, until they report it's done with the UninstallDoneLabel
+func (r *CcRuntimeReconciler) runUninstallJobs() error {
+	nodes, err := r.getNodesWithLabels(map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+	if err != nil {
+		return err
+	}
+
+	result, err := r.runUninstallNodeJobs(nodes.Items)
+	if err != nil {
+		return err
+	}
+
+	for _, failed := range result.failed {
+		if !containsFailedNode(r.ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesList, failed.Name) {
+			r.recordEvent(corev1.EventTypeWarning, "UninstallFailed", "Uninstallation failed on node %s: %s", failed.Name, failed.Error)
+		}
+	}
+	r.ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesList = result.failed
+	r.ccRuntime.Status.UnInstallationStatus.Failed.FailedNodesCount = len(result.failed)
+	return r.updateCcRuntimeStatus()
+}
+
+func containsFailedNode(list []ccv1beta1.FailedNodeStatus, name string) bool {
+	for _, node := range list {
+		if node.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Per-node Jobs", func() {
+	It("names the Jobs within 63 characters", func() {
+		Expect(nodeJobName("uninstall", "worker-0")).To(Equal("cc-operator-uninstall-worker-0"))
+
+		node := "ip-10-0-0-1.eu-west-1.compute.internal." + strings.Repeat("x", 20)
+		name := nodeJobName("uninstall", node)
+		Expect(len(name)).To(BeNumerically("<=", 63))
+		Expect(name).To(HaveSuffix("-" + shortHash([]byte(node))))
+		Expect(name).NotTo(Equal(nodeJobName("uninstall", node+"y")))
+	})
+
+	It("pins the Job to the node", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("jobs"))
+		backoffLimit := int32(1)
+		ccRuntime.Spec.Config.NodeJobs = ccv1beta1.NodeJobsConfig{BackoffLimit: &backoffLimit}
+		r, _ := newTestReconciler(ccRuntime)
+		template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"node.kubernetes.io/worker": ""},
+			Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: ArchLabel, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"s390x"}},
+						}},
+					},
+				},
+			}},
+		}}
+
+		deadline := int64(60)
+		job := r.makeNodeJob("uninstall", "worker-0", template, &deadline)
+		spec := job.Spec.Template.Spec
+		Expect(spec.RestartPolicy).To(Equal(corev1.RestartPolicyNever))
+		Expect(spec.NodeSelector).To(BeNil())
+		terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		Expect(terms).To(HaveLen(1))
+		Expect(terms[0].MatchExpressions).To(HaveLen(1))
+		Expect(terms[0].MatchFields).To(ConsistOf(corev1.NodeSelectorRequirement{
+			Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"worker-0"},
+		}))
+		Expect(spec.Tolerations).To(ContainElement(HaveField("Key", corev1.TaintNodeUnschedulable)))
+		Expect(*job.Spec.BackoffLimit).To(Equal(int32(1)))
+		Expect(*job.Spec.TTLSecondsAfterFinished).To(Equal(DefaultNodeJobTTLSecondsAfterFinished))
+		Expect(*job.Spec.ActiveDeadlineSeconds).To(Equal(int64(60)))
+		Expect(job.Labels).To(HaveKeyWithValue(NodeJobOperationLabel, "uninstall"))
+		Expect(job.Annotations).To(HaveKeyWithValue(NodeJobNodeAnnotation, "worker-0"))
+
+		// The template is left as is
+		Expect(template.Spec.NodeSelector).NotTo(BeNil())
+	})
+
+	Context("uninstalling the nodes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			nodeName  string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("jobs"))
+			createTestCcRuntime(ccRuntime)
+			r, _ = newTestReconciler(ccRuntime)
+
+			nodeName = uniqueName("jobs-node")
+			createTestNode(nodeName, map[string]string{
+				StartUninstallLabel[0]:           StartUninstallLabel[1],
+				"katacontainers.io/kata-runtime": "true",
+			})
+		})
+
+		uninstall := func() *nodeJobsResult {
+			nodes, err := r.getNodesWithLabels(map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := r.runUninstallNodeJobs(nodes.Items)
+			Expect(err).NotTo(HaveOccurred())
+			return result
+		}
+
+		It("runs the payload to completion in a Job owned by the CcRuntime", func() {
+			Expect(uninstall().completed).To(BeEmpty())
+
+			job, err := getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.OwnerReferences).To(ConsistOf(And(
+				HaveField("Kind", "CcRuntime"),
+				HaveField("Name", ccRuntime.Name),
+				HaveField("Controller", HaveValue(BeTrue())))))
+			container := job.Spec.Template.Spec.Containers[0]
+			Expect(container.Command).To(Equal(ccRuntime.Spec.Config.UninstallCmd))
+			Expect(container.Env).To(ContainElements(
+				corev1.EnvVar{Name: "RUN_TO_COMPLETION", Value: "true"},
+				corev1.EnvVar{Name: "HELM_POST_DELETE_HOOK", Value: "true"}))
+
+			completeJob(job)
+			Expect(uninstall().completed).To(ConsistOf(nodeName))
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue("katacontainers.io/kata-runtime", "cleanup"))
+
+			// The node is done, the finished Job is left to its TTL
+			Expect(uninstall().completed).To(BeEmpty())
+			_, err = getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes the Job of a payload reporting its completion and keeping running", func() {
+			uninstall()
+			_, err := getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+
+			setNodeLabels(nodeName, ccRuntime.Spec.Config.UninstallDoneLabel)
+			Expect(uninstall().completed).To(BeEmpty())
+			_, err = getNodeJob(string(UninstallOperation), nodeName)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("restarts the Job when the payload changes before it completed", func() {
+			uninstall()
+			job, err := getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			hash := job.Spec.Template.Annotations[TemplateHashAnnotation]
+
+			ccRuntime.Spec.Config.PayloadImage = "quay.io/kata-containers/kata-deploy:3.24.0"
+			uninstall()
+			_, err = getNodeJob(string(UninstallOperation), nodeName)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+			uninstall()
+			job, err = getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Annotations[TemplateHashAnnotation]).NotTo(Equal(hash))
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("quay.io/kata-containers/kata-deploy:3.24.0"))
+		})
+
+		It("reports the nodes the uninstallation failed on", func() {
+			r, recorder := newTestReconciler(ccRuntime)
+			Expect(r.runUninstallJobs()).To(Succeed())
+			job, err := getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			failJob(job, "DeadlineExceeded", "Job was active longer than specified deadline")
+
+			Expect(r.runUninstallJobs()).To(Succeed())
+			failed := getCcRuntime(ccRuntime.Name).Status.UnInstallationStatus.Failed
+			Expect(failed.FailedNodesCount).To(Equal(1))
+			Expect(failed.FailedNodesList).To(ConsistOf(ccv1beta1.FailedNodeStatus{
+				Name:  nodeName,
+				Error: "DeadlineExceeded: Job was active longer than specified deadline",
+			}))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("UninstallFailed")))
+
+			// Reported once
+			Expect(r.runUninstallJobs()).To(Succeed())
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("deletes the Jobs of an operation", func() {
+			uninstall()
+			Expect(r.deleteNodeJobs("pre-install")).To(Succeed())
+			_, err := getNodeJob(string(UninstallOperation), nodeName)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.deleteNodeJobs(string(UninstallOperation))).To(Succeed())
+			jobs := &batchv1.JobList{}
+			Expect(k8sClient.List(context.TODO(), jobs, client.InNamespace(testNamespace),
+				client.MatchingLabels{NodeJobOperationLabel: string(UninstallOperation)})).To(Succeed())
+			Expect(jobs.Items).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,234 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+/*
+NodeLabelCollector removes the labels the operator set on the nodes that no
+CcRuntime owns anymore, e.g. when a CcRuntime was deleted without its
+finalizer running, or the operator was replaced while uninstalling. Stale
+labels would make the next installation skip its hooks, or start uninstalling
+right away.
+
+A node is owned by the CcRuntimes selecting it with their ccNodeSelector, and
+by the ones still uninstalling it after it left their selection. The labels of
+the operator are the ones of its bookkeeping, and the install and uninstall
+done labels of the built-in profiles and of the CcRuntimes. The done labels are
+also set by kata-deploy installed without the operator, so they are only
+removed from the nodes that have labels of the operator as well.
+
+Nothing is collected while a CcRuntime is being deleted, as its finalizer
+labels the nodes the runtime was installed on, selected or not.
+*/
+type NodeLabelCollector struct {
+	Client   client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+
+	// Interval is how often the labels are collected after the collection at
+	// startup, which is the only one when zero
+	Interval time.Duration
+
+	// DryRun only reports the orphaned labels, in the log and in events of
+	// the nodes, without removing them
+	DryRun bool
+}
+
+// OrphanedNodeLabels are the orphaned labels of a node
+type OrphanedNodeLabels struct {
+	NodeName string
+	Labels   []string
+}
+
+// operatorNodeLabel returns whether the label is one the operator sets for
+// its bookkeeping
+func operatorNodeLabel(key string) bool {
+	switch key {
+	case StartUninstallLabel[0], PreInstallDoneLabel[0], PostUninstallDoneLabel[0], PreflightLabel, ContainerRuntimeLabel:
+		return true
+	}
+	return strings.HasPrefix(key, HookDoneLabelPrefix)
+}
+
+// doneLabels returns the install and uninstall done labels of the built-in
+// profiles and of the CcRuntimes
+func (c *NodeLabelCollector) doneLabels(ccRuntimes []ccv1beta1.CcRuntime) map[string]map[string]bool {
+	labels := map[string]map[string]bool{}
+	add := func(config *ccv1beta1.CcInstallConfig) {
+		for _, doneLabel := range []map[string]string{config.InstallDoneLabel, config.UninstallDoneLabel} {
+			for k, v := range doneLabel {
+				if labels[k] == nil {
+					labels[k] = map[string]bool{}
+				}
+				labels[k][v] = true
+			}
+		}
+	}
+
+	for _, profile := range ccv1beta1.CcRuntimeProfiles {
+		ccRuntime := &ccv1beta1.CcRuntime{Spec: ccv1beta1.CcRuntimeSpec{Profile: profile}}
+		if err := ccRuntime.ApplyProfile(); err != nil {
+			c.Log.Error(err, "loading the profile failed", "profile", profile)
+			continue
+		}
+		add(&ccRuntime.Spec.Config)
+	}
+	for i := range ccRuntimes {
+		ccRuntime := ccRuntimes[i].DeepCopy()
+		if ccRuntime.Spec.Profile != "" {
+			if err := ccRuntime.ApplyProfile(); err != nil {
+				c.Log.Error(err, "applying the profile failed", "ccRuntime", ccRuntime.Name, "profile", ccRuntime.Spec.Profile)
+				continue
+			}
+		}
+		add(&ccRuntime.Spec.Config)
+	}
+	return labels
+}
+
+// Find returns the orphaned labels of the nodes, sorted by node name. It
+// returns nothing while a CcRuntime is being deleted
+func (c *NodeLabelCollector) Find(ctx context.Context) ([]OrphanedNodeLabels, error) {
+	ccRuntimes := &ccv1beta1.CcRuntimeList{}
+	if err := c.Client.List(ctx, ccRuntimes); err != nil {
+		return nil, err
+	}
+	nodes := &corev1.NodeList{}
+	if err := c.Client.List(ctx, nodes); err != nil {
+		return nil, err
+	}
+
+	var selectors []labels.Selector
+	owned := map[string]bool{}
+	for _, ccRuntime := range ccRuntimes.Items {
+		if ccRuntime.DeletionTimestamp != nil {
+			c.Log.Info("skipping the collection of the node labels, a CcRuntime is being deleted", "ccRuntime", ccRuntime.Name)
+			return nil, nil
+		}
+		selector := map[string]string{"node.kubernetes.io/worker": ""}
+		if ccRuntime.Spec.CcNodeSelector != nil {
+			selector = ccRuntime.Spec.CcNodeSelector.MatchLabels
+		}
+		// Matched as the reconciler lists the nodes, the labels of the
+		// selector must be set even when their value is empty
+		selectors = append(selectors, labels.SelectorFromSet(selector))
+		for _, name := range ccRuntime.Status.DepartedNodes {
+			owned[name] = true
+		}
+	}
+	doneLabels := c.doneLabels(ccRuntimes.Items)
+
+	var orphaned []OrphanedNodeLabels
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if owned[node.Name] {
+			continue
+		}
+		selected := false
+		for _, selector := range selectors {
+			selected = selected || selector.Matches(labels.Set(node.Labels))
+		}
+		if selected {
+			continue
+		}
+
+		var operatorLabels, done []string
+		for k, v := range node.Labels {
+			if operatorNodeLabel(k) {
+				operatorLabels = append(operatorLabels, k)
+			} else if doneLabels[k][v] {
+				done = append(done, k)
+			}
+		}
+		if len(operatorLabels) == 0 {
+			continue
+		}
+		operatorLabels = append(operatorLabels, done...)
+		sort.Strings(operatorLabels)
+		orphaned = append(orphaned, OrphanedNodeLabels{NodeName: node.Name, Labels: operatorLabels})
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].NodeName < orphaned[j].NodeName })
+	return orphaned, nil
+}
+
+// Collect removes the orphaned labels of the nodes, or only reports them in
+// dry-run mode
+func (c *NodeLabelCollector) Collect(ctx context.Context) error {
+	orphaned, err := c.Find(ctx)
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphaned {
+		node := &corev1.Node{}
+		if err := c.Client.Get(ctx, client.ObjectKey{Name: orphan.NodeName}, node); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if c.DryRun {
+			c.Log.Info("found orphaned operator labels", "nodeName", orphan.NodeName, "labels", orphan.Labels)
+			c.recordEvent(node, "OrphanedLabels", "Orphaned operator labels %s, no CcRuntime owns the node",
+				strings.Join(orphan.Labels, ", "))
+			continue
+		}
+		c.Log.Info("removing orphaned operator labels", "nodeName", orphan.NodeName, "labels", orphan.Labels)
+		for _, label := range orphan.Labels {
+			delete(node.Labels, label)
+		}
+		if err := c.Client.Update(ctx, node); err != nil {
+			return err
+		}
+		c.recordEvent(node, "OrphanedLabelsRemoved", "Removed the orphaned operator labels %s, no CcRuntime owns the node",
+			strings.Join(orphan.Labels, ", "))
+	}
+	return nil
+}
+
+func (c *NodeLabelCollector) recordEvent(node *corev1.Node, reason, messageFmt string, args ...interface{}) {
+	if c.Recorder != nil {
+		c.Recorder.Eventf(node, corev1.EventTypeNormal, reason, messageFmt, args...)
+	}
+}
+
+// Start implements manager.Runnable. On the leader it collects the labels at
+// startup, and then every Interval until the operator stops.
+func (c *NodeLabelCollector) Start(ctx context.Context) error {
+	collect := func(ctx context.Context) {
+		if err := c.Collect(ctx); err != nil {
+			c.Log.Info("failed to collect the orphaned node labels", "err", err.Error())
+		}
+	}
+	if c.Interval <= 0 {
+		collect(ctx)
+		return nil
+	}
+	wait.UntilWithContext(ctx, collect, c.Interval)
+	return nil
+}
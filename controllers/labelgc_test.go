@@ -0,0 +1,220 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Node label collector", func() {
+	DescribeTable("tells the bookkeeping labels of the operator",
+		func(key string, expected bool) {
+			Expect(operatorNodeLabel(key)).To(Equal(expected))
+		},
+		Entry("startuninstall", StartUninstallLabel[0], true),
+		Entry("preinstall", PreInstallDoneLabel[0], true),
+		Entry("postuninstall", PostUninstallDoneLabel[0], true),
+		Entry("preflight", PreflightLabel, true),
+		Entry("container runtime", ContainerRuntimeLabel, true),
+		Entry("hook done label", HookDoneLabel("ccruntime-sample", "pre-install"), true),
+		Entry("install done label", "katacontainers.io/kata-runtime", false),
+		Entry("TEE label", "intel.feature.node.kubernetes.io/tdx", false),
+		Entry("worker label", "node.kubernetes.io/worker", false),
+	)
+
+	It("takes the done labels of the profiles and of the CcRuntimes", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("labelgc"))
+		ccRuntime.Spec.Config.InstallDoneLabel = map[string]string{"example.com/runtime": "installed"}
+		ccRuntime.Spec.Config.UninstallDoneLabel = map[string]string{"example.com/runtime": "removed"}
+		collector := &NodeLabelCollector{Log: ctrl.Log.WithName("test")}
+
+		Expect(collector.doneLabels([]ccv1beta1.CcRuntime{*ccRuntime})).To(Equal(map[string]map[string]bool{
+			"katacontainers.io/kata-runtime":        {"true": true, "cleanup": true},
+			"confidentialcontainers.org/enclave-cc": {"true": true, "cleanup": true},
+			"example.com/runtime":                   {"installed": true, "removed": true},
+		}))
+	})
+
+	Context("with nodes and CcRuntimes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			recorder  *record.FakeRecorder
+			collector *NodeLabelCollector
+			nodeNames []string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("labelgc"))
+			selectTestNodes(ccRuntime)
+			ccRuntime.Spec.Config.InstallDoneLabel = map[string]string{"example.com/runtime": "installed"}
+			ccRuntime.Spec.Config.UninstallDoneLabel = map[string]string{"example.com/runtime": "removed"}
+			createTestCcRuntime(ccRuntime)
+
+			recorder = record.NewFakeRecorder(100)
+			collector = &NodeLabelCollector{Client: k8sClient, Log: ctrl.Log.WithName("test"), Recorder: recorder}
+			nodeNames = nil
+		})
+
+		node := func(labels map[string]string) string {
+			name := uniqueName("labelgc-node")
+			createTestNode(name, labels)
+			nodeNames = append(nodeNames, name)
+			return name
+		}
+
+		// find returns the orphaned labels of the nodes of the spec
+		find := func() map[string][]string {
+			orphaned, err := collector.Find(context.TODO())
+			Expect(err).NotTo(HaveOccurred())
+			labels := map[string][]string{}
+			for _, orphan := range orphaned {
+				if contains(nodeNames, orphan.NodeName) {
+					labels[orphan.NodeName] = orphan.Labels
+				}
+			}
+			return labels
+		}
+
+		It("infers the nodes the CcRuntimes own", func() {
+			selected := node(map[string]string{
+				testNodeLabel:          ccRuntime.Name,
+				StartUninstallLabel[0]: StartUninstallLabel[1],
+				"example.com/runtime":  "installed",
+			})
+			departed := node(map[string]string{
+				StartUninstallLabel[0]: StartUninstallLabel[1],
+				"example.com/runtime":  "installed",
+			})
+			ccRuntime.Status.DepartedNodes = []string{departed}
+			Expect(k8sClient.Status().Update(context.TODO(), ccRuntime)).To(Succeed())
+			orphan := node(map[string]string{
+				StartUninstallLabel[0]:                       StartUninstallLabel[1],
+				HookDoneLabel(ccRuntime.Name, "pre-install"): "done",
+				"example.com/runtime":                        "installed",
+				"katacontainers.io/kata-runtime":             "cleanup",
+				"intel.feature.node.kubernetes.io/tdx":       "true",
+				"topology.kubernetes.io/zone":                "zone-a",
+			})
+			// The done labels of kata-deploy installed without the operator
+			kataDeploy := node(map[string]string{"katacontainers.io/kata-runtime": "true"})
+			// A done label with another value isn't one of the CcRuntimes
+			otherValue := node(map[string]string{
+				PreflightLabel:        "passed",
+				"example.com/runtime": "pending",
+			})
+
+			orphaned := find()
+			Expect(orphaned).NotTo(HaveKey(selected))
+			Expect(orphaned).NotTo(HaveKey(departed))
+			Expect(orphaned).NotTo(HaveKey(kataDeploy))
+			Expect(orphaned).To(HaveKeyWithValue(orphan, []string{
+				StartUninstallLabel[0],
+				"example.com/runtime",
+				HookDoneLabel(ccRuntime.Name, "pre-install"),
+				"katacontainers.io/kata-runtime",
+			}))
+			Expect(orphaned).To(HaveKeyWithValue(otherValue, []string{PreflightLabel}))
+		})
+
+		It("selects the worker nodes without a ccNodeSelector", func() {
+			workers := newTestCcRuntime(uniqueName("labelgc"))
+			workers.Spec.CcNodeSelector = nil
+			createTestCcRuntime(workers)
+			worker := node(map[string]string{
+				"node.kubernetes.io/worker": "",
+				StartUninstallLabel[0]:      StartUninstallLabel[1],
+			})
+			other := node(map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+
+			orphaned := find()
+			Expect(orphaned).NotTo(HaveKey(worker))
+			Expect(orphaned).To(HaveKey(other))
+		})
+
+		It("takes the done labels of the profile of a CcRuntime", func() {
+			enclaveCc := newTestCcRuntime(uniqueName("labelgc"))
+			enclaveCc.Spec.Profile = ccv1beta1.EnclaveCcProfile
+			enclaveCc.Spec.Config.InstallDoneLabel = nil
+			enclaveCc.Spec.Config.UninstallDoneLabel = nil
+			selectTestNodes(enclaveCc)
+			createTestCcRuntime(enclaveCc)
+			orphan := node(map[string]string{
+				PreflightLabel:                          "passed",
+				"confidentialcontainers.org/enclave-cc": "true",
+			})
+
+			Expect(find()).To(HaveKeyWithValue(orphan, []string{
+				"confidentialcontainers.org/enclave-cc",
+				PreflightLabel,
+			}))
+		})
+
+		It("collects nothing while a CcRuntime is being deleted", func() {
+			orphan := node(map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+			Expect(find()).To(HaveKey(orphan))
+
+			ccRuntime.Finalizers = []string{RuntimeConfigFinalizer}
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+			Expect(k8sClient.Delete(context.TODO(), ccRuntime)).To(Succeed())
+			Expect(find()).To(BeEmpty())
+
+			Expect(collector.Collect(context.TODO())).To(Succeed())
+			Expect(getNode(orphan).Labels).To(HaveKey(StartUninstallLabel[0]))
+		})
+
+		It("removes the orphaned labels", func() {
+			orphan := node(map[string]string{
+				StartUninstallLabel[0]:                 StartUninstallLabel[1],
+				"katacontainers.io/kata-runtime":       "true",
+				"intel.feature.node.kubernetes.io/tdx": "true",
+			})
+
+			Expect(collector.Collect(context.TODO())).To(Succeed())
+			Expect(getNode(orphan).Labels).To(Equal(map[string]string{"intel.feature.node.kubernetes.io/tdx": "true"}))
+			Expect(events(recorder)).To(ContainElement(And(
+				ContainSubstring("OrphanedLabelsRemoved"),
+				ContainSubstring(StartUninstallLabel[0]+", katacontainers.io/kata-runtime"))))
+			Expect(find()).NotTo(HaveKey(orphan))
+		})
+
+		It("only reports the orphaned labels in dry-run mode", func() {
+			labels := map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]}
+			orphan := node(labels)
+			collector.DryRun = true
+
+			Expect(collector.Collect(context.TODO())).To(Succeed())
+			Expect(getNode(orphan).Labels).To(Equal(labels))
+			Expect(events(recorder)).To(ContainElement(And(
+				ContainSubstring("OrphanedLabels "),
+				ContainSubstring(StartUninstallLabel[0]))))
+		})
+
+		It("collects once at startup without an interval", func() {
+			orphan := node(map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+
+			Expect(collector.Start(context.TODO())).To(Succeed())
+			Expect(getNode(orphan).Labels).NotTo(HaveKey(StartUninstallLabel[0]))
+		})
+	})
+})
@@ -0,0 +1,310 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+func hasNodeLabels(node *corev1.Node, nodeLabels map[string]string) bool {
+	for k, v := range nodeLabels {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// departedUninstallOperations are the operations of the Jobs uninstalling a
+// departed node
+func (r *CcRuntimeReconciler) departedUninstallOperations() []string {
+	operations := []string{string(UninstallOperation)}
+	for _, stage := range []ccv1beta1.HookStage{ccv1beta1.PreUninstallHookStage, ccv1beta1.PostUninstallHookStage} {
+		for _, hook := range r.hooks(stage) {
+			operations = append(operations, hook.operation)
+		}
+	}
+	return operations
+}
+
+// departedNodeUninstalled returns whether all the steps of the uninstallation
+// are done on the node
+func (r *CcRuntimeReconciler) departedNodeUninstalled(node *corev1.Node) bool {
+	for _, stage := range []ccv1beta1.HookStage{ccv1beta1.PreUninstallHookStage, ccv1beta1.PostUninstallHookStage} {
+		for _, hook := range r.hooks(stage) {
+			if !hasNodeLabels(node, hook.doneLabelSelector()) {
+				return false
+			}
+		}
+	}
+	return !r.uninstallPending(node)
+}
+
+// resetDepartedNode removes the operator labels of the node, and the Jobs that
+// uninstalled it, so the node is uninstalled again if it departs again, or
+// installed again if it comes back
+func (r *CcRuntimeReconciler) resetDepartedNode(node *corev1.Node) error {
+	if _, err := r.removeNodeLabels(&corev1.NodeList{Items: []corev1.Node{*node}}); err != nil {
+		return err
+	}
+	for _, operation := range r.departedUninstallOperations() {
+		if err := r.deleteNodeJob(operation, node.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDepartedNodeHooks runs the hooks of the stage on the nodes, and returns
+// the nodes all of them are done on
+func (r *CcRuntimeReconciler) runDepartedNodeHooks(stage ccv1beta1.HookStage, nodes []corev1.Node,
+	failed *[]ccv1beta1.FailedNodeStatus) ([]corev1.Node, error) {
+	for _, hook := range r.hooks(stage) {
+		pending := func(node *corev1.Node) bool {
+			return !hasNodeLabels(node, hook.doneLabelSelector())
+		}
+		result, err := r.runHookJobs(&hook, nodes, pending)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.labelNodes(result.completed, hook.doneLabelSelector()); err != nil {
+			return nil, err
+		}
+		*failed = append(*failed, result.failed...)
+
+		var done []corev1.Node
+		for i := range nodes {
+			if !pending(&nodes[i]) || contains(result.completed, nodes[i].Name) {
+				done = append(done, nodes[i])
+			}
+		}
+		nodes = done
+	}
+	return nodes, nil
+}
+
+// runDepartedNodeUninstall runs the uninstall Jobs on the nodes, and returns
+// the nodes the uninstallation is done on
+func (r *CcRuntimeReconciler) runDepartedNodeUninstall(nodes []corev1.Node,
+	failed *[]ccv1beta1.FailedNodeStatus) ([]corev1.Node, error) {
+	// The uninstall pods only run on the nodes labelled to be uninstalled
+	var unlabelled []string
+	for i := range nodes {
+		if nodes[i].Labels[StartUninstallLabel[0]] != StartUninstallLabel[1] {
+			unlabelled = append(unlabelled, nodes[i].Name)
+		}
+	}
+	if err := r.labelNodes(unlabelled, map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]}); err != nil {
+		return nil, err
+	}
+
+	result, err := r.runUninstallNodeJobs(nodes)
+	if err != nil {
+		return nil, err
+	}
+	*failed = append(*failed, result.failed...)
+
+	var done []corev1.Node
+	for i := range nodes {
+		if !r.uninstallPending(&nodes[i]) || contains(result.completed, nodes[i].Name) {
+			done = append(done, nodes[i])
+		}
+	}
+	return done, nil
+}
+
+// pruneNodeStatus removes the nodes that aren't selected anymore from the
+// installation status, and the deleted ones from the uninstallation status,
+// and counts the nodes of the lists again
+func (r *CcRuntimeReconciler) pruneNodeStatus(selected, existing map[string]bool) {
+	keep := func(names []string, members map[string]bool) []string {
+		var kept []string
+		for _, name := range names {
+			if members[name] {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	keepFailed := func(nodes []ccv1beta1.FailedNodeStatus, members map[string]bool) []ccv1beta1.FailedNodeStatus {
+		var kept []ccv1beta1.FailedNodeStatus
+		for _, node := range nodes {
+			if members[node.Name] {
+				kept = append(kept, node)
+			}
+		}
+		return kept
+	}
+
+	status := &r.ccRuntime.Status
+	install := &status.InstallationStatus
+	install.InProgress.BinariesInstalledNodesList = keep(install.InProgress.BinariesInstalledNodesList, selected)
+	install.InProgress.InProgressNodesCount = len(install.InProgress.BinariesInstalledNodesList)
+	install.Completed.CompletedNodesList = keep(install.Completed.CompletedNodesList, selected)
+	install.Completed.CompletedNodesCount = len(install.Completed.CompletedNodesList)
+	install.Failed.FailedNodesList = keepFailed(install.Failed.FailedNodesList, selected)
+	install.Failed.FailedNodesCount = len(install.Failed.FailedNodesList)
+
+	uninstall := &status.UnInstallationStatus
+	uninstall.InProgress.BinariesUnInstalledNodesList = keep(uninstall.InProgress.BinariesUnInstalledNodesList, existing)
+	uninstall.Failed.FailedNodesList = keepFailed(uninstall.Failed.FailedNodesList, existing)
+	uninstall.Failed.FailedNodesCount = len(uninstall.Failed.FailedNodesList)
+
+	for i := range status.Hooks {
+		status.Hooks[i].CompletedNodesList = keep(status.Hooks[i].CompletedNodesList, selected)
+		status.Hooks[i].FailedNodesList = keepFailed(status.Hooks[i].FailedNodesList, selected)
+	}
+
+	var preflight []ccv1beta1.PreflightNodeStatus
+	for _, node := range status.Preflight {
+		if selected[node.Name] {
+			preflight = append(preflight, node)
+		}
+	}
+	status.Preflight = preflight
+
+	var nodeRuntimes []ccv1beta1.NodeRuntimeStatus
+	for _, node := range status.NodeRuntimes {
+		if selected[node.Name] {
+			nodeRuntimes = append(nodeRuntimes, node)
+		}
+	}
+	status.NodeRuntimes = nodeRuntimes
+}
+
+/*
+reconcileNodeMembership uninstalls the runtime from the nodes that left the
+selection of the CcRuntime, e.g. when their label was removed: the preUninstall
+hooks, the uninstall Job and the postUninstall hooks run on each of them, and
+their operator labels are removed once all of them are done. The nodes coming
+back to the selection meanwhile are reset, to be installed again. The nodes
+being uninstalled are reported in status.departedNodes, and the status lists
+only keep the nodes that are still selected, or still exist for the
+uninstallation.
+
+The nodes of the CcRuntime are the ones reported in the status by the previous
+reconciliations.
+*/
+func (r *CcRuntimeReconciler) reconcileNodeMembership(selectedNodes []corev1.Node) error {
+	allNodes := &corev1.NodeList{}
+	if err := r.List(context.TODO(), allNodes); err != nil {
+		r.Log.Info("listing the nodes failed while checking the nodes that left the selection")
+		return err
+	}
+	existing := map[string]bool{}
+	nodesByName := map[string]*corev1.Node{}
+	for i := range allNodes.Items {
+		existing[allNodes.Items[i].Name] = true
+		nodesByName[allNodes.Items[i].Name] = &allNodes.Items[i]
+	}
+	selected := map[string]bool{}
+	for i := range selectedNodes {
+		selected[selectedNodes[i].Name] = true
+	}
+
+	status := &r.ccRuntime.Status
+	members := append([]string{}, status.DepartedNodes...)
+	members = append(members, status.InstallationStatus.Completed.CompletedNodesList...)
+	for _, node := range status.NodeRuntimes {
+		members = append(members, node.Name)
+	}
+
+	var departed, uninstalled []corev1.Node
+	seen := map[string]bool{}
+	for _, name := range members {
+		node := nodesByName[name]
+		// The deleted nodes have nothing left to uninstall
+		if seen[name] || node == nil {
+			continue
+		}
+		seen[name] = true
+
+		switch {
+		case selected[name] && contains(status.DepartedNodes, name):
+			r.Log.Info("resetting the node back in the selection", "nodeName", name)
+			if err := r.resetDepartedNode(node); err != nil {
+				return err
+			}
+		case selected[name]:
+		case r.departedNodeUninstalled(node):
+			uninstalled = append(uninstalled, *node)
+		default:
+			departed = append(departed, *node)
+		}
+	}
+
+	var failed []ccv1beta1.FailedNodeStatus
+	nodes, err := r.runDepartedNodeHooks(ccv1beta1.PreUninstallHookStage, departed, &failed)
+	if err != nil {
+		return err
+	}
+	nodes, err = r.runDepartedNodeUninstall(nodes, &failed)
+	if err != nil {
+		return err
+	}
+	if _, err := r.runDepartedNodeHooks(ccv1beta1.PostUninstallHookStage, nodes, &failed); err != nil {
+		return err
+	}
+
+	previous := status.DeepCopy()
+	departedNames := make([]string, 0, len(departed))
+	for i := range departed {
+		departedNames = append(departedNames, departed[i].Name)
+	}
+	sort.Strings(departedNames)
+	for _, name := range departedNames {
+		if !contains(previous.DepartedNodes, name) {
+			r.recordEvent(corev1.EventTypeNormal, "NodeDeparted", "Uninstalling from node %s, which left the node selector", name)
+		}
+	}
+	status.DepartedNodes = departedNames
+	r.pruneNodeStatus(selected, existing)
+	if len(departed) > 0 || len(previous.DepartedNodes) > 0 {
+		for _, node := range failed {
+			if !containsFailedNode(previous.UnInstallationStatus.Failed.FailedNodesList, node.Name) {
+				r.recordEvent(corev1.EventTypeWarning, "UninstallFailed", "Uninstallation failed on node %s: %s", node.Name, node.Error)
+			}
+		}
+		status.UnInstallationStatus.Failed.FailedNodesList = failed
+		status.UnInstallationStatus.Failed.FailedNodesCount = len(failed)
+	}
+
+	if !equality.Semantic.DeepEqual(previous, status) {
+		if err := r.updateCcRuntimeStatus(); err != nil {
+			r.Log.Info("failed to update status after checking the nodes that left the selection")
+			return err
+		}
+	}
+
+	// The labels set by the steps are only seen by the next reconciliation, the
+	// labels of the nodes are removed then. The nodes are forgotten first, so
+	// they aren't uninstalled again if removing their labels fails
+	for i := range uninstalled {
+		if err := r.resetDepartedNode(&uninstalled[i]); err != nil {
+			return err
+		}
+		r.recordEvent(corev1.EventTypeNormal, "NodeUninstalled",
+			"Uninstalled from node %s, which left the node selector", uninstalled[i].Name)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Node membership", func() {
+	It("prunes the nodes that left the selection from the status", func() {
+		r, _ := newTestReconciler(newTestCcRuntime(uniqueName("membership")))
+		failed := func(names ...string) []ccv1beta1.FailedNodeStatus {
+			var nodes []ccv1beta1.FailedNodeStatus
+			for _, name := range names {
+				nodes = append(nodes, ccv1beta1.FailedNodeStatus{Name: name, Error: "BackoffLimitExceeded"})
+			}
+			return nodes
+		}
+		status := &r.ccRuntime.Status
+		status.InstallationStatus.InProgress.BinariesInstalledNodesList = []string{"worker-1", "worker-2"}
+		status.InstallationStatus.InProgress.InProgressNodesCount = 2
+		status.InstallationStatus.Completed.CompletedNodesList = []string{"worker-1", "worker-3"}
+		status.InstallationStatus.Completed.CompletedNodesCount = 2
+		status.InstallationStatus.Failed.FailedNodesList = failed("worker-2", "worker-4")
+		status.InstallationStatus.Failed.FailedNodesCount = 2
+		status.UnInstallationStatus.InProgress.BinariesUnInstalledNodesList = []string{"worker-3", "worker-5"}
+		status.UnInstallationStatus.Failed.FailedNodesList = failed("worker-3", "worker-5")
+		status.UnInstallationStatus.Failed.FailedNodesCount = 2
+		status.Hooks = []ccv1beta1.HookStatus{{
+			Name:               "pre-install",
+			Stage:              ccv1beta1.PreInstallHookStage,
+			Phase:              ccv1beta1.HookCompleted,
+			CompletedNodesList: []string{"worker-1", "worker-3"},
+			FailedNodesList:    failed("worker-4"),
+		}}
+		status.Preflight = []ccv1beta1.PreflightNodeStatus{{Name: "worker-1", Passed: true}, {Name: "worker-3", Passed: true}}
+		status.NodeRuntimes = []ccv1beta1.NodeRuntimeStatus{
+			{Name: "worker-1", ContainerRuntime: ccv1beta1.ContainerdRuntime},
+			{Name: "worker-3", ContainerRuntime: ccv1beta1.ContainerdRuntime},
+		}
+
+		// worker-3 left the selection, worker-4 and worker-5 were deleted
+		selected := map[string]bool{"worker-1": true, "worker-2": true}
+		existing := map[string]bool{"worker-1": true, "worker-2": true, "worker-3": true}
+		r.pruneNodeStatus(selected, existing)
+
+		Expect(status.InstallationStatus.InProgress.BinariesInstalledNodesList).To(Equal([]string{"worker-1", "worker-2"}))
+		Expect(status.InstallationStatus.InProgress.InProgressNodesCount).To(Equal(2))
+		Expect(status.InstallationStatus.Completed.CompletedNodesList).To(Equal([]string{"worker-1"}))
+		Expect(status.InstallationStatus.Completed.CompletedNodesCount).To(Equal(1))
+		Expect(status.InstallationStatus.Failed.FailedNodesList).To(Equal(failed("worker-2")))
+		Expect(status.InstallationStatus.Failed.FailedNodesCount).To(Equal(1))
+		Expect(status.UnInstallationStatus.InProgress.BinariesUnInstalledNodesList).To(Equal([]string{"worker-3"}))
+		Expect(status.UnInstallationStatus.Failed.FailedNodesList).To(Equal(failed("worker-3")))
+		Expect(status.UnInstallationStatus.Failed.FailedNodesCount).To(Equal(1))
+		Expect(status.Hooks[0].CompletedNodesList).To(Equal([]string{"worker-1"}))
+		Expect(status.Hooks[0].FailedNodesList).To(BeEmpty())
+		Expect(status.Preflight).To(ConsistOf(HaveField("Name", "worker-1")))
+		Expect(status.NodeRuntimes).To(ConsistOf(HaveField("Name", "worker-1")))
+	})
+
+	Context("with a node leaving the selection", func() {
+		const preUninstallHook = "drain"
+
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			recorder  *record.FakeRecorder
+			labels    map[string]string
+			nodeName  string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("membership"))
+			ccRuntime.Spec.Config.PostUninstall.Image = "quay.io/confidential-containers/reqs-payload:latest"
+			ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+				{Name: preUninstallHook, Stage: ccv1beta1.PreUninstallHookStage, Image: "quay.io/coco/drain:latest"},
+			}
+			labels = selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+
+			nodeName = uniqueName("membership-node")
+			createTestNode(nodeName, map[string]string{
+				testNodeLabel:                    ccRuntime.Name,
+				"katacontainers.io/kata-runtime": "true",
+			})
+			ccRuntime.Status.InstallationStatus.Completed.CompletedNodesList = []string{nodeName}
+			ccRuntime.Status.InstallationStatus.Completed.CompletedNodesCount = 1
+			Expect(k8sClient.Status().Update(context.TODO(), ccRuntime)).To(Succeed())
+			r, recorder = newTestReconciler(ccRuntime)
+		})
+
+		// leave removes the label the CcRuntime selects the node with
+		leave := func() {
+			node := getNode(nodeName)
+			delete(node.Labels, testNodeLabel)
+			Expect(k8sClient.Update(context.TODO(), node)).To(Succeed())
+		}
+
+		reconcile := func(selected ...corev1.Node) {
+			Expect(r.reconcileNodeMembership(selected)).To(Succeed())
+		}
+
+		nodeJob := func(operation string) *batchv1.Job {
+			job, err := getNodeJob(operation, nodeName)
+			Expect(err).NotTo(HaveOccurred())
+			return job
+		}
+
+		expectNoNodeJob := func(operation string) {
+			_, err := getNodeJob(operation, nodeName)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Job %s", operation)
+		}
+
+		It("keeps the selected nodes", func() {
+			reconcile(*getNode(nodeName))
+			Expect(getCcRuntime(ccRuntime.Name).Status.DepartedNodes).To(BeEmpty())
+			Expect(getCcRuntime(ccRuntime.Name).Status.InstallationStatus.Completed.CompletedNodesList).To(
+				Equal([]string{nodeName}))
+			expectNoNodeJob("hook-" + preUninstallHook)
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("runs the preUninstall hooks, the uninstallation and the postUninstall hooks in turn", func() {
+			leave()
+			reconcile()
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.DepartedNodes).To(Equal([]string{nodeName}))
+			Expect(stored.Status.InstallationStatus.Completed.CompletedNodesList).To(BeEmpty())
+			Expect(stored.Status.InstallationStatus.Completed.CompletedNodesCount).To(BeZero())
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("NodeDeparted")))
+			hookJob := nodeJob("hook-" + preUninstallHook)
+			Expect(hookJob.OwnerReferences).To(ConsistOf(HaveField("Name", ccRuntime.Name)))
+			expectNoNodeJob(string(UninstallOperation))
+
+			// The uninstallation starts once the preUninstall hooks are done
+			reconcile()
+			expectNoNodeJob(string(UninstallOperation))
+			completeJob(hookJob)
+			reconcile()
+			hook := &r.hooks(ccv1beta1.PreUninstallHookStage)[0]
+			Expect(getNode(nodeName).Labels).To(And(
+				HaveKeyWithValue(hook.doneLabel[0], "done"),
+				HaveKeyWithValue(StartUninstallLabel[0], StartUninstallLabel[1])))
+			uninstallJob := nodeJob(string(UninstallOperation))
+			Expect(uninstallJob.Spec.Template.Spec.Containers[0].Command).To(
+				Equal([]string{"/opt/kata-artifacts/scripts/kata-deploy.sh", "cleanup"}))
+			expectNoNodeJob(string(PostUninstallOperation))
+
+			// The postUninstall hooks run once the node is uninstalled
+			completeJob(uninstallJob)
+			reconcile()
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue("katacontainers.io/kata-runtime", "cleanup"))
+			postUninstallJob := nodeJob(string(PostUninstallOperation))
+			Expect(postUninstallJob.Spec.Template.Spec.Containers[0].Image).To(
+				Equal("quay.io/confidential-containers/reqs-payload:latest"))
+
+			completeJob(postUninstallJob)
+			reconcile()
+			postUninstall := &r.hooks(ccv1beta1.PostUninstallHookStage)[0]
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue(postUninstall.doneLabel[0], "done"))
+			Expect(getCcRuntime(ccRuntime.Name).Status.DepartedNodes).To(Equal([]string{nodeName}))
+
+			// The next reconciliation sees all the steps are done, and resets the node
+			reconcile()
+			Expect(getCcRuntime(ccRuntime.Name).Status.DepartedNodes).To(BeEmpty())
+			Expect(getNode(nodeName).Labels).NotTo(Or(
+				HaveKey(hook.doneLabel[0]),
+				HaveKey(postUninstall.doneLabel[0]),
+				HaveKey(StartUninstallLabel[0]),
+				HaveKey("katacontainers.io/kata-runtime")))
+			for _, operation := range r.departedUninstallOperations() {
+				expectNoNodeJob(operation)
+			}
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("NodeUninstalled")))
+
+			// The node isn't a member anymore, and isn't uninstalled again
+			reconcile()
+			expectNoNodeJob("hook-" + preUninstallHook)
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("reports the nodes the uninstallation failed on", func() {
+			leave()
+			reconcile()
+			completeJob(nodeJob("hook-" + preUninstallHook))
+			reconcile()
+			failJob(nodeJob(string(UninstallOperation)), "BackoffLimitExceeded", "Job has reached the specified backoff limit")
+			events(recorder)
+
+			reconcile()
+			failed := getCcRuntime(ccRuntime.Name).Status.UnInstallationStatus.Failed
+			Expect(failed.FailedNodesList).To(ConsistOf(And(
+				HaveField("Name", nodeName),
+				HaveField("Error", ContainSubstring("BackoffLimitExceeded")))))
+			Expect(failed.FailedNodesCount).To(Equal(1))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("UninstallFailed")))
+			expectNoNodeJob(string(PostUninstallOperation))
+
+			// The failure is only reported once
+			reconcile()
+			Expect(events(recorder)).To(BeEmpty())
+			Expect(getCcRuntime(ccRuntime.Name).Status.DepartedNodes).To(Equal([]string{nodeName}))
+		})
+
+		It("resets a departed node coming back to the selection", func() {
+			leave()
+			reconcile()
+			completeJob(nodeJob("hook-" + preUninstallHook))
+			reconcile()
+			nodeJob(string(UninstallOperation))
+
+			setNodeLabels(nodeName, labels)
+			reconcile(*getNode(nodeName))
+			Expect(getCcRuntime(ccRuntime.Name).Status.DepartedNodes).To(BeEmpty())
+			hook := &r.hooks(ccv1beta1.PreUninstallHookStage)[0]
+			Expect(getNode(nodeName).Labels).NotTo(Or(HaveKey(hook.doneLabel[0]), HaveKey(StartUninstallLabel[0])))
+			Expect(getNode(nodeName).Labels).To(HaveKeyWithValue(testNodeLabel, ccRuntime.Name))
+			for _, operation := range r.departedUninstallOperations() {
+				expectNoNodeJob(operation)
+			}
+		})
+
+		It("forgets the deleted nodes", func() {
+			Expect(k8sClient.Delete(context.TODO(), getNode(nodeName))).To(Succeed())
+
+			reconcile()
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.DepartedNodes).To(BeEmpty())
+			Expect(stored.Status.InstallationStatus.Completed.CompletedNodesList).To(BeEmpty())
+			expectNoNodeJob("hook-" + preUninstallHook)
+			Expect(events(recorder)).To(BeEmpty())
+		})
+	})
+})
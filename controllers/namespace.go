@@ -0,0 +1,131 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// podSecurityLabels are the Pod Security Admission labels set on the namespace
+// to allow the privileged payload pods
+var podSecurityLabels = []string{
+	"pod-security.kubernetes.io/enforce",
+	"pod-security.kubernetes.io/audit",
+	"pod-security.kubernetes.io/warn",
+}
+
+// labelNamespace allows privileged pods in the namespace via the Pod Security
+// Admission controller. The original values of the labels are saved in an
+// annotation, so restoreNamespaceLabels can put them back.
+func (r *CcRuntimeReconciler) labelNamespace() error {
+	if !r.LabelNamespace {
+		return nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: r.Namespace}, ns); err != nil {
+		r.Log.Info("failed to get the namespace to label", "namespace", r.Namespace)
+		return err
+	}
+
+	changed := false
+	if _, saved := ns.Annotations[PodSecurityLabelsAnnotation]; !saved {
+		original := map[string]string{}
+		for _, label := range podSecurityLabels {
+			if value, ok := ns.Labels[label]; ok {
+				original[label] = value
+			}
+		}
+		data, err := json.Marshal(original)
+		if err != nil {
+			return err
+		}
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+		ns.Annotations[PodSecurityLabelsAnnotation] = string(data)
+		changed = true
+	}
+
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	for _, label := range podSecurityLabels {
+		if ns.Labels[label] != "privileged" {
+			ns.Labels[label] = "privileged"
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	r.Log.Info("Labelling Namespace", "namespace", r.Namespace)
+	return r.Update(context.TODO(), ns)
+}
+
+// restoreNamespaceLabels puts back the Pod Security Admission labels the
+// namespace had before labelNamespace, once no CcRuntime but the one being
+// deleted is left. It runs before the finalizer of the last CcRuntime is
+// removed, and again once it's gone in case another CcRuntime was deleted
+// along with it.
+func (r *CcRuntimeReconciler) restoreNamespaceLabels() error {
+	if !r.LabelNamespace {
+		return nil
+	}
+
+	ccRuntimeList := &ccv1beta1.CcRuntimeList{}
+	if err := r.List(context.TODO(), ccRuntimeList); err != nil {
+		return err
+	}
+	for _, ccRuntime := range ccRuntimeList.Items {
+		if ccRuntime.Name != r.ccRuntime.Name {
+			return nil
+		}
+	}
+
+	ns := &corev1.Namespace{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: r.Namespace}, ns); err != nil {
+		return err
+	}
+	saved, ok := ns.Annotations[PodSecurityLabelsAnnotation]
+	if !ok {
+		return nil
+	}
+	original := map[string]string{}
+	if err := json.Unmarshal([]byte(saved), &original); err != nil {
+		r.Log.Error(err, "ignoring the invalid saved Pod Security labels", "namespace", r.Namespace)
+	}
+
+	for _, label := range podSecurityLabels {
+		if value, ok := original[label]; ok {
+			ns.Labels[label] = value
+		} else {
+			delete(ns.Labels, label)
+		}
+	}
+	delete(ns.Annotations, PodSecurityLabelsAnnotation)
+
+	r.Log.Info("Restoring the Namespace labels", "namespace", r.Namespace)
+	return r.Update(context.TODO(), ns)
+}
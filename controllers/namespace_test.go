@@ -0,0 +1,165 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Namespace Pod Security labels", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+		namespace string
+	)
+
+	getNamespace := func() *corev1.Namespace {
+		ns := &corev1.Namespace{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: namespace}, ns)).To(Succeed())
+		return ns
+	}
+
+	originalLabels := map[string]string{
+		"pod-security.kubernetes.io/enforce": "restricted",
+		"pod-security.kubernetes.io/warn":    "baseline",
+		"team":                               "platform",
+	}
+
+	// labels returns the labels of the namespace the spec set, without the
+	// kubernetes.io/metadata.name one of the API server
+	labels := func(ns *corev1.Namespace) map[string]string {
+		set := map[string]string{}
+		for k, v := range ns.Labels {
+			if k != corev1.LabelMetadataName {
+				set[k] = v
+			}
+		}
+		return set
+	}
+
+	// newReconciler returns a reconciler labelling the namespace of the spec
+	newReconciler := func(ccRuntime *ccv1beta1.CcRuntime) *CcRuntimeReconciler {
+		r, _ := newTestReconciler(ccRuntime)
+		r.Namespace = namespace
+		r.LabelNamespace = true
+		return r
+	}
+
+	BeforeEach(func() {
+		namespace = uniqueName("psa")
+		nsLabels := map[string]string{}
+		for k, v := range originalLabels {
+			nsLabels[k] = v
+		}
+		Expect(k8sClient.Create(context.TODO(), &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: nsLabels},
+		})).To(Succeed())
+
+		ccRuntime = newTestCcRuntime(uniqueName("psa"))
+		ccRuntime.Finalizers = []string{RuntimeConfigFinalizer}
+		selectTestNodes(ccRuntime)
+		createTestCcRuntime(ccRuntime)
+		r = newReconciler(ccRuntime)
+	})
+
+	It("allows privileged pods and saves the labels it changes", func() {
+		Expect(r.labelNamespace()).To(Succeed())
+		ns := getNamespace()
+		Expect(labels(ns)).To(Equal(map[string]string{
+			"pod-security.kubernetes.io/enforce": "privileged",
+			"pod-security.kubernetes.io/audit":   "privileged",
+			"pod-security.kubernetes.io/warn":    "privileged",
+			"team":                               "platform",
+		}))
+		Expect(ns.Annotations[PodSecurityLabelsAnnotation]).To(MatchJSON(
+			`{"pod-security.kubernetes.io/enforce":"restricted","pod-security.kubernetes.io/warn":"baseline"}`))
+
+		// The labels saved first are kept
+		Expect(r.labelNamespace()).To(Succeed())
+		Expect(getNamespace().Annotations[PodSecurityLabelsAnnotation]).To(
+			Equal(ns.Annotations[PodSecurityLabelsAnnotation]))
+	})
+
+	It("leaves the namespace alone without --label-namespace", func() {
+		r.LabelNamespace = false
+		Expect(r.labelNamespace()).To(Succeed())
+		ns := getNamespace()
+		Expect(labels(ns)).To(Equal(originalLabels))
+		Expect(ns.Annotations).NotTo(HaveKey(PodSecurityLabelsAnnotation))
+	})
+
+	It("restores the labels before removing the finalizer of the last CcRuntime", func() {
+		Expect(r.labelNamespace()).To(Succeed())
+
+		Expect(k8sClient.Delete(context.TODO(), ccRuntime)).To(Succeed())
+		r.ccRuntime = getCcRuntime(ccRuntime.Name)
+		Expect(r.ccRuntime.DeletionTimestamp).NotTo(BeNil())
+		_, err := r.processCcRuntimeDeleteRequest()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(ccRuntime), &ccv1beta1.CcRuntime{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		ns := getNamespace()
+		Expect(labels(ns)).To(Equal(originalLabels))
+		Expect(ns.Annotations).NotTo(HaveKey(PodSecurityLabelsAnnotation))
+	})
+
+	It("keeps the labels while other CcRuntimes are left and restores them once they're gone", func() {
+		other := newTestCcRuntime(uniqueName("psa"))
+		createTestCcRuntime(other)
+		Expect(r.labelNamespace()).To(Succeed())
+
+		Expect(k8sClient.Delete(context.TODO(), ccRuntime)).To(Succeed())
+		r.ccRuntime = getCcRuntime(ccRuntime.Name)
+		_, err := r.processCcRuntimeDeleteRequest()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getNamespace().Labels).To(HaveKeyWithValue("pod-security.kubernetes.io/enforce", "privileged"))
+
+		// The last CcRuntime is deleted along with it, the next reconciliation
+		// of the gone CcRuntime restores them
+		Expect(k8sClient.Delete(context.TODO(), other)).To(Succeed())
+		_, err = r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ccRuntime)})
+		Expect(err).NotTo(HaveOccurred())
+		ns := getNamespace()
+		Expect(labels(ns)).To(Equal(originalLabels))
+		Expect(ns.Annotations).NotTo(HaveKey(PodSecurityLabelsAnnotation))
+	})
+
+	It("removes the labels the namespace didn't have", func() {
+		ns := getNamespace()
+		ns.Labels = nil
+		Expect(k8sClient.Update(context.TODO(), ns)).To(Succeed())
+		Expect(r.labelNamespace()).To(Succeed())
+		Expect(getNamespace().Annotations[PodSecurityLabelsAnnotation]).To(Equal("{}"))
+
+		Expect(r.restoreNamespaceLabels()).To(Succeed())
+		ns = getNamespace()
+		for _, label := range podSecurityLabels {
+			Expect(ns.Labels).NotTo(HaveKey(label))
+		}
+	})
+})
@@ -0,0 +1,209 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// podTemplateOverrideFields are the fields of the pod template the overrides
+// may set, nil allowing anything below the field. The images, security
+// settings and ServiceAccount of the pods are left out, so the overrides can't
+// bypass the digest pinning, the signature verification, the mirrors, the
+// security profile or the dedicated ServiceAccount
+var podTemplateOverrideFields = map[string]interface{}{
+	"metadata": map[string]interface{}{
+		"labels":      nil,
+		"annotations": nil,
+	},
+	"spec": map[string]interface{}{
+		"priorityClassName": nil,
+		"affinity":          nil,
+		"tolerations":       nil,
+		"dnsPolicy":         nil,
+		"containers": []interface{}{
+			map[string]interface{}{
+				"name":      nil,
+				"resources": nil,
+			},
+		},
+	},
+}
+
+// checkOverrideFields returns an error naming the first field of the patch
+// that isn't allowed
+func checkOverrideFields(patch interface{}, allowed interface{}, path string) error {
+	switch allowed := allowed.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		fields, ok := patch.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for name, value := range fields {
+			fieldAllowed, ok := allowed[name]
+			if !ok {
+				return fmt.Errorf("%s.%s can't be overridden", path, name)
+			}
+			if err := checkOverrideFields(value, fieldAllowed, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items, ok := patch.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a list", path)
+		}
+		for i, item := range items {
+			if err := checkOverrideFields(item, allowed[0], fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// patchPodTemplate applies the strategic merge patch to the pod template. The
+// patch may only set the fields of podTemplateOverrideFields
+func patchPodTemplate(template *corev1.PodTemplateSpec, patch *runtime.RawExtension) error {
+	if patch == nil || len(patch.Raw) == 0 {
+		return nil
+	}
+
+	var fields interface{}
+	if err := json.Unmarshal(patch.Raw, &fields); err != nil {
+		return err
+	}
+	if err := checkOverrideFields(fields, podTemplateOverrideFields, "podTemplateOverrides"); err != nil {
+		return err
+	}
+
+	original, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch.Raw, corev1.PodTemplateSpec{})
+	if err != nil {
+		return err
+	}
+
+	result := corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return err
+	}
+	for _, container := range result.Spec.Containers {
+		if container.Image == "" {
+			return fmt.Errorf("container %q doesn't exist in the pod template", container.Name)
+		}
+	}
+	// The DaemonSets select their pods with their labels
+	for key, value := range template.Labels {
+		if result.Labels[key] != value {
+			return fmt.Errorf("podTemplateOverrides can't change the %s label the pods are selected with", key)
+		}
+	}
+	// The affinity may be replaced as a whole, the nodes the pod template
+	// excludes, e.g. the architectures with their own image, stay excluded
+	for _, requirement := range requiredNodeRequirements(&template.Spec) {
+		requireNode(&result.Spec, requirement)
+	}
+	*template = result
+	return nil
+}
+
+// requiredNodeRequirements returns the requirements all the terms of the
+// required node affinity of the pod spec share
+func requiredNodeRequirements(spec *corev1.PodSpec) []corev1.NodeSelectorRequirement {
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil ||
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return nil
+	}
+	var requirements []corev1.NodeSelectorRequirement
+	for _, requirement := range terms[0].MatchExpressions {
+		shared := true
+		for _, term := range terms[1:] {
+			shared = shared && containsRequirement(term.MatchExpressions, requirement)
+		}
+		if shared {
+			requirements = append(requirements, requirement)
+		}
+	}
+	return requirements
+}
+
+// applyPodTemplateOverride applies one of the podTemplateOverrides to the pod
+// template. The overrides are validated by validatePodTemplateOverrides before
+// anything is rendered, so a failure only leaves the template unchanged.
+func (r *CcRuntimeReconciler) applyPodTemplateOverride(template *corev1.PodTemplateSpec, patch *runtime.RawExtension) {
+	if err := patchPodTemplate(template, patch); err != nil {
+		r.Log.Error(err, "failed to apply the pod template override")
+	}
+}
+
+// validatePodTemplateOverrides checks that the podTemplateOverrides apply to
+// the pod templates and reports the outcome in a condition
+func (r *CcRuntimeReconciler) validatePodTemplateOverrides() error {
+	overrides := &r.ccRuntime.Spec.Config.PodTemplateOverrides
+	if overrides.Install == nil && overrides.Uninstall == nil && overrides.Hooks == nil {
+		if meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, PodTemplateOverridesValidCondition) {
+			return r.updateCcRuntimeStatus()
+		}
+		return nil
+	}
+
+	var errs []error
+	for _, override := range []struct {
+		name      string
+		container string
+		patch     *runtime.RawExtension
+	}{
+		{"install", "cc-runtime-install-pod", overrides.Install},
+		{"uninstall", "cc-runtime-install-pod", overrides.Uninstall},
+		{"hooks", hookContainerName, overrides.Hooks},
+	} {
+		template := &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{"name": "cc-operator-" + override.name},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: override.container, Image: "image"}},
+			},
+		}
+		if err := patchPodTemplate(template, override.patch); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", override.name, err))
+		}
+	}
+
+	return r.setConditionFromError(metav1.Condition{
+		Type:    PodTemplateOverridesValidCondition,
+		Reason:  "Valid",
+		Message: "The pod template overrides apply",
+	}, "InvalidPodTemplateOverrides", errors.Join(errs...))
+}
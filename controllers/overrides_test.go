@@ -0,0 +1,121 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Pod template overrides", func() {
+	DescribeTable("validating the patches",
+		func(patch string, want string) {
+			ccRuntime := newTestCcRuntime(uniqueName("overrides"))
+			ccRuntime.Spec.Config.PodTemplateOverrides.Install = &runtime.RawExtension{Raw: []byte(patch)}
+			createTestCcRuntime(ccRuntime)
+			r, _ := newTestReconciler(ccRuntime)
+
+			err := r.validatePodTemplateOverrides()
+			condition := meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions,
+				PodTemplateOverridesValidCondition)
+			Expect(condition).NotTo(BeNil())
+			if want == "" {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring(want)))
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("InvalidPodTemplateOverrides"))
+		},
+		Entry("labels, priority class and resources",
+			`{"metadata":{"labels":{"team":"platform"}},"spec":{"priorityClassName":"system-node-critical",`+
+				`"containers":[{"name":"cc-runtime-install-pod","resources":{"limits":{"memory":"512Mi"}}}]}}`, ""),
+		Entry("image",
+			`{"spec":{"containers":[{"name":"cc-runtime-install-pod","image":"quay.io/attacker/payload"}]}}`,
+			"install: podTemplateOverrides.spec.containers[0].image can't be overridden"),
+		Entry("security context",
+			`{"spec":{"securityContext":{"runAsUser":0}}}`,
+			"install: podTemplateOverrides.spec.securityContext can't be overridden"),
+		Entry("unknown container",
+			`{"spec":{"containers":[{"name":"sidecar","resources":{}}]}}`,
+			`install: container "sidecar" doesn't exist in the pod template`),
+		Entry("selector label",
+			`{"metadata":{"labels":{"name":"other"}}}`,
+			"install: podTemplateOverrides can't change the name label the pods are selected with"),
+		Entry("labels replaced",
+			`{"metadata":{"labels":{"$patch":"replace","team":"platform"}}}`,
+			"install: podTemplateOverrides can't change the name label the pods are selected with"),
+		Entry("labels removed",
+			`{"metadata":{"labels":null}}`,
+			"install: podTemplateOverrides can't change the name label the pods are selected with"),
+	)
+
+	Context("replacing the affinity", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("overrides"))
+			ccRuntime.Spec.Config.Architectures = []ccv1beta1.ArchitectureConfig{
+				{Arch: "s390x", PayloadImage: "quay.io/kata-containers/kata-deploy:3.23.0-s390x"},
+			}
+			r, _ = newTestReconciler(ccRuntime)
+		})
+
+		excludeS390x := corev1.NodeSelectorRequirement{
+			Key: ArchLabel, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"s390x"},
+		}
+
+		It("keeps excluding the architectures with their own image", func() {
+			ccRuntime.Spec.Config.PodTemplateOverrides.Install = &runtime.RawExtension{Raw: []byte(
+				`{"spec":{"affinity":{"nodeAffinity":{"$patch":"replace","requiredDuringSchedulingIgnoredDuringExecution":` +
+					`{"nodeSelectorTerms":[{"matchExpressions":[{"key":"node-role.kubernetes.io/tee","operator":"Exists"}]},` +
+					`{"matchExpressions":[{"key":"example.com/sev","operator":"Exists"}]}]}}}}}`)}
+
+			ds, err := r.processDaemonset(InstallOperation, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			terms := ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			Expect(terms).To(HaveLen(2))
+			Expect(terms[0].MatchExpressions).To(ConsistOf(
+				HaveField("Key", "node-role.kubernetes.io/tee"), excludeS390x))
+			Expect(terms[1].MatchExpressions).To(ConsistOf(
+				HaveField("Key", "example.com/sev"), excludeS390x))
+			Expect(ds.Spec.Template.Labels).To(HaveKeyWithValue("name", ds.Name))
+		})
+
+		It("doesn't repeat the requirements the patch keeps", func() {
+			ccRuntime.Spec.Config.PodTemplateOverrides.Install = &runtime.RawExtension{Raw: []byte(
+				`{"spec":{"priorityClassName":"system-node-critical"}}`)}
+
+			ds, err := r.processDaemonset(InstallOperation, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			terms := ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			Expect(terms).To(ConsistOf(corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{excludeS390x},
+			}))
+		})
+	})
+})
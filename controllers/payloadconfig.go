@@ -0,0 +1,206 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// PayloadConfigMountPath is where the configFrom keys are mounted in the installer pods
+	PayloadConfigMountPath = "/etc/cc-operator/config"
+
+	payloadConfigVolumeName = "cc-operator-payload-config"
+)
+
+// readPayloadConfig returns the value of the key a configFrom entry references
+func (r *CcRuntimeReconciler) readPayloadConfig(source *ccv1beta1.PayloadConfigSource) ([]byte, error) {
+	key := types.NamespacedName{Namespace: r.Namespace}
+
+	if ref := source.SecretKeyRef; ref != nil {
+		key.Name = ref.Name
+		secret := &corev1.Secret{}
+		if err := r.Get(context.TODO(), key, secret); err != nil {
+			return nil, fmt.Errorf("%s: failed to get Secret %s: %w", source.Name, ref.Name, err)
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return nil, fmt.Errorf("%s: Secret %s has no key %s", source.Name, ref.Name, ref.Key)
+		}
+		return value, nil
+	}
+
+	if ref := source.ConfigMapKeyRef; ref != nil {
+		key.Name = ref.Name
+		configMap := &corev1.ConfigMap{}
+		if err := r.Get(context.TODO(), key, configMap); err != nil {
+			return nil, fmt.Errorf("%s: failed to get ConfigMap %s: %w", source.Name, ref.Name, err)
+		}
+		if value, ok := configMap.Data[ref.Key]; ok {
+			return []byte(value), nil
+		}
+		if value, ok := configMap.BinaryData[ref.Key]; ok {
+			return value, nil
+		}
+		return nil, fmt.Errorf("%s: ConfigMap %s has no key %s", source.Name, ref.Name, ref.Key)
+	}
+
+	return nil, fmt.Errorf("%s: neither secretKeyRef nor configMapKeyRef is set", source.Name)
+}
+
+// resolvePayloadConfig reads the Secrets and ConfigMaps referenced by configFrom
+// and keeps a hash of their content, which is set on the pod templates so a
+// rotation rolls out. Only the references are reported, never the values.
+func (r *CcRuntimeReconciler) resolvePayloadConfig() error {
+	r.payloadConfigHash = ""
+	sources := r.ccRuntime.Spec.Config.ConfigFrom
+	if len(sources) == 0 {
+		if meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, PayloadConfigResolvedCondition) {
+			return r.updateCcRuntimeStatus()
+		}
+		return nil
+	}
+
+	var errs []error
+	hash := sha256.New()
+	for i := range sources {
+		value, err := r.readPayloadConfig(&sources[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		valueHash := sha256.Sum256(value)
+		fmt.Fprintf(hash, "%s=%x\n", sources[i].Name, valueHash)
+	}
+
+	err := errors.Join(errs...)
+	if err == nil {
+		r.payloadConfigHash = hex.EncodeToString(hash.Sum(nil))[:16]
+	}
+	return r.setConditionFromError(metav1.Condition{
+		Type:    PayloadConfigResolvedCondition,
+		Reason:  "Resolved",
+		Message: "All the configFrom keys are available",
+	}, "PayloadConfigNotFound", err)
+}
+
+// addPayloadConfig exposes the configFrom keys to the first container of the
+// pod template, as environment variables and as files in PayloadConfigMountPath
+func (r *CcRuntimeReconciler) addPayloadConfig(template *corev1.PodTemplateSpec) {
+	sources := r.ccRuntime.Spec.Config.ConfigFrom
+	if len(sources) == 0 {
+		return
+	}
+
+	container := &template.Spec.Containers[0]
+	projections := make([]corev1.VolumeProjection, 0, len(sources))
+	for _, source := range sources {
+		env := corev1.EnvVar{Name: source.Name, ValueFrom: &corev1.EnvVarSource{}}
+		item := []corev1.KeyToPath{{Path: source.Name}}
+		if ref := source.SecretKeyRef; ref != nil {
+			env.ValueFrom.SecretKeyRef = ref.DeepCopy()
+			item[0].Key = ref.Key
+			projections = append(projections, corev1.VolumeProjection{
+				Secret: &corev1.SecretProjection{LocalObjectReference: ref.LocalObjectReference, Items: item},
+			})
+		} else if ref := source.ConfigMapKeyRef; ref != nil {
+			env.ValueFrom.ConfigMapKeyRef = ref.DeepCopy()
+			item[0].Key = ref.Key
+			projections = append(projections, corev1.VolumeProjection{
+				ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: ref.LocalObjectReference, Items: item},
+			})
+		} else {
+			continue
+		}
+		container.Env = append(container.Env, env)
+	}
+
+	var mode int32 = 0400
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: payloadConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: projections, DefaultMode: &mode},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      payloadConfigVolumeName,
+		MountPath: PayloadConfigMountPath,
+		ReadOnly:  true,
+	})
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[PayloadConfigHashAnnotation] = r.payloadConfigHash
+}
+
+// mapPayloadConfigToRequests enqueues the CcRuntimes referencing the Secret or
+// the ConfigMap in configFrom, as the KBS CA certificate, as an agent policy or
+// in spec.peerPods
+func (r *CcRuntimeReconciler) mapPayloadConfigToRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+	reconcileRequests := r.mapPeerPodsToRequests(ctx, obj)
+	if obj.GetNamespace() != r.Namespace {
+		return reconcileRequests
+	}
+	_, isSecret := obj.(*corev1.Secret)
+
+	ccRuntimeList := &ccv1beta1.CcRuntimeList{}
+	if err := r.List(ctx, ccRuntimeList); err != nil {
+		return nil
+	}
+
+	for _, ccRuntime := range ccRuntimeList.Items {
+		if attestation := ccRuntime.Spec.Attestation; isSecret && attestation != nil &&
+			attestation.KbsCACertSecretRef != nil && attestation.KbsCACertSecretRef.Name == obj.GetName() {
+			reconcileRequests = append(reconcileRequests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ccRuntime.Name},
+			})
+			continue
+		}
+		for _, runtimeClass := range ccRuntime.Spec.Config.RuntimeClasses {
+			if !isSecret && runtimeClass.AgentPolicy != nil && runtimeClass.AgentPolicy.Name == obj.GetName() {
+				reconcileRequests = append(reconcileRequests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: ccRuntime.Name},
+				})
+				break
+			}
+		}
+		for _, source := range ccRuntime.Spec.Config.ConfigFrom {
+			if (isSecret && source.SecretKeyRef != nil && source.SecretKeyRef.Name == obj.GetName()) ||
+				(!isSecret && source.ConfigMapKeyRef != nil && source.ConfigMapKeyRef.Name == obj.GetName()) {
+				reconcileRequests = append(reconcileRequests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: ccRuntime.Name},
+				})
+				break
+			}
+		}
+	}
+	return reconcileRequests
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Payload configuration", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+		secret    *corev1.Secret
+		configMap *corev1.ConfigMap
+	)
+
+	BeforeEach(func() {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: uniqueName("payload-secret"), Namespace: testNamespace},
+			Data:       map[string][]byte{"token": []byte("s3cr3t")},
+		}
+		Expect(k8sClient.Create(context.TODO(), secret)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, context.TODO(), secret)
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: uniqueName("payload-config"), Namespace: testNamespace},
+			Data:       map[string]string{"proxy": "http://proxy.example.com:3128"},
+		}
+		Expect(k8sClient.Create(context.TODO(), configMap)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, context.TODO(), configMap)
+
+		ccRuntime = newTestCcRuntime(uniqueName("payload-config"))
+		ccRuntime.Spec.Config.ConfigFrom = []ccv1beta1.PayloadConfigSource{
+			{
+				Name: "REGISTRY_TOKEN",
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name}, Key: "token",
+				},
+			},
+			{
+				Name: "HTTPS_PROXY",
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name}, Key: "proxy",
+				},
+			},
+		}
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+	})
+
+	resolvedCondition := func() *metav1.Condition {
+		return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, PayloadConfigResolvedCondition)
+	}
+
+	It("exposes the keys as environment variables and files of the installer pods", func() {
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		Expect(resolvedCondition()).To(HaveField("Status", metav1.ConditionTrue))
+
+		ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+			{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+		}
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		hook, err := r.makeHookPodTemplate(&r.hooks(ccv1beta1.PostInstallHookStage)[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		mode := int32(0400)
+		for _, template := range []corev1.PodTemplateSpec{ds.Spec.Template, hook} {
+			container := template.Spec.Containers[0]
+			Expect(container.Env).To(ContainElements(
+				corev1.EnvVar{Name: "REGISTRY_TOKEN", ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: ccRuntime.Spec.Config.ConfigFrom[0].SecretKeyRef,
+				}},
+				corev1.EnvVar{Name: "HTTPS_PROXY", ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: ccRuntime.Spec.Config.ConfigFrom[1].ConfigMapKeyRef,
+				}},
+			))
+			Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name: payloadConfigVolumeName, MountPath: PayloadConfigMountPath, ReadOnly: true,
+			}))
+			Expect(template.Spec.Volumes).To(ContainElement(corev1.Volume{
+				Name: payloadConfigVolumeName,
+				VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+					DefaultMode: &mode,
+					Sources: []corev1.VolumeProjection{
+						{Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+							Items:                []corev1.KeyToPath{{Key: "token", Path: "REGISTRY_TOKEN"}},
+						}},
+						{ConfigMap: &corev1.ConfigMapProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name},
+							Items:                []corev1.KeyToPath{{Key: "proxy", Path: "HTTPS_PROXY"}},
+						}},
+					},
+				}},
+			}))
+			Expect(template.Annotations).To(HaveKeyWithValue(PayloadConfigHashAnnotation, r.payloadConfigHash))
+		}
+	})
+
+	It("rolls the pods out when a value is rotated", func() {
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		hash := r.payloadConfigHash
+		Expect(hash).To(HaveLen(16))
+
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		Expect(r.payloadConfigHash).To(Equal(hash))
+
+		configMap.Data["proxy"] = "http://proxy.example.com:8080"
+		Expect(k8sClient.Update(context.TODO(), configMap)).To(Succeed())
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		Expect(r.payloadConfigHash).NotTo(Equal(hash))
+
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Annotations).To(HaveKeyWithValue(PayloadConfigHashAnnotation, r.payloadConfigHash))
+	})
+
+	DescribeTable("reporting the missing keys without their values",
+		func(change func(), want string) {
+			change()
+			r, recorder := newTestReconciler(ccRuntime)
+
+			err := r.resolvePayloadConfig()
+			Expect(err).To(MatchError(ContainSubstring(want)))
+			Expect(r.payloadConfigHash).To(BeEmpty())
+			condition := resolvedCondition()
+			Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("PayloadConfigNotFound"))
+			Expect(condition.Message).NotTo(ContainSubstring("s3cr3t"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("PayloadConfigNotFound")))
+		},
+		Entry("missing Secret", func() {
+			ccRuntime.Spec.Config.ConfigFrom[0].SecretKeyRef.Name = "missing"
+		}, "REGISTRY_TOKEN: failed to get Secret missing"),
+		Entry("missing Secret key", func() {
+			ccRuntime.Spec.Config.ConfigFrom[0].SecretKeyRef.Key = "password"
+		}, "REGISTRY_TOKEN: Secret "),
+		Entry("missing ConfigMap key", func() {
+			ccRuntime.Spec.Config.ConfigFrom[1].ConfigMapKeyRef.Key = "no_proxy"
+		}, "HTTPS_PROXY: ConfigMap "),
+	)
+
+	It("reads the binary data of the ConfigMaps", func() {
+		configMap.BinaryData = map[string][]byte{"ca.crt": {0x30, 0x82}}
+		Expect(k8sClient.Update(context.TODO(), configMap)).To(Succeed())
+
+		value, err := r.readPayloadConfig(&ccv1beta1.PayloadConfigSource{
+			Name: "CA_CERT",
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name}, Key: "ca.crt",
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte{0x30, 0x82}))
+	})
+
+	It("removes the condition and the volume without configFrom", func() {
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		ccRuntime.Spec.Config.ConfigFrom = nil
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+		Expect(r.resolvePayloadConfig()).To(Succeed())
+		Expect(resolvedCondition()).To(BeNil())
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Annotations).NotTo(HaveKey(PayloadConfigHashAnnotation))
+		Expect(ds.Spec.Template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", payloadConfigVolumeName)))
+	})
+
+	It("reconciles the CcRuntimes referencing a rotated Secret or ConfigMap", func() {
+		request := reconcile.Request{NamespacedName: client.ObjectKey{Name: ccRuntime.Name}}
+
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), secret)).To(ContainElement(request))
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), configMap)).To(ContainElement(request))
+
+		// A ConfigMap named like the Secret isn't referenced
+		other := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: secret.Name, Namespace: testNamespace}}
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), other)).NotTo(ContainElement(request))
+		other = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: configMap.Name, Namespace: "default"}}
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), other)).NotTo(ContainElement(request))
+	})
+})
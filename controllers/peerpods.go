@@ -0,0 +1,331 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	nodeapi "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	peerpodconfig "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/api/v1alpha1"
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// PeerPodsRuntimeClassName is the runtime class, and handler, of the peer pods
+	PeerPodsRuntimeClassName = "kata-remote"
+
+	// peerPodsVMResource is the extended resource the PeerPodConfig controller
+	// advertises on the nodes, up to the limit of peer pods per node
+	peerPodsVMResource corev1.ResourceName = "kata.peerpods.io/vm"
+
+	// caaDaemonsetName is the name of the cloud-api-adaptor DaemonSet the
+	// PeerPodConfig controller creates
+	caaDaemonsetName = "peerpodconfig-ctrl-caa-daemon"
+
+	// cloudProviderEnv is the setting of the cloud-api-adaptor selecting the cloud provider
+	cloudProviderEnv = "CLOUD_PROVIDER"
+)
+
+func (r *CcRuntimeReconciler) peerPodsConfigMapName() string {
+	return "cc-operator-peer-pods-" + r.ccRuntime.Name
+}
+
+// peerPodsOverhead returns the overhead of the pods of the kata-remote runtime class
+func peerPodsOverhead(config *ccv1beta1.PeerPodsConfig) corev1.ResourceList {
+	if len(config.Overhead) > 0 {
+		return config.Overhead
+	}
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("250m"),
+		corev1.ResourceMemory: resource.MustParse("120Mi"),
+		peerPodsVMResource:    resource.MustParse("1"),
+	}
+}
+
+func peerPodsLimit(config *ccv1beta1.PeerPodsConfig) int32 {
+	if config.Limit == nil {
+		return DefaultPeerPodsLimit
+	}
+	return *config.Limit
+}
+
+// renderPeerPodsConfig returns the settings of the cloud provider, with the
+// cloud provider of spec.peerPods, and checks that its credentials exist
+func (r *CcRuntimeReconciler) renderPeerPodsConfig() (map[string]string, error) {
+	peerPods := r.ccRuntime.Spec.PeerPods
+
+	configMap := &corev1.ConfigMap{}
+	key := types.NamespacedName{Name: peerPods.ConfigMapRef.Name, Namespace: r.PeerPodsNamespace}
+	if err := r.Get(context.TODO(), key, configMap); err != nil {
+		return nil, fmt.Errorf("failed to get the peer pods ConfigMap %s: %w", key.Name, err)
+	}
+	if provider, ok := configMap.Data[cloudProviderEnv]; ok && provider != peerPods.CloudProvider {
+		return nil, fmt.Errorf("ConfigMap %s sets %s to %s, but spec.peerPods.cloudProvider is %s",
+			key.Name, cloudProviderEnv, provider, peerPods.CloudProvider)
+	}
+
+	secret := &corev1.Secret{}
+	key = types.NamespacedName{Name: peerPods.SecretRef.Name, Namespace: r.PeerPodsNamespace}
+	if err := r.Get(context.TODO(), key, secret); err != nil {
+		return nil, fmt.Errorf("failed to get the peer pods Secret %s: %w", key.Name, err)
+	}
+
+	data := map[string]string{cloudProviderEnv: peerPods.CloudProvider}
+	for k, v := range configMap.Data {
+		if k != cloudProviderEnv {
+			data[k] = v
+		}
+	}
+	return data, nil
+}
+
+// reconcilePeerPodsRuntimeClass creates the kata-remote runtime class, with
+// the overhead of the peer pods
+func (r *CcRuntimeReconciler) reconcilePeerPodsRuntimeClass() error {
+	runtimeClass := &nodeapi.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: PeerPodsRuntimeClassName}}
+	_, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, runtimeClass, func() error {
+		// The handler is immutable
+		if runtimeClass.Handler == "" {
+			runtimeClass.Handler = PeerPodsRuntimeClassName
+		}
+		runtimeClass.Overhead = &nodeapi.Overhead{PodFixed: peerPodsOverhead(r.ccRuntime.Spec.PeerPods)}
+		return controllerutil.SetControllerReference(r.ccRuntime, runtimeClass, r.Scheme)
+	})
+	return err
+}
+
+// peerPodsReady checks that the cloud-api-adaptor runs on all the nodes it's
+// scheduled on, and returns what it's waiting for otherwise
+func (r *CcRuntimeReconciler) peerPodsReady() (bool, string, error) {
+	ds := &appsv1.DaemonSet{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: caaDaemonsetName, Namespace: r.PeerPodsNamespace}, ds)
+	if errors.IsNotFound(err) {
+		return false, "Waiting for the PeerPodConfig controller to create the cloud-api-adaptor DaemonSet", nil
+	} else if err != nil {
+		return false, "", err
+	}
+
+	if ds.Status.DesiredNumberScheduled == 0 {
+		return false, "The cloud-api-adaptor DaemonSet isn't scheduled on any node", nil
+	}
+	if ds.Status.NumberReady < ds.Status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("The cloud-api-adaptor is ready on %d of %d nodes",
+			ds.Status.NumberReady, ds.Status.DesiredNumberScheduled), nil
+	}
+	return true, "", nil
+}
+
+// reconcilePeerPods creates the PeerPodConfig of spec.peerPods, owned by the
+// CcRuntime, along with the ConfigMap it references and the kata-remote
+// runtime class. The PeerPodsReady condition reflects whether the
+// cloud-api-adaptor runs, without blocking the installation of the payload.
+func (r *CcRuntimeReconciler) reconcilePeerPods() error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: r.peerPodsConfigMapName(), Namespace: r.PeerPodsNamespace},
+	}
+	peerPodConfig := &peerpodconfig.PeerPodConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: r.ccRuntime.Name, Namespace: r.PeerPodsNamespace},
+	}
+
+	if r.ccRuntime.Spec.PeerPods == nil {
+		// The PeerPodConfig API is only used, and may only exist, when peer
+		// pods were configured
+		if meta.FindStatusCondition(r.ccRuntime.Status.Conditions, PeerPodsReadyCondition) == nil {
+			return nil
+		}
+		if err := r.deletePeerPods(peerPodConfig, configMap); err != nil {
+			return err
+		}
+		meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, PeerPodsReadyCondition)
+		return r.updateCcRuntimeStatus()
+	}
+	peerPods := r.ccRuntime.Spec.PeerPods
+
+	condition := metav1.Condition{
+		Type:               PeerPodsReadyCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Ready",
+		Message:            "The cloud-api-adaptor runs on all its nodes",
+		ObservedGeneration: r.ccRuntime.Generation,
+	}
+	// The PeerPodConfig is only created once its controller runs
+	err := r.ensurePeerPodsControllers()
+	if unavailable, ok := err.(*PeerPodsUnavailableError); ok {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = unavailable.Reason
+		condition.Message = err.Error()
+		if !meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition) {
+			return err
+		}
+		r.recordEvent(corev1.EventTypeWarning, "PeerPodsUnavailable", "%s", err.Error())
+		if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+			r.Log.Info("failed to update status after checking the peer pods controllers")
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	data, err := r.renderPeerPodsConfig()
+	if err == nil {
+		_, err = controllerutil.CreateOrUpdate(context.TODO(), r.Client, configMap, func() error {
+			configMap.Data = data
+			return controllerutil.SetControllerReference(r.ccRuntime, configMap, r.Scheme)
+		})
+	}
+	if err == nil {
+		_, err = controllerutil.CreateOrUpdate(context.TODO(), r.Client, peerPodConfig, func() error {
+			peerPodConfig.Spec.CloudSecretName = peerPods.SecretRef.Name
+			peerPodConfig.Spec.ConfigMapName = configMap.Name
+			peerPodConfig.Spec.Limit = strconv.Itoa(int(peerPodsLimit(peerPods)))
+			peerPodConfig.Spec.InstanceType = peerPods.InstanceType
+			peerPodConfig.Spec.NodeSelector = nil
+			if r.ccRuntime.Spec.CcNodeSelector != nil {
+				peerPodConfig.Spec.NodeSelector = r.ccRuntime.Spec.CcNodeSelector.MatchLabels
+			}
+			return controllerutil.SetControllerReference(r.ccRuntime, peerPodConfig, r.Scheme)
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to create the PeerPodConfig %s: %w", peerPodConfig.Name, err)
+		}
+	}
+	if err == nil {
+		err = r.reconcilePeerPodsRuntimeClass()
+	}
+
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Invalid"
+		condition.Message = err.Error()
+	} else {
+		ready, message, readyErr := r.peerPodsReady()
+		if readyErr != nil {
+			return readyErr
+		}
+		if !ready {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "Pending"
+			condition.Message = message
+		}
+	}
+
+	if !meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition) {
+		return err
+	}
+	if err != nil {
+		r.recordEvent(corev1.EventTypeWarning, "InvalidPeerPodsConfig", "%s", err.Error())
+	} else if condition.Status == metav1.ConditionTrue {
+		r.recordEvent(corev1.EventTypeNormal, "PeerPodsReady", "%s", condition.Message)
+	}
+	if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+		r.Log.Info("failed to update status after reconciling the peer pods")
+		if err == nil {
+			return updateErr
+		}
+	}
+	return err
+}
+
+// ensurePeerPodsControllers starts the peer pods controllers, when the
+// operator runs them
+func (r *CcRuntimeReconciler) ensurePeerPodsControllers() error {
+	if r.PeerPodsControllers == nil {
+		return nil
+	}
+	return r.PeerPodsControllers.Ensure(context.TODO())
+}
+
+// deletePeerPods deletes what reconcilePeerPods created once spec.peerPods is
+// removed. The kata-remote runtime class is kept while the payload installs it.
+func (r *CcRuntimeReconciler) deletePeerPods(peerPodConfig *peerpodconfig.PeerPodConfig, configMap *corev1.ConfigMap) error {
+	for _, obj := range []client.Object{peerPodConfig, configMap} {
+		if err := r.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+			return err
+		}
+	}
+
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		if runtimeClass.Name == PeerPodsRuntimeClassName {
+			return nil
+		}
+	}
+	runtimeClass := &nodeapi.RuntimeClass{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: PeerPodsRuntimeClassName}, runtimeClass)
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(runtimeClass, r.ccRuntime) {
+		return nil
+	}
+	r.Log.Info("Deleting the peer pods runtime class", "runtimeClass", runtimeClass.Name)
+	if err := r.Delete(context.TODO(), runtimeClass); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// peerPodsReferences reflects whether the object is one of the ConfigMap,
+// Secret and cloud-api-adaptor DaemonSet of the peer pods of the CcRuntime
+func (r *CcRuntimeReconciler) peerPodsReferences(ccRuntime *ccv1beta1.CcRuntime, obj client.Object) bool {
+	peerPods := ccRuntime.Spec.PeerPods
+	if peerPods == nil || obj.GetNamespace() != r.PeerPodsNamespace {
+		return false
+	}
+	switch obj.(type) {
+	case *corev1.ConfigMap:
+		return obj.GetName() == peerPods.ConfigMapRef.Name
+	case *corev1.Secret:
+		return obj.GetName() == peerPods.SecretRef.Name
+	case *appsv1.DaemonSet:
+		return obj.GetName() == caaDaemonsetName
+	}
+	return false
+}
+
+// mapPeerPodsToRequests enqueues the CcRuntimes whose peer pods run with the
+// cloud-api-adaptor DaemonSet, so the PeerPodsReady condition follows it
+func (r *CcRuntimeReconciler) mapPeerPodsToRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+	ccRuntimeList := &ccv1beta1.CcRuntimeList{}
+	if err := r.List(ctx, ccRuntimeList); err != nil {
+		return nil
+	}
+
+	var reconcileRequests []reconcile.Request
+	for i := range ccRuntimeList.Items {
+		if r.peerPodsReferences(&ccRuntimeList.Items[i], obj) {
+			reconcileRequests = append(reconcileRequests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ccRuntimeList.Items[i].Name},
+			})
+		}
+	}
+	return reconcileRequests
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	nodeapi "k8s.io/api/node/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	peerpodconfig "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/api/v1alpha1"
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// newTestPeerPodsCcRuntime returns a CcRuntime configuring peer pods on AWS,
+// with their ConfigMap and Secret
+func newTestPeerPodsCcRuntime() *ccv1beta1.CcRuntime {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: uniqueName("peer-pods-cm"), Namespace: testNamespace},
+		Data:       map[string]string{"AWS_REGION": "eu-west-1", "PODVM_AMI_ID": "ami-0123456789"},
+	}
+	Expect(k8sClient.Create(context.TODO(), configMap)).To(Succeed())
+	DeferCleanup(k8sClient.Delete, context.TODO(), configMap)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: uniqueName("peer-pods-secret"), Namespace: testNamespace},
+		Data:       map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIA"), "AWS_SECRET_ACCESS_KEY": []byte("s3cr3t")},
+	}
+	Expect(k8sClient.Create(context.TODO(), secret)).To(Succeed())
+	DeferCleanup(k8sClient.Delete, context.TODO(), secret)
+
+	ccRuntime := newTestCcRuntime(uniqueName("peer-pods"))
+	ccRuntime.Spec.PeerPods = &ccv1beta1.PeerPodsConfig{
+		CloudProvider: "aws",
+		ConfigMapRef:  corev1.LocalObjectReference{Name: configMap.Name},
+		SecretRef:     corev1.LocalObjectReference{Name: secret.Name},
+		InstanceType:  "m6a.large",
+	}
+	return ccRuntime
+}
+
+// deletePeerPodsRuntimeClass deletes the kata-remote runtime class the specs
+// share
+func deletePeerPodsRuntimeClass() {
+	runtimeClass := &nodeapi.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: PeerPodsRuntimeClassName}}
+	if err := k8sClient.Delete(context.TODO(), runtimeClass); err != nil && !apierrors.IsNotFound(err) {
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+var _ = Describe("Peer pods", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+	)
+
+	BeforeEach(func() {
+		ccRuntime = newTestPeerPodsCcRuntime()
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+		r.PeerPodsNamespace = testNamespace
+		DeferCleanup(deletePeerPodsRuntimeClass)
+	})
+
+	readyCondition := func() *metav1.Condition {
+		return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, PeerPodsReadyCondition)
+	}
+
+	getPeerPodConfig := func() (*peerpodconfig.PeerPodConfig, error) {
+		peerPodConfig := &peerpodconfig.PeerPodConfig{}
+		err := k8sClient.Get(context.TODO(), client.ObjectKey{Name: ccRuntime.Name, Namespace: testNamespace}, peerPodConfig)
+		return peerPodConfig, err
+	}
+
+	// createCaaDaemonset creates the DaemonSet of the PeerPodConfig controller,
+	// ready on some of the nodes
+	createCaaDaemonset := func(ready, desired int32) *appsv1.DaemonSet {
+		labels := map[string]string{"app": "cloud-api-adaptor"}
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: caaDaemonsetName, Namespace: testNamespace},
+			Spec: appsv1.DaemonSetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{Containers: []corev1.Container{
+						{Name: "cloud-api-adaptor", Image: "quay.io/confidential-containers/cloud-api-adaptor:latest"},
+					}},
+				},
+			},
+		}
+		Expect(k8sClient.Create(context.TODO(), ds)).To(Succeed())
+		DeferCleanup(func() {
+			_ = k8sClient.Delete(context.TODO(), ds)
+		})
+		ds.Status = appsv1.DaemonSetStatus{DesiredNumberScheduled: desired, NumberReady: ready}
+		Expect(k8sClient.Status().Update(context.TODO(), ds)).To(Succeed())
+		return ds
+	}
+
+	It("creates the PeerPodConfig, its ConfigMap and the kata-remote runtime class", func() {
+		Expect(r.reconcilePeerPods()).To(Succeed())
+
+		peerPodConfig, err := getPeerPodConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metav1.IsControlledBy(peerPodConfig, ccRuntime)).To(BeTrue())
+		Expect(peerPodConfig.Spec.CloudSecretName).To(Equal(ccRuntime.Spec.PeerPods.SecretRef.Name))
+		Expect(peerPodConfig.Spec.ConfigMapName).To(Equal(r.peerPodsConfigMapName()))
+		Expect(peerPodConfig.Spec.Limit).To(Equal("10"))
+		Expect(peerPodConfig.Spec.InstanceType).To(Equal("m6a.large"))
+		Expect(peerPodConfig.Spec.NodeSelector).To(Equal(map[string]string{"node.kubernetes.io/worker": ""}))
+
+		configMap := &corev1.ConfigMap{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: r.peerPodsConfigMapName(), Namespace: testNamespace},
+			configMap)).To(Succeed())
+		Expect(configMap.Data).To(Equal(map[string]string{
+			"CLOUD_PROVIDER": "aws", "AWS_REGION": "eu-west-1", "PODVM_AMI_ID": "ami-0123456789",
+		}))
+
+		runtimeClass := &nodeapi.RuntimeClass{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: PeerPodsRuntimeClassName}, runtimeClass)).To(Succeed())
+		Expect(runtimeClass.Handler).To(Equal(PeerPodsRuntimeClassName))
+		Expect(runtimeClass.Overhead.PodFixed).To(Equal(corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("250m"),
+			corev1.ResourceMemory: resource.MustParse("120Mi"),
+			peerPodsVMResource:    resource.MustParse("1"),
+		}))
+		Expect(metav1.IsControlledBy(runtimeClass, ccRuntime)).To(BeTrue())
+
+		condition := readyCondition()
+		Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("Pending"))
+		Expect(condition.Message).To(ContainSubstring("create the cloud-api-adaptor DaemonSet"))
+	})
+
+	It("takes the limit and the overhead of the spec", func() {
+		limit := int32(4)
+		ccRuntime.Spec.PeerPods.Limit = &limit
+		ccRuntime.Spec.PeerPods.Overhead = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+		Expect(r.reconcilePeerPods()).To(Succeed())
+
+		peerPodConfig, err := getPeerPodConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peerPodConfig.Spec.Limit).To(Equal("4"))
+		runtimeClass := &nodeapi.RuntimeClass{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: PeerPodsRuntimeClassName}, runtimeClass)).To(Succeed())
+		Expect(runtimeClass.Overhead.PodFixed).To(Equal(corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse("256Mi"),
+		}))
+	})
+
+	It("follows the cloud-api-adaptor DaemonSet", func() {
+		r, recorder := newTestReconciler(ccRuntime)
+		r.PeerPodsNamespace = testNamespace
+		ds := createCaaDaemonset(1, 2)
+
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		Expect(readyCondition()).To(HaveField("Message", "The cloud-api-adaptor is ready on 1 of 2 nodes"))
+		Expect(events(recorder)).To(BeEmpty())
+
+		ds.Status.NumberReady = 2
+		Expect(k8sClient.Status().Update(context.TODO(), ds)).To(Succeed())
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		Expect(readyCondition()).To(HaveField("Status", metav1.ConditionTrue))
+		Expect(events(recorder)).To(ConsistOf(ContainSubstring("PeerPodsReady")))
+
+		request := reconcile.Request{NamespacedName: client.ObjectKey{Name: ccRuntime.Name}}
+		Expect(r.mapPeerPodsToRequests(context.TODO(), ds)).To(ContainElement(request))
+	})
+
+	DescribeTable("reporting the invalid configurations",
+		func(change func(*ccv1beta1.PeerPodsConfig), want string) {
+			change(ccRuntime.Spec.PeerPods)
+			r, recorder := newTestReconciler(ccRuntime)
+			r.PeerPodsNamespace = testNamespace
+
+			Expect(r.reconcilePeerPods()).To(MatchError(ContainSubstring(want)))
+			condition := readyCondition()
+			Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("Invalid"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("InvalidPeerPodsConfig")))
+			_, err := getPeerPodConfig()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		},
+		Entry("missing ConfigMap", func(p *ccv1beta1.PeerPodsConfig) { p.ConfigMapRef.Name = "missing" },
+			"failed to get the peer pods ConfigMap missing"),
+		Entry("missing Secret", func(p *ccv1beta1.PeerPodsConfig) { p.SecretRef.Name = "missing" },
+			"failed to get the peer pods Secret missing"),
+	)
+
+	It("reports a ConfigMap setting another cloud provider", func() {
+		configMap := &corev1.ConfigMap{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{
+			Name: ccRuntime.Spec.PeerPods.ConfigMapRef.Name, Namespace: testNamespace}, configMap)).To(Succeed())
+		configMap.Data[cloudProviderEnv] = "libvirt"
+		Expect(k8sClient.Update(context.TODO(), configMap)).To(Succeed())
+
+		Expect(r.reconcilePeerPods()).To(MatchError(ContainSubstring("sets CLOUD_PROVIDER to libvirt")))
+	})
+
+	It("deletes what it created once spec.peerPods is removed", func() {
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		ccRuntime.Spec.PeerPods = nil
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		_, err := getPeerPodConfig()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = k8sClient.Get(context.TODO(), client.ObjectKey{Name: r.peerPodsConfigMapName(), Namespace: testNamespace},
+			&corev1.ConfigMap{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = k8sClient.Get(context.TODO(), client.ObjectKey{Name: PeerPodsRuntimeClassName}, &nodeapi.RuntimeClass{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(readyCondition()).To(BeNil())
+	})
+
+	It("keeps the kata-remote runtime class the payload installs", func() {
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		ccRuntime.Spec.PeerPods = nil
+		ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{{Name: PeerPodsRuntimeClassName}}
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+		Expect(r.reconcilePeerPods()).To(Succeed())
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: PeerPodsRuntimeClassName},
+			&nodeapi.RuntimeClass{})).To(Succeed())
+	})
+
+	It("reconciles the CcRuntimes of a changed ConfigMap or Secret of the peer pods namespace", func() {
+		request := reconcile.Request{NamespacedName: client.ObjectKey{Name: ccRuntime.Name}}
+		configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name: ccRuntime.Spec.PeerPods.ConfigMapRef.Name, Namespace: testNamespace}}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name: ccRuntime.Spec.PeerPods.SecretRef.Name, Namespace: testNamespace}}
+		Expect(r.mapPeerPodsToRequests(context.TODO(), configMap)).To(ContainElement(request))
+		Expect(r.mapPeerPodsToRequests(context.TODO(), secret)).To(ContainElement(request))
+
+		secret.Namespace = "default"
+		Expect(r.mapPeerPodsToRequests(context.TODO(), secret)).NotTo(ContainElement(request))
+	})
+})
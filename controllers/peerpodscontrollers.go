@@ -0,0 +1,330 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/config"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	peerpodcontrollers "github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl/controllers"
+	peerpodconfigcontrollers "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/controllers"
+
+	peerpod "github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl/api/v1alpha1"
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// PeerPodsMissingCRDsReason is the reason of the PeerPodsReady condition
+	// when the peer pods CRDs aren't installed
+	PeerPodsMissingCRDsReason = "MissingCRDs"
+
+	// PeerPodsMissingPermissionsReason is the reason of the PeerPodsReady
+	// condition when the operator lacks the RBAC of the peer pods controllers
+	PeerPodsMissingPermissionsReason = "MissingPermissions"
+)
+
+// peerPodsKinds are the kinds the peer pods controllers reconcile
+var peerPodsKinds = []schema.GroupVersionKind{
+	{Group: "confidentialcontainers.org", Version: "v1alpha1", Kind: "PeerPodConfig"},
+	{Group: "confidentialcontainers.org", Version: "v1alpha1", Kind: "PeerPod"},
+}
+
+// peerPodsPermissions are the permissions the peer pods controllers need, the
+// namespaced ones in the peer pods namespace
+var peerPodsPermissions = []authorizationv1.ResourceAttributes{
+	{Group: "confidentialcontainers.org", Resource: "peerpodconfigs", Verb: "watch"},
+	{Group: "confidentialcontainers.org", Resource: "peerpodconfigs", Verb: "update"},
+	{Group: "confidentialcontainers.org", Resource: "peerpodconfigs", Subresource: "status", Verb: "update"},
+	{Group: "confidentialcontainers.org", Resource: "peerpods", Verb: "watch"},
+	{Group: "confidentialcontainers.org", Resource: "peerpods", Verb: "update"},
+	{Group: "confidentialcontainers.org", Resource: "peerpods", Subresource: "finalizers", Verb: "update"},
+	{Group: "confidentialcontainers.org", Resource: "peerpods", Subresource: "status", Verb: "update"},
+	{Group: "", Resource: "nodes", Subresource: "status", Verb: "patch"},
+	{Group: "apps", Resource: "daemonsets", Verb: "create"},
+	{Group: "apps", Resource: "daemonsets", Verb: "update"},
+}
+
+// PeerPodsUnavailableError explains why the peer pods controllers can't run
+type PeerPodsUnavailableError struct {
+	// Reason is the reason of the PeerPodsReady condition
+	Reason string
+
+	// Missing lists the missing CRDs or permissions
+	Missing []string
+}
+
+func (e *PeerPodsUnavailableError) Error() string {
+	if e.Reason == PeerPodsMissingCRDsReason {
+		return "the peer pods controllers can't run, the CRDs of " + strings.Join(e.Missing, ", ") + " aren't installed"
+	}
+	return "the peer pods controllers can't run, the operator isn't allowed to " + strings.Join(e.Missing, ", ")
+}
+
+/*
+PeerPodsControllers runs the PeerPodConfig and PeerPod controllers of the
+cloud-api-adaptor while CcRuntimes configure peer pods, so the same operator
+deployment serves clusters with and without peer pods. The controllers run in
+a manager of their own, as controllers can't be removed from a running
+manager.
+
+The CcRuntime reconciler starts the controllers for the CcRuntimes with
+spec.peerPods. They stop once no CcRuntime configures peer pods and no PeerPod
+is left, the PeerPod controller deleting the virtual machines of the PeerPods.
+*/
+type PeerPodsControllers struct {
+	// Config is the configuration the manager of the controllers connects with
+	Config *rest.Config
+
+	// Scheme holds the peer pods types
+	Scheme *runtime.Scheme
+
+	// RESTMapper tells whether the peer pods CRDs are installed
+	RESTMapper meta.RESTMapper
+
+	// Reader reads the CcRuntimes and PeerPods without caching them
+	Reader client.Reader
+
+	// Namespace is the namespace of the PeerPodConfigs and of the cloud-api-adaptor
+	Namespace string
+
+	// IdleCheckInterval is how often the controllers check whether they are
+	// still needed, a minute by default
+	IdleCheckInterval time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Check verifies that the peer pods CRDs are installed and that the operator
+// has the permissions of the controllers. It returns a PeerPodsUnavailableError
+// when something is missing.
+func (c *PeerPodsControllers) Check(ctx context.Context) error {
+	var missing []string
+	for _, gvk := range peerPodsKinds {
+		_, err := c.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			missing = append(missing, gvk.Kind)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return &PeerPodsUnavailableError{Reason: PeerPodsMissingCRDsReason, Missing: missing}
+	}
+
+	clientset, err := kubernetes.NewForConfig(c.Config)
+	if err != nil {
+		return err
+	}
+	for _, permission := range peerPodsPermissions {
+		attributes := permission
+		if attributes.Group == "apps" {
+			attributes.Namespace = c.Namespace
+		}
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx,
+			&authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+			}, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		if !review.Status.Allowed {
+			resource := attributes.Resource
+			if attributes.Subresource != "" {
+				resource += "/" + attributes.Subresource
+			}
+			missing = append(missing, fmt.Sprintf("%s %s", attributes.Verb, resource))
+		}
+	}
+	if len(missing) > 0 {
+		return &PeerPodsUnavailableError{Reason: PeerPodsMissingPermissionsReason, Missing: missing}
+	}
+	return nil
+}
+
+// Ensure starts the controllers unless they run already. It returns a
+// PeerPodsUnavailableError when they can't run.
+func (c *PeerPodsControllers) Ensure(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running() {
+		return nil
+	}
+	if err := c.Check(ctx); err != nil {
+		return err
+	}
+	return c.start()
+}
+
+// Running reflects whether the controllers run
+func (c *PeerPodsControllers) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running()
+}
+
+func (c *PeerPodsControllers) running() bool {
+	if c.done == nil {
+		return false
+	}
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *PeerPodsControllers) start() error {
+	// The controllers are set up again on each start, under the same names.
+	// Only the objects of the cloud-api-adaptor are cached in its namespace,
+	// the PeerPods being in the namespaces of the workloads.
+	skipNameValidation := true
+	namespace := map[string]cache.Config{c.Namespace: {}}
+	mgr, err := ctrl.NewManager(c.Config, ctrl.Options{
+		Scheme:  c.Scheme,
+		Metrics: metricsserver.Options{BindAddress: "0"},
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&appsv1.DaemonSet{}: {Namespaces: namespace},
+				&corev1.ConfigMap{}: {Namespaces: namespace},
+				&corev1.Secret{}:    {Namespaces: namespace},
+			},
+		},
+		Controller: config.Controller{SkipNameValidation: &skipNameValidation},
+	})
+	if err != nil {
+		return err
+	}
+	if err = (&peerpodconfigcontrollers.PeerPodConfigReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("RemotePodConfig"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create peerpod config controller: %w", err)
+	}
+	if err = (&peerpodcontrollers.PeerPodReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		// setting nil will delegate Provider creation to reconcile time.
+		Provider: nil,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create peerpod resources controller: %w", err)
+	}
+
+	log := ctrl.Log.WithName("peerpods")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(ctx); err != nil {
+			log.Error(err, "the peer pods controllers stopped")
+		}
+	}()
+	interval := c.IdleCheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		needed, err := c.needed(ctx)
+		if err != nil {
+			log.Info("failed to check whether the peer pods controllers are needed", "err", err.Error())
+			return
+		}
+		if !needed {
+			log.Info("stopping the peer pods controllers, no CcRuntime configures peer pods and no PeerPod is left")
+			cancel()
+		}
+	}, interval)
+
+	c.cancel, c.done = cancel, done
+	log.Info("started the peer pods controllers")
+	return nil
+}
+
+// Stop stops the controllers and waits for them to return
+func (c *PeerPodsControllers) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel, c.done = nil, nil
+}
+
+// needed reflects whether a CcRuntime configures peer pods, or PeerPods still
+// need their controller to delete their virtual machine and remove their
+// finalizer
+func (c *PeerPodsControllers) needed(ctx context.Context) (bool, error) {
+	ccRuntimeList := &ccv1beta1.CcRuntimeList{}
+	if err := c.Reader.List(ctx, ccRuntimeList); err != nil {
+		return false, err
+	}
+	for _, ccRuntime := range ccRuntimeList.Items {
+		if ccRuntime.Spec.PeerPods != nil {
+			return true, nil
+		}
+	}
+
+	peerPods := &peerpod.PeerPodList{}
+	err := c.Reader.List(ctx, peerPods, client.Limit(1))
+	if meta.IsNoMatchError(err) || errors.IsForbidden(err) {
+		return false, nil
+	}
+	return len(peerPods.Items) > 0, err
+}
+
+// Start implements manager.Runnable. On the leader it starts the controllers
+// for the PeerPods left by a previous run of the operator, and stops them
+// with the operator.
+func (c *PeerPodsControllers) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("peerpods")
+	needed, err := c.needed(ctx)
+	if err != nil {
+		log.Info("failed to check whether the peer pods controllers are needed", "err", err.Error())
+	} else if needed {
+		if err := c.Ensure(ctx); err != nil {
+			log.Info("the peer pods controllers can't start", "err", err.Error())
+		}
+	}
+	<-ctx.Done()
+	c.Stop()
+	return nil
+}
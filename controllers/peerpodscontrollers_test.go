@@ -0,0 +1,140 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	peerpod "github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl/api/v1alpha1"
+	peerpodconfig "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/api/v1alpha1"
+)
+
+var _ = Describe("Peer pods controllers", func() {
+	// newTestPeerPodsControllers returns the controllers of a cluster the
+	// RESTMapper knows the kinds of
+	newTestPeerPodsControllers := func(kinds ...meta.RESTScope) *PeerPodsControllers {
+		mapper := meta.NewDefaultRESTMapper(nil)
+		for i := range kinds {
+			mapper.Add(peerPodsKinds[i], kinds[i])
+		}
+		return &PeerPodsControllers{
+			Config:     cfg,
+			Scheme:     scheme.Scheme,
+			RESTMapper: mapper,
+			Reader:     k8sClient,
+			Namespace:  testNamespace,
+		}
+	}
+
+	DescribeTable("reporting the missing CRDs",
+		func(kinds []meta.RESTScope, want string) {
+			err := newTestPeerPodsControllers(kinds...).Check(context.TODO())
+			Expect(err).To(MatchError(want))
+			unavailable, ok := err.(*PeerPodsUnavailableError)
+			Expect(ok).To(BeTrue())
+			Expect(unavailable.Reason).To(Equal(PeerPodsMissingCRDsReason))
+		},
+		Entry("no CRD", nil,
+			"the peer pods controllers can't run, the CRDs of PeerPodConfig, PeerPod aren't installed"),
+		Entry("PeerPod CRD missing", []meta.RESTScope{meta.RESTScopeNamespace},
+			"the peer pods controllers can't run, the CRDs of PeerPod aren't installed"),
+	)
+
+	It("reports the missing permissions", func() {
+		err := (&PeerPodsUnavailableError{
+			Reason:  PeerPodsMissingPermissionsReason,
+			Missing: []string{"watch peerpods", "update peerpods/finalizers"},
+		}).Error()
+		Expect(err).To(Equal("the peer pods controllers can't run, the operator isn't allowed to " +
+			"watch peerpods, update peerpods/finalizers"))
+	})
+
+	It("checks the permissions once the CRDs are installed", func() {
+		if cfg == nil {
+			Skip("the permissions are only reviewed by an API server")
+		}
+		controllers := newTestPeerPodsControllers(meta.RESTScopeNamespace, meta.RESTScopeNamespace)
+		Expect(controllers.Check(context.TODO())).To(Succeed())
+	})
+
+	It("isn't running until started", func() {
+		controllers := newTestPeerPodsControllers()
+		Expect(controllers.Running()).To(BeFalse())
+		controllers.Stop()
+		Expect(controllers.Running()).To(BeFalse())
+	})
+
+	Context("deciding whether the controllers are needed", func() {
+		It("isn't needed without peer pods", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("peer-pods"))
+			createTestCcRuntime(ccRuntime)
+			Expect(newTestPeerPodsControllers().needed(context.TODO())).To(BeFalse())
+		})
+
+		It("is needed while a CcRuntime configures peer pods", func() {
+			createTestCcRuntime(newTestPeerPodsCcRuntime())
+			Expect(newTestPeerPodsControllers().needed(context.TODO())).To(BeTrue())
+		})
+
+		It("is needed while a PeerPod is left", func() {
+			peerPod := &peerpod.PeerPod{
+				ObjectMeta: metav1.ObjectMeta{Name: uniqueName("peer-pod"), Namespace: testNamespace},
+				Spec:       peerpod.PeerPodSpec{CloudProvider: "aws", InstanceID: "i-0123456789"},
+			}
+			Expect(k8sClient.Create(context.TODO(), peerPod)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, context.TODO(), peerPod)
+			Expect(newTestPeerPodsControllers().needed(context.TODO())).To(BeTrue())
+		})
+
+		It("doesn't start the controllers with the operator when they aren't needed", func() {
+			controllers := newTestPeerPodsControllers()
+			ctx, cancel := context.WithCancel(context.TODO())
+			cancel()
+			Expect(controllers.Start(ctx)).To(Succeed())
+			Expect(controllers.Running()).To(BeFalse())
+		})
+	})
+
+	It("reports the controllers can't run on the CcRuntime", func() {
+		ccRuntime := newTestPeerPodsCcRuntime()
+		createTestCcRuntime(ccRuntime)
+		r, recorder := newTestReconciler(ccRuntime)
+		r.PeerPodsNamespace = testNamespace
+		r.PeerPodsControllers = newTestPeerPodsControllers()
+
+		Expect(r.reconcilePeerPods()).To(MatchError(ContainSubstring("aren't installed")))
+		condition := meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, PeerPodsReadyCondition)
+		Expect(condition).To(HaveField("Status", metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal(PeerPodsMissingCRDsReason))
+		Expect(events(recorder)).To(ConsistOf(ContainSubstring("PeerPodsUnavailable")))
+		err := k8sClient.Get(context.TODO(), client.ObjectKey{Name: ccRuntime.Name, Namespace: testNamespace},
+			&peerpodconfig.PeerPodConfig{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		// Reported once
+		Expect(r.reconcilePeerPods()).To(HaveOccurred())
+		Expect(events(recorder)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// AgentPoliciesMountPath is where the agent policies are mounted in the installer pods
+	AgentPoliciesMountPath = "/etc/cc-operator/policies"
+
+	agentPoliciesVolumeName = "cc-operator-agent-policies"
+)
+
+func (r *CcRuntimeReconciler) agentPoliciesConfigMapName() string {
+	return "cc-operator-agent-policies-" + r.ccRuntime.Name
+}
+
+// runtimeClassesWithAgentPolicy returns the runtime classes that have an agent policy
+func (r *CcRuntimeReconciler) runtimeClassesWithAgentPolicy() []ccv1beta1.RuntimeClass {
+	var runtimeClasses []ccv1beta1.RuntimeClass
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		if runtimeClass.AgentPolicy != nil {
+			runtimeClasses = append(runtimeClasses, runtimeClass)
+		}
+	}
+	return runtimeClasses
+}
+
+// readAgentPolicy returns the Rego agent policy of a runtime class
+func (r *CcRuntimeReconciler) readAgentPolicy(runtimeClass *ccv1beta1.RuntimeClass) (string, error) {
+	ref := runtimeClass.AgentPolicy
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: r.Namespace}, configMap); err != nil {
+		return "", fmt.Errorf("%s: failed to get ConfigMap %s: %w", runtimeClass.Name, ref.Name, err)
+	}
+	policy, ok := configMap.Data[ref.Key]
+	if !ok || strings.TrimSpace(policy) == "" {
+		return "", fmt.Errorf("%s: ConfigMap %s has no policy in key %s", runtimeClass.Name, ref.Name, ref.Key)
+	}
+	return policy, nil
+}
+
+// reconcileAgentPolicies gathers the agent policies of the runtime classes in
+// a ConfigMap mounted by the install pods. The payload only copies the
+// policies to the host when it installs the runtime, so their hash is set on
+// the pod templates for a policy change to roll out, and their digests are
+// only reported once the nodes installed them, see confirmAgentPolicies.
+func (r *CcRuntimeReconciler) reconcileAgentPolicies() error {
+	r.agentPolicies = nil
+	r.agentPoliciesHash = ""
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: r.agentPoliciesConfigMapName(), Namespace: r.Namespace},
+	}
+
+	runtimeClasses := r.runtimeClassesWithAgentPolicy()
+	if len(runtimeClasses) == 0 {
+		if err := r.Delete(context.TODO(), configMap); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, AgentPoliciesResolvedCondition) {
+			return r.updateCcRuntimeStatus()
+		}
+		return nil
+	}
+
+	var errs []error
+	data := map[string]string{}
+	statuses := make([]ccv1beta1.AgentPolicyStatus, 0, len(runtimeClasses))
+	for i := range runtimeClasses {
+		policy, err := r.readAgentPolicy(&runtimeClasses[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		data[strings.TrimPrefix(runtimeClasses[i].Name, "kata-")+".rego"] = policy
+		statuses = append(statuses, ccv1beta1.AgentPolicyStatus{
+			RuntimeClass: runtimeClasses[i].Name,
+			ConfigMap:    runtimeClasses[i].AgentPolicy.Name,
+			Key:          runtimeClasses[i].AgentPolicy.Key,
+			Digest:       fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(policy))),
+		})
+	}
+
+	err := errors.Join(errs...)
+	if err == nil {
+		// Nothing is distributed until all the policies are available
+		_, err = controllerutil.CreateOrUpdate(context.TODO(), r.Client, configMap, func() error {
+			configMap.Data = data
+			return controllerutil.SetControllerReference(r.ccRuntime, configMap, r.Scheme)
+		})
+	}
+	if err == nil {
+		r.agentPolicies = statuses
+		r.agentPoliciesHash, err = hashObject(data)
+	}
+	return r.setConditionFromError(metav1.Condition{
+		Type:    AgentPoliciesResolvedCondition,
+		Reason:  "Resolved",
+		Message: "The agent policies are distributed in ConfigMap " + configMap.Name,
+	}, "AgentPolicyNotFound", err)
+}
+
+// confirmAgentPolicies reports the digests of the agent policies once all the
+// nodes installed the payload with them
+func (r *CcRuntimeReconciler) confirmAgentPolicies() {
+	if equality.Semantic.DeepEqual(r.agentPolicies, r.ccRuntime.Status.AgentPolicies) {
+		return
+	}
+	for _, status := range r.agentPolicies {
+		r.Log.Info("agent policy installed", "runtimeClass", status.RuntimeClass, "digest", status.Digest)
+	}
+	if len(r.agentPolicies) > 0 {
+		r.recordEvent(corev1.EventTypeNormal, "AgentPoliciesInstalled", "Agent policies installed on all the nodes")
+	}
+	r.ccRuntime.Status.AgentPolicies = r.agentPolicies
+}
+
+// addAgentPolicies passes the agent policies to the first container of the pod
+// template. AGENT_POLICY_MAPPING maps each shim to the path of its default
+// agent policy, as shim:path pairs separated by commas.
+func (r *CcRuntimeReconciler) addAgentPolicies(template *corev1.PodTemplateSpec) {
+	runtimeClasses := r.runtimeClassesWithAgentPolicy()
+	if len(runtimeClasses) == 0 {
+		return
+	}
+
+	var policyMapping []string
+	for _, runtimeClass := range runtimeClasses {
+		shim := strings.TrimPrefix(runtimeClass.Name, "kata-")
+		policyMapping = append(policyMapping, shim+":"+path.Join(AgentPoliciesMountPath, shim+".rego"))
+	}
+	sort.Strings(policyMapping)
+
+	container := &template.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "AGENT_POLICY_MAPPING",
+		Value: strings.Join(policyMapping, ","),
+	})
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: agentPoliciesVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.agentPoliciesConfigMapName()},
+			},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      agentPoliciesVolumeName,
+		MountPath: AgentPoliciesMountPath,
+		ReadOnly:  true,
+	})
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[AgentPoliciesHashAnnotation] = r.agentPoliciesHash
+}
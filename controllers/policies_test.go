@@ -0,0 +1,189 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Agent policies", func() {
+	const (
+		allowAll = "package agent_policy\n\ndefault AllowRequestsFailingPolicy := true\n"
+		denyExec = "package agent_policy\n\ndefault ExecProcessRequest := false\n"
+	)
+
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+		policies  *corev1.ConfigMap
+	)
+
+	BeforeEach(func() {
+		policies = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: uniqueName("policies"), Namespace: testNamespace},
+			Data:       map[string]string{"allow-all.rego": allowAll, "deny-exec.rego": denyExec, "empty.rego": " \n"},
+		}
+		Expect(k8sClient.Create(context.TODO(), policies)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, context.TODO(), policies)
+
+		policyRef := func(key string) *corev1.ConfigMapKeySelector {
+			return &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: policies.Name}, Key: key,
+			}
+		}
+		ccRuntime = newTestCcRuntime(uniqueName("policies"))
+		ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{
+			{Name: "kata-qemu-tdx", Snapshotter: "nydus", PullType: "guest-pull", AgentPolicy: policyRef("deny-exec.rego")},
+			{Name: "kata-qemu-snp", Snapshotter: "nydus", PullType: "guest-pull", AgentPolicy: policyRef("allow-all.rego")},
+			{Name: "kata-qemu", Snapshotter: "", PullType: ""},
+		}
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+	})
+
+	getConfigMap := func() (*corev1.ConfigMap, error) {
+		configMap := &corev1.ConfigMap{}
+		err := k8sClient.Get(context.TODO(),
+			client.ObjectKey{Name: r.agentPoliciesConfigMapName(), Namespace: testNamespace}, configMap)
+		return configMap, err
+	}
+
+	resolvedCondition := func() *metav1.Condition {
+		return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, AgentPoliciesResolvedCondition)
+	}
+
+	digest := func(policy string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(policy)))
+	}
+
+	It("distributes the policies of the runtime classes to the install pods", func() {
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		Expect(resolvedCondition()).To(HaveField("Status", metav1.ConditionTrue))
+
+		configMap, err := getConfigMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMap.OwnerReferences).To(ConsistOf(HaveField("Name", ccRuntime.Name)))
+		Expect(configMap.Data).To(Equal(map[string]string{"qemu-tdx.rego": denyExec, "qemu-snp.rego": allowAll}))
+
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		container := ds.Spec.Template.Spec.Containers[0]
+		Expect(container.Env).To(ContainElement(corev1.EnvVar{
+			Name: "AGENT_POLICY_MAPPING",
+			Value: "qemu-snp:" + AgentPoliciesMountPath + "/qemu-snp.rego," +
+				"qemu-tdx:" + AgentPoliciesMountPath + "/qemu-tdx.rego",
+		}))
+		Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name: agentPoliciesVolumeName, MountPath: AgentPoliciesMountPath, ReadOnly: true,
+		}))
+		Expect(ds.Spec.Template.Spec.Volumes).To(ContainElement(
+			HaveField("VolumeSource.ConfigMap.Name", r.agentPoliciesConfigMapName())))
+		Expect(ds.Spec.Template.Annotations).To(HaveKeyWithValue(AgentPoliciesHashAnnotation, r.agentPoliciesHash))
+	})
+
+	It("reports the digests once the nodes installed the policies", func() {
+		r, recorder := newTestReconciler(ccRuntime)
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		Expect(ccRuntime.Status.AgentPolicies).To(BeEmpty())
+
+		r.confirmAgentPolicies()
+		Expect(ccRuntime.Status.AgentPolicies).To(ConsistOf(
+			ccv1beta1.AgentPolicyStatus{
+				RuntimeClass: "kata-qemu-tdx", ConfigMap: policies.Name, Key: "deny-exec.rego", Digest: digest(denyExec),
+			},
+			ccv1beta1.AgentPolicyStatus{
+				RuntimeClass: "kata-qemu-snp", ConfigMap: policies.Name, Key: "allow-all.rego", Digest: digest(allowAll),
+			},
+		))
+		Expect(events(recorder)).To(ConsistOf(ContainSubstring("AgentPoliciesInstalled")))
+
+		r.confirmAgentPolicies()
+		Expect(events(recorder)).To(BeEmpty())
+	})
+
+	It("rolls a policy change out without changing the payload", func() {
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		before, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		policies.Data["allow-all.rego"] = allowAll + "\ndefault CopyFileRequest := false\n"
+		Expect(k8sClient.Update(context.TODO(), policies)).To(Succeed())
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		after, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(after.Spec.Template.Annotations[AgentPoliciesHashAnnotation]).NotTo(
+			Equal(before.Spec.Template.Annotations[AgentPoliciesHashAnnotation]))
+		Expect(after.Spec.Template.Annotations[TemplateHashAnnotation]).NotTo(
+			Equal(before.Spec.Template.Annotations[TemplateHashAnnotation]))
+		Expect(after.Spec.Template.Spec.Containers[0].Image).To(Equal(before.Spec.Template.Spec.Containers[0].Image))
+		configMap, err := getConfigMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMap.Data["qemu-snp.rego"]).To(ContainSubstring("CopyFileRequest"))
+	})
+
+	DescribeTable("distributing nothing until all the policies are available",
+		func(key, want string) {
+			ccRuntime.Spec.Config.RuntimeClasses[1].AgentPolicy.Key = key
+			r, recorder := newTestReconciler(ccRuntime)
+
+			Expect(r.reconcileAgentPolicies()).To(MatchError(ContainSubstring(want)))
+			Expect(r.agentPoliciesHash).To(BeEmpty())
+			Expect(r.agentPolicies).To(BeEmpty())
+			Expect(resolvedCondition()).To(HaveField("Reason", "AgentPolicyNotFound"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("AgentPolicyNotFound")))
+			_, err := getConfigMap()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		},
+		Entry("missing key", "missing.rego", "kata-qemu-snp: ConfigMap "),
+		Entry("empty policy", "empty.rego", "has no policy in key empty.rego"),
+	)
+
+	It("deletes the ConfigMap and the condition without agent policies", func() {
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		for i := range ccRuntime.Spec.Config.RuntimeClasses {
+			ccRuntime.Spec.Config.RuntimeClasses[i].AgentPolicy = nil
+		}
+		Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+		Expect(r.reconcileAgentPolicies()).To(Succeed())
+		_, err := getConfigMap()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(resolvedCondition()).To(BeNil())
+	})
+
+	It("reconciles the CcRuntimes using a changed policy", func() {
+		request := reconcile.Request{NamespacedName: client.ObjectKey{Name: ccRuntime.Name}}
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), policies)).To(ContainElement(request))
+
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: policies.Name, Namespace: testNamespace}}
+		Expect(r.mapPayloadConfigToRequests(context.TODO(), secret)).NotTo(ContainElement(request))
+	})
+})
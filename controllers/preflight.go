@@ -0,0 +1,495 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// PreflightLabel is set to failed on the nodes failing the preflight checks,
+	// which the install DaemonSets don't run on
+	PreflightLabel = "confidentialcontainers.org/preflight"
+
+	// preflightFailed is the value of PreflightLabel on the failing nodes
+	preflightFailed = "failed"
+
+	// preflightOperation identifies the Jobs gathering the facts on the nodes
+	preflightOperation = "preflight"
+
+	// preflightRecheckInterval is how often the facts of the failing nodes are
+	// gathered again
+	preflightRecheckInterval = 5 * time.Minute
+)
+
+// defaultInstallPaths are the host paths the payload installs under
+var defaultInstallPaths = []string{"/opt"}
+
+// preflightScript reports the facts the operator checks in the termination
+// message of its container, one key=value per line
+const preflightScript = `
+out=/dev/termination-log
+: > "$out"
+for m in ${KERNEL_MODULES}; do
+  [ -d "/sys/module/$m" ] || echo "missing-module=$m" >> "$out"
+done
+if [ -f /sys/fs/cgroup/cgroup.controllers ]; then echo "cgroup=2" >> "$out"; else echo "cgroup=1" >> "$out"; fi
+for p in ${INSTALL_PATHS}; do
+  d="/host$p"
+  while [ ! -e "$d" ]; do d=$(dirname "$d"); done
+  echo "free-disk=$p:$(df -Pk "$d" | awk 'NR==2 {print $4}')" >> "$out"
+done
+for p in ${CONFLICTING_PATHS}; do
+  [ -e "/host$p" ] && echo "conflict=$p" >> "$out"
+done
+exit 0
+`
+
+func (r *CcRuntimeReconciler) preflightPolicy() ccv1beta1.PreflightPolicy {
+	if r.ccRuntime.Spec.Config.Preflight.Policy == "" {
+		return ccv1beta1.BlockPreflightPolicy
+	}
+	return r.ccRuntime.Spec.Config.Preflight.Policy
+}
+
+func (r *CcRuntimeReconciler) preflightKernelModules() []string {
+	preflight := &r.ccRuntime.Spec.Config.Preflight
+	if preflight.KernelModules != nil {
+		return preflight.KernelModules
+	}
+	if r.ccRuntime.Spec.RuntimeName == "enclave-cc" {
+		return nil
+	}
+	return []string{"kvm", "vhost_vsock"}
+}
+
+func (r *CcRuntimeReconciler) preflightInstallPaths() []string {
+	if len(r.ccRuntime.Spec.Config.Preflight.InstallPaths) > 0 {
+		return r.ccRuntime.Spec.Config.Preflight.InstallPaths
+	}
+	return defaultInstallPaths
+}
+
+// excludedByPreflight reflects whether the node is left out of the
+// installation for failing the preflight checks
+func (r *CcRuntimeReconciler) excludedByPreflight(node *corev1.Node) bool {
+	if !r.ccRuntime.Spec.Config.Preflight.Enabled || r.preflightPolicy() != ccv1beta1.ExcludePreflightPolicy {
+		return false
+	}
+	for _, status := range r.ccRuntime.Status.Preflight {
+		if status.Name == node.Name {
+			return !status.Passed
+		}
+	}
+	return false
+}
+
+// withoutExcludedNodes returns the nodes the CcRuntime is installed on
+func (r *CcRuntimeReconciler) withoutExcludedNodes(nodes []corev1.Node) []corev1.Node {
+	var included []corev1.Node
+	for _, node := range nodes {
+		if !r.excludedByPreflight(&node) {
+			included = append(included, node)
+		}
+	}
+	return included
+}
+
+// preflightNodeHook returns the hook gathering the facts on the nodes of the
+// architecture, with the payload image of the architecture by default
+func (r *CcRuntimeReconciler) preflightNodeHook(arch string) *nodeHook {
+	preflight := &r.ccRuntime.Spec.Config.Preflight
+	image := preflight.Image
+	if image == "" {
+		image = r.payloadImage(arch)
+	}
+	return &nodeHook{
+		HookConfig: ccv1beta1.HookConfig{
+			Name:  preflightOperation,
+			Stage: ccv1beta1.PreInstallHookStage,
+			Image: image,
+			Cmd:   []string{"/bin/sh", "-c", preflightScript},
+			EnvironmentVariables: []corev1.EnvVar{
+				{Name: "KERNEL_MODULES", Value: strings.Join(r.preflightKernelModules(), " ")},
+				{Name: "INSTALL_PATHS", Value: strings.Join(r.preflightInstallPaths(), " ")},
+				{Name: "CONFLICTING_PATHS", Value: strings.Join(preflight.ConflictingPaths, " ")},
+			},
+			Volumes: []corev1.Volume{{
+				Name:         "host",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}},
+			}},
+			VolumeMounts:   []corev1.VolumeMount{{Name: "host", MountPath: "/host", ReadOnly: true}},
+			TimeoutSeconds: preflight.TimeoutSeconds,
+		},
+		operation: preflightOperation,
+		doneLabel: []string{PreflightLabel, "passed"},
+	}
+}
+
+// preflightFacts reads the facts the Job of the node reported
+func (r *CcRuntimeReconciler) preflightFacts(nodeName string) (*ccv1beta1.PreflightNodeStatus, error) {
+	job := &batchv1.Job{}
+	err := r.Get(context.TODO(), client.ObjectKey{Namespace: r.Namespace, Name: nodeJobName(preflightOperation, nodeName)}, job)
+	if err != nil {
+		return nil, err
+	}
+	// The pods of a previous Job of the same name may still be there
+	pods := &corev1.PodList{}
+	err = r.List(context.TODO(), pods, client.InNamespace(r.Namespace),
+		client.MatchingLabels{batchv1.ControllerUidLabel: string(job.UID)})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == hookContainerName && status.State.Terminated != nil && status.State.Terminated.ExitCode == 0 {
+				return parsePreflightFacts(nodeName, status.State.Terminated.Message)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no completed preflight pod found for node %s", nodeName)
+}
+
+func parsePreflightFacts(nodeName string, message string) (*ccv1beta1.PreflightNodeStatus, error) {
+	status := &ccv1beta1.PreflightNodeStatus{Name: nodeName}
+	for _, line := range strings.Split(message, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "missing-module":
+			status.MissingKernelModules = append(status.MissingKernelModules, value)
+		case "cgroup":
+			version, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("node %s reported the invalid cgroup version %q", nodeName, value)
+			}
+			status.CgroupVersion = int32(version)
+		case "free-disk":
+			path, kib, _ := strings.Cut(value, ":")
+			free, err := strconv.ParseInt(kib, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("node %s reported the invalid free disk space %q under %s", nodeName, kib, path)
+			}
+			if status.FreeDisk == nil {
+				status.FreeDisk = map[string]resource.Quantity{}
+			}
+			status.FreeDisk[path] = *resource.NewQuantity(free*1024, resource.BinarySI)
+		case "conflict":
+			status.ConflictingPaths = append(status.ConflictingPaths, value)
+		}
+	}
+	return status, nil
+}
+
+// parseVersion returns the numeric components leading the version, e.g.
+// 5.15.0 for 5.15.0-91-generic or v1.7.2
+func parseVersion(version string) []int {
+	var parts []int
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, _ := strconv.Atoi(part[:end])
+		parts = append(parts, n)
+		if end < len(part) {
+			break
+		}
+	}
+	return parts
+}
+
+// versionAtLeast reflects whether the version is the minimum one or later
+func versionAtLeast(version string, minimum string) bool {
+	v, m := parseVersion(version), parseVersion(minimum)
+	for i := range m {
+		if i >= len(v) {
+			return m[i] == 0
+		}
+		if v[i] != m[i] {
+			return v[i] > m[i]
+		}
+	}
+	return true
+}
+
+// evaluatePreflight checks the facts of the node, along with its NodeInfo,
+// against the preflight configuration
+func (r *CcRuntimeReconciler) evaluatePreflight(status *ccv1beta1.PreflightNodeStatus, node *corev1.Node) {
+	preflight := &r.ccRuntime.Spec.Config.Preflight
+	status.KernelVersion = node.Status.NodeInfo.KernelVersion
+	status.ContainerRuntimeVersion = node.Status.NodeInfo.ContainerRuntimeVersion
+
+	var failures []string
+	if preflight.MinKernelVersion != "" && !versionAtLeast(status.KernelVersion, preflight.MinKernelVersion) {
+		failures = append(failures, fmt.Sprintf("kernel %s is older than %s", status.KernelVersion, preflight.MinKernelVersion))
+	}
+	if len(status.MissingKernelModules) > 0 {
+		failures = append(failures, "kernel modules not loaded: "+strings.Join(status.MissingKernelModules, ", "))
+	}
+	if len(preflight.ContainerRuntimes) > 0 {
+		runtime, version, _ := strings.Cut(status.ContainerRuntimeVersion, "://")
+		minimum, supported := preflight.ContainerRuntimes[runtime]
+		if !supported {
+			failures = append(failures, fmt.Sprintf("container runtime %s is not supported", status.ContainerRuntimeVersion))
+		} else if minimum != "" && !versionAtLeast(version, minimum) {
+			failures = append(failures, fmt.Sprintf("container runtime %s is older than %s", status.ContainerRuntimeVersion, minimum))
+		}
+	}
+	if preflight.CgroupVersion != 0 && status.CgroupVersion != preflight.CgroupVersion {
+		failures = append(failures, fmt.Sprintf("the node runs cgroup v%d, not v%d", status.CgroupVersion, preflight.CgroupVersion))
+	}
+	if preflight.MinFreeDisk != nil {
+		for _, path := range r.preflightInstallPaths() {
+			free, found := status.FreeDisk[path]
+			if found && free.Cmp(*preflight.MinFreeDisk) < 0 {
+				failures = append(failures, fmt.Sprintf("%s free under %s, less than %s", free.String(), path, preflight.MinFreeDisk.String()))
+			}
+		}
+	}
+	if len(status.ConflictingPaths) > 0 {
+		failures = append(failures, "conflicting runtimes found: "+strings.Join(status.ConflictingPaths, ", "))
+	}
+	// A failed Job is kept as a failure until the facts are gathered again
+	for _, failure := range status.Failures {
+		if strings.HasPrefix(failure, "the preflight Job failed") {
+			failures = append(failures, failure)
+		}
+	}
+	status.Failures = failures
+	status.Passed = len(failures) == 0
+}
+
+/*
+runPreflight gathers the facts of the selected nodes with a Job each, once per
+pod template, and checks them against the preflight configuration. The results
+are reported in the status, and the failing nodes are labelled so the install
+DaemonSets don't run on them. It returns true once the installation can go on:
+all the facts are gathered, and all the nodes passed or the failing ones are
+excluded.
+*/
+func (r *CcRuntimeReconciler) runPreflight(nodes []corev1.Node) (bool, ctrl.Result, error) {
+	requeue := ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}
+	if !r.ccRuntime.Spec.Config.Preflight.Enabled {
+		return true, ctrl.Result{}, r.cleanupPreflight()
+	}
+
+	previous := map[string]ccv1beta1.PreflightNodeStatus{}
+	for _, status := range r.ccRuntime.Status.Preflight {
+		previous[status.Name] = status
+	}
+
+	statuses := make([]ccv1beta1.PreflightNodeStatus, 0, len(nodes))
+	var pendingNodes []string
+	groups := groupNodesByArch(nodes, func(arch string) bool { return r.archPayloadImage(arch) != "" })
+	for _, group := range groups {
+		template, err := r.makeHookPodTemplate(r.preflightNodeHook(group.arch))
+		if err != nil {
+			return false, ctrl.Result{}, err
+		}
+		factsHash := template.Annotations[TemplateHashAnnotation]
+		unknown := func(node *corev1.Node) bool {
+			status, found := previous[node.Name]
+			return !found || status.FactsHash != factsHash
+		}
+		// The failing nodes are checked again, in case they were fixed
+		pending := func(node *corev1.Node) bool {
+			status := previous[node.Name]
+			return unknown(node) || (!status.Passed && time.Since(status.LastGatheredTime.Time) > preflightRecheckInterval)
+		}
+		result, err := r.runNodeJobs(preflightOperation, &template, group.nodes, pending, nil,
+			r.ccRuntime.Spec.Config.Preflight.TimeoutSeconds)
+		if err != nil {
+			return false, requeue, err
+		}
+
+		gathered := map[string]*ccv1beta1.PreflightNodeStatus{}
+		for _, name := range result.completed {
+			status, err := r.preflightFacts(name)
+			if err != nil {
+				return false, requeue, err
+			}
+			gathered[name] = status
+		}
+		for _, failed := range result.failed {
+			gathered[failed.Name] = &ccv1beta1.PreflightNodeStatus{
+				Name:     failed.Name,
+				Failures: []string{"the preflight Job failed: " + failed.Error},
+			}
+		}
+
+		for i := range group.nodes {
+			node := &group.nodes[i]
+			status, found := previous[node.Name]
+			if facts, ok := gathered[node.Name]; ok {
+				status, found = *facts, true
+				status.FactsHash = factsHash
+				status.LastGatheredTime = metav1.Now()
+				// The Job is deleted, or it would report its facts again once the
+				// pod template changes
+				if err := r.deleteJob(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+					Name: nodeJobName(preflightOperation, node.Name), Namespace: r.Namespace,
+				}}); err != nil {
+					return false, requeue, err
+				}
+			} else if unknown(node) {
+				pendingNodes = append(pendingNodes, node.Name)
+				if !found {
+					continue
+				}
+			}
+			r.evaluatePreflight(&status, node)
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	var failedNodes, passedNodes []string
+	var failures []string
+	for _, status := range statuses {
+		if status.Passed {
+			passedNodes = append(passedNodes, status.Name)
+		} else {
+			failedNodes = append(failedNodes, status.Name)
+			failures = append(failures, status.Name+": "+strings.Join(status.Failures, "; "))
+		}
+	}
+	if err := r.labelPreflightResults(nodes, failedNodes, passedNodes); err != nil {
+		return false, requeue, err
+	}
+
+	condition := metav1.Condition{
+		Type:               PreflightPassedCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Passed",
+		Message:            fmt.Sprintf("All the %d nodes passed the preflight checks", len(statuses)),
+		ObservedGeneration: r.ccRuntime.Generation,
+	}
+	done := true
+	switch {
+	case len(failedNodes) > 0 && r.preflightPolicy() == ccv1beta1.ExcludePreflightPolicy:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NodesExcluded"
+		condition.Message = "The nodes failing the preflight checks are excluded from the installation: " + strings.Join(failures, ", ")
+	case len(failedNodes) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Failed"
+		condition.Message = "The installation waits for the nodes to pass the preflight checks: " + strings.Join(failures, ", ")
+		done = false
+	}
+	if len(pendingNodes) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Pending"
+		condition.Message = "Gathering the facts of the nodes " + strings.Join(pendingNodes, ", ")
+		done = false
+	}
+
+	changed := meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition)
+	if changed && condition.Status == metav1.ConditionFalse && condition.Reason != "Pending" {
+		r.recordEvent(corev1.EventTypeWarning, "PreflightFailed", "%s", condition.Message)
+	}
+	if !equality.Semantic.DeepEqual(statuses, r.ccRuntime.Status.Preflight) {
+		r.ccRuntime.Status.Preflight = statuses
+		changed = true
+	}
+	if changed {
+		if err := r.updateCcRuntimeStatus(); err != nil {
+			r.Log.Info("failed to update status after the preflight checks")
+			return false, requeue, err
+		}
+	}
+	if !done {
+		r.Log.Info("waiting for the preflight checks", "pending", pendingNodes, "failed", failedNodes)
+		return false, requeue, nil
+	}
+	return true, ctrl.Result{}, nil
+}
+
+// labelPreflightResults labels the failing nodes, and removes the label from
+// the nodes that pass now
+func (r *CcRuntimeReconciler) labelPreflightResults(nodes []corev1.Node, failedNodes, passedNodes []string) error {
+	var newlyFailed []string
+	passed := &corev1.NodeList{}
+	for _, node := range nodes {
+		failing := node.Labels[PreflightLabel] == preflightFailed
+		if contains(failedNodes, node.Name) && !failing {
+			newlyFailed = append(newlyFailed, node.Name)
+		} else if contains(passedNodes, node.Name) && failing {
+			passed.Items = append(passed.Items, node)
+		}
+	}
+	if err := r.labelNodes(newlyFailed, map[string]string{PreflightLabel: preflightFailed}); err != nil {
+		return err
+	}
+	return r.removeNodeLabel(passed, PreflightLabel)
+}
+
+// cleanupPreflight removes the results of the preflight checks once they're
+// disabled
+func (r *CcRuntimeReconciler) cleanupPreflight() error {
+	if len(r.ccRuntime.Status.Preflight) == 0 &&
+		meta.FindStatusCondition(r.ccRuntime.Status.Conditions, PreflightPassedCondition) == nil {
+		return nil
+	}
+	if err := r.deleteNodeJobs(preflightOperation); err != nil {
+		return err
+	}
+	nodes, err := r.getNodesWithLabels(map[string]string{PreflightLabel: preflightFailed})
+	if err != nil {
+		return err
+	}
+	if err := r.removeNodeLabel(nodes, PreflightLabel); err != nil {
+		return err
+	}
+	r.ccRuntime.Status.Preflight = nil
+	meta.RemoveStatusCondition(&r.ccRuntime.Status.Conditions, PreflightPassedCondition)
+	return r.updateCcRuntimeStatus()
+}
+
+// excludePreflightFailures keeps the pods of the install DaemonSets off the
+// nodes failing the preflight checks
+func (r *CcRuntimeReconciler) excludePreflightFailures(spec *corev1.PodSpec) {
+	if !r.ccRuntime.Spec.Config.Preflight.Enabled {
+		return
+	}
+	requireNode(spec, corev1.NodeSelectorRequirement{
+		Key:      PreflightLabel,
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{preflightFailed},
+	})
+}
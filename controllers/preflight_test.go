@@ -0,0 +1,346 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// reportPreflightFacts completes the preflight Job of the node with a pod
+// reporting the facts in its termination message, as the preflight script does
+func reportPreflightFacts(nodeName, facts string) {
+	job, err := getNodeJob(preflightOperation, nodeName)
+	Expect(err).NotTo(HaveOccurred())
+	// The fake client doesn't set the UIDs the pods are matched with
+	if job.UID == "" {
+		job.UID = types.UID(uniqueName("uid"))
+		Expect(k8sClient.Update(context.TODO(), job)).To(Succeed())
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-" + uniqueName("pod"),
+			Namespace: testNamespace,
+			Labels:    map[string]string{batchv1.ControllerUidLabel: string(job.UID)},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      nodeName,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers:    []corev1.Container{{Name: hookContainerName, Image: job.Spec.Template.Spec.Containers[0].Image}},
+		},
+	}
+	Expect(k8sClient.Create(context.TODO(), pod)).To(Succeed())
+	DeferCleanup(k8sClient.Delete, context.TODO(), pod)
+	pod.Status = corev1.PodStatus{
+		Phase: corev1.PodSucceeded,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  hookContainerName,
+			Image: pod.Spec.Containers[0].Image,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0, Message: facts}},
+		}},
+	}
+	Expect(k8sClient.Status().Update(context.TODO(), pod)).To(Succeed())
+	completeJob(job)
+}
+
+var _ = Describe("Preflight checks", func() {
+	DescribeTable("comparing the versions",
+		func(version, minimum string, want bool) {
+			Expect(versionAtLeast(version, minimum)).To(Equal(want))
+		},
+		Entry("distribution kernel", "5.15.0-91-generic", "5.10", true),
+		Entry("older kernel", "4.18.0-553.el8_10.x86_64", "5.10", false),
+		Entry("same version", "v1.7.2", "1.7.2", true),
+		Entry("older patch", "1.7.1", "1.7.2", false),
+		Entry("shorter version", "6.1", "6.1.0", true),
+		Entry("shorter older version", "6.1", "6.1.1", false),
+		Entry("major version", "6.0", "5.19", true),
+	)
+
+	It("parses the facts the script reports", func() {
+		status, err := parsePreflightFacts("worker-0",
+			"missing-module=kvm\nmissing-module=vhost_vsock\ncgroup=2\nfree-disk=/opt:1048576\nconflict=/opt/confidential-containers\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status).To(Equal(&ccv1beta1.PreflightNodeStatus{
+			Name:                 "worker-0",
+			MissingKernelModules: []string{"kvm", "vhost_vsock"},
+			CgroupVersion:        2,
+			FreeDisk:             map[string]resource.Quantity{"/opt": *resource.NewQuantity(1<<30, resource.BinarySI)},
+			ConflictingPaths:     []string{"/opt/confidential-containers"},
+		}))
+	})
+
+	DescribeTable("rejecting the invalid facts",
+		func(facts, want string) {
+			_, err := parsePreflightFacts("worker-0", facts)
+			Expect(err).To(MatchError(want))
+		},
+		Entry("cgroup version", "cgroup=unified", `node worker-0 reported the invalid cgroup version "unified"`),
+		Entry("free disk space", "free-disk=/opt:", `node worker-0 reported the invalid free disk space "" under /opt`),
+	)
+
+	DescribeTable("evaluating the facts",
+		func(config ccv1beta1.PreflightConfig, facts ccv1beta1.PreflightNodeStatus, want []string) {
+			ccRuntime := newTestCcRuntime(uniqueName("preflight"))
+			ccRuntime.Spec.Config.Preflight = config
+			r, _ := newTestReconciler(ccRuntime)
+			node := &corev1.Node{Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{
+				KernelVersion:           "5.14.0-427.el9.x86_64",
+				ContainerRuntimeVersion: "containerd://1.7.27",
+			}}}
+
+			r.evaluatePreflight(&facts, node)
+			Expect(facts.KernelVersion).To(Equal("5.14.0-427.el9.x86_64"))
+			Expect(facts.ContainerRuntimeVersion).To(Equal("containerd://1.7.27"))
+			Expect(facts.Failures).To(Equal(want))
+			Expect(facts.Passed).To(Equal(len(want) == 0))
+		},
+		Entry("passing node",
+			ccv1beta1.PreflightConfig{MinKernelVersion: "5.10", ContainerRuntimes: map[string]string{"containerd": "1.7"},
+				CgroupVersion: 2, MinFreeDisk: resource.NewQuantity(1<<30, resource.BinarySI)},
+			ccv1beta1.PreflightNodeStatus{CgroupVersion: 2,
+				FreeDisk: map[string]resource.Quantity{"/opt": resource.MustParse("2Gi")}},
+			nil),
+		Entry("old kernel", ccv1beta1.PreflightConfig{MinKernelVersion: "6.1"}, ccv1beta1.PreflightNodeStatus{},
+			[]string{"kernel 5.14.0-427.el9.x86_64 is older than 6.1"}),
+		Entry("missing kernel modules", ccv1beta1.PreflightConfig{},
+			ccv1beta1.PreflightNodeStatus{MissingKernelModules: []string{"kvm", "vhost_vsock"}},
+			[]string{"kernel modules not loaded: kvm, vhost_vsock"}),
+		Entry("unsupported container runtime",
+			ccv1beta1.PreflightConfig{ContainerRuntimes: map[string]string{"cri-o": ""}}, ccv1beta1.PreflightNodeStatus{},
+			[]string{"container runtime containerd://1.7.27 is not supported"}),
+		Entry("old container runtime",
+			ccv1beta1.PreflightConfig{ContainerRuntimes: map[string]string{"containerd": "2.0"}}, ccv1beta1.PreflightNodeStatus{},
+			[]string{"container runtime containerd://1.7.27 is older than 2.0"}),
+		Entry("cgroup v1", ccv1beta1.PreflightConfig{CgroupVersion: 2}, ccv1beta1.PreflightNodeStatus{CgroupVersion: 1},
+			[]string{"the node runs cgroup v1, not v2"}),
+		Entry("low free disk space",
+			ccv1beta1.PreflightConfig{MinFreeDisk: resource.NewQuantity(1<<30, resource.BinarySI)},
+			ccv1beta1.PreflightNodeStatus{FreeDisk: map[string]resource.Quantity{"/opt": resource.MustParse("512Mi")}},
+			[]string{"512Mi free under /opt, less than 1Gi"}),
+		Entry("conflicting runtimes", ccv1beta1.PreflightConfig{},
+			ccv1beta1.PreflightNodeStatus{ConflictingPaths: []string{"/opt/confidential-containers"}},
+			[]string{"conflicting runtimes found: /opt/confidential-containers"}),
+		Entry("failed Job kept until the facts are gathered again", ccv1beta1.PreflightConfig{},
+			ccv1beta1.PreflightNodeStatus{Failures: []string{"the preflight Job failed: BackoffLimitExceeded", "stale failure"}},
+			[]string{"the preflight Job failed: BackoffLimitExceeded"}),
+	)
+
+	DescribeTable("checking the kernel modules of the runtime",
+		func(runtimeName ccv1beta1.CcRuntimeName, modules []string, want []string) {
+			ccRuntime := newTestCcRuntime(uniqueName("preflight"))
+			ccRuntime.Spec.RuntimeName = runtimeName
+			ccRuntime.Spec.Config.Preflight.KernelModules = modules
+			r, _ := newTestReconciler(ccRuntime)
+			Expect(r.preflightKernelModules()).To(Equal(want))
+		},
+		Entry("kata", ccv1beta1.CcRuntimeName("kata"), nil, []string{"kvm", "vhost_vsock"}),
+		Entry("enclave-cc", ccv1beta1.CcRuntimeName("enclave-cc"), nil, nil),
+		Entry("configured", ccv1beta1.CcRuntimeName("kata"), []string{"kvm_intel"}, []string{"kvm_intel"}),
+		Entry("none", ccv1beta1.CcRuntimeName("kata"), []string{}, []string{}),
+	)
+
+	It("gathers the facts with the payload image and the host filesystem read-only", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("preflight"))
+		ccRuntime.Spec.Config.Preflight = ccv1beta1.PreflightConfig{
+			Enabled: true, ConflictingPaths: []string{"/opt/confidential-containers", "/usr/local/bin/containerd"},
+		}
+		r, _ := newTestReconciler(ccRuntime)
+
+		hook := r.preflightNodeHook("")
+		Expect(hook.Image).To(Equal(ccRuntime.Spec.Config.PayloadImage))
+		Expect(hook.EnvironmentVariables).To(ConsistOf(
+			corev1.EnvVar{Name: "KERNEL_MODULES", Value: "kvm vhost_vsock"},
+			corev1.EnvVar{Name: "INSTALL_PATHS", Value: "/opt"},
+			corev1.EnvVar{Name: "CONFLICTING_PATHS", Value: "/opt/confidential-containers /usr/local/bin/containerd"}))
+		Expect(hook.VolumeMounts).To(ConsistOf(corev1.VolumeMount{Name: "host", MountPath: "/host", ReadOnly: true}))
+
+		ccRuntime.Spec.Config.Preflight.Image = "quay.io/confidential-containers/preflight:latest"
+		Expect(r.preflightNodeHook("").Image).To(Equal("quay.io/confidential-containers/preflight:latest"))
+	})
+
+	It("keeps the install DaemonSet off the failing nodes", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("preflight"))
+		ccRuntime.Spec.Config.Preflight.Enabled = true
+		r, _ := newTestReconciler(ccRuntime)
+
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		terms := ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		for _, term := range terms {
+			Expect(term.MatchExpressions).To(ContainElement(corev1.NodeSelectorRequirement{
+				Key: PreflightLabel, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"failed"},
+			}))
+		}
+	})
+
+	Context("running on the nodes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			labels    map[string]string
+			passing   string
+			failing   string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("preflight"))
+			ccRuntime.Spec.Config.Preflight = ccv1beta1.PreflightConfig{
+				Enabled:           true,
+				MinKernelVersion:  "5.10",
+				ContainerRuntimes: map[string]string{"containerd": "1.7"},
+				MinFreeDisk:       resource.NewQuantity(1<<30, resource.BinarySI),
+			}
+			labels = selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+			r, _ = newTestReconciler(ccRuntime)
+
+			passing, failing = uniqueName("preflight-node"), uniqueName("preflight-node")
+			for _, name := range []string{passing, failing} {
+				createTestNode(name, labels)
+				setNodeInfo(name, corev1.NodeSystemInfo{
+					KernelVersion: "6.8.0-45-generic", ContainerRuntimeVersion: "containerd://1.7.27",
+				})
+			}
+		})
+
+		preflight := func(r *CcRuntimeReconciler) bool {
+			nodes, err := r.getNodesWithLabels(labels)
+			Expect(err).NotTo(HaveOccurred())
+			done, _, err := r.runPreflight(nodes.Items)
+			Expect(err).NotTo(HaveOccurred())
+			return done
+		}
+		condition := func() *metav1.Condition {
+			return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions, PreflightPassedCondition)
+		}
+		gather := func(r *CcRuntimeReconciler) {
+			Expect(preflight(r)).To(BeFalse())
+			Expect(condition()).To(HaveField("Reason", "Pending"))
+			reportPreflightFacts(passing, "cgroup=2\nfree-disk=/opt:4194304\n")
+			reportPreflightFacts(failing, "missing-module=vhost_vsock\ncgroup=2\nfree-disk=/opt:4194304\n")
+		}
+
+		It("blocks the installation on the failing nodes", func() {
+			r, recorder := newTestReconciler(ccRuntime)
+			gather(r)
+
+			Expect(preflight(r)).To(BeFalse())
+			status := getCcRuntime(ccRuntime.Name).Status.Preflight
+			Expect(status).To(HaveLen(2))
+			Expect(status).To(ContainElements(
+				And(HaveField("Name", passing), HaveField("Passed", true),
+					HaveField("KernelVersion", "6.8.0-45-generic"), HaveField("FactsHash", Not(BeEmpty()))),
+				And(HaveField("Name", failing), HaveField("Passed", false),
+					HaveField("Failures", []string{"kernel modules not loaded: vhost_vsock"}))))
+			Expect(condition()).To(And(HaveField("Status", metav1.ConditionFalse), HaveField("Reason", "Failed")))
+			Expect(condition().Message).To(ContainSubstring(failing + ": kernel modules not loaded: vhost_vsock"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("PreflightFailed")))
+
+			Expect(getNode(failing).Labels).To(HaveKeyWithValue(PreflightLabel, "failed"))
+			Expect(getNode(passing).Labels).NotTo(HaveKey(PreflightLabel))
+			for _, name := range []string{passing, failing} {
+				_, err := getNodeJob(preflightOperation, name)
+				Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			}
+
+			// The facts are kept until the failing node is checked again
+			Expect(preflight(r)).To(BeFalse())
+			_, err := getNodeJob(preflightOperation, failing)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("checks the failing nodes again", func() {
+			gather(r)
+			Expect(preflight(r)).To(BeFalse())
+
+			stored := getCcRuntime(ccRuntime.Name)
+			for i := range stored.Status.Preflight {
+				stored.Status.Preflight[i].LastGatheredTime = metav1.NewTime(time.Now().Add(-2 * preflightRecheckInterval))
+			}
+			Expect(k8sClient.Status().Update(context.TODO(), stored)).To(Succeed())
+			r, _ = newTestReconciler(stored)
+
+			Expect(preflight(r)).To(BeFalse())
+			_, err := getNodeJob(preflightOperation, failing)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = getNodeJob(preflightOperation, passing)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+			// The node was fixed
+			reportPreflightFacts(failing, "cgroup=2\nfree-disk=/opt:4194304\n")
+			Expect(preflight(r)).To(BeTrue())
+			Expect(condition()).To(HaveField("Status", metav1.ConditionTrue))
+			Expect(getNode(failing).Labels).NotTo(HaveKey(PreflightLabel))
+		})
+
+		It("excludes the failing nodes from the installation", func() {
+			ccRuntime.Spec.Config.Preflight.Policy = ccv1beta1.ExcludePreflightPolicy
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+			gather(r)
+
+			Expect(preflight(r)).To(BeTrue())
+			Expect(condition()).To(HaveField("Reason", "NodesExcluded"))
+			Expect(r.excludedByPreflight(getNode(failing))).To(BeTrue())
+			Expect(r.excludedByPreflight(getNode(passing))).To(BeFalse())
+			included := r.withoutExcludedNodes([]corev1.Node{*getNode(passing), *getNode(failing)})
+			Expect(included).To(ConsistOf(HaveField("Name", passing)))
+		})
+
+		It("reports a failed Job as a failure of the node", func() {
+			ccRuntime.Spec.Config.Preflight.Policy = ccv1beta1.ExcludePreflightPolicy
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+			Expect(preflight(r)).To(BeFalse())
+			reportPreflightFacts(passing, "cgroup=2\n")
+			job, err := getNodeJob(preflightOperation, failing)
+			Expect(err).NotTo(HaveOccurred())
+			failJob(job, "DeadlineExceeded", "Job was active longer than specified deadline")
+
+			Expect(preflight(r)).To(BeTrue())
+			Expect(getCcRuntime(ccRuntime.Name).Status.Preflight).To(ContainElement(And(
+				HaveField("Name", failing),
+				HaveField("Failures", []string{
+					"the preflight Job failed: DeadlineExceeded: Job was active longer than specified deadline",
+				}))))
+		})
+
+		It("removes the results once disabled", func() {
+			gather(r)
+			Expect(preflight(r)).To(BeFalse())
+			ccRuntime.Spec.Config.Preflight.Enabled = false
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+			Expect(preflight(r)).To(BeTrue())
+			Expect(getCcRuntime(ccRuntime.Name).Status.Preflight).To(BeEmpty())
+			Expect(condition()).To(BeNil())
+			Expect(getNode(failing).Labels).NotTo(HaveKey(PreflightLabel))
+		})
+	})
+})
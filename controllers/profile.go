@@ -0,0 +1,95 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// resolveProfile merges the configuration of the CcRuntime over its profile,
+// and reports the merged configuration in the status. The reconciler works on
+// the merged configuration, while the updates of the CcRuntime keep the one
+// written by the user
+func (r *CcRuntimeReconciler) resolveProfile() error {
+	r.writtenSpec = nil
+	if r.ccRuntime.Spec.Profile == "" {
+		if r.ccRuntime.Status.EffectiveConfig == nil {
+			return nil
+		}
+		r.ccRuntime.Status.EffectiveConfig = nil
+		return r.updateCcRuntimeStatus()
+	}
+
+	r.writtenSpec = r.ccRuntime.Spec.DeepCopy()
+	if err := r.ccRuntime.ApplyProfile(); err != nil {
+		r.Log.Error(err, "applying the profile failed", "profile", r.ccRuntime.Spec.Profile)
+		return err
+	}
+	if equality.Semantic.DeepEqual(r.ccRuntime.Status.EffectiveConfig, &r.ccRuntime.Spec.Config) {
+		return nil
+	}
+	r.ccRuntime.Status.EffectiveConfig = r.ccRuntime.Spec.Config.DeepCopy()
+	if err := r.updateCcRuntimeStatus(); err != nil {
+		r.Log.Info("failed to update status with the effective configuration")
+		return err
+	}
+	return nil
+}
+
+// updateCcRuntime writes the CcRuntime with the configuration and runtime name
+// written by the user, rather than the ones merged with the profile. The other
+// fields of the spec, e.g. the default node selector, are written as they are
+func (r *CcRuntimeReconciler) updateCcRuntime() (ctrl.Result, error) {
+	var err error
+	if r.writtenSpec == nil {
+		err = r.Update(context.TODO(), r.ccRuntime)
+	} else {
+		effective := r.ccRuntime.Spec.DeepCopy()
+		r.ccRuntime.Spec.Config = *r.writtenSpec.Config.DeepCopy()
+		r.ccRuntime.Spec.RuntimeName = r.writtenSpec.RuntimeName
+		err = r.Update(context.TODO(), r.ccRuntime)
+		if err == nil {
+			r.writtenSpec = r.ccRuntime.Spec.DeepCopy()
+		}
+		effective.DeepCopyInto(&r.ccRuntime.Spec)
+	}
+	if err != nil {
+		r.Log.Error(err, "failed to update ccRuntime")
+		return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// updateCcRuntimeStatus writes the status of the CcRuntime, keeping the
+// configuration merged with the profile when the update replaces the spec with
+// the stored one
+func (r *CcRuntimeReconciler) updateCcRuntimeStatus() error {
+	if r.writtenSpec == nil {
+		return r.Status().Update(context.TODO(), r.ccRuntime)
+	}
+	effective := r.ccRuntime.Spec.DeepCopy()
+	err := r.Status().Update(context.TODO(), r.ccRuntime)
+	if err == nil {
+		r.writtenSpec = r.ccRuntime.Spec.DeepCopy()
+	}
+	effective.DeepCopyInto(&r.ccRuntime.Spec)
+	return err
+}
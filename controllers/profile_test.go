@@ -0,0 +1,100 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Profiles", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+	)
+
+	BeforeEach(func() {
+		ccRuntime = newTestCcRuntime(uniqueName("profile"))
+		ccRuntime.Spec.Profile = ccv1beta1.S390xProfile
+		ccRuntime.Spec.RuntimeName = ""
+		ccRuntime.Spec.Config = ccv1beta1.CcInstallConfig{
+			PayloadImage: "quay.io/kata-containers/kata-deploy:3.24.0",
+		}
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+	})
+
+	It("works on the configuration merged over the profile", func() {
+		Expect(r.resolveProfile()).To(Succeed())
+		Expect(ccRuntime.Spec.RuntimeName).To(Equal(ccv1beta1.CcRuntimeName("kata")))
+		Expect(ccRuntime.Spec.Config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.24.0"))
+		Expect(ccRuntime.Spec.Config.InstallCmd).To(Equal([]string{"/opt/kata-artifacts/scripts/kata-deploy.sh", "install"}))
+		Expect(ccRuntime.Spec.Config.RuntimeClasses).To(ContainElement(HaveField("Name", "kata-qemu-se")))
+
+		stored := getCcRuntime(ccRuntime.Name)
+		Expect(stored.Status.EffectiveConfig).To(Equal(&ccRuntime.Spec.Config))
+		Expect(stored.Spec.RuntimeName).To(BeEmpty())
+		Expect(stored.Spec.Config).To(Equal(ccv1beta1.CcInstallConfig{
+			PayloadImage: "quay.io/kata-containers/kata-deploy:3.24.0",
+		}))
+	})
+
+	It("keeps the merged configuration across the updates", func() {
+		Expect(r.resolveProfile()).To(Succeed())
+		effective := ccRuntime.Spec.DeepCopy()
+
+		ccRuntime.Status.TotalNodesCount = 3
+		Expect(r.updateCcRuntimeStatus()).To(Succeed())
+		Expect(&ccRuntime.Spec).To(Equal(effective))
+		Expect(getCcRuntime(ccRuntime.Name).Status.TotalNodesCount).To(Equal(3))
+
+		ccRuntime.Finalizers = []string{RuntimeConfigFinalizer}
+		_, err := r.updateCcRuntime()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(&ccRuntime.Spec).To(Equal(effective))
+		stored := getCcRuntime(ccRuntime.Name)
+		Expect(stored.Finalizers).To(ConsistOf(RuntimeConfigFinalizer))
+		Expect(stored.Spec.RuntimeName).To(BeEmpty())
+		Expect(stored.Spec.Config.InstallCmd).To(BeEmpty())
+	})
+
+	It("only updates the effective configuration when it changes", func() {
+		Expect(r.resolveProfile()).To(Succeed())
+		resourceVersion := getCcRuntime(ccRuntime.Name).ResourceVersion
+
+		r, _ = newTestReconciler(getCcRuntime(ccRuntime.Name))
+		Expect(r.resolveProfile()).To(Succeed())
+		Expect(getCcRuntime(ccRuntime.Name).ResourceVersion).To(Equal(resourceVersion))
+	})
+
+	It("drops the effective configuration without a profile", func() {
+		Expect(r.resolveProfile()).To(Succeed())
+		Expect(getCcRuntime(ccRuntime.Name).Status.EffectiveConfig).NotTo(BeNil())
+
+		stored := getCcRuntime(ccRuntime.Name)
+		stored.Spec = newTestCcRuntime(stored.Name).Spec
+		Expect(k8sClient.Update(context.TODO(), stored)).To(Succeed())
+		r, _ = newTestReconciler(stored)
+		Expect(r.resolveProfile()).To(Succeed())
+		Expect(getCcRuntime(ccRuntime.Name).Status.EffectiveConfig).To(BeNil())
+		Expect(r.writtenSpec).To(BeNil())
+	})
+})
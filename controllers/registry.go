@@ -0,0 +1,401 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubEndpoint = "registry-1.docker.io"
+
+	// maxManifestSize limits what is read from the registry for manifests and small blobs
+	maxManifestSize = 4 << 20
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ImageResolver resolves image references to the digest of their manifest
+type ImageResolver interface {
+	Resolve(ctx context.Context, image string, credentials RegistryCredentials) (string, error)
+}
+
+// RegistryAuth holds the credentials of a single registry
+type RegistryAuth struct {
+	Username string
+	Password string
+}
+
+// RegistryCredentials maps registry hosts to their credentials
+type RegistryCredentials map[string]RegistryAuth
+
+// credentialsFromSecret reads the registry credentials of a kubernetes.io/dockerconfigjson
+// or kubernetes.io/dockercfg Secret
+func credentialsFromSecret(secret *corev1.Secret) (RegistryCredentials, error) {
+	type authEntry struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}
+	var auths map[string]authEntry
+
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config := struct {
+			Auths map[string]authEntry `json:"auths"`
+		}{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return nil, fmt.Errorf("failed to parse secret %s: %w", secret.Name, err)
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return nil, fmt.Errorf("failed to parse secret %s: %w", secret.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("secret %s has unsupported type %s", secret.Name, secret.Type)
+	}
+
+	credentials := RegistryCredentials{}
+	for host, entry := range auths {
+		if entry.Auth != "" && entry.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode the auth of %s in secret %s: %w", host, secret.Name, err)
+			}
+			entry.Username, entry.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		// Entries may be full URLs, e.g. https://index.docker.io/v1/
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		if host == "index.docker.io" {
+			host = dockerHubRegistry
+		}
+		credentials[host] = RegistryAuth{Username: entry.Username, Password: entry.Password}
+	}
+	return credentials, nil
+}
+
+// imageReference is a parsed container image reference
+type imageReference struct {
+	// Name is the image name as written, without tag or digest
+	Name       string
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func parseImageReference(image string) (imageReference, error) {
+	ref := imageReference{}
+	if image == "" {
+		return ref, fmt.Errorf("empty image reference")
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.Contains(ref.Digest, ":") {
+			return ref, fmt.Errorf("invalid digest in image reference %q", image)
+		}
+	}
+	// A tag is a ':' after the last '/', anything before is a registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	ref.Name = name
+
+	registry, repository, found := strings.Cut(name, "/")
+	if !found || (!strings.ContainsAny(registry, ".:") && registry != "localhost") {
+		registry = dockerHubRegistry
+		repository = name
+	}
+	if registry == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	if repository == "" {
+		return ref, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref.Registry = registry
+	ref.Repository = repository
+	return ref, nil
+}
+
+// reference returns the digest if set, the tag otherwise
+func (ref imageReference) reference() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
+
+// pinned returns the image reference pinned to the given digest
+func (ref imageReference) pinned(digest string) string {
+	return ref.Name + "@" + digest
+}
+
+// RegistryClient talks to OCI distribution registries
+type RegistryClient struct {
+	HTTPClient *http.Client
+}
+
+// NewRegistryClient returns a RegistryClient with sensible timeouts
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Resolve returns the digest of the manifest the image reference points to
+func (c *RegistryClient) Resolve(ctx context.Context, image string, credentials RegistryCredentials) (string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	resp, err := c.get(ctx, http.MethodHead, ref, "/manifests/"+ref.Tag, manifestMediaTypes, credentials)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// The registry didn't report the digest, compute it from the manifest
+	manifest, _, err := c.getManifest(ctx, ref, ref.Tag, credentials)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// getManifest fetches a manifest by tag or digest and returns it along with its media type
+func (c *RegistryClient) getManifest(ctx context.Context, ref imageReference, reference string,
+	credentials RegistryCredentials) ([]byte, string, error) {
+	resp, err := c.get(ctx, http.MethodGet, ref, "/manifests/"+reference, manifestMediaTypes, credentials)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// getBlob fetches a small blob and checks it against its digest
+func (c *RegistryClient) getBlob(ctx context.Context, ref imageReference, digest string,
+	credentials RegistryCredentials) ([]byte, error) {
+	resp, err := c.get(ctx, http.MethodGet, ref, "/blobs/"+digest, nil, credentials)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("blob %s of %s doesn't match its digest", digest, ref.Name)
+	}
+	return data, nil
+}
+
+// get issues a request against the repository of ref, authenticating when the
+// registry asks for it. A response is only returned for 2xx status codes.
+func (c *RegistryClient) get(ctx context.Context, method string, ref imageReference, path string,
+	accept []string, credentials RegistryCredentials) (*http.Response, error) {
+	endpoint := ref.Registry
+	if endpoint == dockerHubRegistry {
+		endpoint = dockerHubEndpoint
+	}
+	u := url.URL{
+		Scheme: registryScheme(endpoint),
+		Host:   endpoint,
+		Path:   "/v2/" + ref.Repository + path,
+	}
+	auth, hasAuth := credentials[ref.Registry]
+
+	newRequest := func(authorization string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		var authorization string
+		scheme, params := parseAuthChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			token, err := c.fetchToken(ctx, params, ref.Repository, auth, hasAuth)
+			if err != nil {
+				return nil, err
+			}
+			authorization = "Bearer " + token
+		case "basic":
+			if !hasAuth {
+				return nil, fmt.Errorf("registry %s requires credentials", ref.Registry)
+			}
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+		default:
+			return nil, fmt.Errorf("registry %s requested unsupported authentication %q", ref.Registry, challenge)
+		}
+
+		req, err = newRequest(authorization)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected status %s", method, u.String(), resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *RegistryClient) fetchToken(ctx context.Context, params map[string]string, repository string,
+	auth RegistryAuth, hasAuth bool) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasAuth {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s failed: %s", realm.Host, resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// registryScheme returns http for registries on the local host, as container runtimes do
+func registryScheme(endpoint string) string {
+	host := endpoint
+	if h, _, err := net.SplitHostPort(endpoint); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.example.com/token",service="registry.example.com"
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
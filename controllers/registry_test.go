@@ -0,0 +1,269 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+const (
+	testIndex = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	testBlob  = `{"critical":{}}`
+)
+
+func testDigest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// testRegistry serves the v1 tag of the coco/payload repository as an image
+// index, and a blob, behind the authentication of auth
+type testRegistry struct {
+	// auth is the authentication required, "", "bearer" or "basic"
+	auth string
+	// digestHeader is whether Docker-Content-Digest is set on the manifests
+	digestHeader bool
+	// blob is what the blob of testBlob's digest is served as
+	blob string
+
+	// requests counts the requests made to the registry, token excluded
+	requests int
+	// accept is the Accept header of the last manifest request
+	accept string
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:coco/payload:pull" ||
+			req.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"test-token"}`))
+		return
+	}
+
+	reg.requests++
+	authorization := req.Header.Get("Authorization")
+	switch reg.auth {
+	case "bearer":
+		if authorization != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="http://`+req.Host+`/token",service="test-registry",scope="repository:coco/payload:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case "basic":
+		if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch req.URL.Path {
+	case "/v2/coco/payload/manifests/v1":
+		reg.accept = req.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		if reg.digestHeader {
+			w.Header().Set("Docker-Content-Digest", testDigest(testIndex))
+		}
+		if req.Method == http.MethodGet {
+			_, _ = w.Write([]byte(testIndex))
+		}
+	case "/v2/coco/payload/blobs/" + testDigest(testBlob):
+		_, _ = w.Write([]byte(reg.blob))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Registry client", func() {
+	type resolveCase struct {
+		registry     testRegistry
+		image        string
+		credentials  bool
+		want         string
+		wantRequests int
+		wantErr      string
+	}
+
+	DescribeTable("resolving image references",
+		func(tc resolveCase) {
+			registry := tc.registry
+			server := httptest.NewServer(&registry)
+			defer server.Close()
+			host := strings.TrimPrefix(server.URL, "http://")
+
+			var creds RegistryCredentials
+			if tc.credentials {
+				creds = RegistryCredentials{host: {Username: "user", Password: "secret"}}
+			}
+			got, err := NewRegistryClient().Resolve(context.TODO(), host+"/"+tc.image, creds)
+			if tc.wantErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(tc.wantErr)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(tc.want))
+			Expect(registry.requests).To(Equal(tc.wantRequests))
+			if tc.wantRequests > 0 {
+				Expect(registry.accept).To(ContainSubstring("application/vnd.oci.image.index.v1+json"))
+			}
+		},
+		Entry("tag to digest", resolveCase{
+			registry:     testRegistry{digestHeader: true},
+			image:        "coco/payload:v1",
+			want:         testDigest(testIndex),
+			wantRequests: 1,
+		}),
+		Entry("index manifest without digest header", resolveCase{
+			registry:     testRegistry{},
+			image:        "coco/payload:v1",
+			want:         testDigest(testIndex),
+			wantRequests: 2,
+		}),
+		Entry("digest left as is", resolveCase{
+			registry: testRegistry{},
+			image:    "coco/payload@" + testDigest(testBlob),
+			want:     testDigest(testBlob),
+		}),
+		Entry("bearer token retry", resolveCase{
+			registry:     testRegistry{auth: "bearer", digestHeader: true},
+			image:        "coco/payload:v1",
+			credentials:  true,
+			want:         testDigest(testIndex),
+			wantRequests: 2,
+		}),
+		Entry("bearer token without credentials", resolveCase{
+			registry: testRegistry{auth: "bearer", digestHeader: true},
+			image:    "coco/payload:v1",
+			wantErr:  "token request",
+		}),
+		Entry("basic authentication retry", resolveCase{
+			registry:     testRegistry{auth: "basic", digestHeader: true},
+			image:        "coco/payload:v1",
+			credentials:  true,
+			want:         testDigest(testIndex),
+			wantRequests: 2,
+		}),
+		Entry("basic authentication without credentials", resolveCase{
+			registry: testRegistry{auth: "basic", digestHeader: true},
+			image:    "coco/payload:v1",
+			wantErr:  "requires credentials",
+		}),
+		Entry("unknown tag", resolveCase{
+			registry: testRegistry{digestHeader: true},
+			image:    "coco/payload:v2",
+			wantErr:  "unexpected status 404",
+		}),
+	)
+
+	DescribeTable("fetching blobs",
+		func(blob string, wantErr bool) {
+			server := httptest.NewServer(&testRegistry{blob: blob})
+			defer server.Close()
+			ref, err := parseImageReference(strings.TrimPrefix(server.URL, "http://") + "/coco/payload:v1")
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := NewRegistryClient().getBlob(context.TODO(), ref, testDigest(testBlob), nil)
+			if wantErr {
+				Expect(err).To(MatchError(ContainSubstring("doesn't match its digest")))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(testBlob))
+		},
+		Entry("matching digest", testBlob, false),
+		Entry("digest mismatch", `{"critical":{"tampered":true}}`, true),
+	)
+
+	Context("pinning the image digests", func() {
+		It("pins the images once per generation", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("pin"))
+			ccRuntime.Spec.Config.PinImageDigests = true
+			createTestCcRuntime(ccRuntime)
+			r, _ := newTestReconciler(ccRuntime)
+			resolver := &testResolver{digest: testDigest(testIndex)}
+			r.ImageResolver = resolver
+
+			Expect(r.resolveImages()).To(Succeed())
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.Images).To(HaveLen(1))
+			Expect(stored.Status.Images[0].Digest).To(Equal(testDigest(testIndex)))
+			Expect(stored.Status.Images[0].ResolvedImage).To(
+				Equal("quay.io/kata-containers/kata-deploy@" + testDigest(testIndex)))
+			Expect(meta.IsStatusConditionTrue(stored.Status.Conditions, ImagesResolvedCondition)).To(BeTrue())
+
+			Expect(r.resolveImages()).To(Succeed())
+			Expect(resolver.calls).To(Equal(1))
+		})
+
+		It("reports the images that can't be resolved", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("pin"))
+			ccRuntime.Spec.Config.PinImageDigests = true
+			createTestCcRuntime(ccRuntime)
+			r, recorder := newTestReconciler(ccRuntime)
+			r.ImageResolver = &testResolver{err: fmt.Errorf("unexpected status 404")}
+
+			Expect(r.resolveImages()).To(MatchError(ContainSubstring("unexpected status 404")))
+			stored := getCcRuntime(ccRuntime.Name)
+			condition := meta.FindStatusCondition(stored.Status.Conditions, ImagesResolvedCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal("ResolutionFailed"))
+			Expect(events(recorder)).To(ContainElement(ContainSubstring("ImageResolutionFailed")))
+		})
+
+		It("renders the tags without pinImageDigests", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("pin"))
+			createTestCcRuntime(ccRuntime)
+			r, _ := newTestReconciler(ccRuntime)
+
+			Expect(r.resolveImages()).To(Succeed())
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.Images[0].ResolvedImage).To(Equal(ccRuntime.Spec.Config.PayloadImage))
+			Expect(stored.Status.Images[0].Digest).To(BeEmpty())
+		})
+	})
+})
+
+// testResolver resolves every image to the same digest
+type testResolver struct {
+	digest string
+	err    error
+	calls  int
+}
+
+func (t *testResolver) Resolve(ctx context.Context, image string, credentials RegistryCredentials) (string, error) {
+	t.calls++
+	return t.digest, t.err
+}
@@ -0,0 +1,534 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// shortHash returns a short hash of the data
+func shortHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// hashObject returns a short, stable hash of the JSON representation of obj
+func hashObject(obj interface{}) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %T: %w", obj, err)
+	}
+	return shortHash(data), nil
+}
+
+// payloadRevision is the payload configuration a revision records in its
+// ControllerRevision
+type payloadRevision struct {
+	PayloadImage         string                          `json:"payloadImage"`
+	Architectures        []ccv1beta1.ArchitectureConfig  `json:"architectures,omitempty"`
+	EnvironmentVariables []corev1.EnvVar                 `json:"environmentVariables,omitempty"`
+	ConfigFrom           []ccv1beta1.PayloadConfigSource `json:"configFrom,omitempty"`
+	Attestation          *ccv1beta1.AttestationConfig    `json:"attestation,omitempty"`
+	PreInstall           ccv1beta1.PreInstallConfig      `json:"preInstall,omitempty"`
+	PostUninstall        ccv1beta1.PostUninstallConfig   `json:"postUninstall,omitempty"`
+	Hooks                []ccv1beta1.HookConfig          `json:"hooks,omitempty"`
+}
+
+func newPayloadRevision(spec *ccv1beta1.CcRuntimeSpec) *payloadRevision {
+	return &payloadRevision{
+		PayloadImage:         spec.Config.PayloadImage,
+		Architectures:        spec.Config.Architectures,
+		EnvironmentVariables: spec.Config.EnvironmentVariables,
+		ConfigFrom:           spec.Config.ConfigFrom,
+		Attestation:          spec.Attestation,
+		PreInstall:           spec.Config.PreInstall,
+		PostUninstall:        spec.Config.PostUninstall,
+		Hooks:                spec.Config.Hooks,
+	}
+}
+
+// apply sets the payload configuration of the revision in the spec
+func (p *payloadRevision) apply(spec *ccv1beta1.CcRuntimeSpec) {
+	spec.Config.PayloadImage = p.PayloadImage
+	spec.Config.Architectures = p.Architectures
+	spec.Config.EnvironmentVariables = p.EnvironmentVariables
+	spec.Config.ConfigFrom = p.ConfigFrom
+	spec.Attestation = p.Attestation
+	spec.Config.PreInstall = p.PreInstall
+	spec.Config.PostUninstall = p.PostUninstall
+	spec.Config.Hooks = p.Hooks
+}
+
+// hookImages returns the images of the preInstall, postUninstall and hooks of the revision
+func (p *payloadRevision) hookImages() []ccv1beta1.RevisionImage {
+	var images []ccv1beta1.RevisionImage
+	if p.PreInstall.Image != "" {
+		images = append(images, ccv1beta1.RevisionImage{Name: "preInstall", Image: p.PreInstall.Image})
+	}
+	if p.PostUninstall.Image != "" {
+		images = append(images, ccv1beta1.RevisionImage{Name: "postUninstall", Image: p.PostUninstall.Image})
+	}
+	for _, hook := range p.Hooks {
+		images = append(images, ccv1beta1.RevisionImage{Name: hook.Name, Image: hook.Image})
+	}
+	return images
+}
+
+// payloadHash identifies the parts of the install configuration that are
+// recorded in a revision
+func payloadHash(spec *ccv1beta1.CcRuntimeSpec) (string, error) {
+	return hashObject(newPayloadRevision(spec))
+}
+
+// setTemplateHash annotates the pod template of the hooks with the hash of the
+// template itself, so a Job is started over when it changes before completing
+func setTemplateHash(template *corev1.PodTemplateSpec) error {
+	hash, err := hashObject(template)
+	if err != nil {
+		return err
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[TemplateHashAnnotation] = hash
+	return nil
+}
+
+// setPayloadHash annotates the pod template of the payload with the hash of
+// the payload configuration recorded in the revisions, and of the content it
+// references: the configFrom values, the attestation configuration and the
+// agent policies, whose hashes the template is annotated with. What the
+// operator renders around them, e.g. its own environment variables or the
+// rewritten images, is left out, so upgrading the operator doesn't roll the
+// payload out again on every node.
+func (r *CcRuntimeReconciler) setPayloadHash(template *corev1.PodTemplateSpec) error {
+	payload, err := payloadHash(&r.ccRuntime.Spec)
+	if err != nil {
+		return err
+	}
+	references := map[string]string{}
+	for _, key := range []string{PayloadConfigHashAnnotation, AttestationHashAnnotation, AgentPoliciesHashAnnotation} {
+		if value, ok := template.Annotations[key]; ok {
+			references[key] = value
+		}
+	}
+	hash, err := hashObject([]interface{}{payload, references})
+	if err != nil {
+		return err
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[TemplateHashAnnotation] = hash
+	return nil
+}
+
+func templateHashChanged(found, desired *appsv1.DaemonSet) bool {
+	return found.Spec.Template.Annotations[TemplateHashAnnotation] != desired.Spec.Template.Annotations[TemplateHashAnnotation]
+}
+
+func rollbackFailureThreshold(config *ccv1beta1.RollbackConfig) int {
+	if config.FailureThreshold <= 0 {
+		return DefaultRollbackFailureThreshold
+	}
+	return config.FailureThreshold
+}
+
+func revisionHistoryLimit(config *ccv1beta1.RollbackConfig) int {
+	if config.RevisionHistoryLimit <= 0 {
+		return DefaultRevisionHistoryLimit
+	}
+	return config.RevisionHistoryLimit
+}
+
+func (r *CcRuntimeReconciler) findRevisionByNumber(revision int64) *ccv1beta1.CcRuntimeRevision {
+	for i := range r.ccRuntime.Status.Revisions {
+		if r.ccRuntime.Status.Revisions[i].Revision == revision {
+			return &r.ccRuntime.Status.Revisions[i]
+		}
+	}
+	return nil
+}
+
+func (r *CcRuntimeReconciler) findRevisionByHash(hash string) *ccv1beta1.CcRuntimeRevision {
+	for i := range r.ccRuntime.Status.Revisions {
+		if r.ccRuntime.Status.Revisions[i].Hash == hash {
+			return &r.ccRuntime.Status.Revisions[i]
+		}
+	}
+	return nil
+}
+
+// lastKnownGoodRevision returns the most recent revision that differs from the
+// payload configuration with the given hash
+func (r *CcRuntimeReconciler) lastKnownGoodRevision(hash string) *ccv1beta1.CcRuntimeRevision {
+	for i := len(r.ccRuntime.Status.Revisions) - 1; i >= 0; i-- {
+		if r.ccRuntime.Status.Revisions[i].Hash != hash {
+			return &r.ccRuntime.Status.Revisions[i]
+		}
+	}
+	return nil
+}
+
+func (r *CcRuntimeReconciler) controllerRevisionName(hash string) string {
+	return "cc-operator-revision-" + r.ccRuntime.Name + "-" + hash
+}
+
+// saveRevision stores the payload configuration of the revision in its
+// ControllerRevision, owned by the CcRuntime
+func (r *CcRuntimeReconciler) saveRevision(revision int64, hash string, payload *payloadRevision) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	controllerRevision := &appsv1.ControllerRevision{}
+	err = r.Get(context.TODO(), types.NamespacedName{Name: r.controllerRevisionName(hash), Namespace: r.Namespace}, controllerRevision)
+	if err == nil {
+		// The data of a ControllerRevision is immutable, and the same for the same hash
+		if controllerRevision.Revision == revision {
+			return nil
+		}
+		controllerRevision.Revision = revision
+		return r.Update(context.TODO(), controllerRevision)
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	controllerRevision = &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.controllerRevisionName(hash),
+			Namespace: r.Namespace,
+		},
+		Data:     runtime.RawExtension{Raw: data},
+		Revision: revision,
+	}
+	if err := controllerutil.SetControllerReference(r.ccRuntime, controllerRevision, r.Scheme); err != nil {
+		return err
+	}
+	return r.Create(context.TODO(), controllerRevision)
+}
+
+// loadRevision reads the payload configuration of the revision from its ControllerRevision
+func (r *CcRuntimeReconciler) loadRevision(rev *ccv1beta1.CcRuntimeRevision) (*payloadRevision, error) {
+	controllerRevision := &appsv1.ControllerRevision{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: r.controllerRevisionName(rev.Hash), Namespace: r.Namespace}, controllerRevision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the ControllerRevision of revision %d: %w", rev.Revision, err)
+	}
+	payload := &payloadRevision{}
+	if err := json.Unmarshal(controllerRevision.Data.Raw, payload); err != nil {
+		return nil, fmt.Errorf("failed to decode the ControllerRevision of revision %d: %w", rev.Revision, err)
+	}
+	return payload, nil
+}
+
+// deleteRevision deletes the ControllerRevision of a revision dropped from the history
+func (r *CcRuntimeReconciler) deleteRevision(rev *ccv1beta1.CcRuntimeRevision) error {
+	controllerRevision := &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{Name: r.controllerRevisionName(rev.Hash), Namespace: r.Namespace},
+	}
+	return client.IgnoreNotFound(r.Delete(context.TODO(), controllerRevision))
+}
+
+// recordRevision adds the current payload configuration to the revision
+// history, once it's been installed on all nodes. The configuration is stored
+// in a ControllerRevision, the caller is responsible for updating the status.
+func (r *CcRuntimeReconciler) recordRevision() error {
+	payload := newPayloadRevision(&r.ccRuntime.Spec)
+	hash, err := payloadHash(&r.ccRuntime.Spec)
+	if err != nil {
+		return err
+	}
+
+	if rev := r.findRevisionByHash(hash); rev != nil {
+		r.ccRuntime.Status.CurrentRevision = rev.Revision
+		return nil
+	}
+
+	var next int64 = 1
+	if n := len(r.ccRuntime.Status.Revisions); n > 0 {
+		next = r.ccRuntime.Status.Revisions[n-1].Revision + 1
+	}
+
+	r.Log.Info("recording new revision", "revision", next, "payloadImage", payload.PayloadImage)
+	if err := r.saveRevision(next, hash, payload); err != nil {
+		r.Log.Info("failed to store the revision", "revision", next)
+		return err
+	}
+	r.ccRuntime.Status.Revisions = append(r.ccRuntime.Status.Revisions, ccv1beta1.CcRuntimeRevision{
+		Revision:      next,
+		Hash:          hash,
+		PayloadImage:  payload.PayloadImage,
+		HookImages:    payload.hookImages(),
+		InstalledTime: metav1.Now(),
+	})
+	limit := revisionHistoryLimit(&r.ccRuntime.Spec.Config.Rollback)
+	for len(r.ccRuntime.Status.Revisions) > limit {
+		if err := r.deleteRevision(&r.ccRuntime.Status.Revisions[0]); err != nil {
+			return err
+		}
+		r.ccRuntime.Status.Revisions = r.ccRuntime.Status.Revisions[1:]
+	}
+	r.ccRuntime.Status.CurrentRevision = next
+
+	// A rollback is over once a later payload configuration installed
+	if meta.IsStatusConditionTrue(r.ccRuntime.Status.Conditions, RolledBackCondition) {
+		meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+			Type:               RolledBackCondition,
+			Status:             metav1.ConditionFalse,
+			Reason:             "RevisionInstalled",
+			Message:            fmt.Sprintf("Revision %d was installed on all nodes", next),
+			ObservedGeneration: r.ccRuntime.Generation,
+		})
+	}
+	return nil
+}
+
+// processRollbackRequest handles the RollbackToRevisionAnnotation set by the user
+func (r *CcRuntimeReconciler) processRollbackRequest(value string) (ctrl.Result, error) {
+	revision, err := strconv.ParseInt(value, 10, 64)
+	var rev *ccv1beta1.CcRuntimeRevision
+	if err == nil {
+		rev = r.findRevisionByNumber(revision)
+	}
+
+	if rev == nil {
+		r.Log.Info("ignoring rollback request to unknown revision", "revision", value)
+		r.recordEvent(corev1.EventTypeWarning, "RollbackFailed", "Revision %q is not recorded in the status", value)
+		delete(r.ccRuntime.Annotations, RollbackToRevisionAnnotation)
+		return r.updateCcRuntime()
+	}
+
+	return r.rollbackToRevision(rev, "RollbackRequested",
+		fmt.Sprintf("Rolled back to revision %d as requested by the %s annotation", rev.Revision, RollbackToRevisionAnnotation))
+}
+
+// rollbackToRevision restores the payload configuration recorded in the given revision
+func (r *CcRuntimeReconciler) rollbackToRevision(rev *ccv1beta1.CcRuntimeRevision, reason, message string) (ctrl.Result, error) {
+	// Keep a copy, as updating the status replaces the object the revision points into
+	target := rev.DeepCopy()
+	payload, err := r.loadRevision(target)
+	if err != nil {
+		r.Log.Info("failed to read the revision to roll back to", "revision", target.Revision)
+		r.recordEvent(corev1.EventTypeWarning, "RollbackFailed", "%s", err.Error())
+		return ctrl.Result{}, err
+	}
+
+	r.Log.Info("rolling back payload configuration", "revision", target.Revision, "payloadImage", target.PayloadImage)
+	meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, metav1.Condition{
+		Type:               RolledBackCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: r.ccRuntime.Generation,
+	})
+	err = r.updateCcRuntimeStatus()
+	if err != nil {
+		r.Log.Info("failed to update status before rolling back")
+		return ctrl.Result{}, err
+	}
+
+	// The configuration written by the user is restored too when it's merged
+	// with a profile, as it's the one updating the CcRuntime writes
+	payload.apply(&r.ccRuntime.Spec)
+	if r.writtenSpec != nil {
+		payload.apply(r.writtenSpec)
+	}
+	delete(r.ccRuntime.Annotations, RollbackToRevisionAnnotation)
+
+	res, err := r.updateCcRuntime()
+	if err != nil {
+		return res, err
+	}
+	r.recordEvent(corev1.EventTypeWarning, "RolledBack", "%s", message)
+	return ctrl.Result{Requeue: true, RequeueAfter: time.Second * 10}, nil
+}
+
+// currentInstallPods returns the pods of the install DaemonSets that run
+// their current pod template, by node name. The pods of a previous rollout
+// are left out, as the nodes they run on haven't installed the current payload
+// configuration yet
+func (r *CcRuntimeReconciler) currentInstallPods(installDss []*appsv1.DaemonSet) (map[string]*corev1.Pod, error) {
+	current := map[string]*corev1.Pod{}
+	for _, installDs := range installDss {
+		pods := &corev1.PodList{}
+		listOpts := []client.ListOption{
+			client.InNamespace(installDs.Namespace),
+			client.MatchingLabels(installDs.Spec.Selector.MatchLabels),
+		}
+		if err := r.List(context.TODO(), pods, listOpts...); err != nil {
+			r.Log.Info("failed to list the installation pods")
+			return nil, err
+		}
+
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Annotations[TemplateHashAnnotation] == installDs.Spec.Template.Annotations[TemplateHashAnnotation] {
+				current[pod.Spec.NodeName] = pod
+			}
+		}
+	}
+	return current, nil
+}
+
+// updateFailedNodes reports the nodes where the pods of the current install
+// DaemonSets fail in the installation status
+func (r *CcRuntimeReconciler) updateFailedNodes(pods map[string]*corev1.Pod) {
+	var failed []ccv1beta1.FailedNodeStatus
+	for nodeName, pod := range pods {
+		if reason := podFailureReason(pod); reason != "" {
+			failed = append(failed, ccv1beta1.FailedNodeStatus{
+				Name:  nodeName,
+				Error: reason,
+			})
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Name < failed[j].Name })
+
+	r.ccRuntime.Status.InstallationStatus.Failed.FailedNodesList = failed
+	r.ccRuntime.Status.InstallationStatus.Failed.FailedNodesCount = len(failed)
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func podFailureReason(pod *corev1.Pod) string {
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Sprintf("%s: %s", pod.Status.Reason, pod.Status.Message)
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "CrashLoopBackOff", "ErrImagePull", "ImagePullBackOff", "InvalidImageName",
+				"CreateContainerConfigError", "CreateContainerError":
+				return fmt.Sprintf("%s: %s", w.Reason, w.Message)
+			}
+		}
+		if t := cs.State.Terminated; t != nil && t.ExitCode != 0 {
+			return fmt.Sprintf("%s: exit code %d", t.Reason, t.ExitCode)
+		}
+	}
+	return ""
+}
+
+// checkAutomaticRollback rolls back to the last known-good revision when the
+// current payload configuration never completed and failed on too many nodes.
+// It returns true when a rollback was triggered.
+func (r *CcRuntimeReconciler) checkAutomaticRollback() (bool, ctrl.Result, error) {
+	config := &r.ccRuntime.Spec.Config
+	if !config.Rollback.Auto {
+		return false, ctrl.Result{}, nil
+	}
+
+	failed := r.ccRuntime.Status.InstallationStatus.Failed.FailedNodesCount
+	if failed < rollbackFailureThreshold(&config.Rollback) {
+		return false, ctrl.Result{}, nil
+	}
+
+	return r.rollbackToLastKnownGood("InstallationFailed",
+		fmt.Sprintf("Installation failed on %d node(s)", failed))
+}
+
+// rollbackToLastKnownGood rolls back to the last known-good revision, unless
+// automatic rollback is disabled or the current payload configuration itself
+// is known-good. It returns true when a rollback was triggered.
+func (r *CcRuntimeReconciler) rollbackToLastKnownGood(reason, message string) (bool, ctrl.Result, error) {
+	config := &r.ccRuntime.Spec.Config
+	if !config.Rollback.Auto {
+		return false, ctrl.Result{}, nil
+	}
+
+	hash, err := payloadHash(&r.ccRuntime.Spec)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if r.findRevisionByHash(hash) != nil {
+		// Never roll back from a configuration that was known-good
+		return false, ctrl.Result{}, nil
+	}
+
+	rev := r.lastKnownGoodRevision(hash)
+	if rev == nil {
+		r.Log.Info("no known-good revision to roll back to", "reason", reason)
+		return false, ctrl.Result{}, nil
+	}
+
+	res, err := r.rollbackToRevision(rev, reason,
+		fmt.Sprintf("%s, rolled back to revision %d", message, rev.Revision))
+	return true, res, err
+}
+
+func (r *CcRuntimeReconciler) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(r.ccRuntime, eventType, reason, messageFmt, args...)
+}
+
+// setConditionFromError sets the condition when err is nil, otherwise the
+// condition of the same type with status False, the reason and err as message,
+// also reported in a warning event. The status is only updated when the
+// condition changed. It returns err, or the failure to update the status.
+func (r *CcRuntimeReconciler) setConditionFromError(condition metav1.Condition, reason string, err error) error {
+	condition.Status = metav1.ConditionTrue
+	condition.ObservedGeneration = r.ccRuntime.Generation
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reason
+		condition.Message = err.Error()
+	}
+
+	if !meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition) {
+		return err
+	}
+	if err != nil {
+		r.recordEvent(corev1.EventTypeWarning, reason, "%s", err.Error())
+	}
+	if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+		r.Log.Info("failed to update status after setting a condition", "condition", condition.Type)
+		if err == nil {
+			return updateErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Payload revisions", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+		recorder  *record.FakeRecorder
+	)
+
+	BeforeEach(func() {
+		ccRuntime = newTestCcRuntime(uniqueName("revisions"))
+		createTestCcRuntime(ccRuntime)
+		r, recorder = newTestReconciler(ccRuntime)
+	})
+
+	installHash := func(r *CcRuntimeReconciler) string {
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		return ds.Spec.Template.Annotations[TemplateHashAnnotation]
+	}
+
+	// installPayload records the current payload configuration as installed
+	// on all nodes, as monitorCcRuntimeInstallation does
+	installPayload := func(image string) {
+		ccRuntime.Spec.Config.PayloadImage = image
+		Expect(r.recordRevision()).To(Succeed())
+		Expect(r.updateCcRuntimeStatus()).To(Succeed())
+	}
+
+	Context("the template hash of the install DaemonSets", func() {
+		It("ignores what the operator renders around the payload", func() {
+			hash := installHash(r)
+			Expect(hash).NotTo(BeEmpty())
+
+			r.ImageRewriteRules = []ImageRewriteRule{{Source: "quay.io", Mirror: "mirror.example.com/quay.io"}}
+			Expect(installHash(r)).To(Equal(hash))
+		})
+
+		It("changes with the payload configuration", func() {
+			hash := installHash(r)
+			ccRuntime.Spec.Config.PayloadImage = "quay.io/kata-containers/kata-deploy:3.24.0"
+			Expect(installHash(r)).NotTo(Equal(hash))
+		})
+
+		It("changes with the content the payload references", func() {
+			ccRuntime.Spec.Config.ConfigFrom = []ccv1beta1.PayloadConfigSource{{
+				Name:         "KBS_TOKEN",
+				SecretKeyRef: &corev1.SecretKeySelector{Key: "token"},
+			}}
+			r.payloadConfigHash = "0123456789abcdef"
+			hash := installHash(r)
+			r.payloadConfigHash = "fedcba9876543210"
+			Expect(installHash(r)).NotTo(Equal(hash))
+		})
+	})
+
+	Context("recording revisions", func() {
+		It("stores each installed payload configuration once", func() {
+			installPayload("quay.io/kata-containers/kata-deploy:3.22.0")
+			installPayload("quay.io/kata-containers/kata-deploy:3.23.0")
+			installPayload("quay.io/kata-containers/kata-deploy:3.23.0")
+
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.Revisions).To(HaveLen(2))
+			Expect(stored.Status.CurrentRevision).To(BeEquivalentTo(2))
+			Expect(stored.Status.Revisions[0].PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.22.0"))
+
+			for _, rev := range stored.Status.Revisions {
+				controllerRevision := &appsv1.ControllerRevision{}
+				Expect(k8sClient.Get(context.TODO(), client.ObjectKey{
+					Name: r.controllerRevisionName(rev.Hash), Namespace: testNamespace,
+				}, controllerRevision)).To(Succeed())
+				Expect(controllerRevision.Revision).To(Equal(rev.Revision))
+				Expect(controllerRevision.OwnerReferences).To(ContainElement(HaveField("Name", ccRuntime.Name)))
+			}
+		})
+
+		It("drops the revisions beyond the history limit with their ControllerRevision", func() {
+			ccRuntime.Spec.Config.Rollback.RevisionHistoryLimit = 2
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+			installPayload("quay.io/kata-containers/kata-deploy:3.21.0")
+			first := ccRuntime.Status.Revisions[0]
+			installPayload("quay.io/kata-containers/kata-deploy:3.22.0")
+			installPayload("quay.io/kata-containers/kata-deploy:3.23.0")
+
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Status.Revisions).To(HaveLen(2))
+			Expect(stored.Status.Revisions[0].Revision).To(BeEquivalentTo(2))
+			err := k8sClient.Get(context.TODO(), client.ObjectKey{
+				Name: r.controllerRevisionName(first.Hash), Namespace: testNamespace,
+			}, &appsv1.ControllerRevision{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Context("rolling back on request", func() {
+		BeforeEach(func() {
+			installPayload("quay.io/kata-containers/kata-deploy:3.22.0")
+			installPayload("quay.io/kata-containers/kata-deploy:3.23.0")
+		})
+
+		It("restores the payload configuration of the annotated revision", func() {
+			ccRuntime.Annotations = map[string]string{RollbackToRevisionAnnotation: "1"}
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+			_, err := r.processRollbackRequest("1")
+			Expect(err).NotTo(HaveOccurred())
+
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Spec.Config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.22.0"))
+			Expect(stored.Annotations).NotTo(HaveKey(RollbackToRevisionAnnotation))
+			condition := meta.FindStatusCondition(stored.Status.Conditions, RolledBackCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(BeEquivalentTo("True"))
+			Expect(condition.Reason).To(Equal("RollbackRequested"))
+			Expect(events(recorder)).To(ContainElement(ContainSubstring("RolledBack")))
+		})
+
+		It("ignores an unknown revision", func() {
+			ccRuntime.Annotations = map[string]string{RollbackToRevisionAnnotation: "7"}
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+
+			_, err := r.processRollbackRequest("7")
+			Expect(err).NotTo(HaveOccurred())
+
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Spec.Config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.23.0"))
+			Expect(stored.Annotations).NotTo(HaveKey(RollbackToRevisionAnnotation))
+			Expect(meta.FindStatusCondition(stored.Status.Conditions, RolledBackCondition)).To(BeNil())
+			Expect(events(recorder)).To(ContainElement(ContainSubstring("RollbackFailed")))
+		})
+
+		It("ends the rollback once a later revision is installed", func() {
+			_, err := r.processRollbackRequest("1")
+			Expect(err).NotTo(HaveOccurred())
+
+			installPayload("quay.io/kata-containers/kata-deploy:3.24.0")
+			stored := getCcRuntime(ccRuntime.Name)
+			condition := meta.FindStatusCondition(stored.Status.Conditions, RolledBackCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(BeEquivalentTo("False"))
+			Expect(condition.Reason).To(Equal("RevisionInstalled"))
+		})
+	})
+
+	Context("rolling back automatically", func() {
+		BeforeEach(func() {
+			installPayload("quay.io/kata-containers/kata-deploy:3.22.0")
+			ccRuntime.Spec.Config.Rollback.Auto = true
+			ccRuntime.Spec.Config.Rollback.FailureThreshold = 2
+			ccRuntime.Spec.Config.PayloadImage = "quay.io/kata-containers/kata-deploy:broken"
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+		})
+
+		failNodes := func(count int) {
+			ccRuntime.Status.InstallationStatus.Failed.FailedNodesCount = count
+			for i := 0; i < count; i++ {
+				ccRuntime.Status.InstallationStatus.Failed.FailedNodesList = append(
+					ccRuntime.Status.InstallationStatus.Failed.FailedNodesList,
+					ccv1beta1.FailedNodeStatus{Name: uniqueName("node"), Error: "CrashLoopBackOff: back-off"})
+			}
+		}
+
+		It("waits for FailureThreshold failed nodes", func() {
+			failNodes(1)
+			rolledBack, _, err := r.checkAutomaticRollback()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rolledBack).To(BeFalse())
+			Expect(getCcRuntime(ccRuntime.Name).Spec.Config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:broken"))
+		})
+
+		It("rolls back to the last known-good revision", func() {
+			failNodes(2)
+			rolledBack, _, err := r.checkAutomaticRollback()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rolledBack).To(BeTrue())
+
+			stored := getCcRuntime(ccRuntime.Name)
+			Expect(stored.Spec.Config.PayloadImage).To(Equal("quay.io/kata-containers/kata-deploy:3.22.0"))
+			condition := meta.FindStatusCondition(stored.Status.Conditions, RolledBackCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal("InstallationFailed"))
+		})
+
+		It("never rolls back from a known-good revision", func() {
+			ccRuntime.Spec.Config.PayloadImage = "quay.io/kata-containers/kata-deploy:3.22.0"
+			failNodes(2)
+			rolledBack, _, err := r.checkAutomaticRollback()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rolledBack).To(BeFalse())
+		})
+
+		It("is off unless rollback.auto is set", func() {
+			ccRuntime.Spec.Config.Rollback.Auto = false
+			failNodes(2)
+			rolledBack, _, err := r.checkAutomaticRollback()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rolledBack).To(BeFalse())
+		})
+	})
+
+	It("reports the failures of the pods on the current template only", func() {
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		hash := ds.Spec.Template.Annotations[TemplateHashAnnotation]
+
+		pod := func(name, nodeName, hash string, reason string) *corev1.Pod {
+			p := &corev1.Pod{}
+			p.Name = name
+			p.Namespace = testNamespace
+			p.Labels = ds.Spec.Selector.MatchLabels
+			p.Annotations = map[string]string{TemplateHashAnnotation: hash}
+			p.Spec.NodeName = nodeName
+			p.Spec.Containers = []corev1.Container{{Name: "cc-runtime-install-pod", Image: "image"}}
+			Expect(k8sClient.Create(context.TODO(), p)).To(Succeed())
+			DeferCleanup(func() { _ = k8sClient.Delete(context.TODO(), p) })
+			p.Status.ContainerStatuses = []corev1.ContainerStatus{{
+				Name:  "cc-runtime-install-pod",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+			}}
+			Expect(k8sClient.Status().Update(context.TODO(), p)).To(Succeed())
+			return p
+		}
+		pod(uniqueName("current"), "node-a", hash, "CrashLoopBackOff")
+		pod(uniqueName("previous"), "node-b", "previous", "CrashLoopBackOff")
+
+		pods, err := r.currentInstallPods([]*appsv1.DaemonSet{ds})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pods).To(HaveLen(1))
+		Expect(pods).To(HaveKey("node-a"))
+
+		r.updateFailedNodes(pods)
+		Expect(ccRuntime.Status.InstallationStatus.Failed.FailedNodesCount).To(Equal(1))
+		Expect(ccRuntime.Status.InstallationStatus.Failed.FailedNodesList[0].Name).To(Equal("node-a"))
+	})
+})
@@ -0,0 +1,229 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// ContainerRuntimeLabel holds the container runtime detected on the node, which
+// the install DaemonSet of the runtime is scheduled on
+const ContainerRuntimeLabel = "confidentialcontainers.org/container-runtime"
+
+// nodeContainerRuntime splits the container runtime version of the node, e.g.
+// containerd://1.7.2
+func nodeContainerRuntime(node *corev1.Node) (ccv1beta1.ContainerRuntime, string) {
+	runtime, version, _ := strings.Cut(node.Status.NodeInfo.ContainerRuntimeVersion, "://")
+	return ccv1beta1.ContainerRuntime(runtime), version
+}
+
+// containerRuntimeConfig returns the configuration of the container runtime,
+// nil when the pods are rendered the same for all the runtimes
+func (r *CcRuntimeReconciler) containerRuntimeConfig(runtime string) *ccv1beta1.ContainerRuntimeConfig {
+	if r.ccRuntime.Spec.Config.ContainerRuntimes == nil || runtime == "" {
+		return nil
+	}
+	return r.ccRuntime.Spec.Config.ContainerRuntimes.Get(ccv1beta1.ContainerRuntime(runtime))
+}
+
+// installRuntimes returns the container runtimes installed by their own
+// DaemonSet, or only the empty runtime when all the nodes share one
+func (r *CcRuntimeReconciler) installRuntimes() []string {
+	config := r.ccRuntime.Spec.Config.ContainerRuntimes
+	if config == nil {
+		return []string{""}
+	}
+	var runtimes []string
+	for _, runtime := range ccv1beta1.ContainerRuntimes {
+		if config.Get(runtime) != nil {
+			runtimes = append(runtimes, string(runtime))
+		}
+	}
+	return runtimes
+}
+
+// groupNodesByRuntime splits the groups of nodes by container runtime, when
+// the pods are rendered for each runtime
+func (r *CcRuntimeReconciler) groupNodesByRuntime(groups []archNodes) []archNodes {
+	if r.ccRuntime.Spec.Config.ContainerRuntimes == nil {
+		return groups
+	}
+	var split []archNodes
+	for _, group := range groups {
+		index := map[ccv1beta1.ContainerRuntime]int{}
+		for _, node := range group.nodes {
+			runtime, _ := nodeContainerRuntime(&node)
+			i, ok := index[runtime]
+			if !ok {
+				i = len(split)
+				index[runtime] = i
+				split = append(split, archNodes{arch: group.arch, runtime: string(runtime)})
+			}
+			split[i].nodes = append(split[i].nodes, node)
+		}
+	}
+	return split
+}
+
+// addContainerRuntimeConfig adds the volumes and environment variables of the
+// container runtime to the pod template. The lists are copied, as the pod
+// template shares them with the CcRuntime spec
+func addContainerRuntimeConfig(spec *corev1.PodSpec, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount,
+	envVars []corev1.EnvVar) {
+	spec.Volumes = append(append([]corev1.Volume{}, spec.Volumes...), volumes...)
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		container.VolumeMounts = append(append([]corev1.VolumeMount{}, container.VolumeMounts...), volumeMounts...)
+		container.Env = append(append([]corev1.EnvVar{}, container.Env...), envVars...)
+	}
+}
+
+// unsupportedCombinations lists what the configuration asks for that the
+// nodes running the container runtime can't do
+func (r *CcRuntimeReconciler) unsupportedCombinations(runtime ccv1beta1.ContainerRuntime) []string {
+	config := &r.ccRuntime.Spec.Config
+	supported := false
+	for _, known := range ccv1beta1.ContainerRuntimes {
+		supported = supported || runtime == known
+	}
+	if !supported {
+		return []string{fmt.Sprintf("the container runtime %q isn't supported", runtime)}
+	}
+
+	var problems []string
+	if config.ContainerRuntimes != nil && config.ContainerRuntimes.Get(runtime) == nil {
+		problems = append(problems, fmt.Sprintf("containerRuntimes has no configuration for %s", runtime))
+	}
+	if runtime != ccv1beta1.CriORuntime {
+		return problems
+	}
+	// The containerd switches and the snapshotters only apply to containerd
+	if config.PreInstall.Image != "" && config.PreInstall.Containerd != "" && config.PreInstall.Containerd != ccv1beta1.NoContainerd {
+		problems = append(problems, fmt.Sprintf("preInstall.containerd installs the %s containerd", config.PreInstall.Containerd))
+	}
+	if config.PreInstall.Image != "" && config.PreInstall.InstallNydusSnapshotter != nil && *config.PreInstall.InstallNydusSnapshotter {
+		problems = append(problems, "preInstall.installNydusSnapshotter installs a containerd snapshotter")
+	}
+	for _, runtimeClass := range config.RuntimeClasses {
+		if runtimeClass.Snapshotter != "" {
+			problems = append(problems, fmt.Sprintf("the runtime class %s uses the containerd snapshotter %s",
+				runtimeClass.Name, runtimeClass.Snapshotter))
+		}
+	}
+	return problems
+}
+
+// validateContainerRuntimes detects the container runtime of the nodes,
+// reports it in the status, and checks the configuration is supported on each
+// of them
+func (r *CcRuntimeReconciler) validateContainerRuntimes(nodes []corev1.Node) error {
+	statuses := make([]ccv1beta1.NodeRuntimeStatus, 0, len(nodes))
+	nodesByRuntime := map[ccv1beta1.ContainerRuntime][]string{}
+	for i := range nodes {
+		runtime, version := nodeContainerRuntime(&nodes[i])
+		statuses = append(statuses, ccv1beta1.NodeRuntimeStatus{
+			Name:             nodes[i].Name,
+			ContainerRuntime: runtime,
+			Version:          version,
+		})
+		nodesByRuntime[runtime] = append(nodesByRuntime[runtime], nodes[i].Name)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	runtimes := make([]string, 0, len(nodesByRuntime))
+	for runtime := range nodesByRuntime {
+		runtimes = append(runtimes, string(runtime))
+	}
+	sort.Strings(runtimes)
+	var problems []string
+	for _, runtime := range runtimes {
+		nodeNames := nodesByRuntime[ccv1beta1.ContainerRuntime(runtime)]
+		if unsupported := r.unsupportedCombinations(ccv1beta1.ContainerRuntime(runtime)); len(unsupported) > 0 {
+			problems = append(problems, fmt.Sprintf("on the %s nodes %s, %s", runtime,
+				strings.Join(nodeNames, ", "), strings.Join(unsupported, ", ")))
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:               ContainerRuntimesSupportedCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Supported",
+		Message:            "The configuration is supported by the container runtimes " + strings.Join(runtimes, ", "),
+		ObservedGeneration: r.ccRuntime.Generation,
+	}
+	var err error
+	if len(problems) > 0 {
+		err = fmt.Errorf("unsupported container runtime configuration: %s", strings.Join(problems, "; "))
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Unsupported"
+		condition.Message = err.Error()
+	}
+
+	conditionChanged := meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition)
+	statusChanged := !equality.Semantic.DeepEqual(statuses, r.ccRuntime.Status.NodeRuntimes)
+	if !conditionChanged && !statusChanged {
+		return err
+	}
+	r.ccRuntime.Status.NodeRuntimes = statuses
+	if conditionChanged && err != nil {
+		r.recordEvent(corev1.EventTypeWarning, "UnsupportedContainerRuntime", "%s", err.Error())
+	}
+	if updateErr := r.updateCcRuntimeStatus(); updateErr != nil {
+		r.Log.Info("failed to update status after detecting the container runtimes")
+		if err == nil {
+			return updateErr
+		}
+	}
+	return err
+}
+
+// labelNodeRuntimes labels the nodes with their container runtime when each
+// runtime is installed by its own DaemonSet, and removes the labels otherwise
+func (r *CcRuntimeReconciler) labelNodeRuntimes(nodes *corev1.NodeList) error {
+	if r.ccRuntime.Spec.Config.ContainerRuntimes == nil {
+		labelled := &corev1.NodeList{}
+		for _, node := range nodes.Items {
+			if _, ok := node.Labels[ContainerRuntimeLabel]; ok {
+				labelled.Items = append(labelled.Items, node)
+			}
+		}
+		return r.removeNodeLabel(labelled, ContainerRuntimeLabel)
+	}
+
+	nodesByRuntime := map[string][]string{}
+	for i := range nodes.Items {
+		runtime, _ := nodeContainerRuntime(&nodes.Items[i])
+		if nodes.Items[i].Labels[ContainerRuntimeLabel] != string(runtime) {
+			nodesByRuntime[string(runtime)] = append(nodesByRuntime[string(runtime)], nodes.Items[i].Name)
+		}
+	}
+	for runtime, nodeNames := range nodesByRuntime {
+		if err := r.labelNodes(nodeNames, map[string]string{ContainerRuntimeLabel: runtime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// withContainerRuntime returns a node running the container runtime
+func withContainerRuntime(name, version string) corev1.Node {
+	node := testNode(name, nil)
+	node.Status.NodeInfo.ContainerRuntimeVersion = version
+	return node
+}
+
+var _ = Describe("Container runtimes", func() {
+	enabled := true
+	crioConfig := &ccv1beta1.ContainerRuntimesConfig{
+		Containerd: &ccv1beta1.ContainerRuntimeConfig{},
+		CriO: &ccv1beta1.ContainerRuntimeConfig{
+			InstallerVolumes: []corev1.Volume{{Name: "crio-conf", VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/etc/crio/"}}}},
+			InstallerVolumeMounts: []corev1.VolumeMount{{Name: "crio-conf", MountPath: "/etc/crio/"}},
+			HookVolumes: []corev1.Volume{{Name: "crio-hooks", VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/usr/share/containers/oci/hooks.d"}}}},
+			HookVolumeMounts:     []corev1.VolumeMount{{Name: "crio-hooks", MountPath: "/usr/share/containers/oci/hooks.d"}},
+			EnvironmentVariables: []corev1.EnvVar{{Name: "CONTAINER_RUNTIME", Value: "crio"}},
+		},
+	}
+
+	DescribeTable("splitting the container runtime version of the node",
+		func(version string, wantRuntime ccv1beta1.ContainerRuntime, wantVersion string) {
+			node := withContainerRuntime("worker-0", version)
+			runtime, runtimeVersion := nodeContainerRuntime(&node)
+			Expect(runtime).To(Equal(wantRuntime))
+			Expect(runtimeVersion).To(Equal(wantVersion))
+		},
+		Entry("containerd", "containerd://1.7.27", ccv1beta1.ContainerdRuntime, "1.7.27"),
+		Entry("CRI-O", "cri-o://1.31.0", ccv1beta1.CriORuntime, "1.31.0"),
+		Entry("not reported yet", "", ccv1beta1.ContainerRuntime(""), ""),
+	)
+
+	DescribeTable("installing the container runtimes with their own DaemonSet",
+		func(config *ccv1beta1.ContainerRuntimesConfig, want []string) {
+			ccRuntime := newTestCcRuntime(uniqueName("runtime"))
+			ccRuntime.Spec.Config.ContainerRuntimes = config
+			r, _ := newTestReconciler(ccRuntime)
+			Expect(r.installRuntimes()).To(Equal(want))
+		},
+		Entry("same pods for all", nil, []string{""}),
+		Entry("both", crioConfig, []string{"containerd", "cri-o"}),
+		Entry("only CRI-O", &ccv1beta1.ContainerRuntimesConfig{CriO: crioConfig.CriO}, []string{"cri-o"}),
+	)
+
+	It("groups the nodes by container runtime within their architecture", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("runtime"))
+		r, _ := newTestReconciler(ccRuntime)
+		groups := []archNodes{{nodes: []corev1.Node{
+			withContainerRuntime("worker-0", "containerd://1.7.27"),
+			withContainerRuntime("worker-1", "cri-o://1.31.0"),
+			withContainerRuntime("worker-2", "containerd://2.0.4"),
+		}}, {arch: "s390x", nodes: []corev1.Node{withContainerRuntime("worker-3", "cri-o://1.31.0")}}}
+		Expect(r.groupNodesByRuntime(groups)).To(Equal(groups))
+
+		ccRuntime.Spec.Config.ContainerRuntimes = crioConfig
+		split := r.groupNodesByRuntime(groups)
+		Expect(split).To(HaveLen(3))
+		nodeNames := func(group archNodes) []string {
+			var names []string
+			for _, node := range group.nodes {
+				names = append(names, node.Name)
+			}
+			return names
+		}
+		Expect([]string{split[0].arch, split[0].runtime}).To(Equal([]string{"", "containerd"}))
+		Expect(nodeNames(split[0])).To(Equal([]string{"worker-0", "worker-2"}))
+		Expect([]string{split[1].arch, split[1].runtime}).To(Equal([]string{"", "cri-o"}))
+		Expect(nodeNames(split[1])).To(Equal([]string{"worker-1"}))
+		Expect([]string{split[2].arch, split[2].runtime}).To(Equal([]string{"s390x", "cri-o"}))
+		Expect(nodeNames(split[2])).To(Equal([]string{"worker-3"}))
+	})
+
+	DescribeTable("finding what the container runtime doesn't support",
+		func(runtime ccv1beta1.ContainerRuntime, change func(*ccv1beta1.CcInstallConfig), want []string) {
+			ccRuntime := newTestCcRuntime(uniqueName("runtime"))
+			if change != nil {
+				change(&ccRuntime.Spec.Config)
+			}
+			r, _ := newTestReconciler(ccRuntime)
+			Expect(r.unsupportedCombinations(runtime)).To(Equal(want))
+		},
+		Entry("containerd", ccv1beta1.ContainerdRuntime, nil, nil),
+		Entry("CRI-O", ccv1beta1.CriORuntime, nil, nil),
+		Entry("unknown runtime", ccv1beta1.ContainerRuntime("docker"), nil,
+			[]string{`the container runtime "docker" isn't supported`}),
+		Entry("runtime without configuration", ccv1beta1.ContainerdRuntime,
+			func(config *ccv1beta1.CcInstallConfig) {
+				config.ContainerRuntimes = &ccv1beta1.ContainerRuntimesConfig{CriO: crioConfig.CriO}
+			},
+			[]string{"containerRuntimes has no configuration for containerd"}),
+		Entry("containerd switches on CRI-O", ccv1beta1.CriORuntime,
+			func(config *ccv1beta1.CcInstallConfig) {
+				config.PreInstall = ccv1beta1.PreInstallConfig{
+					Image:                   "quay.io/confidential-containers/reqs-payload:latest",
+					Containerd:              ccv1beta1.CocoContainerd,
+					InstallNydusSnapshotter: &enabled,
+				}
+				config.RuntimeClasses = []ccv1beta1.RuntimeClass{
+					{Name: "kata-qemu"}, {Name: "kata-qemu-tdx", Snapshotter: "nydus"},
+				}
+			},
+			[]string{
+				"preInstall.containerd installs the coco containerd",
+				"preInstall.installNydusSnapshotter installs a containerd snapshotter",
+				"the runtime class kata-qemu-tdx uses the containerd snapshotter nydus",
+			}),
+		Entry("containerd switches without a preInstall image", ccv1beta1.CriORuntime,
+			func(config *ccv1beta1.CcInstallConfig) {
+				config.PreInstall = ccv1beta1.PreInstallConfig{Containerd: ccv1beta1.CocoContainerd}
+			}, nil),
+	)
+
+	It("renders the install and uninstall pods for the container runtime", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("runtime"))
+		ccRuntime.Spec.Config.ContainerRuntimes = crioConfig
+		r, _ := newTestReconciler(ccRuntime)
+
+		ds, err := r.processDaemonset(InstallOperation, "", "cri-o")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Name).To(Equal("cc-operator-daemon-install-cri-o"))
+		spec := ds.Spec.Template.Spec
+		Expect(spec.Volumes).To(ContainElement(crioConfig.CriO.InstallerVolumes[0]))
+		Expect(spec.Containers[0].VolumeMounts).To(ContainElement(crioConfig.CriO.InstallerVolumeMounts[0]))
+		Expect(spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "CONTAINER_RUNTIME", Value: "crio"}))
+		for _, term := range spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			Expect(term.MatchExpressions).To(ContainElement(corev1.NodeSelectorRequirement{
+				Key: ContainerRuntimeLabel, Operator: corev1.NodeSelectorOpIn, Values: []string{"cri-o"},
+			}))
+		}
+		// The lists of the spec are left as is
+		Expect(ccRuntime.Spec.Config.InstallerVolumes).NotTo(ContainElement(HaveField("Name", "crio-conf")))
+
+		ds, err = r.processDaemonset(UninstallOperation, "", "cri-o")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.Volumes).To(ContainElement(crioConfig.CriO.InstallerVolumes[0]))
+		Expect(ds.Spec.Template.Spec.Affinity).To(BeNil())
+
+		ds, err = r.processDaemonset(InstallOperation, "", "containerd")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", "crio-conf")))
+	})
+
+	It("renders the hook pods for the container runtime", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("runtime"))
+		ccRuntime.Spec.Config.ContainerRuntimes = crioConfig
+		ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+			{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+		}
+		r, _ := newTestReconciler(ccRuntime)
+		hook := r.hooks(ccv1beta1.PostInstallHookStage)[0]
+		hook.containerRuntime = "cri-o"
+
+		template, err := r.makeHookPodTemplate(&hook)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Spec.Volumes).To(ContainElement(crioConfig.CriO.HookVolumes[0]))
+		Expect(template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", "crio-conf")))
+		Expect(template.Spec.Containers[0].VolumeMounts).To(ContainElement(crioConfig.CriO.HookVolumeMounts[0]))
+		Expect(template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "CONTAINER_RUNTIME", Value: "crio"}))
+	})
+
+	Context("on the nodes", func() {
+		var (
+			ccRuntime        *ccv1beta1.CcRuntime
+			labels           map[string]string
+			containerd, crio string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("runtime"))
+			ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{{Name: "kata-qemu-tdx", Snapshotter: "nydus"}}
+			labels = selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+
+			containerd, crio = uniqueName("runtime-node"), uniqueName("runtime-node")
+			createTestNode(containerd, labels)
+			setNodeInfo(containerd, corev1.NodeSystemInfo{ContainerRuntimeVersion: "containerd://1.7.27"})
+			createTestNode(crio, labels)
+			setNodeInfo(crio, corev1.NodeSystemInfo{ContainerRuntimeVersion: "cri-o://1.31.0"})
+		})
+
+		nodes := func() *corev1.NodeList {
+			r, _ := newTestReconciler(ccRuntime)
+			nodes, err := r.getNodesWithLabels(labels)
+			Expect(err).NotTo(HaveOccurred())
+			return nodes
+		}
+		condition := func() *metav1.Condition {
+			return meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions,
+				ContainerRuntimesSupportedCondition)
+		}
+
+		It("reports the container runtimes of the nodes", func() {
+			ccRuntime.Spec.Config.RuntimeClasses = nil
+			Expect(k8sClient.Update(context.TODO(), ccRuntime)).To(Succeed())
+			r, _ := newTestReconciler(ccRuntime)
+
+			Expect(r.validateContainerRuntimes(nodes().Items)).To(Succeed())
+			Expect(getCcRuntime(ccRuntime.Name).Status.NodeRuntimes).To(ConsistOf(
+				ccv1beta1.NodeRuntimeStatus{Name: containerd, ContainerRuntime: ccv1beta1.ContainerdRuntime, Version: "1.7.27"},
+				ccv1beta1.NodeRuntimeStatus{Name: crio, ContainerRuntime: ccv1beta1.CriORuntime, Version: "1.31.0"}))
+			Expect(condition()).To(And(HaveField("Status", metav1.ConditionTrue),
+				HaveField("Message", "The configuration is supported by the container runtimes containerd, cri-o")))
+		})
+
+		It("reports the configuration the CRI-O nodes don't support once", func() {
+			r, recorder := newTestReconciler(ccRuntime)
+
+			err := r.validateContainerRuntimes(nodes().Items)
+			Expect(err).To(MatchError("unsupported container runtime configuration: on the cri-o nodes " + crio +
+				", the runtime class kata-qemu-tdx uses the containerd snapshotter nydus"))
+			Expect(condition()).To(And(HaveField("Status", metav1.ConditionFalse), HaveField("Reason", "Unsupported")))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("UnsupportedContainerRuntime")))
+
+			Expect(r.validateContainerRuntimes(nodes().Items)).To(HaveOccurred())
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("labels the nodes with their container runtime while they have their own DaemonSet", func() {
+			ccRuntime.Spec.Config.ContainerRuntimes = crioConfig
+			r, _ := newTestReconciler(ccRuntime)
+
+			Expect(r.labelNodeRuntimes(nodes())).To(Succeed())
+			Expect(getNode(containerd).Labels).To(HaveKeyWithValue(ContainerRuntimeLabel, "containerd"))
+			Expect(getNode(crio).Labels).To(HaveKeyWithValue(ContainerRuntimeLabel, "cri-o"))
+
+			ccRuntime.Spec.Config.ContainerRuntimes = nil
+			Expect(r.labelNodeRuntimes(nodes())).To(Succeed())
+			Expect(getNode(containerd).Labels).NotTo(HaveKey(ContainerRuntimeLabel))
+			Expect(getNode(crio).Labels).NotTo(HaveKey(ContainerRuntimeLabel))
+		})
+
+		It("uninstalls the nodes with the pods of their container runtime", func() {
+			ccRuntime.Spec.Config.ContainerRuntimes = crioConfig
+			r, _ := newTestReconciler(ccRuntime)
+			for _, name := range []string{containerd, crio} {
+				setNodeLabels(name, map[string]string{StartUninstallLabel[0]: StartUninstallLabel[1]})
+			}
+
+			_, err := r.runUninstallNodeJobs(nodes().Items)
+			Expect(err).NotTo(HaveOccurred())
+			job, err := getNodeJob(string(UninstallOperation), crio)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Volumes).To(ContainElement(HaveField("Name", "crio-conf")))
+			job, err = getNodeJob(string(UninstallOperation), containerd)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.Spec.Template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", "crio-conf")))
+		})
+	})
+})
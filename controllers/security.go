@@ -0,0 +1,106 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+// installerSecurityContext renders the security context of the install,
+// uninstall and hook containers, and whether their pods run in the host PID
+// namespace
+func (r *CcRuntimeReconciler) installerSecurityContext() (*corev1.SecurityContext, bool) {
+	var runAsUser int64 = 0
+	config := r.ccRuntime.Spec.Config.SecurityContext
+
+	privileged := config.FullyPrivileged()
+	securityContext := &corev1.SecurityContext{
+		Privileged: &privileged,
+		RunAsUser:  &runAsUser,
+	}
+	if config == nil {
+		return securityContext, true
+	}
+
+	if config.Profile == ccv1beta1.RuntimeInstallerSecurityProfile {
+		securityContext.Capabilities = capabilitiesAllowList(ccv1beta1.RuntimeInstallerCapabilities)
+		securityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+		securityContext.AppArmorProfile = &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined}
+	}
+
+	if len(config.Capabilities) > 0 {
+		securityContext.Capabilities = capabilitiesAllowList(config.Capabilities)
+	}
+	if config.SeccompProfile != nil {
+		securityContext.SeccompProfile = config.SeccompProfile.DeepCopy()
+	}
+	if config.AppArmorProfile != nil {
+		securityContext.AppArmorProfile = config.AppArmorProfile.DeepCopy()
+	}
+	if config.SELinuxOptions != nil {
+		securityContext.SELinuxOptions = config.SELinuxOptions.DeepCopy()
+	}
+
+	hostPID := true
+	if config.HostPID != nil {
+		hostPID = *config.HostPID
+	}
+	return securityContext, hostPID
+}
+
+// reportInstallerPrivileges reports in a condition, and with a warning event,
+// when the install, uninstall and hook pods run fully privileged. The
+// validating webhook warns about it as well, but it's disabled by default.
+func (r *CcRuntimeReconciler) reportInstallerPrivileges() error {
+	condition := metav1.Condition{
+		Type:               InstallerPrivilegesReducedCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Reduced",
+		Message:            "The installer pods run with the privileges of spec.config.securityContext",
+		ObservedGeneration: r.ccRuntime.Generation,
+	}
+	fullyPrivileged := r.ccRuntime.Spec.Config.SecurityContext.FullyPrivileged()
+	if fullyPrivileged {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "FullyPrivileged"
+		condition.Message = "The install, uninstall and hook pods run fully privileged, " +
+			"set spec.config.securityContext to reduce their privileges"
+	}
+
+	if !meta.SetStatusCondition(&r.ccRuntime.Status.Conditions, condition) {
+		return nil
+	}
+	if fullyPrivileged {
+		r.recordEvent(corev1.EventTypeWarning, "FullyPrivileged", "%s", condition.Message)
+	}
+	if err := r.updateCcRuntimeStatus(); err != nil {
+		r.Log.Info("failed to update status after checking the installer privileges")
+		return err
+	}
+	return nil
+}
+
+func capabilitiesAllowList(capabilities []corev1.Capability) *corev1.Capabilities {
+	return &corev1.Capabilities{
+		Add:  append([]corev1.Capability{}, capabilities...),
+		Drop: []corev1.Capability{"ALL"},
+	}
+}
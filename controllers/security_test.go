@@ -0,0 +1,171 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Installer security context", func() {
+	boolPtr := func(b bool) *bool { return &b }
+	root := int64(0)
+
+	DescribeTable("rendering the security context",
+		func(config *ccv1beta1.InstallerSecurityContext, want *corev1.SecurityContext, wantHostPID bool) {
+			ccRuntime := newTestCcRuntime(uniqueName("security"))
+			ccRuntime.Spec.Config.SecurityContext = config
+			r, _ := newTestReconciler(ccRuntime)
+
+			securityContext, hostPID := r.installerSecurityContext()
+			Expect(securityContext).To(Equal(want))
+			Expect(hostPID).To(Equal(wantHostPID))
+		},
+		Entry("privileged by default", nil,
+			&corev1.SecurityContext{Privileged: boolPtr(true), RunAsUser: &root}, true),
+		Entry("privileged profile",
+			&ccv1beta1.InstallerSecurityContext{Profile: ccv1beta1.PrivilegedSecurityProfile},
+			&corev1.SecurityContext{Privileged: boolPtr(true), RunAsUser: &root}, true),
+		Entry("runtime-installer profile",
+			&ccv1beta1.InstallerSecurityContext{Profile: ccv1beta1.RuntimeInstallerSecurityProfile},
+			&corev1.SecurityContext{
+				Privileged: boolPtr(false),
+				RunAsUser:  &root,
+				Capabilities: &corev1.Capabilities{
+					Add:  ccv1beta1.RuntimeInstallerCapabilities,
+					Drop: []corev1.Capability{"ALL"},
+				},
+				SeccompProfile:  &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+				AppArmorProfile: &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+			}, true),
+		Entry("capabilities allow-list replacing the ones of the profile",
+			&ccv1beta1.InstallerSecurityContext{
+				Profile:        ccv1beta1.RuntimeInstallerSecurityProfile,
+				Capabilities:   []corev1.Capability{"SYS_ADMIN", "SYS_PTRACE"},
+				SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				SELinuxOptions: &corev1.SELinuxOptions{Type: "spc_t"},
+				HostPID:        boolPtr(false),
+			},
+			&corev1.SecurityContext{
+				Privileged: boolPtr(false),
+				RunAsUser:  &root,
+				Capabilities: &corev1.Capabilities{
+					Add:  []corev1.Capability{"SYS_ADMIN", "SYS_PTRACE"},
+					Drop: []corev1.Capability{"ALL"},
+				},
+				SeccompProfile:  &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				AppArmorProfile: &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+				SELinuxOptions:  &corev1.SELinuxOptions{Type: "spc_t"},
+			}, false),
+		Entry("capabilities allow-list without a profile",
+			&ccv1beta1.InstallerSecurityContext{Privileged: boolPtr(false), Capabilities: []corev1.Capability{"SYS_ADMIN"}},
+			&corev1.SecurityContext{
+				Privileged: boolPtr(false),
+				RunAsUser:  &root,
+				Capabilities: &corev1.Capabilities{
+					Add:  []corev1.Capability{"SYS_ADMIN"},
+					Drop: []corev1.Capability{"ALL"},
+				},
+			}, true),
+		Entry("privileged on top of the runtime-installer profile",
+			&ccv1beta1.InstallerSecurityContext{Profile: ccv1beta1.RuntimeInstallerSecurityProfile, Privileged: boolPtr(true)},
+			&corev1.SecurityContext{
+				Privileged: boolPtr(true),
+				RunAsUser:  &root,
+				Capabilities: &corev1.Capabilities{
+					Add:  ccv1beta1.RuntimeInstallerCapabilities,
+					Drop: []corev1.Capability{"ALL"},
+				},
+				SeccompProfile:  &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+				AppArmorProfile: &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+			}, true),
+	)
+
+	It("doesn't share the capabilities of the profile with the pods", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("security"))
+		ccRuntime.Spec.Config.SecurityContext = &ccv1beta1.InstallerSecurityContext{
+			Profile: ccv1beta1.RuntimeInstallerSecurityProfile,
+		}
+		r, _ := newTestReconciler(ccRuntime)
+
+		securityContext, _ := r.installerSecurityContext()
+		securityContext.Capabilities.Add[0] = "NET_ADMIN"
+		Expect(ccv1beta1.RuntimeInstallerCapabilities[0]).To(Equal(corev1.Capability("CHOWN")))
+	})
+
+	It("renders the security context on the install, uninstall and hook pods", func() {
+		ccRuntime := newTestCcRuntime(uniqueName("security"))
+		ccRuntime.Spec.Config.SecurityContext = &ccv1beta1.InstallerSecurityContext{
+			Profile: ccv1beta1.RuntimeInstallerSecurityProfile,
+			HostPID: boolPtr(false),
+		}
+		ccRuntime.Spec.Config.Hooks = []ccv1beta1.HookConfig{
+			{Name: "smoke-test", Stage: ccv1beta1.PostInstallHookStage, Image: "quay.io/coco/smoke-test:latest"},
+		}
+		r, _ := newTestReconciler(ccRuntime)
+		want, _ := r.installerSecurityContext()
+
+		for _, operation := range []DaemonOperation{InstallOperation, UninstallOperation} {
+			ds, err := r.processDaemonset(operation, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Spec.Template.Spec.HostPID).To(BeFalse())
+			Expect(ds.Spec.Template.Spec.Containers[0].SecurityContext).To(Equal(want))
+		}
+		template, err := r.makeHookPodTemplate(&r.hooks(ccv1beta1.PostInstallHookStage)[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Spec.HostPID).To(BeFalse())
+		Expect(template.Spec.Containers[0].SecurityContext).To(Equal(want))
+	})
+
+	Context("reporting the privileges", func() {
+		It("warns about fully privileged pods once", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("security"))
+			createTestCcRuntime(ccRuntime)
+			r, recorder := newTestReconciler(ccRuntime)
+
+			Expect(r.reportInstallerPrivileges()).To(Succeed())
+			condition := meta.FindStatusCondition(getCcRuntime(ccRuntime.Name).Status.Conditions,
+				InstallerPrivilegesReducedCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("FullyPrivileged"))
+			Expect(events(recorder)).To(ConsistOf(ContainSubstring("FullyPrivileged")))
+
+			Expect(r.reportInstallerPrivileges()).To(Succeed())
+			Expect(events(recorder)).To(BeEmpty())
+		})
+
+		It("reports the reduced privileges", func() {
+			ccRuntime := newTestCcRuntime(uniqueName("security"))
+			ccRuntime.Spec.Config.SecurityContext = &ccv1beta1.InstallerSecurityContext{
+				Profile: ccv1beta1.RuntimeInstallerSecurityProfile,
+			}
+			createTestCcRuntime(ccRuntime)
+			r, recorder := newTestReconciler(ccRuntime)
+
+			Expect(r.reportInstallerPrivileges()).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(getCcRuntime(ccRuntime.Name).Status.Conditions,
+				InstallerPrivilegesReducedCondition)).To(BeTrue())
+			Expect(events(recorder)).To(BeEmpty())
+		})
+	})
+})
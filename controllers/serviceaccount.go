@@ -0,0 +1,118 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// payloadRules are the only rights of the dedicated ServiceAccount
+var payloadRules = []rbacv1.PolicyRule{
+	{
+		// kata-deploy and the hooks label their own node once done, e.g. with the
+		// installDoneLabel and the hook done labels, and the node the pod runs on
+		// is only known at runtime, hence the rights on all the nodes. The
+		// ClusterRole can't restrict them to the labels, and kubectl label only
+		// needs to patch the node.
+		APIGroups: []string{""},
+		Resources: []string{"nodes"},
+		Verbs:     []string{"get", "patch"},
+	},
+	{
+		// The operator sets CREATE_RUNTIMECLASSES, so kata-deploy creates the
+		// RuntimeClasses of its shims on install with kubectl apply and deletes
+		// them on uninstall
+		APIGroups: []string{"node.k8s.io"},
+		Resources: []string{"runtimeclasses"},
+		Verbs:     []string{"get", "create", "patch", "delete"},
+	},
+}
+
+// payloadServiceAccountName returns the ServiceAccount the payload pods run with
+func (r *CcRuntimeReconciler) payloadServiceAccountName() string {
+	if name := r.ccRuntime.Spec.Config.ServiceAccount.Name; name != "" {
+		return name
+	}
+	return "cc-operator-payload-" + r.ccRuntime.Name
+}
+
+func (r *CcRuntimeReconciler) payloadAutomountToken() *bool {
+	return r.ccRuntime.Spec.Config.ServiceAccount.AutomountToken
+}
+
+// reconcilePayloadServiceAccount creates the dedicated ServiceAccount of the
+// payload pods, bound to a ClusterRole with the payloadRules. They are owned by
+// the CcRuntime and garbage collected with it.
+func (r *CcRuntimeReconciler) reconcilePayloadServiceAccount() error {
+	if r.ccRuntime.Spec.Config.ServiceAccount.Name != "" {
+		return nil
+	}
+	name := r.payloadServiceAccountName()
+
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: r.Namespace},
+	}
+	clusterRole := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+
+	for _, obj := range []struct {
+		object client.Object
+		mutate func()
+	}{
+		{serviceAccount, func() {}},
+		{clusterRole, func() {
+			clusterRole.Rules = payloadRules
+		}},
+		{clusterRoleBinding, func() {
+			clusterRoleBinding.RoleRef = rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     name,
+			}
+			clusterRoleBinding.Subjects = []rbacv1.Subject{
+				{
+					Kind:      rbacv1.ServiceAccountKind,
+					Name:      name,
+					Namespace: r.Namespace,
+				},
+			}
+		}},
+	} {
+		result, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, obj.object, func() error {
+			obj.mutate()
+			return controllerutil.SetControllerReference(r.ccRuntime, obj.object, r.Scheme)
+		})
+		if err != nil {
+			r.Log.Error(err, "failed to reconcile the payload ServiceAccount", "name", obj.object.GetName())
+			return err
+		}
+		if result != controllerutil.OperationResultNone {
+			r.Log.Info("payload ServiceAccount reconciled", "name", obj.object.GetName(), "result", result)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+var _ = Describe("Payload ServiceAccount", func() {
+	var (
+		ccRuntime *ccv1beta1.CcRuntime
+		r         *CcRuntimeReconciler
+	)
+
+	BeforeEach(func() {
+		ccRuntime = newTestCcRuntime(uniqueName("payload-sa"))
+		createTestCcRuntime(ccRuntime)
+		r, _ = newTestReconciler(ccRuntime)
+	})
+
+	// ownedByCcRuntime matches the objects the garbage collector deletes with
+	// the CcRuntime
+	ownedByCcRuntime := func() types.GomegaMatcher {
+		return HaveField("OwnerReferences", ConsistOf(And(
+			HaveField("Kind", "CcRuntime"),
+			HaveField("Name", ccRuntime.Name),
+			HaveField("UID", ccRuntime.UID),
+			HaveField("Controller", HaveValue(BeTrue())),
+			HaveField("BlockOwnerDeletion", HaveValue(BeTrue())))))
+	}
+
+	It("binds the ServiceAccount to the payload rules only", func() {
+		Expect(r.reconcilePayloadServiceAccount()).To(Succeed())
+		name := "cc-operator-payload-" + ccRuntime.Name
+		Expect(r.payloadServiceAccountName()).To(Equal(name))
+
+		serviceAccount := &corev1.ServiceAccount{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: testNamespace},
+			serviceAccount)).To(Succeed())
+		Expect(serviceAccount.ObjectMeta).To(ownedByCcRuntime())
+
+		clusterRole := &rbacv1.ClusterRole{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: name}, clusterRole)).To(Succeed())
+		Expect(clusterRole.ObjectMeta).To(ownedByCcRuntime())
+		Expect(clusterRole.Rules).To(ConsistOf(
+			rbacv1.PolicyRule{
+				APIGroups: []string{""},
+				Resources: []string{"nodes"},
+				Verbs:     []string{"get", "patch"},
+			},
+			rbacv1.PolicyRule{
+				APIGroups: []string{"node.k8s.io"},
+				Resources: []string{"runtimeclasses"},
+				Verbs:     []string{"get", "create", "patch", "delete"},
+			},
+		))
+
+		clusterRoleBinding := &rbacv1.ClusterRoleBinding{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: name}, clusterRoleBinding)).To(Succeed())
+		Expect(clusterRoleBinding.ObjectMeta).To(ownedByCcRuntime())
+		Expect(clusterRoleBinding.RoleRef).To(Equal(rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name,
+		}))
+		Expect(clusterRoleBinding.Subjects).To(ConsistOf(rbacv1.Subject{
+			Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: testNamespace,
+		}))
+	})
+
+	It("restores the rules changed in the cluster", func() {
+		Expect(r.reconcilePayloadServiceAccount()).To(Succeed())
+		clusterRole := &rbacv1.ClusterRole{}
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: r.payloadServiceAccountName()},
+			clusterRole)).To(Succeed())
+		clusterRole.Rules = append(clusterRole.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"},
+		})
+		Expect(k8sClient.Update(context.TODO(), clusterRole)).To(Succeed())
+
+		Expect(r.reconcilePayloadServiceAccount()).To(Succeed())
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(clusterRole), clusterRole)).To(Succeed())
+		Expect(clusterRole.Rules).To(Equal(payloadRules))
+	})
+
+	It("runs the payload pods with the ServiceAccount", func() {
+		ds, err := r.processDaemonset(InstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.ServiceAccountName).To(Equal(r.payloadServiceAccountName()))
+	})
+
+	It("uses an existing ServiceAccount without creating one", func() {
+		ccRuntime.Spec.Config.ServiceAccount.Name = "payload"
+		automount := false
+		ccRuntime.Spec.Config.ServiceAccount.AutomountToken = &automount
+
+		Expect(r.reconcilePayloadServiceAccount()).To(Succeed())
+		err := k8sClient.Get(context.TODO(), client.ObjectKey{Name: "cc-operator-payload-" + ccRuntime.Name},
+			&rbacv1.ClusterRole{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		ds, err := r.processDaemonset(UninstallOperation, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.ServiceAccountName).To(Equal("payload"))
+		Expect(ds.Spec.Template.Spec.AutomountServiceAccountToken).To(HaveValue(BeFalse()))
+	})
+})
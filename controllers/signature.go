@@ -0,0 +1,493 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+var (
+	// Fulcio certificate extensions holding the OIDC issuer
+	fulcioIssuerV1OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// VerificationPolicy holds the material used to verify image signatures
+type VerificationPolicy struct {
+	// PublicKeys are used for key based verification
+	PublicKeys []crypto.PublicKey
+
+	// Roots, Issuer and Subject are used for keyless verification, RekorKeys
+	// verifies the transparency log entries of the keyless signatures, keyed on
+	// the log ID, the hex encoded SHA-256 of the key
+	Roots     *x509.CertPool
+	Issuer    string
+	Subject   string
+	RekorKeys map[string]crypto.PublicKey
+}
+
+// ImageVerifier verifies the signatures of images
+type ImageVerifier interface {
+	Verify(ctx context.Context, image string, digest string, policy *VerificationPolicy,
+		credentials RegistryCredentials) error
+}
+
+// Verify checks that the image manifest with the given digest carries a cosign
+// signature matching the policy. Keyless signatures must carry the entry of the
+// transparency log they were recorded in.
+func (c *RegistryClient) Verify(ctx context.Context, image string, digest string, policy *VerificationPolicy,
+	credentials RegistryCredentials) error {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return err
+	}
+
+	// cosign stores the signatures of sha256:<hex> under the sha256-<hex>.sig tag
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	data, _, err := c.getManifest(ctx, ref, sigTag, credentials)
+	if err != nil {
+		return fmt.Errorf("no signature found for %s: %w", ref.pinned(digest), err)
+	}
+
+	manifest := struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid signature manifest for %s: %w", ref.pinned(digest), err)
+	}
+
+	var errs []error
+	for _, layer := range manifest.Layers {
+		payload, err := c.getBlob(ctx, ref, layer.Digest, credentials)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = verifyCosignSignature(payload, layer.Annotations, digest, policy)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no signature found for %s", ref.pinned(digest))
+	}
+	return fmt.Errorf("no valid signature for %s: %w", ref.pinned(digest), errors.Join(errs...))
+}
+
+// verifyCosignSignature verifies a single signature layer
+func verifyCosignSignature(payload []byte, annotations map[string]string, digest string, policy *VerificationPolicy) error {
+	simpleSigning := struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}{}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if simpleSigning.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s", simpleSigning.Critical.Image.DockerManifestDigest)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("missing or invalid signature annotation")
+	}
+
+	if policy.Roots != nil {
+		certs, err := parseCertificates([]byte(annotations[cosignCertificateAnnotation]))
+		if err != nil || len(certs) == 0 {
+			return fmt.Errorf("missing or invalid signing certificate")
+		}
+		integratedTime, err := verifyRekorBundle(annotations[cosignBundleAnnotation], payload, signature, certs[0], policy)
+		if err != nil {
+			return err
+		}
+		if err := verifySigningCertificate(certs[0], annotations, integratedTime, policy); err != nil {
+			return err
+		}
+		return verifySignature(certs[0].PublicKey, payload, signature)
+	}
+
+	for _, key := range policy.PublicKeys {
+		if verifySignature(key, payload, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature doesn't match any of the public keys")
+}
+
+// verifyRekorBundle checks that the signature was recorded in the transparency
+// log while the signing certificate was valid, and returns the time it was
+// recorded at. A leaked key of a short lived certificate is then of no use once
+// the certificate expired.
+func verifyRekorBundle(annotation string, payload, signature []byte, cert *x509.Certificate,
+	policy *VerificationPolicy) (time.Time, error) {
+	if annotation == "" {
+		return time.Time{}, fmt.Errorf("the signature has no transparency log entry")
+	}
+	bundle := struct {
+		SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+		Payload              struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogIndex       int64  `json:"logIndex"`
+			LogID          string `json:"logID"`
+		} `json:"Payload"`
+	}{}
+	if err := json.Unmarshal([]byte(annotation), &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+
+	// The signed entry timestamp signs the RFC 8785 canonical JSON of the entry
+	key, ok := policy.RekorKeys[bundle.Payload.LogID]
+	if !ok {
+		return time.Time{}, fmt.Errorf("the transparency log %s isn't trusted", bundle.Payload.LogID)
+	}
+	entry, err := canonicalJSON(map[string]interface{}{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logID":          bundle.Payload.LogID,
+		"logIndex":       bundle.Payload.LogIndex,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(key, entry, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("the transparency log entry isn't signed by the log: %w", err)
+	}
+
+	// The entry must be the one of this signature, made with this certificate
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry body: %w", err)
+	}
+	record := struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry body: %w", err)
+	}
+	if record.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("unsupported transparency log entry kind %q", record.Kind)
+	}
+	payloadHash := sha256.Sum256(payload)
+	if record.Spec.Data.Hash.Algorithm != "sha256" || record.Spec.Data.Hash.Value != hex.EncodeToString(payloadHash[:]) {
+		return time.Time{}, fmt.Errorf("the transparency log entry is for another payload")
+	}
+	if !bytes.Equal(record.Spec.Signature.Content, signature) {
+		return time.Time{}, fmt.Errorf("the transparency log entry is for another signature")
+	}
+	entryCerts, err := parseCertificates(record.Spec.Signature.PublicKey.Content)
+	if err != nil || len(entryCerts) == 0 || !entryCerts[0].Equal(cert) {
+		return time.Time{}, fmt.Errorf("the transparency log entry is for another certificate")
+	}
+
+	integratedTime := time.Unix(bundle.Payload.IntegratedTime, 0)
+	if integratedTime.Before(cert.NotBefore) || integratedTime.After(cert.NotAfter) {
+		return time.Time{}, fmt.Errorf("the signature was recorded at %s, outside of the validity of the signing certificate",
+			integratedTime.UTC().Format(time.RFC3339))
+	}
+	return integratedTime, nil
+}
+
+// verifySigningCertificate checks that the signing certificate chained up to
+// the Fulcio roots when the signature was recorded, and carries the expected
+// identity
+func verifySigningCertificate(cert *x509.Certificate, annotations map[string]string, integratedTime time.Time,
+	policy *VerificationPolicy) error {
+	intermediates := x509.NewCertPool()
+	chain, _ := parseCertificates([]byte(annotations[cosignChainAnnotation]))
+	for _, c := range chain {
+		intermediates.AddCert(c)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         policy.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("signing certificate isn't trusted: %w", err)
+	}
+
+	if issuer := certificateIssuer(cert); issuer != policy.Issuer {
+		return fmt.Errorf("signing certificate issued by %q, expected %q", issuer, policy.Issuer)
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == policy.Subject {
+			return nil
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == policy.Subject {
+			return nil
+		}
+	}
+	return fmt.Errorf("signing certificate doesn't belong to %q", policy.Subject)
+}
+
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(fulcioIssuerV2OID):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(fulcioIssuerV1OID):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+func verifySignature(key crypto.PublicKey, payload, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, hash[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, payload, signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// rekorLogID returns the ID of the transparency log signing with the key, the
+// hex encoded SHA-256 of its DER encoding
+func rekorLogID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// canonicalJSON serializes the value with the JSON Canonicalization Scheme of
+// RFC 8785: no whitespace, the object keys sorted by their UTF-16 code units,
+// the numbers formatted as ECMAScript does and the strings escaped minimally
+func canonicalJSON(value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeCanonicalJSON(buf, decoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %s: %w", v, err)
+		}
+		buf.WriteString(canonicalNumber(f))
+	case string:
+		writeCanonicalString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return slices.Compare(utf16.Encode([]rune(keys[i])), utf16.Encode([]rune(keys[j]))) < 0
+		})
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported JSON value %T", value)
+	}
+	return nil
+}
+
+// canonicalNumber formats the number as ECMAScript's Number.prototype.toString
+// does, the JSON parsed numbers being finite
+func canonicalNumber(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+	format := byte('e')
+	if abs := math.Abs(f); abs >= 1e-6 && abs < 1e21 {
+		format = 'f'
+	}
+	formatted := strconv.FormatFloat(f, format, -1, 64)
+	// ECMAScript doesn't pad the exponent, 1e-7 rather than 1e-07
+	if i := strings.IndexByte(formatted, 'e'); i > 0 && formatted[i+2] == '0' {
+		formatted = formatted[:i+2] + formatted[i+3:]
+	}
+	return formatted
+}
+
+// writeCanonicalString escapes only the quote, the backslash and the control
+// characters, the short forms being used where JSON has them
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
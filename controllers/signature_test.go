@@ -0,0 +1,434 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testSignedDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testIdentity     = "release@confidentialcontainers.org"
+	testIssuer       = "https://token.actions.githubusercontent.com"
+)
+
+// testSigner plays Fulcio, with a root and an intermediate CA, and Rekor
+type testSigner struct {
+	root             *x509.Certificate
+	intermediate     *x509.Certificate
+	intermediateKey  *ecdsa.PrivateKey
+	intermediatePEM  string
+	rekorKey         *ecdsa.PrivateKey
+	serial           int64
+	certificateStart time.Time
+}
+
+// signOptions describes the keyless signature to make, the zero value being a
+// valid signature of testSignedDigest
+type signOptions struct {
+	digest string
+	// subject and issuer are the identity of the signing certificate
+	subject string
+	issuer  string
+	// expired makes the signing certificate expire before the signature is
+	// recorded in the log
+	expired bool
+	// tamperSET flips a bit of the signed entry timestamp
+	tamperSET bool
+	// tamperEntry changes the log index once the entry is signed
+	tamperEntry bool
+	// noBundle leaves the transparency log entry out
+	noBundle bool
+}
+
+func newTestSigner() *testSigner {
+	s := &testSigner{certificateStart: time.Now().Add(-time.Hour)}
+
+	rootKey := newTestKey()
+	s.root = s.certificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotAfter:              s.certificateStart.Add(24 * time.Hour),
+	}, nil, &rootKey.PublicKey, rootKey)
+
+	s.intermediateKey = newTestKey()
+	s.intermediate = s.certificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "sigstore-intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		NotAfter:              s.certificateStart.Add(24 * time.Hour),
+	}, s.root, &s.intermediateKey.PublicKey, rootKey)
+	s.intermediatePEM = certificatePEM(s.intermediate)
+
+	s.rekorKey = newTestKey()
+	return s
+}
+
+func newTestKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	return key
+}
+
+// certificate issues the template, self signed without a parent
+func (s *testSigner) certificate(template, parent *x509.Certificate, pub crypto.PublicKey,
+	parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	s.serial++
+	template.SerialNumber = big.NewInt(s.serial)
+	if template.NotBefore.IsZero() {
+		template.NotBefore = s.certificateStart
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func certificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func publicKeyPEM(key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// policy returns the keyless policy trusting the CA and the log of the signer
+func (s *testSigner) policy() *VerificationPolicy {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.root)
+	logID, err := rekorLogID(&s.rekorKey.PublicKey)
+	Expect(err).NotTo(HaveOccurred())
+	return &VerificationPolicy{
+		Roots:     roots,
+		Issuer:    testIssuer,
+		Subject:   testIdentity,
+		RekorKeys: map[string]crypto.PublicKey{logID: &s.rekorKey.PublicKey},
+	}
+}
+
+// simpleSigningPayload returns the payload cosign signs for the digest
+func simpleSigningPayload(digest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"quay.io/coco/payload"},`+
+		`"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest))
+}
+
+// sign makes a keyless signature, returning its payload and the annotations of
+// its layer
+func (s *testSigner) sign(options signOptions) ([]byte, map[string]string) {
+	if options.digest == "" {
+		options.digest = testSignedDigest
+	}
+	if options.subject == "" {
+		options.subject = testIdentity
+	}
+	if options.issuer == "" {
+		options.issuer = testIssuer
+	}
+
+	// Fulcio certificates are valid for 10 minutes
+	now := time.Now()
+	notBefore := now.Add(-time.Minute)
+	if options.expired {
+		notBefore = now.Add(-20 * time.Minute)
+	}
+	issuer, err := asn1.Marshal(options.issuer)
+	Expect(err).NotTo(HaveOccurred())
+	leafKey := newTestKey()
+	leaf := s.certificate(&x509.Certificate{
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{options.subject},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2OID, Value: issuer}},
+	}, s.intermediate, &leafKey.PublicKey, s.intermediateKey)
+	leafPEM := certificatePEM(leaf)
+
+	payload := simpleSigningPayload(options.digest)
+	payloadHash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, leafKey, payloadHash[:])
+	Expect(err).NotTo(HaveOccurred())
+
+	annotations := map[string]string{
+		cosignSignatureAnnotation:   base64.StdEncoding.EncodeToString(signature),
+		cosignCertificateAnnotation: leafPEM,
+		cosignChainAnnotation:       s.intermediatePEM + certificatePEM(s.root),
+	}
+	if options.noBundle {
+		return payload, annotations
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data": map[string]interface{}{
+				"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(payloadHash[:])},
+			},
+			"signature": map[string]interface{}{
+				"content":   signature,
+				"publicKey": map[string]interface{}{"content": []byte(leafPEM)},
+			},
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	logID, err := rekorLogID(&s.rekorKey.PublicKey)
+	Expect(err).NotTo(HaveOccurred())
+	entry := map[string]interface{}{
+		"body":           base64.StdEncoding.EncodeToString(body),
+		"integratedTime": now.Unix(),
+		"logID":          logID,
+		"logIndex":       int64(25579),
+	}
+	canonical, err := canonicalJSON(entry)
+	Expect(err).NotTo(HaveOccurred())
+	entryHash := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, s.rekorKey, entryHash[:])
+	Expect(err).NotTo(HaveOccurred())
+
+	if options.tamperSET {
+		set[len(set)-1] ^= 1
+	}
+	if options.tamperEntry {
+		entry["logIndex"] = int64(25580)
+	}
+	bundle, err := json.Marshal(map[string]interface{}{"SignedEntryTimestamp": set, "Payload": entry})
+	Expect(err).NotTo(HaveOccurred())
+	annotations[cosignBundleAnnotation] = string(bundle)
+	return payload, annotations
+}
+
+// signatureRegistry serves the cosign signature manifest of testSignedDigest
+// in the coco/payload repository, with a single layer
+type signatureRegistry struct {
+	payload     []byte
+	annotations map[string]string
+}
+
+func (reg *signatureRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	payloadDigest := testDigest(string(reg.payload))
+	switch req.URL.Path {
+	case "/v2/coco/payload/manifests/" + strings.Replace(testSignedDigest, ":", "-", 1) + ".sig":
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"layers": []map[string]interface{}{{
+				"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+				"digest":      payloadDigest,
+				"size":        len(reg.payload),
+				"annotations": reg.annotations,
+			}},
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_, _ = w.Write(manifest)
+	case "/v2/coco/payload/blobs/" + payloadDigest:
+		_, _ = w.Write(reg.payload)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Image signature verification", func() {
+	DescribeTable("canonicalizing JSON as RFC 8785 does",
+		func(input, want string) {
+			canonical, err := canonicalJSON(json.RawMessage(input))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(canonical)).To(Equal(want))
+		},
+		Entry("whitespace and key order",
+			`{ "logIndex": 1, "body": "Ym9keQ==", "logID": "c0d2", "integratedTime": 1700000000 }`,
+			`{"body":"Ym9keQ==","integratedTime":1700000000,"logID":"c0d2","logIndex":1}`),
+		Entry("nested objects and arrays",
+			`{"b":[true,false,null,{"d":1,"c":2}],"a":{}}`,
+			`{"a":{},"b":[true,false,null,{"c":2,"d":1}]}`),
+		// The examples of RFC 8785 section 3.2.2 and 3.2.3
+		Entry("numbers",
+			`[333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001, -0, 1e21, 1e-7, 0.000001, 100]`,
+			`[333333333.3333333,1e+30,4.5,0.002,1e-27,0,1e+21,1e-7,0.000001,100]`),
+		Entry("strings",
+			`"\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/"`,
+			`"€$\u000f\nA'B\"\\\\\"/"`),
+		Entry("characters Go escapes",
+			`"<a href=\"x\">&</a>\u2028"`,
+			"\"<a href=\\\"x\\\">&</a>\u2028\""),
+		Entry("keys sorted by UTF-16 code units",
+			`{"\u20ac":"Euro Sign","\r":"Carriage Return","\ufb33":"Hebrew Letter Dalet With Dagesh",`+
+				`"1":"One","\ud83d\ude00":"Emoji: Grinning Face","\u0080":"Control",`+
+				`"\u00f6":"Latin Small Letter O With Diaeresis"}`,
+			`{"\r":"Carriage Return","1":"One",`+
+				"\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\","+
+				"\"\u20ac\":\"Euro Sign\",\"\U0001f600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}"),
+	)
+
+	Context("with keyless signatures", func() {
+		var signer *testSigner
+
+		BeforeEach(func() {
+			signer = newTestSigner()
+		})
+
+		It("accepts a signature recorded in the transparency log", func() {
+			payload, annotations := signer.sign(signOptions{})
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest, signer.policy())).To(Succeed())
+		})
+
+		It("accepts the URI identities of workflows", func() {
+			payload, annotations := signer.sign(signOptions{})
+			policy := signer.policy()
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest, policy)).To(Succeed())
+
+			// Email and URI identities are compared as a whole
+			policy.Subject = "release@confidentialcontainers"
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest, policy)).To(
+				MatchError(ContainSubstring("doesn't belong to")))
+		})
+
+		DescribeTable("rejecting signatures",
+			func(options signOptions, changePolicy func(*VerificationPolicy), want string) {
+				payload, annotations := signer.sign(options)
+				policy := signer.policy()
+				if changePolicy != nil {
+					changePolicy(policy)
+				}
+				err := verifyCosignSignature(payload, annotations, testSignedDigest, policy)
+				Expect(err).To(MatchError(ContainSubstring(want)))
+			},
+			Entry("of another identity",
+				signOptions{subject: "attacker@example.com"}, nil,
+				`signing certificate doesn't belong to "release@confidentialcontainers.org"`),
+			Entry("of another issuer",
+				signOptions{issuer: "https://accounts.example.com"}, nil,
+				`signing certificate issued by "https://accounts.example.com"`),
+			Entry("with a tampered signed entry timestamp",
+				signOptions{tamperSET: true}, nil,
+				"the transparency log entry isn't signed by the log"),
+			Entry("with a tampered transparency log entry",
+				signOptions{tamperEntry: true}, nil,
+				"the transparency log entry isn't signed by the log"),
+			Entry("recorded once the certificate expired",
+				signOptions{expired: true}, nil,
+				"outside of the validity of the signing certificate"),
+			Entry("not recorded in the transparency log",
+				signOptions{noBundle: true}, nil,
+				"the signature has no transparency log entry"),
+			Entry("of another image",
+				signOptions{digest: testDigest("another image")}, nil,
+				"signature is for "+testDigest("another image")),
+			Entry("recorded in an untrusted log",
+				signOptions{}, func(policy *VerificationPolicy) {
+					other := newTestSigner()
+					policy.RekorKeys = other.policy().RekorKeys
+				},
+				"isn't trusted"),
+			Entry("chaining up to an untrusted root",
+				signOptions{}, func(policy *VerificationPolicy) {
+					policy.Roots = newTestSigner().policy().Roots
+				},
+				"signing certificate isn't trusted"),
+		)
+
+		It("rejects a transparency log entry of another signature", func() {
+			payload, annotations := signer.sign(signOptions{})
+			_, other := signer.sign(signOptions{})
+			annotations[cosignBundleAnnotation] = other[cosignBundleAnnotation]
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest, signer.policy())).To(
+				MatchError(ContainSubstring("the transparency log entry is for another signature")))
+		})
+
+		It("rejects a signature of another certificate", func() {
+			payload, annotations := signer.sign(signOptions{})
+			_, other := signer.sign(signOptions{})
+			annotations[cosignCertificateAnnotation] = other[cosignCertificateAnnotation]
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest, signer.policy())).To(
+				MatchError(ContainSubstring("the transparency log entry is for another certificate")))
+		})
+	})
+
+	Context("with public keys", func() {
+		It("accepts the signatures of any of the keys", func() {
+			key := newTestKey()
+			payload := simpleSigningPayload(testSignedDigest)
+			hash := sha256.Sum256(payload)
+			signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+			Expect(err).NotTo(HaveOccurred())
+			annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+
+			keys, err := parsePublicKeys(append(publicKeyPEM(&newTestKey().PublicKey), publicKeyPEM(&key.PublicKey)...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(HaveLen(2))
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest,
+				&VerificationPolicy{PublicKeys: keys})).To(Succeed())
+
+			Expect(verifyCosignSignature(payload, annotations, testSignedDigest,
+				&VerificationPolicy{PublicKeys: keys[:1]})).To(
+				MatchError("signature doesn't match any of the public keys"))
+		})
+	})
+
+	Context("against a registry", func() {
+		It("verifies the signature layers of the digest", func() {
+			signer := newTestSigner()
+			payload, annotations := signer.sign(signOptions{})
+			server := httptest.NewServer(&signatureRegistry{payload: payload, annotations: annotations})
+			defer server.Close()
+			image := strings.TrimPrefix(server.URL, "http://") + "/coco/payload:v1"
+
+			Expect(NewRegistryClient().Verify(context.TODO(), image, testSignedDigest, signer.policy(), nil)).To(Succeed())
+
+			err := NewRegistryClient().Verify(context.TODO(), image, testDigest("unsigned"), signer.policy(), nil)
+			Expect(err).To(MatchError(ContainSubstring("no signature found")))
+
+			err = NewRegistryClient().Verify(context.TODO(), image, testSignedDigest, newTestSigner().policy(), nil)
+			Expect(err).To(MatchError(ContainSubstring("no valid signature")))
+		})
+	})
+})
@@ -17,18 +17,32 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	peerpod "github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl/api/v1alpha1"
+	peerpodconfig "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/api/v1alpha1"
 	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
 	//+kubebuilder:scaffold:imports
 )
@@ -36,10 +50,18 @@ import (
 // These tests use Ginkgo (BDD-style Go testing framework). Refer to
 // http://onsi.github.io/ginkgo/ to learn more about Ginkgo.
 
-var cfg *rest.Config //nolint: unused
+var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
 
+const (
+	// testNamespace holds the secondary resources of the CcRuntimes of the tests
+	testNamespace = "confidential-containers-system"
+
+	// testNodeLabel selects the nodes of a spec
+	testNodeLabel = "test.confidentialcontainers.org/ccruntime"
+)
+
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
 
@@ -49,29 +71,214 @@ func TestAPIs(t *testing.T) {
 var _ = BeforeSuite(func() {
 	logf.SetLogger(zap.New(zap.WriteTo(GinkgoWriter), zap.UseDevMode(true)))
 
-	By("bootstrapping test environment")
-	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
-		ErrorIfCRDPathMissing: true,
-	}
-
-	cfg, err := testEnv.Start()
-	Expect(err).NotTo(HaveOccurred())
-	Expect(cfg).NotTo(BeNil())
-
-	err = ccv1beta1.AddToScheme(scheme.Scheme)
+	err := ccv1beta1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
+	Expect(peerpodconfig.AddToScheme(scheme.Scheme)).To(Succeed())
+	Expect(peerpod.AddToScheme(scheme.Scheme)).To(Succeed())
 
 	//+kubebuilder:scaffold:scheme
 
-	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
-	Expect(err).NotTo(HaveOccurred())
+	// make test provides the envtest binaries, a plain go test runs the specs
+	// against the fake client
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		By("using the fake client, KUBEBUILDER_ASSETS is not set")
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme.Scheme).
+			WithStatusSubresource(&ccv1beta1.CcRuntime{}, &batchv1.Job{}, &appsv1.DaemonSet{}, &corev1.Pod{},
+				&corev1.Node{}).
+			Build()
+	} else {
+		By("bootstrapping test environment")
+		testEnv = &envtest.Environment{
+			CRDDirectoryPaths: []string{
+				filepath.Join("..", "config", "crd", "bases"),
+				moduleCRDs("github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl"),
+				moduleCRDs("github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl"),
+			},
+			ErrorIfCRDPathMissing: true,
+		}
+
+		cfg, err = testEnv.Start()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).NotTo(BeNil())
+
+		k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+	}
 	Expect(k8sClient).NotTo(BeNil())
 
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+	Expect(k8sClient.Create(context.TODO(), ns)).To(Succeed())
 })
 
 var _ = AfterSuite(func() {
+	if testEnv == nil {
+		return
+	}
 	By("tearing down the test environment")
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
+
+// moduleCRDs returns the CRD directory of a module the operator depends on
+func moduleCRDs(module string) string {
+	dir, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", module).Output()
+	Expect(err).NotTo(HaveOccurred())
+	return filepath.Join(strings.TrimSpace(string(dir)), "config", "crd", "bases")
+}
+
+var testNameCount int
+
+// uniqueName returns a name no other spec uses, as the specs share the API server
+func uniqueName(prefix string) string {
+	testNameCount++
+	return fmt.Sprintf("%s-%d", prefix, testNameCount)
+}
+
+// newTestCcRuntime returns a CcRuntime installing kata-deploy on the worker
+// nodes, as the base sample does
+func newTestCcRuntime(name string) *ccv1beta1.CcRuntime {
+	return &ccv1beta1.CcRuntime{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: ccv1beta1.CcRuntimeSpec{
+			RuntimeName: "kata",
+			CcNodeSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"node.kubernetes.io/worker": ""},
+			},
+			Config: ccv1beta1.CcInstallConfig{
+				InstallType:        ccv1beta1.BundleInstallType,
+				PayloadImage:       "quay.io/kata-containers/kata-deploy:3.23.0",
+				InstallDoneLabel:   map[string]string{"katacontainers.io/kata-runtime": "true"},
+				UninstallDoneLabel: map[string]string{"katacontainers.io/kata-runtime": "cleanup"},
+				InstallCmd:         []string{"/opt/kata-artifacts/scripts/kata-deploy.sh", "install"},
+				UninstallCmd:       []string{"/opt/kata-artifacts/scripts/kata-deploy.sh", "cleanup"},
+				CleanupCmd:         []string{"/opt/kata-artifacts/scripts/kata-deploy.sh", "reset"},
+			},
+		},
+	}
+}
+
+// createTestCcRuntime creates the CcRuntime, with the status required by the CRD
+func createTestCcRuntime(ccRuntime *ccv1beta1.CcRuntime) {
+	Expect(k8sClient.Create(context.TODO(), ccRuntime)).To(Succeed())
+	DeferCleanup(func() {
+		stored := &ccv1beta1.CcRuntime{}
+		if err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(ccRuntime), stored); err != nil {
+			return
+		}
+		stored.Finalizers = nil
+		_ = k8sClient.Update(context.TODO(), stored)
+		_ = k8sClient.Delete(context.TODO(), stored)
+	})
+	ccRuntime.Status.RuntimeName = ccRuntime.Spec.RuntimeName
+	Expect(k8sClient.Status().Update(context.TODO(), ccRuntime)).To(Succeed())
+}
+
+// newTestReconciler returns a reconciler working on the CcRuntime, as
+// Reconcile sets it up, with events recorded for the specs to check
+func newTestReconciler(ccRuntime *ccv1beta1.CcRuntime) (*CcRuntimeReconciler, *record.FakeRecorder) {
+	recorder := record.NewFakeRecorder(100)
+	return &CcRuntimeReconciler{
+		Client:    k8sClient,
+		Scheme:    scheme.Scheme,
+		Log:       ctrl.Log.WithName("test"),
+		Recorder:  recorder,
+		ccRuntime: ccRuntime,
+		Namespace: testNamespace,
+	}, recorder
+}
+
+// getCcRuntime returns the stored CcRuntime
+func getCcRuntime(name string) *ccv1beta1.CcRuntime {
+	ccRuntime := &ccv1beta1.CcRuntime{}
+	Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: name}, ccRuntime)).To(Succeed())
+	return ccRuntime
+}
+
+// createTestNode creates a node with the labels, removed with the spec
+func createTestNode(name string, labels map[string]string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	Expect(k8sClient.Create(context.TODO(), node)).To(Succeed())
+	DeferCleanup(func() {
+		_ = k8sClient.Delete(context.TODO(), node)
+	})
+	return node
+}
+
+// getNode returns the stored node
+func getNode(name string) *corev1.Node {
+	node := &corev1.Node{}
+	Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: name}, node)).To(Succeed())
+	return node
+}
+
+// events drains the events recorded so far
+func events(recorder *record.FakeRecorder) []string {
+	var recorded []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+// getNodeJob returns the Job of the operation on the node
+func getNodeJob(operation, nodeName string) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	err := k8sClient.Get(context.TODO(), client.ObjectKey{Name: nodeJobName(operation, nodeName), Namespace: testNamespace}, job)
+	return job, err
+}
+
+// completeJob reports the Job succeeded, as the Job controller does
+func completeJob(job *batchv1.Job) {
+	now := metav1.Now()
+	job.Status.StartTime = &now
+	job.Status.CompletionTime = &now
+	job.Status.Succeeded = 1
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+	}
+	Expect(k8sClient.Status().Update(context.TODO(), job)).To(Succeed())
+}
+
+// failJob reports the Job failed, as the Job controller does
+func failJob(job *batchv1.Job, reason, message string) {
+	now := metav1.Now()
+	job.Status.StartTime = &now
+	job.Status.Failed = 1
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, Reason: reason, Message: message, LastTransitionTime: now},
+		{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: reason, Message: message, LastTransitionTime: now},
+	}
+	Expect(k8sClient.Status().Update(context.TODO(), job)).To(Succeed())
+}
+
+// setNodeLabels sets the labels on the stored node, as the pods running on it do
+func setNodeLabels(name string, labels map[string]string) {
+	node := getNode(name)
+	if node.Labels == nil {
+		node.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		node.Labels[k] = v
+	}
+	Expect(k8sClient.Update(context.TODO(), node)).To(Succeed())
+}
+
+// setNodeInfo sets the NodeInfo the kubelet reports on the stored node
+func setNodeInfo(name string, info corev1.NodeSystemInfo) {
+	node := getNode(name)
+	node.Status.NodeInfo = info
+	Expect(k8sClient.Status().Update(context.TODO(), node)).To(Succeed())
+}
+
+// selectTestNodes makes the CcRuntime select only the nodes of the spec, which
+// carry its name in testNodeLabel
+func selectTestNodes(ccRuntime *ccv1beta1.CcRuntime) map[string]string {
+	labels := map[string]string{testNodeLabel: ccRuntime.Name}
+	ccRuntime.Spec.CcNodeSelector = &metav1.LabelSelector{MatchLabels: labels}
+	return labels
+}
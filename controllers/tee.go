@@ -0,0 +1,226 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	nodeapi "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+const (
+	// TeeLabelPrefix prefixes the labels of the TEEs of the nodes, e.g.
+	// tee.confidentialcontainers.org/tdx=true
+	TeeLabelPrefix = "tee.confidentialcontainers.org/"
+
+	// teeProbeHookName is the name of the hook probing the TEEs of the nodes
+	teeProbeHookName = "tee-probe"
+)
+
+// nfdTeeLabels are the Node Feature Discovery labels of the TEEs
+var nfdTeeLabels = map[ccv1beta1.TeeType]string{
+	ccv1beta1.TdxTee:    "feature.node.kubernetes.io/cpu-security.tdx.enabled",
+	ccv1beta1.SevSnpTee: "feature.node.kubernetes.io/cpu-security.sev.snp.enabled",
+	ccv1beta1.SeTee:     "feature.node.kubernetes.io/cpu-security.se.enabled",
+	ccv1beta1.SgxTee:    "feature.node.kubernetes.io/cpu-security.sgx.enabled",
+}
+
+// teeProbeScript labels the node it runs on with the TEEs the host kernel
+// enables
+const teeProbeScript = `
+label() { kubectl label node "${NODE_NAME}" --overwrite "` + TeeLabelPrefix + `$1=true"; }
+[ "$(cat /sys/module/kvm_intel/parameters/tdx 2>/dev/null)" = "Y" ] && label tdx
+[ "$(cat /sys/module/kvm_amd/parameters/sev_snp 2>/dev/null)" = "Y" ] && label sev-snp
+[ "$(cat /sys/firmware/uv/prot_virt_host 2>/dev/null)" = "1" ] && label se
+grep -qw sgx /proc/cpuinfo && label sgx
+exit 0
+`
+
+func teeLabel(tee ccv1beta1.TeeType) string {
+	return TeeLabelPrefix + string(tee)
+}
+
+// nfdTees returns the TEEs Node Feature Discovery found on a node
+func nfdTees(labels map[string]string) []ccv1beta1.TeeType {
+	var tees []ccv1beta1.TeeType
+	for _, tee := range ccv1beta1.TeeTypes {
+		if labels[nfdTeeLabels[tee]] == "true" {
+			tees = append(tees, tee)
+		}
+	}
+	return tees
+}
+
+// nodeHasTee reflects whether a node can run the pods of a runtime class
+// needing the TEE. Only the labels of the operator count, as they are the ones
+// the runtime classes are scheduled with.
+func nodeHasTee(labels map[string]string, tee ccv1beta1.TeeType) bool {
+	return tee == "" || labels[teeLabel(tee)] == "true"
+}
+
+// teeProbeHook returns the hook probing the TEEs of the nodes, run before the
+// other preInstall hooks, if the TEE discovery uses a probe
+func (r *CcRuntimeReconciler) teeProbeHook() *nodeHook {
+	discovery := &r.ccRuntime.Spec.Config.TeeDiscovery
+	if !discovery.Enabled || discovery.ProbeImage == "" {
+		return nil
+	}
+	return &nodeHook{
+		HookConfig: ccv1beta1.HookConfig{
+			Name:  teeProbeHookName,
+			Stage: ccv1beta1.PreInstallHookStage,
+			Image: discovery.ProbeImage,
+			Cmd:   []string{"/bin/sh", "-c", teeProbeScript},
+		},
+		operation: teeProbeHookName,
+		doneLabel: []string{HookDoneLabel(r.ccRuntime.Name, teeProbeHookName), "done"},
+	}
+}
+
+// teeLabelChanges returns, for each TEE, the nodes Node Feature Discovery
+// found it on that miss its label, and, when the labels only come from Node
+// Feature Discovery, the labelled nodes it no longer finds it on
+func teeLabelChanges(nodes []corev1.Node, nfdOnly bool) (missing, stale map[ccv1beta1.TeeType][]string) {
+	missing = map[ccv1beta1.TeeType][]string{}
+	stale = map[ccv1beta1.TeeType][]string{}
+	for _, node := range nodes {
+		found := map[ccv1beta1.TeeType]bool{}
+		for _, tee := range nfdTees(node.Labels) {
+			found[tee] = true
+			if !nodeHasTee(node.Labels, tee) {
+				missing[tee] = append(missing[tee], node.Name)
+			}
+		}
+		if !nfdOnly {
+			continue
+		}
+		for _, tee := range ccv1beta1.TeeTypes {
+			if !found[tee] && nodeHasTee(node.Labels, tee) {
+				stale[tee] = append(stale[tee], node.Name)
+			}
+		}
+	}
+	return missing, stale
+}
+
+// labelNodeTees labels the nodes with the TEEs Node Feature Discovery found,
+// so the runtime classes can select them with a single label. Without a probe
+// the labels follow the ones of Node Feature Discovery, and are removed with
+// them; the labels of the probe are kept, as it only runs on installation.
+func (r *CcRuntimeReconciler) labelNodeTees(nodes *corev1.NodeList) error {
+	discovery := &r.ccRuntime.Spec.Config.TeeDiscovery
+	if !discovery.Enabled {
+		return nil
+	}
+
+	missing, stale := teeLabelChanges(nodes.Items, discovery.ProbeImage == "")
+	for _, tee := range ccv1beta1.TeeTypes {
+		if len(missing[tee]) > 0 {
+			r.Log.Info("labelling nodes with their TEE", "tee", tee, "nodes", missing[tee])
+			if err := r.labelNodes(missing[tee], map[string]string{teeLabel(tee): "true"}); err != nil {
+				return err
+			}
+		}
+		if len(stale[tee]) > 0 {
+			r.Log.Info("removing the TEE label Node Feature Discovery no longer reports", "tee", tee, "nodes", stale[tee])
+			staleNodes := &corev1.NodeList{}
+			for _, node := range nodes.Items {
+				if contains(stale[tee], node.Name) {
+					staleNodes.Items = append(staleNodes.Items, node)
+				}
+			}
+			if err := r.removeNodeLabel(staleNodes, teeLabel(tee)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The runtime classes are counted on the updated labels
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		for _, tee := range ccv1beta1.TeeTypes {
+			if contains(missing[tee], node.Name) {
+				node.Labels[teeLabel(tee)] = "true"
+			} else if contains(stale[tee], node.Name) {
+				delete(node.Labels, teeLabel(tee))
+			}
+		}
+	}
+	return nil
+}
+
+// updateRuntimeClassNodes counts, for each runtime class, the selected nodes
+// with the TEE it needs
+func (r *CcRuntimeReconciler) updateRuntimeClassNodes(nodes *corev1.NodeList) error {
+	statuses := make([]ccv1beta1.RuntimeClassNodesStatus, 0, len(r.ccRuntime.Spec.Config.RuntimeClasses))
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		status := ccv1beta1.RuntimeClassNodesStatus{Name: runtimeClass.Name, Tee: runtimeClass.Tee}
+		for _, node := range nodes.Items {
+			if nodeHasTee(node.Labels, runtimeClass.Tee) {
+				status.NodesCount++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	if equality.Semantic.DeepEqual(statuses, r.ccRuntime.Status.RuntimeClasses) {
+		return nil
+	}
+	r.ccRuntime.Status.RuntimeClasses = statuses
+	return r.updateCcRuntimeStatus()
+}
+
+// scheduleRuntimeClassesOnTees restricts the pods of the runtime classes
+// declaring a TEE to the nodes labelled with it
+func (r *CcRuntimeReconciler) scheduleRuntimeClassesOnTees() error {
+	for _, runtimeClass := range r.ccRuntime.Spec.Config.RuntimeClasses {
+		if runtimeClass.Tee == "" {
+			continue
+		}
+
+		foundRc := &nodeapi.RuntimeClass{}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: runtimeClass.Name}, foundRc)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if foundRc.Scheduling == nil {
+			foundRc.Scheduling = &nodeapi.Scheduling{}
+		}
+		if foundRc.Scheduling.NodeSelector[teeLabel(runtimeClass.Tee)] == "true" {
+			continue
+		}
+		if foundRc.Scheduling.NodeSelector == nil {
+			foundRc.Scheduling.NodeSelector = map[string]string{}
+		}
+		foundRc.Scheduling.NodeSelector[teeLabel(runtimeClass.Tee)] = "true"
+
+		r.Log.Info("scheduling the runtime class on its TEE", "runtimeClass", runtimeClass.Name, "tee", runtimeClass.Tee)
+		if err := r.Update(context.TODO(), foundRc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2021 CNCF.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	nodeapi "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ccv1beta1 "github.com/confidential-containers/operator/api/v1beta1"
+)
+
+func testNode(name string, labels map[string]string) corev1.Node {
+	return corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+var _ = Describe("TEE discovery", func() {
+	DescribeTable("reading the Node Feature Discovery labels",
+		func(labels map[string]string, want []ccv1beta1.TeeType) {
+			Expect(nfdTees(labels)).To(Equal(want))
+		},
+		Entry("no labels", nil, nil),
+		Entry("tdx",
+			map[string]string{"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true"},
+			[]ccv1beta1.TeeType{ccv1beta1.TdxTee}),
+		Entry("several TEEs in the order of TeeTypes",
+			map[string]string{
+				"feature.node.kubernetes.io/cpu-security.sgx.enabled":     "true",
+				"feature.node.kubernetes.io/cpu-security.sev.snp.enabled": "true",
+			},
+			[]ccv1beta1.TeeType{ccv1beta1.SevSnpTee, ccv1beta1.SgxTee}),
+		Entry("disabled",
+			map[string]string{"feature.node.kubernetes.io/cpu-security.se.enabled": "false"}, nil),
+		Entry("operator label only", map[string]string{TeeLabelPrefix + "tdx": "true"}, nil),
+	)
+
+	DescribeTable("matching the nodes with the TEE of a runtime class",
+		func(labels map[string]string, tee ccv1beta1.TeeType, want bool) {
+			Expect(nodeHasTee(labels, tee)).To(Equal(want))
+		},
+		Entry("no TEE needed", nil, ccv1beta1.TeeType(""), true),
+		Entry("labelled", map[string]string{TeeLabelPrefix + "sev-snp": "true"}, ccv1beta1.SevSnpTee, true),
+		Entry("labelled with another TEE", map[string]string{TeeLabelPrefix + "tdx": "true"}, ccv1beta1.SevSnpTee, false),
+		Entry("label not true", map[string]string{TeeLabelPrefix + "tdx": "false"}, ccv1beta1.TdxTee, false),
+		Entry("Node Feature Discovery label only",
+			map[string]string{"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true"}, ccv1beta1.TdxTee, false),
+	)
+
+	DescribeTable("finding the labels to change",
+		func(nfdOnly bool, wantMissing, wantStale map[ccv1beta1.TeeType][]string) {
+			nodes := []corev1.Node{
+				testNode("found", map[string]string{"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true"}),
+				testNode("labelled", map[string]string{
+					"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true",
+					TeeLabelPrefix + "tdx":                                "true",
+				}),
+				testNode("gone", map[string]string{TeeLabelPrefix + "sev-snp": "true"}),
+				testNode("none", nil),
+			}
+			missing, stale := teeLabelChanges(nodes, nfdOnly)
+			Expect(missing).To(Equal(wantMissing))
+			Expect(stale).To(Equal(wantStale))
+		},
+		Entry("Node Feature Discovery only", true,
+			map[ccv1beta1.TeeType][]string{ccv1beta1.TdxTee: {"found"}},
+			map[ccv1beta1.TeeType][]string{ccv1beta1.SevSnpTee: {"gone"}}),
+		Entry("with the probe", false,
+			map[ccv1beta1.TeeType][]string{ccv1beta1.TdxTee: {"found"}},
+			map[ccv1beta1.TeeType][]string{}),
+	)
+
+	Context("on the nodes", func() {
+		var (
+			ccRuntime *ccv1beta1.CcRuntime
+			r         *CcRuntimeReconciler
+			labels    map[string]string
+		)
+
+		BeforeEach(func() {
+			ccRuntime = newTestCcRuntime(uniqueName("tee"))
+			ccRuntime.Spec.Config.TeeDiscovery = ccv1beta1.TeeDiscoveryConfig{Enabled: true}
+			ccRuntime.Spec.Config.RuntimeClasses = []ccv1beta1.RuntimeClass{
+				{Name: uniqueName("kata-qemu")},
+				{Name: uniqueName("kata-qemu-tdx"), Tee: ccv1beta1.TdxTee},
+				{Name: uniqueName("kata-qemu-snp"), Tee: ccv1beta1.SevSnpTee},
+				{Name: uniqueName("kata-qemu-se"), Tee: ccv1beta1.SeTee},
+			}
+			labels = selectTestNodes(ccRuntime)
+			createTestCcRuntime(ccRuntime)
+			r, _ = newTestReconciler(ccRuntime)
+		})
+
+		// createNode creates a selected node with the extra labels
+		createNode := func(extra map[string]string) string {
+			name := uniqueName("tee-node")
+			nodeLabels := map[string]string{}
+			for k, v := range labels {
+				nodeLabels[k] = v
+			}
+			for k, v := range extra {
+				nodeLabels[k] = v
+			}
+			createTestNode(name, nodeLabels)
+			return name
+		}
+
+		selectedNodes := func() *corev1.NodeList {
+			nodes, _, err := r.getAllNodes()
+			Expect(err).NotTo(HaveOccurred())
+			return nodes
+		}
+
+		It("labels the nodes from Node Feature Discovery and counts them per runtime class", func() {
+			tdx := createNode(map[string]string{"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true"})
+			gone := createNode(map[string]string{TeeLabelPrefix + "sev-snp": "true"})
+			plain := createNode(nil)
+
+			nodes := selectedNodes()
+			Expect(r.labelNodeTees(nodes)).To(Succeed())
+			Expect(getNode(tdx).Labels).To(HaveKeyWithValue(TeeLabelPrefix+"tdx", "true"))
+			Expect(getNode(gone).Labels).NotTo(HaveKey(TeeLabelPrefix + "sev-snp"))
+			Expect(getNode(plain).Labels).NotTo(HaveKey(HavePrefix(TeeLabelPrefix)))
+
+			Expect(r.updateRuntimeClassNodes(nodes)).To(Succeed())
+			Expect(getCcRuntime(ccRuntime.Name).Status.RuntimeClasses).To(Equal([]ccv1beta1.RuntimeClassNodesStatus{
+				{Name: ccRuntime.Spec.Config.RuntimeClasses[0].Name, NodesCount: 3},
+				{Name: ccRuntime.Spec.Config.RuntimeClasses[1].Name, Tee: ccv1beta1.TdxTee, NodesCount: 1},
+				{Name: ccRuntime.Spec.Config.RuntimeClasses[2].Name, Tee: ccv1beta1.SevSnpTee},
+				{Name: ccRuntime.Spec.Config.RuntimeClasses[3].Name, Tee: ccv1beta1.SeTee},
+			}))
+		})
+
+		It("keeps the labels of the probe", func() {
+			ccRuntime.Spec.Config.TeeDiscovery.ProbeImage = "quay.io/confidential-containers/reqs-payload:latest"
+			probed := createNode(map[string]string{TeeLabelPrefix + "sev-snp": "true"})
+
+			Expect(r.labelNodeTees(selectedNodes())).To(Succeed())
+			Expect(getNode(probed).Labels).To(HaveKeyWithValue(TeeLabelPrefix+"sev-snp", "true"))
+
+			probe := r.hooks(ccv1beta1.PreInstallHookStage)
+			Expect(probe).NotTo(BeEmpty())
+			Expect(probe[0].Name).To(Equal(teeProbeHookName))
+			Expect(probe[0].Image).To(Equal(ccRuntime.Spec.Config.TeeDiscovery.ProbeImage))
+			Expect(probe[0].doneLabel).To(Equal([]string{HookDoneLabel(ccRuntime.Name, teeProbeHookName), "done"}))
+		})
+
+		It("leaves the nodes alone when the discovery is disabled", func() {
+			ccRuntime.Spec.Config.TeeDiscovery.Enabled = false
+			tdx := createNode(map[string]string{"feature.node.kubernetes.io/cpu-security.tdx.enabled": "true"})
+
+			Expect(r.labelNodeTees(selectedNodes())).To(Succeed())
+			Expect(getNode(tdx).Labels).NotTo(HaveKey(TeeLabelPrefix + "tdx"))
+			Expect(r.teeProbeHook()).To(BeNil())
+		})
+
+		It("schedules the runtime classes on the nodes with their TEE", func() {
+			for _, runtimeClass := range ccRuntime.Spec.Config.RuntimeClasses[:2] {
+				rc := &nodeapi.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: runtimeClass.Name}, Handler: "kata"}
+				Expect(k8sClient.Create(context.TODO(), rc)).To(Succeed())
+				DeferCleanup(k8sClient.Delete, context.TODO(), rc)
+			}
+
+			Expect(r.scheduleRuntimeClassesOnTees()).To(Succeed())
+			rc := &nodeapi.RuntimeClass{}
+			Expect(k8sClient.Get(context.TODO(),
+				client.ObjectKey{Name: ccRuntime.Spec.Config.RuntimeClasses[1].Name}, rc)).To(Succeed())
+			Expect(rc.Scheduling.NodeSelector).To(Equal(map[string]string{TeeLabelPrefix + "tdx": "true"}))
+			Expect(k8sClient.Get(context.TODO(),
+				client.ObjectKey{Name: ccRuntime.Spec.Config.RuntimeClasses[0].Name}, rc)).To(Succeed())
+			Expect(rc.Scheduling).To(BeNil())
+		})
+	})
+
+	It("requires the discovery for the runtime classes with a TEE", func() {
+		config := &ccv1beta1.CcInstallConfig{
+			RuntimeClasses: []ccv1beta1.RuntimeClass{{Name: "kata-qemu-tdx", Tee: ccv1beta1.TdxTee}},
+		}
+		Expect(config.ValidateTees()).To(MatchError("runtimeClasses kata-qemu-tdx: tee needs teeDiscovery.enabled"))
+		config.TeeDiscovery.Enabled = true
+		Expect(config.ValidateTees()).To(Succeed())
+	})
+})
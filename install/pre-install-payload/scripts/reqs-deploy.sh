@@ -258,6 +258,12 @@ function remove_nydus_snapshotter_from_containerd() {
 }
 
 label_node() {
+	# The operator tells the hooks which label reports their completion
+	if [ -n "${HOOK_DONE_LABEL:-}" ]; then
+		kubectl label --overwrite node "${NODE_NAME}" "${HOOK_DONE_LABEL}"
+		return
+	fi
+
 	case "${1}" in
 	install)
 		kubectl label node "${NODE_NAME}" confidentialcontainers.org/preinstall=done
@@ -332,8 +338,14 @@ function main() {
 	label_node "${action}"
 
 
-	# It is assumed this script will be called as a daemonset. As a result, do
-	# not return, otherwise the daemon will restart and reexecute the script.
+	# When run as a Job the operator tracks the completion from the Job status
+	if [ "${RUN_TO_COMPLETION:-false}" = "true" ]; then
+		return
+	fi
+
+	# Otherwise it is assumed this script will be called as a daemonset. As a
+	# result, do not return, otherwise the daemon will restart and reexecute
+	# the script.
 	sleep infinity
 }
 
@@ -21,20 +21,21 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
-
-	peerpodcontrollers "github.com/confidential-containers/cloud-api-adaptor/src/peerpod-ctrl/controllers"
-	peerpodconfigcontrollers "github.com/confidential-containers/cloud-api-adaptor/src/peerpodconfig-ctrl/controllers"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -73,6 +74,12 @@ func main() {
 	var probeAddr string
 	var ccRuntimeNamespace string
 	var enablePeerPodControllers bool
+	var enableNamespaceLabelling bool
+	var imageRewriteConfig string
+	var imageRewriteRules []controllers.ImageRewriteRule
+	var enableNodeLabelGC bool
+	var nodeLabelGCInterval time.Duration
+	var nodeLabelGCDryRun bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&secureMetrics, "metrics-secure", false,
 		"Enable role based authentication/authorization for the metrics endpoint")
@@ -82,7 +89,27 @@ func main() {
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&enablePeerPodControllers, "peer-pods", false,
-		"Enable Peerpod controllers.")
+		"Deprecated: the Peerpod controllers run while CcRuntimes configure spec.peerPods.")
+	flag.BoolVar(&enableNamespaceLabelling, "label-namespace", false,
+		"Label the CcRuntime namespace to allow privileged pods via Pod Security Admission while CcRuntimes exist.")
+	flag.StringVar(&imageRewriteConfig, "image-rewrite-config", "",
+		"Path to a file with the rules mapping source registries to mirrors for all the rendered images.")
+	flag.Func("image-rewrite", "A source=mirror rule mapping a source registry to a mirror. Can be repeated.",
+		func(value string) error {
+			rule, err := controllers.ParseImageRewriteRule(value)
+			if err != nil {
+				return err
+			}
+			imageRewriteRules = append(imageRewriteRules, rule)
+			return nil
+		})
+	flag.BoolVar(&enableNodeLabelGC, "node-label-gc", false,
+		"Remove the operator labels of the nodes no CcRuntime owns, at startup and every --node-label-gc-interval.")
+	flag.DurationVar(&nodeLabelGCInterval, "node-label-gc-interval", time.Hour,
+		"How often the orphaned node labels are collected after startup, only at startup when 0.")
+	flag.BoolVar(&nodeLabelGCDryRun, "node-label-gc-dry-run", false,
+		"Only report the orphaned node labels in the log and in node events, without removing them, "+
+			"even without --node-label-gc.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -91,6 +118,19 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if enablePeerPodControllers {
+		setupLog.Info("the --peer-pods flag is deprecated, the Peerpod controllers run while CcRuntimes configure spec.peerPods")
+	}
+
+	if imageRewriteConfig != "" {
+		rules, err := controllers.LoadImageRewriteRules(imageRewriteConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load the image rewrite rules")
+			os.Exit(1)
+		}
+		imageRewriteRules = append(imageRewriteRules, rules...)
+	}
+
 	// TODO: add enable-http2 boolean flag which is what the latest
 	// scaffolding gives to control http/2 enablement.
 	disableHTTP2 := func(cfg *tls.Config) {
@@ -115,8 +155,32 @@ func main() {
 		metricsServerOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
 	}
 
+	ns := os.Getenv("CCRUNTIME_NAMESPACE")
+	if ns == "" {
+		ns = ccRuntimeNamespace
+	}
+
+	// The peer pods controllers read the namespace of the cloud-api-adaptor
+	// from the environment
+	peerPodsNamespace := os.Getenv("PEERPODS_NAMESPACE")
+	if peerPodsNamespace == "" {
+		peerPodsNamespace = ns
+		os.Setenv("PEERPODS_NAMESPACE", ns)
+	}
+
+	// Only the Secrets and ConfigMaps of the operator namespaces are watched
+	cacheNamespaces := map[string]cache.Config{ns: {}, peerPodsNamespace: {}}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
+		Scheme: scheme,
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Secret{}:    {Namespaces: cacheNamespaces},
+				&corev1.ConfigMap{}: {Namespaces: cacheNamespaces},
+				// The revisions are only kept in the operator namespace
+				&appsv1.ControllerRevision{}: {Namespaces: map[string]cache.Config{ns: {}}},
+			},
+		},
 		Metrics:                metricsServerOptions,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
@@ -127,46 +191,71 @@ func main() {
 		os.Exit(1)
 	}
 
-	ns := os.Getenv("CCRUNTIME_NAMESPACE")
-	if ns == "" {
-		ns = ccRuntimeNamespace
+	if enableNamespaceLabelling && ns == metav1.NamespaceSystem {
+		setupLog.Info("not labelling namespace, use a dedicated --cc-runtime-namespace to allow privileged pods", "namespace", ns)
+		enableNamespaceLabelling = false
 	}
 
-	err = labelNamespace(context.TODO(), mgr, ns)
+	err = ensureNamespace(context.TODO(), mgr, ns)
 	if err != nil {
-		setupLog.Error(err, "unable to add labels to namespace")
+		setupLog.Error(err, "unable to create namespace", "namespace", ns)
 		os.Exit(1)
 	}
 
+	// The peer pods controllers run while CcRuntimes configure peer pods
+	peerPodsControllers := &controllers.PeerPodsControllers{
+		Config:     mgr.GetConfig(),
+		Scheme:     mgr.GetScheme(),
+		RESTMapper: mgr.GetRESTMapper(),
+		Reader:     mgr.GetAPIReader(),
+		Namespace:  peerPodsNamespace,
+	}
+	if err := mgr.Add(peerPodsControllers); err != nil {
+		setupLog.Error(err, "unable to set up the peer pods controllers")
+		os.Exit(1)
+	}
+
+	if enableNodeLabelGC || nodeLabelGCDryRun {
+		if err := mgr.Add(&controllers.NodeLabelCollector{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("nodelabelgc"),
+			Recorder: mgr.GetEventRecorderFor("ccruntime-controller"),
+			Interval: nodeLabelGCInterval,
+			DryRun:   nodeLabelGCDryRun,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up the node label collector")
+			os.Exit(1)
+		}
+	}
+
+	registryClient := controllers.NewRegistryClient()
 	if err = (&controllers.CcRuntimeReconciler{
 		Client:    mgr.GetClient(),
 		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("ccruntime-controller"),
 		Namespace: ns,
+
+		ImageResolver: registryClient,
+		ImageVerifier: registryClient,
+
+		ImageRewriteRules: imageRewriteRules,
+		LabelNamespace:    enableNamespaceLabelling,
+		PeerPodsNamespace: peerPodsNamespace,
+
+		PeerPodsControllers: peerPodsControllers,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CcRuntime")
 		os.Exit(1)
 	}
 
-	if enablePeerPodControllers {
-		if err = (&peerpodconfigcontrollers.PeerPodConfigReconciler{
-			Client: mgr.GetClient(),
-			Log:    ctrl.Log.WithName("controllers").WithName("RemotePodConfig"),
-			Scheme: mgr.GetScheme(),
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create peerpod config controller", "controller", "PeerPodConfig")
-			os.Exit(1)
-		}
-
-		if err = (&peerpodcontrollers.PeerPodReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
-			// setting nil will delegate Provider creation to reconcile time.
-			Provider: nil,
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create peerpod resources controller", "controller", "PeerPod")
+	// The webhook needs serving certificates, see config/default/manager_webhook_patch.yaml
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		if err = (&ccv1beta1.CcRuntime{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CcRuntime")
 			os.Exit(1)
 		}
 	}
+
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -185,25 +274,19 @@ func main() {
 	}
 }
 
-func labelNamespace(ctx context.Context, mgr manager.Manager, nsName string) error {
-
+// ensureNamespace creates the namespace of the CcRuntime secondary resources
+// when it's missing
+func ensureNamespace(ctx context.Context, mgr manager.Manager, nsName string) error {
 	ns := &corev1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: nsName,
 		},
 	}
 	err := mgr.GetAPIReader().Get(ctx, client.ObjectKeyFromObject(ns), ns)
-	if err != nil {
-		setupLog.Error(err, "Unable to add label to the namespace")
+	if !apierrors.IsNotFound(err) {
 		return err
 	}
 
-	setupLog.Info("Labelling Namespace")
-	setupLog.Info("Labels: ", "Labels", ns.Labels)
-	// Add namespace label to allow privilege pods via Pod Security Admission controller
-	ns.Labels["pod-security.kubernetes.io/enforce"] = "privileged"
-	ns.Labels["pod-security.kubernetes.io/audit"] = "privileged"
-	ns.Labels["pod-security.kubernetes.io/warn"] = "privileged"
-
-	return mgr.GetClient().Update(ctx, ns)
+	setupLog.Info("Creating Namespace", "namespace", nsName)
+	return mgr.GetClient().Create(ctx, ns)
 }
@@ -98,7 +98,7 @@ install_operator() {
 	pushd "$project_dir" >/dev/null
 	# We should use a locally built image for operator.
 	kustomization_set_image config/manager controller "${IMG}"
-	kubectl apply -k config/default
+	kubectl apply --server-side -k config/default
 	popd >/dev/null
 
 	# Wait the operator controller to be running.